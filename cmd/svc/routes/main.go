@@ -11,6 +11,7 @@ import (
 	"github.com/golang/glog"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"runtime"
 	"time"
@@ -27,6 +28,7 @@ func init() {
 
 var teamAddr string
 var solo bool
+var debugHttp string
 
 func init() {
 
@@ -34,6 +36,20 @@ func init() {
 
 	flag.BoolVar(&solo, "solo", false, "Run in solo mode.")
 
+	flag.StringVar(&debugHttp, "debug-http", "",
+		"serve expvar gauges at http://<addr>/debug/vars, e.g. live collection lags, port 0 picks any")
+
+}
+
+// serve expvar registered with the default mux, the actual address is logged
+func serveDebugHttp(addr string) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		glog.Errorf("Failed serving debug http at [%s]: %+v", addr, err)
+		return
+	}
+	glog.Infof("Debug vars [pid=%d] at http://%s/debug/vars", os.Getpid(), ln.Addr())
+	go http.Serve(ln, nil)
 }
 
 func main() {
@@ -49,6 +65,10 @@ func main() {
 
 	flag.Parse()
 
+	if debugHttp != "" {
+		serveDebugHttp(debugHttp)
+	}
+
 	var poolConfig svcs.ServiceConfig
 	poolConfig, err = svcs.GetServiceConfig("routes")
 	if err != nil {
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"expvar"
 	"flag"
 	"log"
 	"net"
@@ -78,6 +79,9 @@ func main() {
 
 	definePageRoutes(router)
 
+	// gauges of this process, e.g. live collection lags of the monolith
+	router.Handle("/debug/vars", expvar.Handler())
+
 	srv := &http.Server{
 		Handler:      router,
 		Addr:         webCfg.Http,
@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/complyue/ddgo/pkg/drivers"
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+)
+
+// show the simulation clock of drivings, or control it when posted with a mode to
+// set, and/or a duration to step, in milliseconds
+func controlClock(w http.ResponseWriter, r *http.Request) {
+	var err error
+	result := map[string]interface{}{}
+	w.Header().Set("Content-Type", "application/json")
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(err)
+			result["err"] = fmt.Sprintf("%+v", err)
+		}
+		buf, e := json.Marshal(result)
+		if e != nil {
+			panic(e)
+		}
+		w.Write(buf)
+	}()
+
+	params := mux.Vars(r)
+	tid := params["tid"]
+
+	var reqData struct {
+		Mode  string  // real/scaled/paused/stepped, not changed if empty
+		Scale float64 // for the scaled mode
+		Step  int64   // milliseconds to step, in stepped mode
+	}
+	if r.Method == http.MethodPost {
+		decoder := json.NewDecoder(r.Body)
+		if err = decoder.Decode(&reqData); err != nil {
+			panic(err)
+		}
+	}
+
+	driversApi, err := GetDriversService(tid)
+	if err != nil {
+		panic(err)
+	}
+
+	var cs *drivers.ClockState
+	if reqData.Mode != "" {
+		if cs, err = driversApi.SetClock(reqData.Mode, reqData.Scale); err != nil {
+			panic(err)
+		}
+	}
+	if reqData.Step > 0 {
+		if cs, err = driversApi.StepClock(time.Duration(reqData.Step) * time.Millisecond); err != nil {
+			panic(err)
+		}
+	}
+	if cs == nil {
+		if cs, err = driversApi.FetchClock(); err != nil {
+			panic(err)
+		}
+	}
+	result["mode"] = cs.Mode
+	result["scale"] = cs.Scale
+	result["now"] = cs.Now.Seconds()
+	result["waiting"] = cs.Waiting
+}
@@ -4,6 +4,7 @@ import (
 	"sync"
 
 	"github.com/complyue/ddgo/pkg/drivers"
+	"github.com/complyue/ddgo/pkg/livecoll"
 	"github.com/complyue/ddgo/pkg/routes"
 	"github.com/gorilla/mux"
 )
@@ -80,10 +81,50 @@ func DefineHttpRoutes(router *mux.Router) {
 	router.HandleFunc("/api/{tid}/waypoint", showWaypoints)
 	router.HandleFunc("/api/{tid}/waypoint/add", addWaypoint)
 	router.HandleFunc("/api/{tid}/waypoint/move", moveWaypoint)
+	router.HandleFunc("/api/{tid}/waypoint/delete", deleteWaypoint)
+
+	router.HandleFunc("/api/{tid}/route", showRoutes)
+	router.HandleFunc("/api/{tid}/route/add", addRoute)
+	router.HandleFunc("/api/{tid}/route/update", updateRoute)
+	router.HandleFunc("/api/{tid}/route/delete", deleteRoute)
 
 	router.HandleFunc("/api/{tid}/truck", showTrucks)
 	router.HandleFunc("/api/{tid}/truck/add", addTruck)
 	router.HandleFunc("/api/{tid}/truck/move", moveTruck)
 	router.HandleFunc("/api/{tid}/truck/stop", stopTruck)
+	router.HandleFunc("/api/{tid}/truck/assign", assignTruckRoute)
+	router.HandleFunc("/api/{tid}/truck/strategy", setTruckStrategy)
+	router.HandleFunc("/api/{tid}/truck/delete", deleteTruck)
+
+	router.HandleFunc("/api/{tid}/clock", controlClock)
+
+}
 
+// tell the browser about a version conflict, for it to catch up with the latest
+// state rather than retry blindly
+func reportConflict(result map[string]interface{}, err error) {
+	if ce, ok := livecoll.IsConflict(err); ok {
+		result["conflict"] = map[string]interface{}{
+			"expected": ce.Expected, "actual": ce.Actual,
+		}
+	}
+}
+
+// new values of changed fields, other than those already told by more specific
+// messages, nil if none or the delta is not known
+func otherChanges(delta livecoll.Delta, told ...string) map[string]interface{} {
+	var changes map[string]interface{}
+nextField:
+	for _, fc := range delta {
+		for _, field := range told {
+			if fc.Field == field {
+				continue nextField
+			}
+		}
+		if changes == nil {
+			changes = make(map[string]interface{})
+		}
+		changes[fc.Field] = fc.New
+	}
+	return changes
 }
@@ -0,0 +1,292 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/complyue/ddgo/pkg/livecoll"
+	"github.com/complyue/ddgo/pkg/routes"
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/golang/glog"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+// relay live route collection changes over a websocket, observing a replica
+// of the collection
+type rtcChgRelay struct {
+	routesAPI *routes.ConsumerAPI // consuming api to routes service
+	wsc       *websocket.Conn     // the websocket connection
+}
+
+func (rtc *rtcChgRelay) Reloaded(ccn livecoll.CCN, rts []livecoll.Member) (stop bool) {
+	return rtc.send(map[string]interface{}{
+		"type":   "initial",
+		"routes": rts,
+	})
+}
+
+// Created
+func (rtc *rtcChgRelay) Created(ccn livecoll.CCN, eo livecoll.Member) (stop bool) {
+	return rtc.send(rtc.createdMsg(eo))
+}
+
+// Updated
+func (rtc *rtcChgRelay) Updated(ccn livecoll.CCN, former, eo livecoll.Member, delta livecoll.Delta) (stop bool) {
+	return rtc.send(rtc.updatedMsg(eo, delta))
+}
+
+// Deleted
+func (rtc *rtcChgRelay) Deleted(ccn livecoll.CCN, id interface{}, former livecoll.Member) (stop bool) {
+	return rtc.send(rtc.deletedMsg(id))
+}
+
+// Batched changes are sent in a single message, for the viewer to apply at once,
+// e.g. all routes a deleted waypoint has been taken out of
+func (rtc *rtcChgRelay) Batched(ccn livecoll.CCN, changes []livecoll.ReplicaChange) (stop bool) {
+	msgs := make([]map[string]interface{}, 0, len(changes))
+	for _, rc := range changes {
+		switch evo := rc.Event.(type) {
+		case livecoll.CreatedEvent:
+			msgs = append(msgs, rtc.createdMsg(evo.EO))
+		case livecoll.UpdatedEvent:
+			msgs = append(msgs, rtc.updatedMsg(evo.EO, evo.Delta))
+		case livecoll.DeletedEvent:
+			msgs = append(msgs, rtc.deletedMsg(evo.ID))
+		}
+	}
+	return rtc.send(map[string]interface{}{
+		"type":    "batch",
+		"changes": msgs,
+	})
+}
+
+func (rtc *rtcChgRelay) createdMsg(eo livecoll.Member) map[string]interface{} {
+	return map[string]interface{}{
+		"type":  "created",
+		"route": eo.(*routes.Route),
+	}
+}
+
+// routes are small, the whole route is sent along with the fields changed
+func (rtc *rtcChgRelay) updatedMsg(eo livecoll.Member, delta livecoll.Delta) map[string]interface{} {
+	rt := eo.(*routes.Route)
+	return map[string]interface{}{
+		"type":  "updated",
+		"tid":   rtc.routesAPI.Tid(),
+		"route": rt, "changes": otherChanges(delta, "version"),
+		"version": rt.Version,
+	}
+}
+
+func (rtc *rtcChgRelay) deletedMsg(id interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "deleted",
+		"tid":  rtc.routesAPI.Tid(), "_id": id,
+	}
+}
+
+func (rtc *rtcChgRelay) send(msg map[string]interface{}) (stop bool) {
+	if e := rtc.wsc.WriteJSON(msg); e != nil {
+		glog.Error(e)
+		return true
+	}
+	return
+}
+
+func showRoutes(w http.ResponseWriter, r *http.Request) {
+	var err error
+
+	var wsc *websocket.Conn
+	wsc, err = wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		glog.Error(errors.RichError(err))
+		return
+	}
+
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			err = errors.RichError(err)
+			glog.Error(err)
+		}
+	}()
+
+	params := mux.Vars(r)
+	tid := params["tid"]
+
+	routesAPI, err := GetRoutesService(tid)
+	if err != nil {
+		panic(err)
+	}
+	relay := &rtcChgRelay{
+		routesAPI: routesAPI, wsc: wsc,
+	}
+	replica := livecoll.NewCoalescingReplica("rtc", routesAPI.RouteSource(), relay)
+	replica.Start()
+
+	go func() {
+		// the viewer is gone once reading fails, relay no more changes
+		defer replica.Stop()
+		for {
+			var msgIn map[string]interface{}
+			if err := wsc.ReadJSON(&msgIn); err != nil {
+				glog.Errorf("WS error: %+v", err)
+				return
+			}
+			if len(msgIn) <= 0 {
+				// keep alive
+				routesAPI.EnsureAlive()
+			}
+		}
+	}()
+}
+
+func addRoute(w http.ResponseWriter, r *http.Request) {
+	var err error
+	result := map[string]interface{}{}
+	w.Header().Set("Content-Type", "application/json")
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(err)
+			result["err"] = fmt.Sprintf("%+v", err)
+		}
+		buf, e := json.Marshal(result)
+		if e != nil {
+			panic(e)
+		}
+		w.Write(buf)
+	}()
+
+	params := mux.Vars(r)
+	tid := params["tid"]
+
+	var reqData struct {
+		Label     string
+		Waypoints []string
+		Loop      bool
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&reqData); err != nil {
+		panic(err)
+	}
+	wpIDs, err := routes.ParseWaypointIDs(reqData.Waypoints)
+	if err != nil {
+		panic(err)
+	}
+
+	routesApi, err := GetRoutesService(tid)
+	if err != nil {
+		panic(err)
+	}
+
+	err = routesApi.AddRoute(reqData.Label, wpIDs, reqData.Loop)
+	if err != nil {
+		panic(err)
+	}
+}
+
+func updateRoute(w http.ResponseWriter, r *http.Request) {
+	var err error
+	result := map[string]interface{}{}
+	w.Header().Set("Content-Type", "application/json")
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(err)
+			result["err"] = fmt.Sprintf("%+v", err)
+		}
+		buf, e := json.Marshal(result)
+		if e != nil {
+			panic(e)
+		}
+		w.Write(buf)
+	}()
+
+	params := mux.Vars(r)
+	tid := params["tid"]
+
+	var reqData struct {
+		Id        string `json:"_id"`
+		Label     string
+		Waypoints []string
+		Loop      bool
+		Version   *int // update only if still of this version, if specified
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&reqData); err != nil {
+		panic(err)
+	}
+	wpIDs, err := routes.ParseWaypointIDs(reqData.Waypoints)
+	if err != nil {
+		panic(err)
+	}
+
+	routesApi, err := GetRoutesService(tid)
+	if err != nil {
+		panic(err)
+	}
+
+	if reqData.Version == nil {
+		err = routesApi.UpdateRoute(reqData.Id, reqData.Label, wpIDs, reqData.Loop)
+	} else {
+		var version int
+		version, err = routesApi.UpdateRouteIf(
+			reqData.Id, *reqData.Version, reqData.Label, wpIDs, reqData.Loop,
+		)
+		result["version"] = version
+		reportConflict(result, err)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func deleteRoute(w http.ResponseWriter, r *http.Request) {
+	var err error
+	result := map[string]interface{}{}
+	w.Header().Set("Content-Type", "application/json")
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(err)
+			result["err"] = fmt.Sprintf("%+v", err)
+		}
+		buf, e := json.Marshal(result)
+		if e != nil {
+			panic(e)
+		}
+		w.Write(buf)
+	}()
+
+	params := mux.Vars(r)
+	tid := params["tid"]
+
+	var reqData struct {
+		Id string `json:"_id"`
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&reqData); err != nil {
+		panic(err)
+	}
+
+	routesApi, err := GetRoutesService(tid)
+	if err != nil {
+		panic(err)
+	}
+
+	err = routesApi.DeleteRoute(reqData.Id)
+	if err != nil {
+		panic(err)
+	}
+}
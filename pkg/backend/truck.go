@@ -13,113 +13,113 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// relay live truck collection changes over a websocket
+// relay live truck collection changes over a websocket, observing a replica of
+// the collection
 type tkcChgRelay struct {
 	driversAPI *drivers.ConsumerAPI // consuming api to drivers service
 	wsc        *websocket.Conn      // the websocket connection
-	ccn        int                  // known change number of the live truck collection
 }
 
-func (tkc *tkcChgRelay) reload() bool {
-	// fetch current snapshot of the whole collection
-	ccn, tkl := tkc.driversAPI.FetchTrucks()
-
-	glog.V(1).Infof(" * tkc reloaded %v -> %v", tkc.ccn, ccn)
-	tkc.ccn = ccn
-
+func (tkc *tkcChgRelay) Reloaded(ccn livecoll.CCN, tks []livecoll.Member) (stop bool) {
 	if e := tkc.wsc.WriteJSON(map[string]interface{}{
 		"type":   "initial",
-		"trucks": tkl,
+		"trucks": tks,
 	}); e != nil {
 		glog.Error(errors.RichError(e))
 		return true
 	}
 
-	return false
+	return
 }
 
-func (tkc *tkcChgRelay) Subscribed() (stop bool) {
-	return tkc.reload()
+// Created
+func (tkc *tkcChgRelay) Created(ccn livecoll.CCN, eo livecoll.Member) (stop bool) {
+	return tkc.send(tkc.createdMsg(eo))
 }
 
-func (tkc *tkcChgRelay) Epoch(ccn int) (stop bool) {
-	glog.V(1).Infof(" ** Reloading tkc due to epoch CCN %v -> %v", tkc.ccn, ccn)
-	return tkc.reload()
+// Updated
+func (tkc *tkcChgRelay) Updated(ccn livecoll.CCN, former, eo livecoll.Member, delta livecoll.Delta) (stop bool) {
+	for _, msg := range tkc.updatedMsgs(eo, delta) {
+		if stop = tkc.send(msg); stop {
+			return
+		}
+	}
+	return
 }
 
-// Created
-func (tkc *tkcChgRelay) MemberCreated(ccn int, eo livecoll.Member) (stop bool) {
-	if ccnDistance := livecoll.ChgDistance(ccn, tkc.ccn); ccnDistance <= 0 {
-		// ignore out-dated events
-		return
-	} else if ccnDistance > 1 {
-		// event ccn is ahead of locally known ccn, reload
-		glog.V(1).Infof(" ** Reloading tkc due to epoch CCN %v -> %v", tkc.ccn, ccn)
-		return tkc.reload()
-	}
-	tk := eo.(*drivers.Truck)
+// Deleted
+func (tkc *tkcChgRelay) Deleted(ccn livecoll.CCN, id interface{}, former livecoll.Member) (stop bool) {
+	return tkc.send(tkc.deletedMsg(id))
+}
 
-	tkc.ccn = ccn
+// Batched changes are sent in a single message, for the viewer to apply at once
+func (tkc *tkcChgRelay) Batched(ccn livecoll.CCN, changes []livecoll.ReplicaChange) (stop bool) {
+	msgs := make([]map[string]interface{}, 0, len(changes))
+	for _, rc := range changes {
+		switch evo := rc.Event.(type) {
+		case livecoll.CreatedEvent:
+			msgs = append(msgs, tkc.createdMsg(evo.EO))
+		case livecoll.UpdatedEvent:
+			msgs = append(msgs, tkc.updatedMsgs(evo.EO, evo.Delta)...)
+		case livecoll.DeletedEvent:
+			msgs = append(msgs, tkc.deletedMsg(evo.ID))
+		}
+	}
+	return tkc.send(map[string]interface{}{
+		"type":    "batch",
+		"changes": msgs,
+	})
+}
 
-	if e := tkc.wsc.WriteJSON(map[string]interface{}{
+func (tkc *tkcChgRelay) createdMsg(eo livecoll.Member) map[string]interface{} {
+	tk := eo.(*drivers.Truck)
+	return map[string]interface{}{
 		"type":  "created",
 		"truck": tk,
-	}); e != nil {
-		glog.Error(e)
-		return true
 	}
-
-	return
 }
 
-// Updated
-func (tkc *tkcChgRelay) MemberUpdated(ccn int, eo livecoll.Member) (stop bool) {
-	if ccnDistance := livecoll.ChgDistance(ccn, tkc.ccn); ccnDistance <= 0 {
-		// ignore out-dated events
-		return
-	} else if ccnDistance > 1 {
-		// event ccn is ahead of locally known ccn, reload
-		glog.V(1).Infof(" ** Reloading tkc due to epoch CCN %v -> %v", tkc.ccn, ccn)
-		return tkc.reload()
-	}
+// messages by fields changed, both moved and stopped if not known
+func (tkc *tkcChgRelay) updatedMsgs(eo livecoll.Member, delta livecoll.Delta) []map[string]interface{} {
 	tk := eo.(*drivers.Truck)
-
-	tkc.ccn = ccn
-
-	// TODO distinguish move/stop
-	if e := tkc.wsc.WriteJSON(map[string]interface{}{
-		"type": "moved",
-		"tid":  tkc.driversAPI.Tid(), "seq": tk.Seq, "_id": tk.Id, "x": tk.X, "y": tk.Y,
-	}); e != nil {
-		glog.Error(e)
-		return true
+	var msgs []map[string]interface{}
+	if delta.Changed("x", "y") {
+		msgs = append(msgs, map[string]interface{}{
+			"type": "moved",
+			"tid":  tkc.driversAPI.Tid(), "seq": tk.Seq, "_id": tk.Id, "x": tk.X, "y": tk.Y,
+			"version": tk.Version,
+		})
 	}
-	if e := tkc.wsc.WriteJSON(map[string]interface{}{
-		"type": "stopped",
-		"tid":  tkc.driversAPI.Tid(), "seq": tk.Seq, "_id": tk.Id, "moving": tk.Moving,
-	}); e != nil {
-		glog.Error(e)
-		return true
+	if delta.Changed("moving") {
+		msgs = append(msgs, map[string]interface{}{
+			"type": "stopped",
+			"tid":  tkc.driversAPI.Tid(), "seq": tk.Seq, "_id": tk.Id, "moving": tk.Moving,
+			"version": tk.Version,
+		})
 	}
-
-	return
+	if changes := otherChanges(delta, "x", "y", "moving", "version"); changes != nil || len(msgs) <= 0 {
+		// e.g. relabeled, or only the version bumped
+		msgs = append(msgs, map[string]interface{}{
+			"type": "updated",
+			"tid":  tkc.driversAPI.Tid(), "seq": tk.Seq, "_id": tk.Id, "changes": changes,
+			"version": tk.Version,
+		})
+	}
+	return msgs
 }
 
-// Deleted
-func (tkc *tkcChgRelay) MemberDeleted(ccn int, id interface{}) (stop bool) {
-	if ccnDistance := livecoll.ChgDistance(ccn, tkc.ccn); ccnDistance <= 0 {
-		// ignore out-dated events
-		return
-	} else if ccnDistance > 1 {
-		// event ccn is ahead of locally known ccn, reload
-		glog.V(1).Infof(" ** Reloading tkc due to epoch CCN %v -> %v", tkc.ccn, ccn)
-		return tkc.reload()
+func (tkc *tkcChgRelay) deletedMsg(id interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "deleted",
+		"tid":  tkc.driversAPI.Tid(), "_id": id,
 	}
+}
 
-	tkc.ccn = ccn
-
-	// todo notify delete event
-
+func (tkc *tkcChgRelay) send(msg map[string]interface{}) (stop bool) {
+	if e := tkc.wsc.WriteJSON(msg); e != nil {
+		glog.Error(e)
+		return true
+	}
 	return
 }
 
@@ -157,15 +157,24 @@ func showTrucks(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		panic(err)
 	}
-	subr := &tkcChgRelay{
-		driversAPI: driversAPI, wsc: wsc, ccn: 0,
+	// viewers can opt to watch part of the collection, e.g. ?bbox=0,0,100,100
+	filter, err := livecoll.ParseFilter(r.URL.Query().Get)
+	if err != nil {
+		panic(err)
+	}
+	relay := &tkcChgRelay{
+		driversAPI: driversAPI, wsc: wsc,
 	}
-	driversAPI.SubscribeTrucks(subr)
+	replica := livecoll.NewCoalescingReplica("tkc", driversAPI.TruckSource(filter), relay)
+	replica.Sparse = filter != nil
+	replica.Start()
 
 	// kickoff drivers team TODO find a better place to do this
 	driversAPI.DriversKickoff(tid)
 
 	go func() {
+		// the viewer is gone once reading fails, relay no more changes
+		defer replica.Stop()
 		for {
 			var msgIn map[string]interface{}
 			if err := wsc.ReadJSON(&msgIn); err != nil {
@@ -248,9 +257,10 @@ func moveTruck(w http.ResponseWriter, r *http.Request) {
 	tid := params["tid"]
 
 	var reqData struct {
-		Seq  int
-		Id   string `json:"_id"`
-		X, Y float64
+		Seq     int
+		Id      string `json:"_id"`
+		X, Y    float64
+		Version *int // move only if still of this version, if specified
 	}
 	decoder := json.NewDecoder(r.Body)
 	if err = decoder.Decode(&reqData); err != nil {
@@ -262,7 +272,16 @@ func moveTruck(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	err = driversApi.MoveTruck(tid, reqData.Seq, reqData.Id, reqData.X, reqData.Y)
+	if reqData.Version == nil {
+		err = driversApi.MoveTruck(tid, reqData.Seq, reqData.Id, reqData.X, reqData.Y)
+	} else {
+		var version int
+		version, err = driversApi.MoveTruckIf(
+			tid, reqData.Seq, reqData.Id, *reqData.Version, reqData.X, reqData.Y,
+		)
+		result["version"] = version
+		reportConflict(result, err)
+	}
 	if err != nil {
 		panic(err)
 	}
@@ -291,9 +310,167 @@ func stopTruck(w http.ResponseWriter, r *http.Request) {
 	tid := params["tid"]
 
 	var reqData struct {
-		Seq    int
-		Id     string `json:"_id"`
-		Moving bool
+		Seq     int
+		Id      string `json:"_id"`
+		Moving  bool
+		Version *int // tell only if still of this version, if specified
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&reqData); err != nil {
+		panic(err)
+	}
+
+	driversApi, err := GetDriversService(tid)
+	if err != nil {
+		panic(err)
+	}
+
+	if reqData.Version == nil {
+		err = driversApi.StopTruck(tid, reqData.Seq, reqData.Id, reqData.Moving)
+	} else {
+		var version int
+		version, err = driversApi.StopTruckIf(
+			tid, reqData.Seq, reqData.Id, *reqData.Version, reqData.Moving,
+		)
+		result["version"] = version
+		reportConflict(result, err)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func assignTruckRoute(w http.ResponseWriter, r *http.Request) {
+	var err error
+	result := map[string]interface{}{}
+	w.Header().Set("Content-Type", "application/json")
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(err)
+			result["err"] = fmt.Sprintf("%+v", err)
+		}
+		buf, e := json.Marshal(result)
+		if e != nil {
+			panic(e)
+		}
+		w.Write(buf)
+	}()
+
+	params := mux.Vars(r)
+	tid := params["tid"]
+
+	var reqData struct {
+		Seq     int
+		Id      string `json:"_id"`
+		Route   string // empty to roam through all waypoints
+		Version *int   // assign only if still of this version, if specified
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&reqData); err != nil {
+		panic(err)
+	}
+
+	driversApi, err := GetDriversService(tid)
+	if err != nil {
+		panic(err)
+	}
+
+	if reqData.Version == nil {
+		err = driversApi.AssignRoute(tid, reqData.Seq, reqData.Id, reqData.Route)
+	} else {
+		var version int
+		version, err = driversApi.AssignRouteIf(
+			tid, reqData.Seq, reqData.Id, *reqData.Version, reqData.Route,
+		)
+		result["version"] = version
+		reportConflict(result, err)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func setTruckStrategy(w http.ResponseWriter, r *http.Request) {
+	var err error
+	result := map[string]interface{}{}
+	w.Header().Set("Content-Type", "application/json")
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(err)
+			result["err"] = fmt.Sprintf("%+v", err)
+		}
+		buf, e := json.Marshal(result)
+		if e != nil {
+			panic(e)
+		}
+		w.Write(buf)
+	}()
+
+	params := mux.Vars(r)
+	tid := params["tid"]
+
+	var reqData struct {
+		Seq      int
+		Id       string `json:"_id"`
+		Strategy string // empty for the default
+		Version  *int   // select only if still of this version, if specified
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&reqData); err != nil {
+		panic(err)
+	}
+
+	driversApi, err := GetDriversService(tid)
+	if err != nil {
+		panic(err)
+	}
+
+	if reqData.Version == nil {
+		err = driversApi.SetDrivingStrategy(tid, reqData.Seq, reqData.Id, reqData.Strategy)
+	} else {
+		var version int
+		version, err = driversApi.SetDrivingStrategyIf(
+			tid, reqData.Seq, reqData.Id, *reqData.Version, reqData.Strategy,
+		)
+		result["version"] = version
+		reportConflict(result, err)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func deleteTruck(w http.ResponseWriter, r *http.Request) {
+	var err error
+	result := map[string]interface{}{}
+	w.Header().Set("Content-Type", "application/json")
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(err)
+			result["err"] = fmt.Sprintf("%+v", err)
+		}
+		buf, e := json.Marshal(result)
+		if e != nil {
+			panic(e)
+		}
+		w.Write(buf)
+	}()
+
+	params := mux.Vars(r)
+	tid := params["tid"]
+
+	var reqData struct {
+		Seq int
+		Id  string `json:"_id"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	if err = decoder.Decode(&reqData); err != nil {
@@ -305,7 +482,7 @@ func stopTruck(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	err = driversApi.StopTruck(tid, reqData.Seq, reqData.Id, reqData.Moving)
+	err = driversApi.DeleteTruck(tid, reqData.Seq, reqData.Id)
 	if err != nil {
 		panic(err)
 	}
@@ -13,23 +13,17 @@ import (
 	"github.com/gorilla/websocket"
 )
 
-// relay live waypoint collection changes over a websocket
+// relay live waypoint collection changes over a websocket, observing a replica
+// of the collection
 type wpcChgRelay struct {
 	routesAPI *routes.ConsumerAPI // consuming api to routes service
 	wsc       *websocket.Conn     // the websocket connection
-	ccn       int                 // known change number of the live waypoint collection
 }
 
-func (wpc *wpcChgRelay) reload() (stop bool) {
-	// fetch current snapshot of the whole collection
-	ccn, wpl := wpc.routesAPI.FetchWaypoints()
-
-	glog.V(1).Infof(" * wpc reloaded %v -> %v", wpc.ccn, ccn)
-	wpc.ccn = ccn
-
+func (wpc *wpcChgRelay) Reloaded(ccn livecoll.CCN, wps []livecoll.Member) (stop bool) {
 	if e := wpc.wsc.WriteJSON(map[string]interface{}{
 		"type": "initial",
-		"wps":  wpl,
+		"wps":  wps,
 	}); e != nil {
 		glog.Error(errors.RichError(e))
 		return true
@@ -38,80 +32,87 @@ func (wpc *wpcChgRelay) reload() (stop bool) {
 	return
 }
 
-func (wpc *wpcChgRelay) Subscribed() (stop bool) {
-	return wpc.reload()
+// Created
+func (wpc *wpcChgRelay) Created(ccn livecoll.CCN, eo livecoll.Member) (stop bool) {
+	return wpc.send(wpc.createdMsg(eo))
 }
 
-func (wpc *wpcChgRelay) Epoch(ccn int) (stop bool) {
-	glog.V(1).Infof(" ** Reloading wpc due to epoch CCN %v -> %v", wpc.ccn, ccn)
-	return wpc.reload()
+// Updated
+func (wpc *wpcChgRelay) Updated(ccn livecoll.CCN, former, eo livecoll.Member, delta livecoll.Delta) (stop bool) {
+	for _, msg := range wpc.updatedMsgs(eo, delta) {
+		if stop = wpc.send(msg); stop {
+			return
+		}
+	}
+	return
 }
 
-// Created
-func (wpc *wpcChgRelay) MemberCreated(ccn int, eo livecoll.Member) (stop bool) {
-	if ccnDistance := livecoll.ChgDistance(ccn, wpc.ccn); ccnDistance <= 0 {
-		// ignore out-dated events
-		return
-	} else if ccnDistance > 1 {
-		// event ccn is ahead of locally known ccn, reload
-		glog.V(1).Infof(" ** Reloading wpc due to CCN changed %v -> %v", wpc.ccn, ccn)
-		return wpc.reload()
-	}
-	wp := eo.(*routes.Waypoint)
+// Deleted
+func (wpc *wpcChgRelay) Deleted(ccn livecoll.CCN, id interface{}, former livecoll.Member) (stop bool) {
+	return wpc.send(wpc.deletedMsg(id))
+}
 
-	wpc.ccn = ccn
+// Batched changes are sent in a single message, for the viewer to apply at once
+func (wpc *wpcChgRelay) Batched(ccn livecoll.CCN, changes []livecoll.ReplicaChange) (stop bool) {
+	msgs := make([]map[string]interface{}, 0, len(changes))
+	for _, rc := range changes {
+		switch evo := rc.Event.(type) {
+		case livecoll.CreatedEvent:
+			msgs = append(msgs, wpc.createdMsg(evo.EO))
+		case livecoll.UpdatedEvent:
+			msgs = append(msgs, wpc.updatedMsgs(evo.EO, evo.Delta)...)
+		case livecoll.DeletedEvent:
+			msgs = append(msgs, wpc.deletedMsg(evo.ID))
+		}
+	}
+	return wpc.send(map[string]interface{}{
+		"type":    "batch",
+		"changes": msgs,
+	})
+}
 
-	if e := wpc.wsc.WriteJSON(map[string]interface{}{
+func (wpc *wpcChgRelay) createdMsg(eo livecoll.Member) map[string]interface{} {
+	wp := eo.(*routes.Waypoint)
+	return map[string]interface{}{
 		"type": "created",
 		"wp":   wp,
-	}); e != nil {
-		glog.Error(e)
-		return true
 	}
-
-	return
 }
 
-// Updated
-func (wpc *wpcChgRelay) MemberUpdated(ccn int, eo livecoll.Member) (stop bool) {
-	if ccnDistance := livecoll.ChgDistance(ccn, wpc.ccn); ccnDistance <= 0 {
-		// ignore out-dated events
-		return
-	} else if ccnDistance > 1 {
-		// event ccn is ahead of locally known ccn, reload
-		glog.V(1).Infof(" ** Reloading wpc due to CCN changed %v -> %v", wpc.ccn, ccn)
-		return wpc.reload()
-	}
+// messages by fields changed, moved if not known
+func (wpc *wpcChgRelay) updatedMsgs(eo livecoll.Member, delta livecoll.Delta) []map[string]interface{} {
 	wp := eo.(*routes.Waypoint)
-
-	wpc.ccn = ccn
-
-	if e := wpc.wsc.WriteJSON(map[string]interface{}{
-		"type": "moved",
-		"tid":  wpc.routesAPI.Tid(), "seq": wp.Seq, "_id": wp.Id, "x": wp.X, "y": wp.Y,
-	}); e != nil {
-		glog.Error(e)
-		return true
+	var msgs []map[string]interface{}
+	if delta.Changed("x", "y") {
+		msgs = append(msgs, map[string]interface{}{
+			"type": "moved",
+			"tid":  wpc.routesAPI.Tid(), "seq": wp.Seq, "_id": wp.Id, "x": wp.X, "y": wp.Y,
+			"version": wp.Version,
+		})
 	}
-
-	return
+	if changes := otherChanges(delta, "x", "y", "version"); changes != nil || len(msgs) <= 0 {
+		// e.g. relabeled, or only the version bumped
+		msgs = append(msgs, map[string]interface{}{
+			"type": "updated",
+			"tid":  wpc.routesAPI.Tid(), "seq": wp.Seq, "_id": wp.Id, "changes": changes,
+			"version": wp.Version,
+		})
+	}
+	return msgs
 }
 
-// Deleted
-func (wpc *wpcChgRelay) MemberDeleted(ccn int, id interface{}) (stop bool) {
-	if ccnDistance := livecoll.ChgDistance(ccn, wpc.ccn); ccnDistance <= 0 {
-		// ignore out-dated events
-		return
-	} else if ccnDistance > 1 {
-		// event ccn is ahead of locally known ccn, reload
-		glog.V(1).Infof(" ** Reloading wpc due to CCN changed %v -> %v", wpc.ccn, ccn)
-		return wpc.reload()
+func (wpc *wpcChgRelay) deletedMsg(id interface{}) map[string]interface{} {
+	return map[string]interface{}{
+		"type": "deleted",
+		"tid":  wpc.routesAPI.Tid(), "_id": id,
 	}
+}
 
-	wpc.ccn = ccn
-
-	// todo notify delete event
-
+func (wpc *wpcChgRelay) send(msg map[string]interface{}) (stop bool) {
+	if e := wpc.wsc.WriteJSON(msg); e != nil {
+		glog.Error(e)
+		return true
+	}
 	return
 }
 
@@ -142,12 +143,21 @@ func showWaypoints(w http.ResponseWriter, r *http.Request) {
 	if err != nil {
 		panic(err)
 	}
-	subr := &wpcChgRelay{
-		routesAPI: routesAPI, wsc: wsc, ccn: 0,
+	// viewers can opt to watch part of the collection, e.g. ?bbox=0,0,100,100
+	filter, err := livecoll.ParseFilter(r.URL.Query().Get)
+	if err != nil {
+		panic(err)
+	}
+	relay := &wpcChgRelay{
+		routesAPI: routesAPI, wsc: wsc,
 	}
-	routesAPI.SubscribeWaypoints(subr)
+	replica := livecoll.NewCoalescingReplica("wpc", routesAPI.WaypointSource(filter), relay)
+	replica.Sparse = filter != nil
+	replica.Start()
 
 	go func() {
+		// the viewer is gone once reading fails, relay no more changes
+		defer replica.Stop()
 		for {
 			var msgIn map[string]interface{}
 			if err := wsc.ReadJSON(&msgIn); err != nil {
@@ -229,9 +239,61 @@ func moveWaypoint(w http.ResponseWriter, r *http.Request) {
 	tid := params["tid"]
 
 	var reqData struct {
-		Seq  int
-		Id   string `json:"_id"`
-		X, Y float64
+		Seq     int
+		Id      string `json:"_id"`
+		X, Y    float64
+		Version *int // move only if still of this version, if specified
+	}
+	decoder := json.NewDecoder(r.Body)
+	if err = decoder.Decode(&reqData); err != nil {
+		panic(err)
+	}
+
+	routesApi, err := GetRoutesService(tid)
+	if err != nil {
+		panic(err)
+	}
+
+	if reqData.Version == nil {
+		err = routesApi.MoveWaypoint(tid, reqData.Seq, reqData.Id, reqData.X, reqData.Y)
+	} else {
+		var version int
+		version, err = routesApi.MoveWaypointIf(
+			tid, reqData.Seq, reqData.Id, *reqData.Version, reqData.X, reqData.Y,
+		)
+		result["version"] = version
+		reportConflict(result, err)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+func deleteWaypoint(w http.ResponseWriter, r *http.Request) {
+	var err error
+	result := map[string]interface{}{}
+	w.Header().Set("Content-Type", "application/json")
+	defer func() {
+		if e := recover(); e != nil {
+			err = errors.RichError(e)
+		}
+		if err != nil {
+			glog.Error(err)
+			result["err"] = fmt.Sprintf("%+v", err)
+		}
+		buf, e := json.Marshal(result)
+		if e != nil {
+			panic(e)
+		}
+		w.Write(buf)
+	}()
+
+	params := mux.Vars(r)
+	tid := params["tid"]
+
+	var reqData struct {
+		Seq int
+		Id  string `json:"_id"`
 	}
 	decoder := json.NewDecoder(r.Body)
 	if err = decoder.Decode(&reqData); err != nil {
@@ -243,7 +305,7 @@ func moveWaypoint(w http.ResponseWriter, r *http.Request) {
 		panic(err)
 	}
 
-	err = routesApi.MoveWaypoint(tid, reqData.Seq, reqData.Id, reqData.X, reqData.Y)
+	err = routesApi.DeleteWaypoint(tid, reqData.Seq, reqData.Id)
 	if err != nil {
 		panic(err)
 	}
@@ -1,10 +1,9 @@
 package dbc
 
 import (
-	"encoding/json"
-	"io/ioutil"
-	"os"
+	"sync"
 
+	"github.com/complyue/ddgo/pkg/svcs"
 	"github.com/complyue/hbigo/pkg/errors"
 	"github.com/globalsign/mgo"
 	"github.com/golang/glog"
@@ -12,8 +11,14 @@ import (
 
 var session *mgo.Session
 var db *mgo.Database
+var muDB sync.Mutex
 
+// DB connects to the mongodb configured as "db" by `svcs.GetServiceConfig()`, so
+// a config overridden applies as well as to `OpenRepo()`.
 func DB() *mgo.Database {
+	muDB.Lock()
+	defer muDB.Unlock()
+
 	var err error
 	defer func() {
 		if e := recover(); e != nil {
@@ -26,24 +31,12 @@ func DB() *mgo.Database {
 	}()
 
 	for db == nil {
-		servicesEtc, e := ioutil.ReadFile("etc/services.json")
-		if e != nil {
-			cwd, _ := os.Getwd()
-			err = errors.Wrapf(e, "Can NOT read etc/services.json`, [%s] may not be the right directory ?\n", cwd)
-			return nil
-		}
-
-		svcConfigs := make(map[string]struct {
-			Url string
-		})
-		err = json.Unmarshal(servicesEtc, &svcConfigs)
+		var dbConfig svcs.ServiceConfig
+		dbConfig, err = svcs.GetServiceConfig("db")
 		if err != nil {
-			err = errors.Wrap(err, "Failed parsing services.json")
 			return nil
 		}
 
-		dbConfig := svcConfigs["db"]
-
 		session, err = mgo.Dial(dbConfig.Url)
 		if err != nil {
 			return nil
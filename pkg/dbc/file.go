@@ -0,0 +1,386 @@
+package dbc
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/glog"
+)
+
+func init() {
+	RegisterRepoScheme("file", func(u *url.URL, collName string) (Repo, error) {
+		if u.Path == "" {
+			return nil, errors.Errorf("No directory in db url [%s]", u.String())
+		}
+		dir := filepath.Join(u.Path, collName)
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+		return &fileRepo{
+			dir:     dir,
+			tenants: make(map[string]*tenantFile),
+		}, nil
+	})
+}
+
+// MaxRecordSize caps the length of a record in tenant files, as bson documents are
+// at most 16MB, a larger length can only be read from a corrupted file.
+const MaxRecordSize = 16<<20 + 1024
+
+// CompactThreshold is the number of records a tenant file has to grow beyond,
+// before it's compacted into a snapshot of live documents.
+var CompactThreshold = 1000
+
+// repo backed by local files, selected by a db url like `file:///var/lib/ddgo`,
+// each tenant has an append-only log file of bson records under the directory of
+// the collection, e.g.
+//
+//	/var/lib/ddgo/truck/<tid>.log
+//
+// the log is compacted into a snapshot, when it has grown to more than twice the
+// number of live documents.
+//
+// multiple processes can share the files, e.g. service processes of a pool, a
+// `<tid>.lock` file is flock'ed around each operation, and changes made by other
+// processes are picked up before each operation.
+type fileRepo struct {
+	dir string
+
+	mu      sync.Mutex
+	tenants map[string]*tenantFile
+}
+
+type fileRecord struct {
+	Op     string      `bson:"op"` // "i" for insert, "u" for update, "d" for delete
+	ID     interface{} `bson:"id"`
+	Doc    bson.M      `bson:"doc,omitempty"`
+	Fields bson.M      `bson:"fields,omitempty"`
+}
+
+type fileDoc struct {
+	n   int // insertion order
+	doc bson.M
+}
+
+// the replayed state of a tenant's log file
+type tenantFile struct {
+	logPath, lockPath string
+
+	mu      sync.Mutex
+	f       *os.File // opened for appending
+	size    int64    // bytes replayed or appended
+	records int      // records in the file
+	lastN   int
+	docs    map[interface{}]*fileDoc
+}
+
+func (r *fileRepo) tenant(tid string) *tenantFile {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tf, ok := r.tenants[tid]
+	if !ok {
+		base := filepath.Join(r.dir, url.PathEscape(tid))
+		tf = &tenantFile{
+			logPath: base + ".log", lockPath: base + ".lock",
+		}
+		r.tenants[tid] = tf
+	}
+	return tf
+}
+
+// run `op` with the tenant file locked, and state synced with the file
+func (tf *tenantFile) locked(op func() error) error {
+	tf.mu.Lock()
+	defer tf.mu.Unlock()
+
+	lf, err := os.OpenFile(tf.lockPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer lf.Close()
+	if err = syscall.Flock(int(lf.Fd()), syscall.LOCK_EX); err != nil {
+		return errors.Wrapf(err, "Failed locking %s", tf.lockPath)
+	}
+	defer syscall.Flock(int(lf.Fd()), syscall.LOCK_UN)
+
+	if err = tf.sync(); err != nil {
+		return err
+	}
+	return op()
+}
+
+// pick up changes made by other processes, should be called with the file locked.
+func (tf *tenantFile) sync() error {
+	fi, err := os.Stat(tf.logPath)
+	if os.IsNotExist(err) {
+		fi, err = nil, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if tf.f != nil {
+		if ofi, err := tf.f.Stat(); err == nil && fi != nil && os.SameFile(ofi, fi) {
+			if fi.Size() == tf.size {
+				return nil // nothing changed
+			}
+			// appended by others, replay the tail
+			return tf.replay(tf.size)
+		}
+		// compacted by others, or removed
+		tf.f.Close()
+		tf.f = nil
+	}
+
+	tf.size, tf.records, tf.lastN = 0, 0, 0
+	tf.docs = make(map[interface{}]*fileDoc)
+	if tf.f, err = os.OpenFile(tf.logPath, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	return tf.replay(0)
+}
+
+func (tf *tenantFile) replay(from int64) error {
+	rf, err := os.Open(tf.logPath)
+	if err != nil {
+		return err
+	}
+	defer rf.Close()
+	fi, err := rf.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err = rf.Seek(from, io.SeekStart); err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(rf)
+	goodSize := from
+	for goodSize < fi.Size() {
+		var rec fileRecord
+		n, err := readRecord(br, &rec)
+		if err == io.EOF || err == io.ErrUnexpectedEOF ||
+			(err != nil && n > 0 && goodSize+int64(n) == fi.Size()) {
+			// a partial record at the very end, left by a crash while appending,
+			// cut it off so further appends start from a clean position.
+			glog.Warningf("Truncating %s at %d due to broken record: %+v",
+				tf.logPath, goodSize, err)
+			if err = os.Truncate(tf.logPath, goodSize); err != nil {
+				return err
+			}
+			break
+		}
+		if err != nil {
+			// records after it can't be located, nor trusted
+			tf.size = goodSize
+			return errors.Wrapf(err, "Corrupted %s at %d", tf.logPath, goodSize)
+		}
+		tf.apply(&rec)
+		goodSize += int64(n)
+	}
+	tf.size = goodSize
+	return nil
+}
+
+// read the next record, `n` is its length once that's read and valid
+func readRecord(br *bufio.Reader, rec *fileRecord) (n int, err error) {
+	var lenBuf [4]byte
+	if _, err = io.ReadFull(br, lenBuf[:]); err != nil {
+		return
+	}
+	n = int(binary.LittleEndian.Uint32(lenBuf[:]))
+	if n < 5 || n > MaxRecordSize {
+		return 0, errors.Errorf("Bad record length %d", n)
+	}
+	data := make([]byte, n)
+	copy(data, lenBuf[:])
+	if _, err = io.ReadFull(br, data[4:]); err != nil {
+		return
+	}
+	err = bson.Unmarshal(data, rec)
+	return
+}
+
+func (tf *tenantFile) apply(rec *fileRecord) {
+	tf.records++
+	switch rec.Op {
+	case "i":
+		tf.lastN++
+		tf.docs[rec.ID] = &fileDoc{tf.lastN, rec.Doc}
+	case "u":
+		if fd, ok := tf.docs[rec.ID]; ok {
+			for k, v := range rec.Fields {
+				fd.doc[k] = v
+			}
+		}
+	case "d":
+		delete(tf.docs, rec.ID)
+	default:
+		glog.Warningf("Unknown op [%s] in %s", rec.Op, tf.logPath)
+	}
+}
+
+// should be called with the file locked.
+func (tf *tenantFile) append(rec *fileRecord) error {
+	data, err := bson.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if n, err := tf.f.Write(data); err != nil {
+		if n > 0 {
+			// cut off the partial record, or appends after it would be lost
+			if terr := tf.f.Truncate(tf.size); terr != nil {
+				glog.Errorf("Failed truncating %s back to %d: %+v", tf.logPath, tf.size, terr)
+			}
+		}
+		return err
+	}
+	tf.size += int64(len(data))
+	tf.apply(rec)
+
+	if tf.records > CompactThreshold && tf.records > 2*len(tf.docs) {
+		if err := tf.compact(); err != nil {
+			// not fatal, the log is still intact
+			glog.Errorf("Failed compacting %s: %+v", tf.logPath, err)
+		}
+	}
+	return nil
+}
+
+// rewrite the log as a snapshot of live documents, should be called with the file
+// locked.
+func (tf *tenantFile) compact() error {
+	tmpPath := tf.logPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(tmpPath)
+		}
+	}()
+
+	w := bufio.NewWriter(f)
+	var size int64
+	for _, fd := range tf.sortedDocs() {
+		data, err := bson.Marshal(&fileRecord{Op: "i", ID: fd.doc["_id"], Doc: fd.doc})
+		if err != nil {
+			return err
+		}
+		if _, err = w.Write(data); err != nil {
+			return err
+		}
+		size += int64(len(data))
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	f = nil
+	if err = os.Rename(tmpPath, tf.logPath); err != nil {
+		return err
+	}
+
+	glog.V(1).Infof("Compacted %s from %d records to %d.", tf.logPath, tf.records, len(tf.docs))
+	tf.f.Close()
+	if tf.f, err = os.OpenFile(tf.logPath, os.O_RDWR|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+	tf.size, tf.records = size, len(tf.docs)
+	return nil
+}
+
+func (tf *tenantFile) sortedDocs() []*fileDoc {
+	return sortFileDocs(tf.docs)
+}
+
+// documents in insertion order
+func sortFileDocs(docs map[interface{}]*fileDoc) []*fileDoc {
+	fds := make([]*fileDoc, 0, len(docs))
+	for _, fd := range docs {
+		fds = append(fds, fd)
+	}
+	sort.Slice(fds, func(i, j int) bool { return fds[i].n < fds[j].n })
+	return fds
+}
+
+func (r *fileRepo) LoadAll(tid string, result interface{}) error {
+	tf := r.tenant(tid)
+	return tf.locked(func() error {
+		fds := tf.sortedDocs()
+		docs := make([]bson.M, len(fds))
+		for i, fd := range fds {
+			docs[i] = fd.doc
+		}
+		return decodeDocs(docs, result)
+	})
+}
+
+func (r *fileRepo) Insert(tid string, doc interface{}) error {
+	m, id, err := encodeDoc(doc)
+	if err != nil {
+		return err
+	}
+
+	tf := r.tenant(tid)
+	return tf.locked(func() error {
+		if _, ok := tf.docs[id]; ok {
+			return errors.Errorf("Duplicate _id %+v", id)
+		}
+		return tf.append(&fileRecord{Op: "i", ID: id, Doc: m})
+	})
+}
+
+func (r *fileRepo) Update(tid string, id interface{}, fields map[string]interface{}) error {
+	tf := r.tenant(tid)
+	return tf.locked(func() error {
+		if _, ok := tf.docs[id]; !ok {
+			return ErrNotFound
+		}
+		return tf.append(&fileRecord{Op: "u", ID: id, Fields: bson.M(fields)})
+	})
+}
+
+func (r *fileRepo) UpdateVersioned(
+	tid string, id interface{}, version int, fields map[string]interface{},
+) error {
+	tf := r.tenant(tid)
+	return tf.locked(func() error {
+		fd, ok := tf.docs[id]
+		if !ok {
+			return ErrNotFound
+		}
+		// checked with the file locked, so no other process can change it in between
+		if docVersion(fd.doc) != version {
+			return ErrConflict
+		}
+		return tf.append(&fileRecord{Op: "u", ID: id, Fields: versionedFields(version, fields)})
+	})
+}
+
+func (r *fileRepo) Delete(tid string, id interface{}) error {
+	tf := r.tenant(tid)
+	return tf.locked(func() error {
+		if _, ok := tf.docs[id]; !ok {
+			return ErrNotFound
+		}
+		return tf.append(&fileRecord{Op: "d", ID: id})
+	})
+}
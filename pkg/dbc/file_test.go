@@ -0,0 +1,206 @@
+package dbc
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+type fileTestDoc struct {
+	Id      string  `json:"_id" bson:"_id"`
+	X       float64 `json:"x"`
+	Version int     `json:"version"`
+}
+
+// open a file repo under `dir`, each one opened is like of another process
+func openFileRepo(t *testing.T, dir string) Repo {
+	u, err := url.Parse("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := repoOpeners["file"](u, "doc")
+	if err != nil {
+		t.Fatalf("Repo not opened: %+v", err)
+	}
+	return r
+}
+
+func loadDocs(t *testing.T, r Repo, tid string) map[string]fileTestDoc {
+	var docs []fileTestDoc
+	if err := r.LoadAll(tid, &docs); err != nil {
+		t.Fatalf("Not loaded: %+v", err)
+	}
+	byId := make(map[string]fileTestDoc, len(docs))
+	for _, doc := range docs {
+		byId[doc.Id] = doc
+	}
+	return byId
+}
+
+func TestFileRepoChanges(t *testing.T) {
+	dir := t.TempDir()
+	r := openFileRepo(t, dir)
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := r.Insert("t", &fileTestDoc{Id: id, X: 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Insert("t", &fileTestDoc{Id: "a"}); err == nil {
+		t.Fatal("Duplicate _id inserted")
+	}
+	if err := r.Update("t", "a", bson.M{"x": 2.0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Update("t", "z", bson.M{"x": 2.0}); err != ErrNotFound {
+		t.Fatalf("Updated a missing document: %v", err)
+	}
+	if err := r.UpdateVersioned("t", "b", 0, bson.M{"x": 3.0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.UpdateVersioned("t", "b", 0, bson.M{"x": 4.0}); err != ErrConflict {
+		t.Fatalf("Stale version not rejected: %v", err)
+	}
+	if err := r.Delete("t", "c"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete("t", "c"); err != ErrNotFound {
+		t.Fatalf("Deleted again: %v", err)
+	}
+
+	want := map[string]fileTestDoc{
+		"a": {Id: "a", X: 2},
+		"b": {Id: "b", X: 3, Version: 1},
+	}
+	check := func(docs map[string]fileTestDoc) {
+		if len(docs) != len(want) {
+			t.Fatalf("Loaded %+v", docs)
+		}
+		for id, doc := range want {
+			if docs[id] != doc {
+				t.Fatalf("Loaded %+v instead of %+v", docs[id], doc)
+			}
+		}
+	}
+	check(loadDocs(t, r, "t"))
+	// replayed after reopened
+	check(loadDocs(t, openFileRepo(t, dir), "t"))
+	if docs := loadDocs(t, r, "other"); len(docs) != 0 {
+		t.Fatalf("Loaded %+v of another tenant", docs)
+	}
+}
+
+func TestFileRepoCompactedByOther(t *testing.T) {
+	defer func(threshold int) { CompactThreshold = threshold }(CompactThreshold)
+	CompactThreshold = 5
+	dir := t.TempDir()
+
+	r := openFileRepo(t, dir)
+	if err := r.Insert("t", &fileTestDoc{Id: "a"}); err != nil {
+		t.Fatal(err)
+	}
+	loadDocs(t, r, "t") // keeps the log file open
+
+	other := openFileRepo(t, dir)
+	logPath := filepath.Join(dir, "doc", "t.log")
+	before, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 20; i++ {
+		if err := other.Update("t", "a", bson.M{"x": float64(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	after, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if os.SameFile(before, after) {
+		t.Fatal("Not compacted")
+	}
+
+	// the file kept open is not the log any more
+	if err := r.UpdateVersioned("t", "a", 0, bson.M{"x": 42.0}); err != nil {
+		t.Fatal(err)
+	}
+	if doc := loadDocs(t, other, "t")["a"]; doc.X != 42 || doc.Version != 1 {
+		t.Fatalf("Loaded %+v by other", doc)
+	}
+}
+
+func TestFileRepoTruncatedRecord(t *testing.T) {
+	dir := t.TempDir()
+	r := openFileRepo(t, dir)
+	for _, id := range []string{"a", "b"} {
+		if err := r.Insert("t", &fileTestDoc{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// crashed while appending a record
+	logPath := filepath.Join(dir, "doc", "t.log")
+	fi, err := os.Stat(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := bson.Marshal(&fileRecord{Op: "i", ID: "c", Doc: bson.M{"_id": "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = f.Write(data[:len(data)/2]); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	r = openFileRepo(t, dir)
+	if docs := loadDocs(t, r, "t"); len(docs) != 2 {
+		t.Fatalf("Loaded %+v", docs)
+	}
+	if cut, err := os.Stat(logPath); err != nil || cut.Size() != fi.Size() {
+		t.Fatalf("Broken record not cut off: %v", err)
+	}
+	if err := r.Insert("t", &fileTestDoc{Id: "c"}); err != nil {
+		t.Fatal(err)
+	}
+	if docs := loadDocs(t, openFileRepo(t, dir), "t"); len(docs) != 3 {
+		t.Fatalf("Loaded %+v", docs)
+	}
+}
+
+func TestFileRepoCorruptedRecord(t *testing.T) {
+	dir := t.TempDir()
+	r := openFileRepo(t, dir)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := r.Insert("t", &fileTestDoc{Id: id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a huge length of the second record
+	logPath := filepath.Join(dir, "doc", "t.log")
+	data, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := int(data[0]) | int(data[1])<<8 | int(data[2])<<16 | int(data[3])<<24
+	data[second+3] = 0x7f
+	if err = os.WriteFile(logPath, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var docs []fileTestDoc
+	if err := openFileRepo(t, dir).LoadAll("t", &docs); err == nil {
+		t.Fatalf("Loaded %+v from a corrupted file", docs)
+	}
+	if fi, err := os.Stat(logPath); err != nil || fi.Size() != int64(len(data)) {
+		t.Fatalf("Corrupted file truncated: %v", err)
+	}
+}
@@ -0,0 +1,143 @@
+package dbc
+
+import (
+	"net/url"
+	"sync"
+
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/globalsign/mgo/bson"
+)
+
+func init() {
+	RegisterRepoScheme("mem", func(u *url.URL, collName string) (Repo, error) {
+		// repos opened at the same url share documents, like they do with a db
+		key := u.Host + u.Path + "/" + collName
+
+		muMem.Lock()
+		defer muMem.Unlock()
+
+		r, ok := memRepos[key]
+		if !ok {
+			r = &memRepo{tenants: make(map[string]*memTenant)}
+			memRepos[key] = r
+		}
+		return r, nil
+	})
+}
+
+var (
+	memRepos = make(map[string]*memRepo)
+	muMem    sync.Mutex
+)
+
+// ResetMemRepos drops all documents stored in repos at `mem://` urls, e.g. for
+// tests to start over with empty storage.
+func ResetMemRepos() {
+	muMem.Lock()
+	defer muMem.Unlock()
+
+	for _, r := range memRepos {
+		r.mu.Lock()
+		r.tenants = make(map[string]*memTenant)
+		r.mu.Unlock()
+	}
+}
+
+// repo keeping documents in memory only, selected by a db url like `mem://` or
+// `mem://<name>` for separate storages. all is lost when the process exits, it's
+// meant for tests and throwaway demos running services in a single process.
+type memRepo struct {
+	mu      sync.Mutex
+	tenants map[string]*memTenant
+}
+
+type memTenant struct {
+	lastN int
+	docs  map[interface{}]*fileDoc
+}
+
+// should be called with `r.mu` locked.
+func (r *memRepo) tenant(tid string) *memTenant {
+	mt, ok := r.tenants[tid]
+	if !ok {
+		mt = &memTenant{docs: make(map[interface{}]*fileDoc)}
+		r.tenants[tid] = mt
+	}
+	return mt
+}
+
+func (r *memRepo) LoadAll(tid string, result interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mt := r.tenant(tid)
+	fds := sortFileDocs(mt.docs)
+	docs := make([]bson.M, len(fds))
+	for i, fd := range fds {
+		docs[i] = fd.doc
+	}
+	return decodeDocs(docs, result)
+}
+
+func (r *memRepo) Insert(tid string, doc interface{}) error {
+	m, id, err := encodeDoc(doc)
+	if err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mt := r.tenant(tid)
+	if _, ok := mt.docs[id]; ok {
+		return errors.Errorf("Duplicate _id %+v", id)
+	}
+	mt.lastN++
+	mt.docs[id] = &fileDoc{mt.lastN, m}
+	return nil
+}
+
+func (r *memRepo) Update(tid string, id interface{}, fields map[string]interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fd, ok := r.tenant(tid).docs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	for k, v := range fields {
+		fd.doc[k] = v
+	}
+	return nil
+}
+
+func (r *memRepo) UpdateVersioned(
+	tid string, id interface{}, version int, fields map[string]interface{},
+) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	fd, ok := r.tenant(tid).docs[id]
+	if !ok {
+		return ErrNotFound
+	}
+	if docVersion(fd.doc) != version {
+		return ErrConflict
+	}
+	for k, v := range versionedFields(version, fields) {
+		fd.doc[k] = v
+	}
+	return nil
+}
+
+func (r *memRepo) Delete(tid string, id interface{}) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	mt := r.tenant(tid)
+	if _, ok := mt.docs[id]; !ok {
+		return ErrNotFound
+	}
+	delete(mt.docs, id)
+	return nil
+}
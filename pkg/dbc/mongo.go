@@ -0,0 +1,90 @@
+package dbc
+
+import (
+	"net/url"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+func init() {
+	RegisterRepoScheme("mongodb", func(u *url.URL, collName string) (Repo, error) {
+		return &mongoRepo{collName}, nil
+	})
+}
+
+// repo backed by a mongodb collection, documents of all tenants are stored in the
+// same collection, with a `tid` field to tell them apart.
+type mongoRepo struct {
+	collName string
+}
+
+func (r *mongoRepo) coll() *mgo.Collection {
+	return DB().C(r.collName)
+}
+
+func (r *mongoRepo) LoadAll(tid string, result interface{}) error {
+	return r.coll().Find(bson.M{"tid": tid}).All(result)
+}
+
+func (r *mongoRepo) Insert(tid string, doc interface{}) error {
+	// in-memory documents do not store the tid, it's only meaningful for a
+	// collection, but needs to present in the db
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	var m bson.M
+	if err = bson.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	m["tid"] = tid
+	return r.coll().Insert(m)
+}
+
+func (r *mongoRepo) Update(tid string, id interface{}, fields map[string]interface{}) error {
+	err := r.coll().Update(bson.M{
+		"tid": tid, "_id": id,
+	}, bson.M{
+		"$set": bson.M(fields),
+	})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *mongoRepo) UpdateVersioned(
+	tid string, id interface{}, version int, fields map[string]interface{},
+) error {
+	selector := bson.M{"tid": tid, "_id": id, VersionField: version}
+	if version == 0 {
+		// documents stored before versioned have no version field
+		selector[VersionField] = bson.M{"$in": []interface{}{0, nil}}
+	}
+	err := r.coll().Update(selector, bson.M{
+		"$set": versionedFields(version, fields),
+	})
+	if err == mgo.ErrNotFound {
+		// tell a missing document from one of another version
+		n, err := r.coll().Find(bson.M{"tid": tid, "_id": id}).Count()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrConflict
+		}
+		return ErrNotFound
+	}
+	return err
+}
+
+func (r *mongoRepo) Delete(tid string, id interface{}) error {
+	err := r.coll().Remove(bson.M{
+		"tid": tid, "_id": id,
+	})
+	if err == mgo.ErrNotFound {
+		return ErrNotFound
+	}
+	return err
+}
@@ -0,0 +1,147 @@
+package dbc
+
+import (
+	"net/url"
+	"reflect"
+	"sync"
+
+	"github.com/complyue/ddgo/pkg/svcs"
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ErrNotFound is returned by repos when the document to update or delete does
+// not exist.
+var ErrNotFound = errors.New("Document not found.")
+
+// ErrConflict is returned by repos when a versioned update is rejected, as the
+// document is not of the version expected.
+var ErrConflict = errors.New("Document version conflict.")
+
+// VersionField is the bson name of the version number of versioned documents, a
+// document without it is of version 0.
+const VersionField = "version"
+
+// Repo is the backing storage of a collection of documents, partitioned by tenant.
+// documents are structs with an `_id` field, as marshaled by bson.
+type Repo interface {
+	// LoadAll loads all documents of a tenant into `result`, which should be a
+	// pointer to a slice of documents.
+	LoadAll(tid string, result interface{}) error
+
+	Insert(tid string, doc interface{}) error
+
+	// Update sets the specified fields of a document, by their bson names.
+	Update(tid string, id interface{}, fields map[string]interface{}) error
+
+	// UpdateVersioned sets the specified fields of a document and increases its
+	// version by 1, only if it's currently of `version`, or returns `ErrConflict`.
+	UpdateVersioned(tid string, id interface{}, version int, fields map[string]interface{}) error
+
+	Delete(tid string, id interface{}) error
+}
+
+// RepoOpener opens a repo for the named collection, at the storage located by url.
+type RepoOpener func(u *url.URL, collName string) (Repo, error)
+
+var (
+	repoOpeners = make(map[string]RepoOpener)
+	muOpeners   sync.RWMutex
+)
+
+// RegisterRepoScheme registers the opener of repos at urls of a scheme.
+func RegisterRepoScheme(scheme string, opener RepoOpener) {
+	muOpeners.Lock()
+	defer muOpeners.Unlock()
+	repoOpeners[scheme] = opener
+}
+
+// OpenRepo opens a repo for the named collection, at the storage configured as
+// "db" in etc/services.json, with the url scheme selecting the backend.
+func OpenRepo(collName string) (Repo, error) {
+	cfg, err := svcs.GetServiceConfig("db")
+	if err != nil {
+		return nil, err
+	}
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Bad db url [%s]", cfg.Url)
+	}
+	muOpeners.RLock()
+	opener, ok := repoOpeners[u.Scheme]
+	muOpeners.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("Unsupported db url [%s]", cfg.Url)
+	}
+	return opener(u, collName)
+}
+
+// marshal a document to its bson form, for repos not backed by a db to store it,
+// the `_id` is required.
+func encodeDoc(doc interface{}) (m bson.M, id interface{}, err error) {
+	data, err := bson.Marshal(doc)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err = bson.Unmarshal(data, &m); err != nil {
+		return nil, nil, err
+	}
+	id, ok := m["_id"]
+	if !ok {
+		return nil, nil, errors.Errorf("Document of type %T has no _id", doc)
+	}
+	return m, id, nil
+}
+
+// decode documents in bson form into `result`, which should be a pointer to a
+// slice of documents.
+func decodeDocs(docs []bson.M, result interface{}) error {
+	rv := reflect.ValueOf(result)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Slice {
+		return errors.Errorf("Need a pointer to slice to load into, not %T", result)
+	}
+	sv, elemType := rv.Elem(), rv.Elem().Type().Elem()
+
+	sv.SetLen(0)
+	for _, doc := range docs {
+		// round trip through bson, for the documents to be decoded the same way
+		// as they're loaded from mongodb
+		data, err := bson.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		ev := reflect.New(elemType)
+		if err = bson.Unmarshal(data, ev.Interface()); err != nil {
+			return err
+		}
+		sv.Set(reflect.Append(sv, ev.Elem()))
+	}
+	return nil
+}
+
+// version of a document in bson form, numbers may have been decoded into any of
+// these types.
+func docVersion(doc bson.M) int {
+	switch v := doc[VersionField].(type) {
+	case int:
+		return v
+	case int32:
+		return int(v)
+	case int64:
+		return int(v)
+	case float64:
+		return int(v)
+	default:
+		return 0
+	}
+}
+
+// fields to set by a versioned update, with the version increased
+func versionedFields(version int, fields map[string]interface{}) bson.M {
+	m := make(bson.M, len(fields)+1)
+	for k, v := range fields {
+		m[k] = v
+	}
+	m[VersionField] = version + 1
+	return m
+}
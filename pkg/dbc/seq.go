@@ -0,0 +1,112 @@
+package dbc
+
+import (
+	"sync"
+
+	"github.com/complyue/hbigo/pkg/errors"
+)
+
+// SeqCounter allocates increasing seqs of a collection per tenant. the last seq is
+// stored in a repo of its own, so seqs of deleted documents are not reused, even
+// after the process restarted.
+type SeqCounter struct {
+	repo     Repo
+	collName string
+}
+
+// the last seq allocated for a collection of a tenant. documents of all tenants
+// may share the same `_id` space, e.g. in a mongodb collection, so the tid is part
+// of it.
+type seqDoc struct {
+	Id      string `json:"_id" bson:"_id"`
+	Seq     int    `json:"seq"`
+	Version int    `json:"version"`
+}
+
+var (
+	seqRepo Repo
+	muSeq   sync.Mutex
+)
+
+// OpenSeqCounter opens the counter of seqs for the named collection, stored along
+// with other collections at the "db" url.
+func OpenSeqCounter(collName string) (*SeqCounter, error) {
+	muSeq.Lock()
+	defer muSeq.Unlock()
+
+	if seqRepo == nil {
+		r, err := OpenRepo("seq")
+		if err != nil {
+			return nil, err
+		}
+		seqRepo = r
+	}
+	return &SeqCounter{seqRepo, collName}, nil
+}
+
+// Next allocates a seq for a new document of the tenant. `atLeast` is the max seq
+// known in use, e.g. of documents stored before the counter was.
+//
+// it's a compare-and-set over versioned updates, so processes sharing the storage
+// never get the same seq.
+func (sc *SeqCounter) Next(tid string, atLeast int) (int, error) {
+	id := tid + "/" + sc.collName
+	for {
+		var docs []seqDoc
+		if err := sc.repo.LoadAll(tid, &docs); err != nil {
+			return 0, err
+		}
+		var (
+			doc   seqDoc
+			found bool
+		)
+		for i := range docs {
+			if docs[i].Id == id {
+				doc, found = docs[i], true
+				break
+			}
+		}
+
+		next := doc.Seq
+		if atLeast > next {
+			next = atLeast
+		}
+		next++
+
+		if !found {
+			if err := sc.repo.Insert(tid, &seqDoc{Id: id, Seq: next}); err != nil {
+				// tell a racing insert from a failure
+				if sc.exists(tid, id) {
+					continue
+				}
+				return 0, err
+			}
+			return next, nil
+		}
+
+		err := sc.repo.UpdateVersioned(tid, id, doc.Version, map[string]interface{}{
+			"seq": next,
+		})
+		if err == ErrConflict {
+			// allocated by another process meanwhile
+			continue
+		}
+		if err != nil {
+			return 0, errors.Wrapf(err, "Failed allocating seq of [%s] for tid=%s", sc.collName, tid)
+		}
+		return next, nil
+	}
+}
+
+func (sc *SeqCounter) exists(tid string, id string) bool {
+	var docs []seqDoc
+	if err := sc.repo.LoadAll(tid, &docs); err != nil {
+		return false
+	}
+	for i := range docs {
+		if docs[i].Id == id {
+			return true
+		}
+	}
+	return false
+}
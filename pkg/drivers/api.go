@@ -10,6 +10,7 @@ import (
 	"github.com/complyue/ddgo/pkg/svcs"
 	"github.com/complyue/hbigo"
 	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/globalsign/mgo/bson"
 	"github.com/golang/glog"
 )
 
@@ -43,8 +44,13 @@ type ConsumerAPI struct {
 	tid string
 
 	// collection change event stream for Trucks
-	tkCCES *isoevt.EventStream
-	tkCCN  int // last known ccn of truck collection
+	tkCCES        *isoevt.EventStream
+	tkCCN         livecoll.CCN // last known ccn of truck collection
+	tkSubscribers int          // unfiltered subscriptions not dropped yet
+
+	// filtered subscriptions to trucks collection, by subscription id
+	tkFiltered map[int]*filteredSubscription
+	lastSid    int
 
 	svc *hbi.TCPConn
 }
@@ -56,6 +62,14 @@ type consumerContext struct {
 	api *ConsumerAPI
 
 	watchingTrucks bool
+	filteredTrucks map[int]bool // ids of filtered subscriptions made over this wire
+}
+
+// a filtered subscription over hbi wire, with its own change event stream
+type filteredSubscription struct {
+	filter *livecoll.Filter
+	id     string // of the single truck watched, empty unless watching one
+	cces   *isoevt.EventStream
 }
 
 // give types to be exposed, with typed nil pointer values to each
@@ -63,6 +77,10 @@ func (ctx *consumerContext) TypesToExpose() []interface{} {
 	return []interface{}{
 		(*Truck)(nil),
 		(*TrucksSnapshot)(nil),
+		(*TruckChange)(nil),
+		(*TruckChanges)(nil),
+		(*livecoll.UpdateOutcome)(nil),
+		(*ClockState)(nil),
 	}
 }
 
@@ -105,7 +123,7 @@ func (api *ConsumerAPI) EnsureConn() *hbi.TCPConn {
 							api:       api,
 						}
 						return ctx
-					}, // single tunnel, use tid as sticky session id, for tenant isolation
+					}, // single tunnel, use tid as sticky session id, for tenant affinity
 					"", api.tid, true)
 				if err == nil {
 					api.svc = svc
@@ -113,7 +131,7 @@ func (api *ConsumerAPI) EnsureConn() *hbi.TCPConn {
 			}
 		}()
 		if err == nil {
-			if api.tkCCES != nil {
+			if api.tkSubscribers > 0 {
 				// consumer has subscribed to Trucks collection change event stream,
 				// make sure the connected wire has subscribed as well,
 				// Epoch event will be fired by service upon each subscription.
@@ -126,6 +144,29 @@ SubscribeTrucks(%#v)
 					ctx.watchingTrucks = true
 				}
 			}
+			if len(api.tkFiltered) > 0 {
+				// the same for filtered subscriptions, with the filter sent along
+				ctx := api.svc.HoCtx().(*consumerContext)
+				if ctx.filteredTrucks == nil {
+					ctx.filteredTrucks = make(map[int]bool)
+				}
+				po := api.svc.MustPoToPeer()
+				for sid, fsub := range api.tkFiltered {
+					if ctx.filteredTrucks[sid] {
+						continue
+					}
+					if fsub.id != "" {
+						po.Notif(fmt.Sprintf(`
+SubscribeTruck(%#v,%#v,%#v)
+`, api.tid, sid, fsub.id))
+					} else {
+						po.NotifBSON(fmt.Sprintf(`
+SubscribeFilteredTrucks(%#v,%#v)
+`, api.tid, sid), fsub.filter, "&Filter{}")
+					}
+					ctx.filteredTrucks[sid] = true
+				}
+			}
 			return api.svc
 		}
 		glog.Errorf("Failed connecting drivers service, retrying... %+v", err)
@@ -133,6 +174,20 @@ SubscribeTrucks(%#v)
 	}
 }
 
+// Disconnect drops the current hbi wire as if it's broken, e.g. for tests to see
+// how subscribers react to reconnection, which happens upon next `EnsureConn()`.
+func (api *ConsumerAPI) Disconnect() {
+	if api.mono {
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.svc != nil {
+		api.svc.Close()
+	}
+}
+
 // get posting endpoint
 func (api *ConsumerAPI) conn() (*consumerContext, hbi.Posting) {
 	svc := api.EnsureConn()
@@ -182,7 +237,121 @@ StopTruck(%#v,%#v,%#v,%#v)
 	return err
 }
 
-func (api *ConsumerAPI) FetchTrucks() (ccn int, tkl []Truck) {
+// MoveTruckIf moves the truck only if it's still of `version`, or returns a
+// `*livecoll.ConflictError`. the new version is returned on success.
+func (api *ConsumerAPI) MoveTruckIf(
+	tid string, seq int, id string, version int, x, y float64,
+) (int, error) {
+	if api.mono {
+		return MoveTruckIf(tid, seq, id, version, x, y)
+	}
+
+	return api.updateIf(id, version, fmt.Sprintf(`
+MoveTruckIf(%#v,%#v,%#v,%#v,%#v,%#v)
+`, tid, seq, id, version, x, y))
+}
+
+// StopTruckIf tells the truck to be moving or not, only if it's still of `version`,
+// or returns a `*livecoll.ConflictError`. the new version is returned on success.
+func (api *ConsumerAPI) StopTruckIf(
+	tid string, seq int, id string, version int, moving bool,
+) (int, error) {
+	if api.mono {
+		return StopTruckIf(tid, seq, id, version, moving)
+	}
+
+	return api.updateIf(id, version, fmt.Sprintf(`
+StopTruckIf(%#v,%#v,%#v,%#v,%#v)
+`, tid, seq, id, version, moving))
+}
+
+func (api *ConsumerAPI) AssignRoute(
+	tid string, seq int, id string, routeID string,
+) error {
+	if api.mono {
+		return AssignRoute(tid, seq, id, routeID)
+	}
+
+	_, po := api.conn()
+	return po.Notif(fmt.Sprintf(`
+AssignRoute(%#v,%#v,%#v,%#v)
+`, tid, seq, id, routeID))
+}
+
+// AssignRouteIf assigns the truck to drive along a route, or to roam if `routeID`
+// is empty, only if it's still of `version`, or returns a `*livecoll.ConflictError`.
+// the new version is returned on success.
+func (api *ConsumerAPI) AssignRouteIf(
+	tid string, seq int, id string, version int, routeID string,
+) (int, error) {
+	if api.mono {
+		return AssignRouteIf(tid, seq, id, version, routeID)
+	}
+
+	return api.updateIf(id, version, fmt.Sprintf(`
+AssignRouteIf(%#v,%#v,%#v,%#v,%#v)
+`, tid, seq, id, version, routeID))
+}
+
+func (api *ConsumerAPI) SetDrivingStrategy(
+	tid string, seq int, id string, strategy string,
+) error {
+	if api.mono {
+		return SetDrivingStrategy(tid, seq, id, strategy)
+	}
+
+	_, po := api.conn()
+	return po.Notif(fmt.Sprintf(`
+SetDrivingStrategy(%#v,%#v,%#v,%#v)
+`, tid, seq, id, strategy))
+}
+
+// SetDrivingStrategyIf selects the strategy for the truck to be driven by, or the
+// default if `strategy` is empty, only if it's still of `version`, or returns a
+// `*livecoll.ConflictError`. the new version is returned on success.
+func (api *ConsumerAPI) SetDrivingStrategyIf(
+	tid string, seq int, id string, version int, strategy string,
+) (int, error) {
+	if api.mono {
+		return SetDrivingStrategyIf(tid, seq, id, version, strategy)
+	}
+
+	return api.updateIf(id, version, fmt.Sprintf(`
+SetDrivingStrategyIf(%#v,%#v,%#v,%#v,%#v)
+`, tid, seq, id, version, strategy))
+}
+
+// run a conditional update at service side, and get its outcome back
+func (api *ConsumerAPI) updateIf(id string, version int, code string) (int, error) {
+	_, po := api.conn()
+	co, err := po.Co()
+	if err != nil {
+		return 0, err
+	}
+	defer co.Close()
+
+	result, err := co.Get(code, "&UpdateOutcome{}")
+	if err != nil {
+		return 0, err
+	}
+	return result.(*livecoll.UpdateOutcome).Result(bson.ObjectIdHex(id), version)
+}
+
+func (api *ConsumerAPI) DeleteTruck(tid string, seq int, id string) error {
+	if api.mono {
+		return DeleteTruck(tid, seq, id)
+	}
+
+	glog.V(1).Infof(" * Requesting truck %v to be deleted ...", seq)
+	_, po := api.conn()
+	err := po.Notif(fmt.Sprintf(`
+DeleteTruck(%#v,%#v,%#v)
+`, tid, seq, id))
+	glog.V(1).Infof(" * Requested truck %v to be deleted.", seq)
+	return err
+}
+
+func (api *ConsumerAPI) FetchTrucks() (ccn livecoll.CCN, tkl []Truck) {
 	if api.mono {
 		tks := FetchTrucks(api.tid)
 
@@ -209,39 +378,301 @@ FetchTrucks(%#v)
 	return
 }
 
-func (api *ConsumerAPI) SubscribeTrucks(subr livecoll.Subscriber) {
+// FetchTruckChangesSince returns the changes after `ccn` as livecoll events in order,
+// `ok` is false if the changes are no longer available, a snapshot should be fetched
+// by `FetchTrucks()` then.
+func (api *ConsumerAPI) FetchTruckChangesSince(ccn livecoll.CCN) (changes []interface{}, ok bool) {
 	if api.mono {
-		ensureLoadedFor(api.tid)
-		tkCollection.Subscribe(subr)
-		return
+		return FetchTruckChangesSince(api.tid, ccn).Events()
 	}
 
-	// ensure the wire is connected
-	api.EnsureConn()
+	_, po := api.conn()
+	co, err := po.Co()
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
 
-	if api.tkCCES == nil { // quick check without sync
-		func() {
-			api.mu.Lock()
-			defer api.mu.Unlock()
+	result, err := co.Get(fmt.Sprintf(`
+FetchTruckChangesSince(%#v,%d,%d)
+`, api.tid, ccn.Epoch, ccn.Seq), "&TruckChanges{}")
+	if err != nil {
+		panic(err)
+	}
+	return result.(*TruckChanges).Events()
+}
+
+// FetchTruck reads a single truck with the ccn it's consistent with, `ok` is false if
+// no such truck.
+func (api *ConsumerAPI) FetchTruck(id bson.ObjectId) (ccn livecoll.CCN, tk *Truck, ok bool) {
+	var chg *TruckChange
+	if api.mono {
+		chg = FetchTruck(api.tid, id)
+	} else {
+		_, po := api.conn()
+		co, err := po.Co()
+		if err != nil {
+			panic(err)
+		}
+		defer co.Close()
 
-			if api.tkCCES != nil { // final check after sync'ed
-				return
+		result, err := co.Get(fmt.Sprintf(`
+FetchTruck(%#v,%#v)
+`, api.tid, id.Hex()), "&TruckChange{}")
+		if err != nil {
+			panic(err)
+		}
+		chg = result.(*TruckChange)
+	}
+	if chg.Deleted {
+		return chg.CCN, nil, false
+	}
+	return chg.CCN, &chg.Truck, true
+}
+
+// TruckSource makes a source for trucks to be replicated from, with only those
+// passing the filter if it's not nil, the replica should be sparse then.
+func (api *ConsumerAPI) TruckSource(filter *livecoll.Filter) livecoll.Source {
+	src := livecoll.SourceFuncs{
+		SubscribeFunc: api.SubscribeTrucks,
+		FetchAllFunc: func() (livecoll.CCN, []livecoll.Member) {
+			ccn, tkl := api.FetchTrucks()
+			members := make([]livecoll.Member, 0, len(tkl))
+			for i := range tkl {
+				// the snapshot is not filtered
+				if filter.Match(&tkl[i]) {
+					members = append(members, &tkl[i])
+				}
 			}
+			return ccn, members
+		},
+		FetchChangesSinceFunc: api.FetchTruckChangesSince,
+	}
+	if filter != nil {
+		src.SubscribeFunc = func(subr livecoll.Subscriber) func() {
+			return api.SubscribeFilteredTrucks(subr, filter)
+		}
+		// changes are not filtered, can't be replayed to a sparse replica
+		src.FetchChangesSinceFunc = nil
+	}
+	return src
+}
 
-			api.tkCCES = isoevt.NewStream()
-		}()
+func (api *ConsumerAPI) SubscribeTrucks(subr livecoll.Subscriber) (unsubscribe func()) {
+	if api.mono {
+		tkc, release, err := ensureLoadedFor(api.tid)
+		if err != nil {
+			panic(err)
+		}
+		defer release()
+		return tkc.Subscribe(subr)
 	}
+
+	func() {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+
+		if api.tkCCES == nil {
+			api.tkCCES = livecoll.NewChangeStream()
+		}
+		api.tkSubscribers++
+	}()
 	// now api.tkCCES is guarranteed to not be nil
 	// consumer side event stream dispatching for Truck changes
-	livecoll.Dispatch(api.tkCCES, subr, func() bool {
+	stopDispatch := livecoll.Dispatch(api.tkCCES, subr, func() bool {
 		// fire Epoch event upon watching started
 		subr.Epoch(api.tkCCN)
 		return false
 	})
+
+	// the wire subscribes upon connected
+	api.EnsureConn()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			stopDispatch()
+			api.releaseTrucks()
+		})
+	}
+}
+
+// count off an unfiltered subscription, the wire stops relaying after the last one
+// dropped. the cces stays for a later subscription to reuse.
+func (api *ConsumerAPI) releaseTrucks() {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	api.tkSubscribers--
+	if api.tkSubscribers > 0 {
+		return
+	}
+	if api.svc == nil || api.svc.Hosting.Cancelled() || api.svc.Posting.Cancelled() {
+		// a new wire won't subscribe it
+		return
+	}
+	ctx := api.svc.HoCtx().(*consumerContext)
+	if !ctx.watchingTrucks {
+		return
+	}
+	ctx.watchingTrucks = false
+	po := api.svc.MustPoToPeer()
+	po.Notif(fmt.Sprintf(`
+UnsubscribeTrucks(%#v,0)
+`, api.tid))
+}
+
+// SubscribeFilteredTrucks subscribes with only changes of trucks passing the filter
+// delivered, the filter is evaluated at service side if consuming over hbi wire.
+// see `livecoll.Filtered()` for semantics.
+func (api *ConsumerAPI) SubscribeFilteredTrucks(subr livecoll.Subscriber, filter *livecoll.Filter) (unsubscribe func()) {
+	if api.mono {
+		tkc, release, err := ensureLoadedFor(api.tid)
+		if err != nil {
+			panic(err)
+		}
+		defer release()
+		return tkc.SubscribeFiltered(subr, filter.Match)
+	}
+
+	if filter == nil {
+		filter = &livecoll.Filter{}
+	}
+	fsub := &filteredSubscription{
+		filter: filter,
+		cces:   livecoll.NewChangeStream(),
+	}
+	sid := api.addFiltered(fsub)
+	// consumer side event stream dispatching for this subscription
+	stopDispatch := livecoll.Dispatch(fsub.cces, subr, func() bool {
+		// fire Epoch event upon watching started
+		subr.Epoch(api.tkCCN)
+		return false
+	})
+
+	// the wire subscribes upon connected
+	api.EnsureConn()
+
+	return func() {
+		stopDispatch()
+		api.dropFiltered(sid)
+	}
+}
+
+// SubscribeTruck watches a single truck, the watcher sees its current value, every
+// update, and finally its deletion, after which the subscription finishes. see
+// `livecoll.WatchMember()` for semantics.
+func (api *ConsumerAPI) SubscribeTruck(id bson.ObjectId, watcher livecoll.MemberWatcher) (unsubscribe func()) {
+	if api.mono {
+		tkc, release, err := ensureLoadedFor(api.tid)
+		if err != nil {
+			panic(err)
+		}
+		defer release()
+		return tkc.SubscribeMember(id, watcher)
+	}
+
+	fsub := &filteredSubscription{
+		id:   id.Hex(),
+		cces: livecoll.NewChangeStream(),
+	}
+	sid := api.addFiltered(fsub)
+	subr := livecoll.WatchMember(id, tkWatch{api, sid, watcher}, func() (livecoll.CCN, livecoll.Member, bool) {
+		ccn, tk, ok := api.FetchTruck(id)
+		if !ok {
+			return ccn, nil, false
+		}
+		return ccn, tk, true
+	})
+	// consumer side event stream dispatching for this subscription
+	stopDispatch := livecoll.Dispatch(fsub.cces, subr, func() bool {
+		// fire Epoch event upon watching started, it finishes right away if no
+		// such truck
+		return subr.Epoch(api.tkCCN)
+	})
+
+	// the wire subscribes upon connected
+	api.EnsureConn()
+
+	return func() {
+		stopDispatch()
+		api.dropFiltered(sid)
+	}
+}
+
+// relays to a member watcher, dropping the subscription once it finished
+type tkWatch struct {
+	api     *ConsumerAPI
+	sid     int
+	watcher livecoll.MemberWatcher
 }
 
-func (ctx *consumerContext) tkCCES() *isoevt.EventStream {
+func (w tkWatch) Current(ccn livecoll.CCN, mo livecoll.Member) (stop bool) {
+	if stop = w.watcher.Current(ccn, mo); stop {
+		w.api.dropFiltered(w.sid)
+	}
+	return
+}
+
+func (w tkWatch) Updated(ccn livecoll.CCN, mo livecoll.Member, delta livecoll.Delta) (stop bool) {
+	if stop = w.watcher.Updated(ccn, mo, delta); stop {
+		w.api.dropFiltered(w.sid)
+	}
+	return
+}
+
+func (w tkWatch) Deleted(ccn livecoll.CCN, id interface{}) {
+	w.watcher.Deleted(ccn, id)
+	w.api.dropFiltered(w.sid)
+}
+
+// register a filtered subscription, the wire subscribes it upon connected
+func (api *ConsumerAPI) addFiltered(fsub *filteredSubscription) (sid int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if api.tkFiltered == nil {
+		api.tkFiltered = make(map[int]*filteredSubscription)
+	}
+	api.lastSid++
+	api.tkFiltered[api.lastSid] = fsub
+	return api.lastSid
+}
+
+// drop a filtered subscription, and tell the service to stop relaying it
+func (api *ConsumerAPI) dropFiltered(sid int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	delete(api.tkFiltered, sid)
+	if api.svc == nil || api.svc.Hosting.Cancelled() || api.svc.Posting.Cancelled() {
+		// a new wire won't subscribe it
+		return
+	}
+	ctx := api.svc.HoCtx().(*consumerContext)
+	if !ctx.filteredTrucks[sid] {
+		return
+	}
+	delete(ctx.filteredTrucks, sid)
+	po := api.svc.MustPoToPeer()
+	po.Notif(fmt.Sprintf(`
+UnsubscribeTrucks(%#v,%#v)
+`, api.tid, sid))
+}
+
+// the consumer side change event stream of a subscription, nil if it's dropped
+func (ctx *consumerContext) tkCCES(sid int) *isoevt.EventStream {
 	api := ctx.api
+	if sid != 0 {
+		api.mu.Lock()
+		fsub := api.tkFiltered[sid]
+		api.mu.Unlock()
+		if fsub == nil {
+			// dropped, with events still on the wire
+			return nil
+		}
+		return fsub.cces
+	}
 	// api.tkCCES won't change once assigned non-nil, we can trust thread local cache
 	cces := api.tkCCES // fast read without sync
 	if cces == nil {   // sync'ed read on cache miss
@@ -255,40 +686,65 @@ func (ctx *consumerContext) tkCCES() *isoevt.EventStream {
 	return cces
 }
 
-func (ctx *consumerContext) TkEpoch(ccn int) {
-	cces := ctx.tkCCES()
-	cces.Post(livecoll.EpochEvent{ccn})
+func (ctx *consumerContext) TkEpoch(sid int, epoch int64, seq uint64) {
+	cces := ctx.tkCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.EpochEvent{livecoll.CCN{epoch, seq}})
 }
 
 // Create
-func (ctx *consumerContext) TkCreated(ccn int) {
+func (ctx *consumerContext) TkCreated(sid int, epoch int64, seq uint64) {
 	eo, err := ctx.Ho().CoRecvObj()
 	if err != nil {
 		panic(err)
 	}
 	tk := eo.(*Truck)
-	cces := ctx.tkCCES()
-	cces.Post(livecoll.CreatedEvent{ccn, tk})
+	cces := ctx.tkCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.CreatedEvent{livecoll.CCN{epoch, seq}, tk})
 }
 
 // Update
-func (ctx *consumerContext) TkUpdated(ccn int) {
+func (ctx *consumerContext) TkUpdated(sid int, epoch int64, seq uint64) {
 	eo, err := ctx.Ho().CoRecvObj()
 	if err != nil {
 		panic(err)
 	}
-	tk := eo.(*Truck)
-	cces := ctx.tkCCES()
-	cces.Post(livecoll.UpdatedEvent{ccn, tk})
+	chg := eo.(*TruckChange)
+	cces := ctx.tkCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.UpdatedEvent{livecoll.CCN{epoch, seq}, &chg.Truck, chg.Delta})
 }
 
 // Delete
-func (ctx *consumerContext) TkDeleted(ccn int) {
-	eo, err := ctx.Ho().CoRecvObj()
+func (ctx *consumerContext) TkDeleted(sid int, epoch int64, seq uint64, id string) {
+	cces := ctx.tkCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.DeletedEvent{livecoll.CCN{epoch, seq}, bson.ObjectIdHex(id)})
+}
+
+// Batch
+func (ctx *consumerContext) TkBatch(sid int, epoch int64, seq uint64) {
+	co, err := ctx.Ho().CoRecvObj()
 	if err != nil {
 		panic(err)
 	}
-	tk := eo.(*Truck)
-	cces := ctx.tkCCES()
-	cces.Post(livecoll.DeletedEvent{ccn, tk})
+	chgs := co.(*TruckChanges)
+	changes := make([]interface{}, len(chgs.Changes))
+	for i := range chgs.Changes {
+		changes[i] = chgs.Changes[i].event()
+	}
+	cces := ctx.tkCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.BatchEvent{livecoll.CCN{epoch, seq}, changes})
 }
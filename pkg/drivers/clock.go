@@ -0,0 +1,405 @@
+package drivers
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// modes of a simulation clock
+const (
+	ClockReal    = "real"    // simulated time goes with wall time
+	ClockScaled  = "scaled"  // simulated time goes faster or slower than wall time
+	ClockPaused  = "paused"  // simulated time stands still
+	ClockStepped = "stepped" // simulated time advances only by `Step()`
+)
+
+// SimClock is the clock drivings of a tenant advance by. simulated time is the
+// duration since the clock created, as it went in the modes set meanwhile.
+type SimClock struct {
+	mu  sync.Mutex
+	cnd *sync.Cond
+
+	mode  string
+	scale float64
+
+	// simulated time now is `base` if not running, or `base` plus wall time since
+	// `wallBase`, scaled, if running
+	base     time.Duration
+	wallBase time.Time
+	changed  chan struct{} // closed upon mode changed, for timed sleepers to wake
+
+	sleepers map[*clockTicker]time.Duration // with deadlines in simulated time
+	busy     int                            // tickers woken, not sleeping again yet
+
+	muStep sync.Mutex // serializes stepping
+}
+
+func NewSimClock() *SimClock {
+	clk := &SimClock{
+		mode: ClockReal, scale: 1,
+		wallBase: time.Now(),
+		changed:  make(chan struct{}),
+		sleepers: make(map[*clockTicker]time.Duration),
+	}
+	clk.cnd = sync.NewCond(&clk.mu)
+	return clk
+}
+
+var (
+	clocks   = make(map[string]*SimClock)
+	muClocks sync.Mutex
+)
+
+// ClockOf gives the simulation clock of a tenant, created in real mode if not yet.
+func ClockOf(tid string) *SimClock {
+	muClocks.Lock()
+	defer muClocks.Unlock()
+
+	clk, ok := clocks[tid]
+	if !ok {
+		clk = NewSimClock()
+		clocks[tid] = clk
+	}
+	return clk
+}
+
+func (clk *SimClock) running() bool {
+	return clk.mode == ClockReal || clk.mode == ClockScaled
+}
+
+// should be called with `clk.mu` locked
+func (clk *SimClock) now() time.Duration {
+	if !clk.running() {
+		return clk.base
+	}
+	return clk.base + time.Duration(float64(time.Since(clk.wallBase))*clk.scale)
+}
+
+// Now gives the simulated time.
+func (clk *SimClock) Now() time.Duration {
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+	return clk.now()
+}
+
+// SetMode changes how simulated time goes from now on, `scale` is only used for
+// the scaled mode.
+func (clk *SimClock) SetMode(mode string, scale float64) error {
+	switch mode {
+	case ClockReal:
+		scale = 1
+	case ClockScaled:
+		if scale <= 0 {
+			return errors.Errorf("Bad clock scale %v", scale)
+		}
+	case ClockPaused, ClockStepped:
+		scale = 0
+	default:
+		return errors.Errorf("No clock mode named [%s]", mode)
+	}
+
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+
+	clk.base, clk.wallBase = clk.now(), time.Now()
+	clk.mode, clk.scale = mode, scale
+	close(clk.changed)
+	clk.changed = make(chan struct{})
+	clk.cnd.Broadcast()
+	glog.V(1).Infof("Simulation clock set %s at %v.", clk, clk.base)
+	return nil
+}
+
+// Step advances simulated time by `d`, in stepped mode only. drivings due meanwhile
+// are woken in order of their deadlines, and each time all woken ones are waited to
+// finish their steps, so trucks in motion move the same way whenever stepped so.
+func (clk *SimClock) Step(d time.Duration) error {
+	clk.muStep.Lock()
+	defer clk.muStep.Unlock()
+
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+
+	if clk.mode != ClockStepped {
+		return errors.Errorf("Clock not steppable in %s mode", clk.mode)
+	}
+	target := clk.base + d
+	for {
+		clk.settle()
+		next, ok := clk.nextDeadline()
+		if !ok || next > target {
+			clk.base = target
+			return nil
+		}
+		clk.base = next
+		clk.cnd.Broadcast()
+	}
+}
+
+// wait until no ticker is due or busy, should be called with `clk.mu` locked
+func (clk *SimClock) settle() {
+	for {
+		if clk.busy <= 0 {
+			if next, ok := clk.nextDeadline(); !ok || next > clk.base {
+				return
+			}
+		}
+		clk.cnd.Wait()
+	}
+}
+
+func (clk *SimClock) nextDeadline() (next time.Duration, ok bool) {
+	for _, deadline := range clk.sleepers {
+		if !ok || deadline < next {
+			next, ok = deadline, true
+		}
+	}
+	return
+}
+
+// Waiting tells how many drivings are waiting on the clock, i.e. trucks in motion.
+func (clk *SimClock) Waiting() int {
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+	return len(clk.sleepers)
+}
+
+func (clk *SimClock) String() string {
+	if clk.mode == ClockScaled {
+		return fmt.Sprintf("%s x%v", clk.mode, clk.scale)
+	}
+	return clk.mode
+}
+
+// a driving advancing by the clock
+type clockTicker struct {
+	clk  *SimClock
+	busy bool // woken, not sleeping again or idle yet
+}
+
+// a new ticker is busy until its driving first sleeps or idles, so a step taken
+// meanwhile waits for the driving to start
+func (clk *SimClock) ticker() *clockTicker {
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+
+	t := &clockTicker{clk: clk}
+	t.setBusy(true)
+	return t
+}
+
+// should be called with `clk.mu` locked
+func (t *clockTicker) setBusy(busy bool) {
+	if busy == t.busy {
+		return
+	}
+	t.busy = busy
+	if busy {
+		t.clk.busy++
+	} else {
+		t.clk.busy--
+		t.clk.cnd.Broadcast()
+	}
+}
+
+// Sleep blocks until simulated time advanced by `d`, the simulated time actually
+// elapsed is returned.
+func (t *clockTicker) Sleep(d time.Duration) time.Duration {
+	clk := t.clk
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+
+	start := clk.now()
+	deadline := start + d
+	clk.sleepers[t] = deadline
+	t.setBusy(false)
+	for {
+		now := clk.now()
+		if now >= deadline {
+			break
+		}
+		if !clk.running() {
+			clk.cnd.Wait()
+			continue
+		}
+		wait := time.Duration(float64(deadline-now) / clk.scale)
+		changed := clk.changed
+		clk.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-changed:
+		}
+		timer.Stop()
+		clk.mu.Lock()
+	}
+	delete(clk.sleepers, t)
+	t.setBusy(true)
+	return clk.now() - start
+}
+
+// Idle tells the clock not to wait for this driving when stepped, e.g. it's stopped.
+func (t *clockTicker) Idle() {
+	clk := t.clk
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+	t.setBusy(false)
+}
+
+// Busy tells the clock to wait for this driving when stepped, until it sleeps or
+// idles again, e.g. it's told to move while idle.
+func (t *clockTicker) Busy() {
+	clk := t.clk
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+	t.setBusy(true)
+}
+
+// ClockState is the state of a simulation clock, as returned over the wire.
+type ClockState struct {
+	Mode    string
+	Scale   float64
+	Now     time.Duration // simulated time
+	Waiting int           // drivings waiting on the clock
+	Err     string        // the control failed if not empty
+}
+
+func clockState(tid string, err error) *ClockState {
+	clk := ClockOf(tid)
+	clk.mu.Lock()
+	defer clk.mu.Unlock()
+
+	cs := &ClockState{
+		Mode: clk.mode, Scale: clk.scale,
+		Now: clk.now(), Waiting: len(clk.sleepers),
+	}
+	if err != nil {
+		cs.Err = fmt.Sprintf("%+v", err)
+	}
+	return cs
+}
+
+// convert back to the result of a clock control at consumer side
+func (cs *ClockState) result() (*ClockState, error) {
+	if cs.Err != "" {
+		return cs, errors.New(cs.Err)
+	}
+	return cs, nil
+}
+
+func FetchClock(tid string) *ClockState {
+	return clockState(tid, nil)
+}
+
+// clocks are per process, a clock is only controlled where drivings of the tenant
+// run, i.e. where its drivers got kicked off. consumers reach there by the tid as
+// sticky session, but a tenant can still land on another process of the pool, e.g.
+// after the one driving it restarted, the control is refused there.
+func controlledClock(tid string) (*SimClock, error) {
+	mu.Lock()
+	_, ok := teams[tid]
+	mu.Unlock()
+	if !ok {
+		return nil, errors.Errorf("Drivers of tenant [%s] not kicked off in this process.", tid)
+	}
+	return ClockOf(tid), nil
+}
+
+func setClock(tid string, mode string, scale float64) *ClockState {
+	clk, err := controlledClock(tid)
+	if err == nil {
+		err = clk.SetMode(mode, scale)
+	}
+	return clockState(tid, err)
+}
+
+func stepClock(tid string, d time.Duration) *ClockState {
+	clk, err := controlledClock(tid)
+	if err == nil {
+		err = clk.Step(d)
+	}
+	return clockState(tid, err)
+}
+
+// SetClock changes the mode of the simulation clock of a tenant, with the state
+// after changed returned. drivers of the tenant should have been kicked off in this
+// process.
+func SetClock(tid string, mode string, scale float64) (*ClockState, error) {
+	return setClock(tid, mode, scale).result()
+}
+
+// StepClock advances the simulation clock of a tenant in stepped mode, returns
+// after trucks in motion have moved accordingly. drivers of the tenant should have
+// been kicked off in this process.
+func StepClock(tid string, d time.Duration) (*ClockState, error) {
+	return stepClock(tid, d).result()
+}
+
+// these service methods have rpc style, failures are returned in the state, not to
+// disconnect the wire
+
+func (ctx *serviceContext) FetchClock(tid string) *ClockState {
+	return FetchClock(tid)
+}
+
+func (ctx *serviceContext) SetClock(tid string, mode string, scale float64) *ClockState {
+	return setClock(tid, mode, scale)
+}
+
+func (ctx *serviceContext) StepClock(tid string, ms int64) *ClockState {
+	return stepClock(tid, time.Duration(ms)*time.Millisecond)
+}
+
+func (api *ConsumerAPI) FetchClock() (*ClockState, error) {
+	if api.mono {
+		return FetchClock(api.tid), nil
+	}
+
+	return api.controlClock(fmt.Sprintf(`
+FetchClock(%#v)
+`, api.tid))
+}
+
+// SetClock changes how simulated time goes for drivings of the tenant, `scale` is
+// only used for the scaled mode.
+func (api *ConsumerAPI) SetClock(mode string, scale float64) (*ClockState, error) {
+	if api.mono {
+		return SetClock(api.tid, mode, scale)
+	}
+
+	return api.controlClock(fmt.Sprintf(`
+SetClock(%#v,%#v,%#v)
+`, api.tid, mode, scale))
+}
+
+// StepClock advances simulated time by `d` in stepped mode, it returns after trucks
+// in motion have moved accordingly. `d` is taken in milliseconds over the wire.
+func (api *ConsumerAPI) StepClock(d time.Duration) (*ClockState, error) {
+	if api.mono {
+		return StepClock(api.tid, d)
+	}
+
+	return api.controlClock(fmt.Sprintf(`
+StepClock(%#v,%#v)
+`, api.tid, int64(d/time.Millisecond)))
+}
+
+// run a clock control at service side, and get the clock state back
+func (api *ConsumerAPI) controlClock(code string) (*ClockState, error) {
+	_, po := api.conn()
+	co, err := po.Co()
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	result, err := co.Get(code, "&ClockState{}")
+	if err != nil {
+		return nil, err
+	}
+	return result.(*ClockState).result()
+}
@@ -0,0 +1,152 @@
+package drivers
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/complyue/ddgo/pkg/routes"
+	"github.com/complyue/ddgo/pkg/svcs"
+)
+
+// positions of trucks by seq
+type truckPositions map[int][2]float64
+
+// drive trucks of a tenant afresh in stepped mode, and tell where they are before
+// and after stepped the same way
+func steppedPositions(t *testing.T, tid string) (started, stepped truckPositions) {
+	for _, xy := range [][2]float64{{100, 0}, {100, 100}, {0, 100}, {-50, -50}, {30, 60}} {
+		if err := routes.AddWaypoint(tid, xy[0], xy[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, xy := range [][2]float64{{0, 0}, {10, 10}, {-10, 20}} {
+		if err := AddTruck(tid, xy[0], xy[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tkl := FetchTrucks(tid).Trucks
+	sort.Slice(tkl, func(i, j int) bool { return tkl[i].Seq < tkl[j].Seq })
+	started = make(truckPositions)
+	for _, tk := range tkl {
+		started[tk.Seq] = [2]float64{tk.X, tk.Y}
+	}
+	// round robin for the first one, random patrols for the rest
+	for _, tk := range tkl[1:] {
+		if err := SetDrivingStrategy(tid, tk.Seq, tk.Id.Hex(), StrategyPatrol); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the clock is controlled where the drivers are kicked off, trucks all stopped
+	// don't go with the clock before it's stepped
+	if _, err := SetClock(tid, ClockStepped, 0); err == nil {
+		t.Fatal("Clock controlled before drivers kicked off")
+	}
+	if err := DriversKickoff(tid); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := SetClock(tid, ClockStepped, 0); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	team := teams[tid]
+	mu.Unlock()
+	waitFor(t, "waypoints replicated to drivers", func() bool {
+		return len(team.wpcLive.snapshot()) == 5
+	})
+
+	for _, tk := range tkl {
+		if err := StopTruck(tid, tk.Seq, tk.Id.Hex(), true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// all drivings made their first steps and wait on the clock
+	waitFor(t, "trucks driven", func() bool {
+		return ClockOf(tid).Waiting() == len(tkl)
+	})
+	for i := 0; i < 30; i++ {
+		if _, err := StepClock(tid, 700*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stepped = make(truckPositions)
+	for _, tk := range FetchTrucks(tid).Trucks {
+		stepped[tk.Seq] = [2]float64{tk.X, tk.Y}
+	}
+	return
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Still not %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSteppedDrivingRepeats(t *testing.T) {
+	svcs.OverrideServiceConfig("db", svcs.ServiceConfig{Url: "mem://stepped"})
+	svcs.OverrideServiceConfig("journal", svcs.ServiceConfig{})
+	InitRoutesService = func(tid string) (*routes.ConsumerAPI, error) {
+		return routes.NewMonoAPI(tid), nil
+	}
+
+	prefix := time.Now().Format("stepped-150405.000000-")
+	started, first := steppedPositions(t, prefix+"a")
+	_, again := steppedPositions(t, prefix+"b")
+
+	if len(first) != 3 || len(again) != 3 {
+		t.Fatalf("Trucks missing: %v vs %v", first, again)
+	}
+	for seq, pos := range first {
+		if again[seq] != pos {
+			t.Errorf("Truck #%d at %v after stepped, but at %v stepped again the same way",
+				seq, pos, again[seq])
+		}
+		if pos == started[seq] {
+			t.Errorf("Truck #%d not moved from %v", seq, pos)
+		}
+	}
+}
+
+func TestToldToMoveRightBeforeStep(t *testing.T) {
+	clk := NewSimClock()
+	if err := clk.SetMode(ClockStepped, 0); err != nil {
+		t.Fatal(err)
+	}
+	dr := &Driving{
+		truck:     &Truck{},
+		cndMoving: sync.NewCond(new(sync.Mutex)),
+		ticker:    clk.ticker(),
+	}
+	var steps int32
+	go func() {
+		defer dr.ticker.Idle()
+		for dr.waitToldBeMoving() {
+			atomic.AddInt32(&steps, 1)
+			dr.ticker.Sleep(drivingTick)
+		}
+	}()
+	defer dr.stop()
+	waitFor(t, "driving idle", func() bool {
+		clk.mu.Lock()
+		defer clk.mu.Unlock()
+		return clk.busy == 0
+	})
+
+	// the step waits for the driving told to move, before it's woken
+	dr.toldToMove(true)
+	if err := clk.Step(drivingTick); err != nil {
+		t.Fatal(err)
+	}
+	// stepped once upon told, and once after a tick
+	if n := atomic.LoadInt32(&steps); n != 2 {
+		t.Fatalf("Stepped %d times", n)
+	}
+}
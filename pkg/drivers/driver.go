@@ -2,132 +2,70 @@ package drivers
 
 import (
 	"fmt"
-	"math"
+	"math/rand"
+	"sort"
 	"sync"
 	"time"
 
 	"github.com/complyue/ddgo/pkg/livecoll"
 	"github.com/complyue/ddgo/pkg/routes"
 	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/globalsign/mgo/bson"
 	"github.com/golang/glog"
 )
 
 var (
-	stuckTid string
-	mu       sync.Mutex
-
-	wpcLive *wpcCache
+	// drivers teams by tid, kicked off once per tenant
+	teams = make(map[string]*driversTeam)
+	mu    sync.Mutex
 )
 
-type wpcCache struct {
-	routesAPI *routes.ConsumerAPI      // consuming api to routes service
-	ccn       int                      // known change number of the live waypoint collection
-	wps       []routes.Waypoint        // local cached waypoint values
-	idToSeq   map[interface{}]int      // lookup seq by id
-	wpBySeq   map[int]*routes.Waypoint // map seq to pointer to waypoints within the `wps` slice
-	mu        sync.Mutex               //
+// the drivers of trucks of a tenant
+type driversTeam struct {
+	tid     string
+	wpcLive *wpcCache         // waypoints of the tenant, subscribed from routes service
+	rtcLive *livecoll.Replica // routes of the tenant, subscribed from routes service
 }
 
-func (wpc *wpcCache) reload() {
-	// fetch current snapshot of the whole collection
-	ccn, wpl := wpc.routesAPI.FetchWaypoints()
-
-	// populate local cache data for the live waypoint collection
-	wpc.mu.Lock()
-	defer wpc.mu.Unlock()
-	wpc.wps = wpl
-	wpc.idToSeq = make(map[interface{}]int)
-	wpc.wpBySeq = make(map[int]*routes.Waypoint)
-	for i := range wpl {
-		wpc.idToSeq[wpl[i].GetID()] = wpl[i].Seq
-		wpc.wpBySeq[wpl[i].Seq] = &wpl[i]
-	}
-	wpc.ccn = ccn
-}
-
-func (wpc *wpcCache) Subscribed() (stop bool) {
-	wpc.reload()
-	return
-}
+// local replica of the waypoint collection of a tenant
+type wpcCache struct {
+	*livecoll.Replica
+	routesAPI *routes.ConsumerAPI // consuming api to routes service
 
-func (wpc *wpcCache) Epoch(ccn int) (stop bool) {
-	glog.V(1).Infof(" ** Reloading wpc due to epoch CCN %v -> %v", wpc.ccn, ccn)
-	wpc.reload()
-	return
+	mu     sync.Mutex        //
+	wps    []routes.Waypoint // waypoints ordered by seq as of `wpsCCN`, never changed in place
+	wpsCCN livecoll.CCN
 }
 
-// Created
-func (wpc *wpcCache) MemberCreated(ccn int, eo livecoll.Member) (stop bool) {
-	if ccnDistance := livecoll.ChgDistance(ccn, wpc.ccn); ccnDistance <= 0 {
-		// ignore out-dated events
-		return
-	} else if ccnDistance > 1 {
-		// event ccn is ahead of locally known ccn, reload
-		glog.V(1).Infof(" ** Reloading wpc due to CCN changed %v -> %v", wpc.ccn, ccn)
-		wpc.reload()
-		return
+func newWpcCache(routesAPI *routes.ConsumerAPI) *wpcCache {
+	return &wpcCache{
+		Replica:   livecoll.NewReplica("wpc", routesAPI.WaypointSource(nil), nil),
+		routesAPI: routesAPI,
 	}
-	wp := eo.(*routes.Waypoint)
-
-	wpc.mu.Lock()
-	defer wpc.mu.Unlock()
-	i := len(wpc.wps)
-	wpc.wps = append(wpc.wps, *wp)
-	wpc.idToSeq[wp.GetID()] = wp.Seq
-	wpc.wpBySeq[wp.Seq] = &wpc.wps[i]
-	wpc.ccn = ccn
-
-	return
 }
 
-// Updated
-func (wpc *wpcCache) MemberUpdated(ccn int, eo livecoll.Member) (stop bool) {
-	if ccnDistance := livecoll.ChgDistance(ccn, wpc.ccn); ccnDistance <= 0 {
-		// ignore out-dated events
-		return
-	} else if ccnDistance > 1 {
-		// event ccn is ahead of locally known ccn, reload
-		glog.V(1).Infof(" ** Reloading wpc due to CCN changed %v -> %v", wpc.ccn, ccn)
-		wpc.reload()
-		return
-	}
-	wp := eo.(*routes.Waypoint)
-
+// the current waypoints ordered by seq, drivings can iterate through it w/o sync,
+// as a changed list is always populated into a new slice
+func (wpc *wpcCache) snapshot() []routes.Waypoint {
 	wpc.mu.Lock()
 	defer wpc.mu.Unlock()
-	wpc.idToSeq[wp.GetID()] = wp.Seq
-	*wpc.wpBySeq[wp.Seq] = *wp
-	wpc.ccn = ccn
 
-	return
-}
-
-// Deleted
-func (wpc *wpcCache) MemberDeleted(ccn int, id interface{}) (stop bool) {
-	if ccnDistance := livecoll.ChgDistance(ccn, wpc.ccn); ccnDistance <= 0 {
-		// ignore out-dated events
-		return
-	} else if ccnDistance > 1 {
-		// event ccn is ahead of locally known ccn, reload
-		glog.V(1).Infof(" ** Reloading wpc due to CCN changed %v -> %v", wpc.ccn, ccn)
-		wpc.reload()
-		return
+	if wpc.wps != nil && wpc.CCN() == wpc.wpsCCN {
+		return wpc.wps
 	}
-
-	wpc.mu.Lock()
-	defer wpc.mu.Unlock()
-	// todo remove wp from the slice `wpc.wps`
-	if seq, ok := wpc.idToSeq[id]; ok {
-		delete(wpc.idToSeq, id)
-		delete(wpc.wpBySeq, seq)
+	ccn, mos := wpc.FetchAll()
+	wps := make([]routes.Waypoint, len(mos))
+	for i, mo := range mos {
+		wps[i] = *(mo.(*routes.Waypoint))
 	}
-	wpc.ccn = ccn
-
-	return
+	sort.Slice(wps, func(i, j int) bool { return wps[i].Seq < wps[j].Seq })
+	wpc.wps, wpc.wpsCCN = wps, ccn
+	return wps
 }
 
 type tkcReact struct {
 	// subscribe to trucks live collection, which managed by the local drivers service
+	team *driversTeam
 }
 
 func (tkc *tkcReact) Subscribed() (stop bool) {
@@ -135,30 +73,36 @@ func (tkc *tkcReact) Subscribed() (stop bool) {
 	return
 }
 
-func (tkc *tkcReact) Epoch(ccn int) (stop bool) {
+func (tkc *tkcReact) Epoch(ccn livecoll.CCN) (stop bool) {
 	// nop
 	return
 }
 
 // Created
-func (tkc *tkcReact) MemberCreated(ccn int, eo livecoll.Member) (stop bool) {
+func (tkc *tkcReact) MemberCreated(ccn livecoll.CCN, eo livecoll.Member) (stop bool) {
 	tk := eo.(*Truck)
 
 	// start a driving immediate when a truck is created,
 	// just for demonstration
-	go NewDriving(tk).start()
+	if dr := NewDriving(tkc.team, tk); dr != nil {
+		go dr.start()
+	}
 
 	return
 }
 
 // Updated
-func (tkc *tkcReact) MemberUpdated(ccn int, eo livecoll.Member) (stop bool) {
+func (tkc *tkcReact) MemberUpdated(ccn livecoll.CCN, eo livecoll.Member, delta livecoll.Delta) (stop bool) {
 	tk := eo.(*Truck)
+	if !delta.Changed("moving") {
+		// just moved along, by the driving itself most likely
+		return
+	}
 
 	// notify the driving goroutine when the truck is told to move or stop
-	dr := drivingCourseByTruckSeq[tk.Seq]
-	if tk.Moving != dr.moving {
-		glog.V(1).Infof(" * Truck %v told moving to be [%v].", tk, tk.Moving)
+	dr := drivingCourseOf(tk.Id)
+	if dr == nil {
+		return
 	}
 	dr.toldToMove(tk.Moving)
 
@@ -166,19 +110,32 @@ func (tkc *tkcReact) MemberUpdated(ccn int, eo livecoll.Member) (stop bool) {
 }
 
 // Deleted
-func (tkc *tkcReact) MemberDeleted(ccn int, id interface{}) (stop bool) {
-	// todo process delete event
+func (tkc *tkcReact) MemberDeleted(ccn livecoll.CCN, id interface{}) (stop bool) {
+	// stop the driving goroutine of a deleted truck
+	muDriving.Lock()
+	dr := drivingCourses[id.(bson.ObjectId)]
+	delete(drivingCourses, id.(bson.ObjectId))
+	muDriving.Unlock()
+	if dr != nil {
+		glog.V(1).Infof(" * Truck %v deleted, stop driving.", dr.truck)
+		dr.stop()
+	}
 	return
 }
 
+// Batch
+func (tkc *tkcReact) MembersChanged(ccn livecoll.CCN, changes []interface{}) (stop bool) {
+	// drivings react to each truck on its own
+	return livecoll.Replay(tkc, changes)
+}
+
 func DriversKickoff(tid string) error {
+	mu.Lock()
+	defer mu.Unlock()
 
-	if stuckTid != "" {
-		if tid != stuckTid {
-			return errors.Errorf("Drivers team already stuck to [%s], not serving [%s]!", stuckTid, tid)
-		}
-		// kickoff only once
-		glog.Warning("Repeated kicking-off of drivers ignored.")
+	if _, ok := teams[tid]; ok {
+		// kickoff only once per tenant
+		glog.Warningf("Repeated kicking-off of drivers for tid=%v ignored.", tid)
 		return nil
 	}
 
@@ -189,26 +146,38 @@ func DriversKickoff(tid string) error {
 	if err != nil {
 		return err
 	}
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		return err
+	}
+	defer release()
 
 	// create live cache of waypoint collection subscribed from routes service
-	wpcLive = &wpcCache{
-		routesAPI: routesAPI,
-		wpBySeq:   make(map[int]*routes.Waypoint),
+	team := &driversTeam{
+		tid:     tid,
+		wpcLive: newWpcCache(routesAPI),
+		rtcLive: livecoll.NewReplica("rtc", routesAPI.RouteSource(), nil),
 	}
-	routesAPI.SubscribeWaypoints(wpcLive)
+	team.wpcLive.Start()
+	team.rtcLive.Start()
 
-	tkCollection.Subscribe(&tkcReact{})
+	// drivings started from here on read it
+	teams[tid] = team
+
+	// the subscription keeps the truck collection from being evicted when idle
+	tkc.Subscribe(&tkcReact{team})
 
 	// list all trucks existing now and start a driving course for each one
-	_, tkl := tkCollection.FetchAll()
-	glog.V(1).Infof("Start driving %v trucks ...", len(tkl))
+	_, tkl := tkc.FetchAll()
+	glog.V(1).Infof("Start driving %v trucks of tid=%v ...", len(tkl), tid)
 	for _, tko := range tkl {
 		tk := tko.(*Truck)
-		glog.V(1).Infof("Start driving truck %v ...", tk)
-		go NewDriving(tk).start()
+		if dr := NewDriving(team, tk); dr != nil {
+			glog.V(1).Infof("Start driving truck %v ...", tk)
+			go dr.start()
+		}
 	}
 
-	stuckTid = tid
 	return nil
 }
 
@@ -232,122 +201,161 @@ func (ctx *serviceContext) DriversKickoff(tid string) {
 
 // TODO `Driving` should be a relation between a truck and a user, yet persisted
 
-var drivingCourseByTruckSeq = map[int]*Driving{}
+var (
+	drivingCourses = map[bson.ObjectId]*Driving{}
+	muDriving      sync.Mutex
+)
+
+func drivingCourseOf(truckId bson.ObjectId) *Driving {
+	muDriving.Lock()
+	defer muDriving.Unlock()
+	return drivingCourses[truckId]
+}
 
-func NewDriving(truck *Truck) *Driving {
+// NewDriving makes the driving course of a truck, nil is returned if the truck has
+// one already, e.g. created after subscribed while also listed by `FetchAll()`.
+func NewDriving(team *driversTeam, truck *Truck) *Driving {
+	muDriving.Lock()
+	defer muDriving.Unlock()
+	if _, ok := drivingCourses[truck.Id]; ok {
+		return nil
+	}
 	dr := &Driving{
+		team:      team,
 		truck:     truck,
 		moving:    truck.Moving,
 		cndMoving: sync.NewCond(new(sync.Mutex)),
+		ticker:    ClockOf(team.tid).ticker(),
 	}
-	drivingCourseByTruckSeq[truck.Seq] = dr
+	drivingCourses[truck.Id] = dr
 	return dr
 }
 
 type Driving struct {
+	team      *driversTeam
 	truck     *Truck
 	moving    bool
+	stopped   bool // the truck is gone, driving should end
+	idle      bool // waiting to be told moving, with the ticker idle
 	cndMoving *sync.Cond
+
+	strategyName string
+	strategy     DrivingStrategy
+	ticker       *clockTicker // advancing by the simulation clock of the tenant
 }
 
 func (dr *Driving) toldToMove(moving bool) {
 	dr.cndMoving.L.Lock()
+	if moving != dr.moving {
+		glog.V(1).Infof(" * Truck %v told moving to be [%v].", dr.truck, moving)
+	}
 	dr.moving = moving
+	if dr.idle && !dr.stopped {
+		// the clock should wait for the driving from when it's told to move, not
+		// only after it's woken, or a step taken in between would miss it
+		if moving {
+			dr.ticker.Busy()
+		} else {
+			dr.ticker.Idle()
+		}
+	}
 	dr.cndMoving.Broadcast()
 	dr.cndMoving.L.Unlock()
 }
 
-func (dr *Driving) waitToldBeMoving() (moving bool) {
+func (dr *Driving) stop() {
 	dr.cndMoving.L.Lock()
-	moving = dr.moving
+	dr.stopped = true
+	dr.cndMoving.Broadcast()
 	dr.cndMoving.L.Unlock()
-	for !moving {
-		dr.cndMoving.L.Lock()
+}
+
+// returns false if the driving has been stopped
+func (dr *Driving) waitToldBeMoving() (moving bool) {
+	dr.cndMoving.L.Lock()
+	defer dr.cndMoving.L.Unlock()
+	if !dr.moving && !dr.stopped {
+		// not to hold the clock from being stepped while waiting
+		dr.ticker.Idle()
+		dr.idle = true
+	}
+	for !dr.moving && !dr.stopped {
 		dr.cndMoving.Wait()
-		moving = dr.moving
-		dr.cndMoving.L.Unlock()
 	}
-	return
+	dr.idle = false
+	return !dr.stopped
 }
 
 /* Driving logic
-currently simulating a dumb head approaching each waypoint in turn if told to
-be moving, or just stay still.
+stepping the truck by its driving strategy if told to be moving, or just stay
+still, see `DrivingStrategy`. steps are paced by the simulation clock of the
+tenant, see `SimClock`.
 */
 func (dr *Driving) start() {
 
-	const speed = 5
-	var (
-		wpi = 0
-		wp  *routes.Waypoint
-	)
-
 	glog.V(1).Infof("Driving truck %v now.", dr.truck)
+	defer dr.ticker.Idle()
 
+	env := &DrivingEnv{dr.team, rand.New(rand.NewSource(int64(dr.truck.Seq)))}
+	// simulated time since last step, no distance covered while stopped
+	elapsed := drivingTick
 	for dr.waitToldBeMoving() {
 
+		wpcLive := dr.team.wpcLive
 		wpcLive.routesAPI.EnsureAlive()
-		wps := wpcLive.wps
 
-		if len(wps) < 1 {
-			glog.Warning("No waypoint yet.")
-			time.Sleep(10 * time.Second)
-			continue
+		// read the latest value of the truck, it may have been dragged elsewhere,
+		// or assigned another route or strategy
+		tkc, release, err := ensureLoadedFor(dr.team.tid)
+		if err != nil {
+			glog.Error(errors.Wrap(err, "Trucks not available ?!"))
+			return
 		}
-
-		// todo sync in reading x,y so draged-to location not overwriten by thread local cache
-		tx, ty := dr.truck.X, dr.truck.Y
-
-		glog.V(2).Infof(" * Stepping truck %v.", dr.truck)
-
-		if wpi >= len(wps) {
-			wpi = 0
+		tko, ok := tkc.Read(dr.truck.Id)
+		release()
+		if !ok {
+			glog.V(1).Infof("Truck %v gone, stop driving.", dr.truck)
+			return
 		}
-		if wp != &wps[wpi] {
-			// find nearest waypoint
-			wp = &wps[0]
-			dNeareast := math.Sqrt(
-				math.Pow(wp.X-tx, 2) + math.Pow(wp.Y-ty, 2),
-			)
-			for i := 1; i < len(wps); i++ {
-				twp := &wps[i]
-				d := math.Sqrt(
-					math.Pow(twp.X-tx, 2) + math.Pow(twp.Y-ty, 2),
-				)
-				if d < dNeareast {
-					dNeareast = d
-					wp = twp
-				}
-			}
+		tk := tko.(*Truck)
+		if !tk.Moving {
+			// stopped, e.g. finished a one-way route, yet to be told
+			dr.ticker.Sleep(drivingTick)
+			elapsed = drivingTick
+			continue
 		}
 
-		distance := math.Sqrt(
-			math.Pow(wp.X-tx, 2) + math.Pow(wp.Y-ty, 2),
-		)
-		if distance <= speed {
-			// reaching aimed waypoint
-			tx, ty = wp.X, wp.Y
-			// toward next waypoint
-			wpi++
-			if wpi >= len(wps) {
-				wpi = 0
+		if name := strategyOf(tk); dr.strategy == nil || name != dr.strategyName {
+			strategy, err := newStrategy(name)
+			if err != nil {
+				glog.Error(errors.Wrapf(err, "Truck %v not drivable", tk))
+				strategy, _ = newStrategy(StrategyRoundRobin)
 			}
-			wp = &wps[wpi]
-		} else {
-			// approaching aimed waypoint
-			_, tx, ty = 0,
-				tx+(wp.X-tx)*speed/distance,
-				ty+(wp.Y-ty)*speed/distance
+			glog.V(1).Infof(" * Driving truck %v by strategy [%s].", tk, name)
+			dr.strategy, dr.strategyName = strategy, name
 		}
 
-		// `MoveTruck()` is proc local business method, just call directly
-		if err := MoveTruck(stuckTid, dr.truck.Seq, dr.truck.Id.Hex(), tx, ty); err != nil {
-			glog.Error(errors.Wrap(err, "Truck move failed ?!"))
-			return
+		glog.V(2).Infof(" * Stepping truck %v.", tk)
+
+		if st := dr.strategy.Step(tk, env, elapsed); st != StateOf(tk) {
+			// `driveTruckIf()` is proc local business method, just call directly. it
+			// fails if the truck is changed meanwhile, the next step starts from there
+			if _, err := driveTruckIf(
+				dr.team.tid, tk.Seq, tk.Id.Hex(), tk.Version, st,
+			); err != nil {
+				if _, ok := livecoll.IsConflict(err); ok {
+					glog.V(1).Infof(" * Truck %v changed by someone else: %v", dr.truck, err)
+				} else {
+					glog.Error(errors.Wrap(err, "Truck move failed ?!"))
+					return
+				}
+			}
 		}
 
-		// 2 steps per second
-		time.Sleep(500 * time.Millisecond)
+		elapsed = dr.ticker.Sleep(drivingTick)
 	}
 
 }
+
+// interval between steps of a driving, in simulated time
+const drivingTick = 500 * time.Millisecond
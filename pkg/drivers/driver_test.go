@@ -0,0 +1,29 @@
+package drivers
+
+import (
+	"testing"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+func TestTruckDrivenOnce(t *testing.T) {
+	team := &driversTeam{tid: "driven-once"}
+	tk := &Truck{Id: bson.NewObjectId()}
+	dr := NewDriving(team, tk)
+	if dr == nil {
+		t.Fatal("No driving for a new truck")
+	}
+	defer func() {
+		muDriving.Lock()
+		delete(drivingCourses, tk.Id)
+		muDriving.Unlock()
+	}()
+
+	// e.g. created right after subscribed, and listed by FetchAll() too
+	if NewDriving(team, tk) != nil {
+		t.Fatal("Truck driven twice")
+	}
+	if drivingCourseOf(tk.Id) != dr {
+		t.Fatal("Driving course replaced")
+	}
+}
@@ -5,7 +5,9 @@ import (
 	"fmt"
 	"net"
 	"os"
+	"sync"
 
+	"github.com/complyue/ddgo/pkg/livecoll"
 	"github.com/complyue/ddgo/pkg/svcs"
 	"github.com/complyue/hbigo"
 	"github.com/complyue/hbigo/pkg/svcpool"
@@ -22,12 +24,51 @@ func NewServiceContext() hbi.HoContext {
 // implementation details of service context
 type serviceContext struct {
 	hbi.HoContext
+
+	mu sync.Mutex
+	// to cancel truck subscriptions relayed over this wire, by subscription id at
+	// consumer side, 0 for the unfiltered one
+	tkSubscriptions map[int]func()
+}
+
+// a subscriber relaying changes over this wire, it stops once the wire is gone, a
+// subscription the consumer has dropped is cancelled directly
+func (ctx *serviceContext) relay(
+	prefix string, sid int, member bool, ship livecoll.Shipping,
+) livecoll.Relay {
+	return livecoll.Relay{
+		Prefix: prefix, Sid: sid, Member: member, Ship: ship,
+		Stopped: ctx.Cancelled,
+		Post: func(code string, obj interface{}, hint string) error {
+			po := ctx.MustPoToPeer()
+			if obj == nil {
+				return po.Notif(code)
+			}
+			return po.NotifBSON(code, obj, hint)
+		},
+	}
+}
+
+// keep the handle of a trucks subscription, to be cancelled once the consumer
+// dropped it. a former one of the same id is cancelled.
+func (ctx *serviceContext) keepTkSubscription(sid int, unsubscribe func()) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if former := ctx.tkSubscriptions[sid]; former != nil {
+		former()
+	}
+	if ctx.tkSubscriptions == nil {
+		ctx.tkSubscriptions = make(map[int]func())
+	}
+	ctx.tkSubscriptions[sid] = unsubscribe
 }
 
 // give types to be exposed, with typed nil pointer values to each
 func (ctx *serviceContext) TypesToExpose() []interface{} {
 	return []interface{}{
 		(*Truck)(nil),
+		(*livecoll.Filter)(nil),
 	}
 }
 
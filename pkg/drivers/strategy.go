@@ -0,0 +1,332 @@
+package drivers
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/complyue/ddgo/pkg/livecoll"
+	"github.com/complyue/ddgo/pkg/routes"
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/glog"
+)
+
+// DrivingSpeed is the distance a truck moves per second.
+var DrivingSpeed = 10.0
+
+// names of the driving strategies shipped, a truck without strategy selected
+// follows its route if assigned one, or goes round robin otherwise.
+const (
+	StrategyRoundRobin = "round-robin"
+	StrategyRoute      = "route"
+	StrategyPatrol     = "patrol"
+	StrategyDepot      = "depot"
+)
+
+// DrivingStrategy decides how a truck moves while it's told to be moving. a
+// strategy is created for each driving, so it can remember things between steps,
+// e.g. the waypoint it's approaching.
+type DrivingStrategy interface {
+	// Step decides the state of the truck after `elapsed` time from its current
+	// state. the truck is left as is if the state returned is not changed.
+	Step(tk *Truck, env *DrivingEnv, elapsed time.Duration) DrivingState
+}
+
+// DrivingState is the state of a truck as decided by a driving strategy.
+type DrivingState struct {
+	X, Y   float64
+	Moving bool
+
+	Route  bson.ObjectId // cleared e.g. when the route is gone
+	NextWp int
+}
+
+// StateOf gives the current state of a truck, for a strategy to start with.
+func StateOf(tk *Truck) DrivingState {
+	return DrivingState{
+		X: tk.X, Y: tk.Y, Moving: tk.Moving,
+		Route: tk.Route, NextWp: tk.NextWp,
+	}
+}
+
+// Approach moves toward (x,y) by `distance` at most, `reached` tells whether it's
+// arrived there.
+func (st *DrivingState) Approach(x, y float64, distance float64) (reached bool) {
+	d := math.Hypot(x-st.X, y-st.Y)
+	if d <= distance {
+		st.X, st.Y = x, y
+		return true
+	}
+	st.X, st.Y = st.X+(x-st.X)*distance/d, st.Y+(y-st.Y)*distance/d
+	return false
+}
+
+// DrivingEnv is what driving strategies see of the world, besides the truck.
+type DrivingEnv struct {
+	team *driversTeam
+	rnd  *rand.Rand
+}
+
+// Rand gives the random source of the driving, strategies should make random
+// choices by it, so a truck moves the same way whenever the clock is stepped the
+// same way. it's seeded by the truck's seq, and not safe for other goroutines.
+func (env *DrivingEnv) Rand() *rand.Rand {
+	return env.rnd
+}
+
+// Waypoint reads a waypoint by id.
+func (env *DrivingEnv) Waypoint(id bson.ObjectId) (*routes.Waypoint, bool) {
+	mo, ok := env.team.wpcLive.Read(id)
+	if !ok {
+		return nil, false
+	}
+	return mo.(*routes.Waypoint), true
+}
+
+// Waypoints gives all waypoints ordered by seq, it's never changed in place, a new
+// slice is returned once waypoints changed.
+func (env *DrivingEnv) Waypoints() []routes.Waypoint {
+	return env.team.wpcLive.snapshot()
+}
+
+// Route reads a route by id, `loaded` is false if routes are not loaded yet, so
+// a route not found is not necessarily deleted.
+func (env *DrivingEnv) Route(id bson.ObjectId) (rt *routes.Route, ok bool, loaded bool) {
+	rtcLive := env.team.rtcLive
+	mo, ok := rtcLive.Read(id)
+	if !ok {
+		return nil, false, rtcLive.CCN() != (livecoll.CCN{})
+	}
+	return mo.(*routes.Route), true, true
+}
+
+var (
+	strategies   = make(map[string]func() DrivingStrategy)
+	muStrategies sync.RWMutex
+)
+
+// RegisterDrivingStrategy makes a driving strategy selectable by name.
+func RegisterDrivingStrategy(name string, newStrategy func() DrivingStrategy) {
+	muStrategies.Lock()
+	defer muStrategies.Unlock()
+	strategies[name] = newStrategy
+}
+
+func init() {
+	RegisterDrivingStrategy(StrategyRoundRobin, func() DrivingStrategy { return &roundRobin{} })
+	RegisterDrivingStrategy(StrategyRoute, func() DrivingStrategy { return &routeFollowing{} })
+	RegisterDrivingStrategy(StrategyPatrol, func() DrivingStrategy { return &randomPatrol{} })
+	RegisterDrivingStrategy(StrategyDepot, func() DrivingStrategy { return &returnToDepot{} })
+}
+
+// the name of the strategy a truck is driven by
+func strategyOf(tk *Truck) string {
+	switch {
+	case tk.Strategy != "":
+		return tk.Strategy
+	case tk.Route != "":
+		return StrategyRoute
+	default:
+		return StrategyRoundRobin
+	}
+}
+
+func newStrategy(name string) (DrivingStrategy, error) {
+	muStrategies.RLock()
+	defer muStrategies.RUnlock()
+
+	newStrategy, ok := strategies[name]
+	if !ok {
+		return nil, errors.Errorf("No driving strategy named [%s]", name)
+	}
+	return newStrategy(), nil
+}
+
+// approaching each waypoint in turn, ordered by seq, starting from the nearest one
+type roundRobin struct {
+	wpi int
+	wp  *routes.Waypoint // at `wpi` of the waypoints
+}
+
+func (s *roundRobin) Step(tk *Truck, env *DrivingEnv, elapsed time.Duration) DrivingState {
+	st := StateOf(tk)
+	wps := env.Waypoints()
+	if len(wps) < 1 {
+		glog.V(1).Infof(" * No waypoint yet for truck %v.", tk)
+		return st
+	}
+
+	if s.wpi >= len(wps) {
+		s.wpi = 0
+	}
+	if s.wp != &wps[s.wpi] {
+		// waypoints changed, find nearest waypoint
+		s.wpi, s.wp = 0, &wps[0]
+		dNeareast := math.Hypot(s.wp.X-tk.X, s.wp.Y-tk.Y)
+		for i := 1; i < len(wps); i++ {
+			twp := &wps[i]
+			if d := math.Hypot(twp.X-tk.X, twp.Y-tk.Y); d < dNeareast {
+				dNeareast = d
+				s.wpi, s.wp = i, twp
+			}
+		}
+	}
+
+	if st.Approach(s.wp.X, s.wp.Y, DrivingSpeed*elapsed.Seconds()) {
+		// toward next waypoint
+		s.wpi++
+		if s.wpi >= len(wps) {
+			s.wpi = 0
+		}
+		s.wp = &wps[s.wpi]
+	}
+	return st
+}
+
+// following the route assigned, looping or stopping at the end. the waypoint being
+// approached is kept on if the route changed meanwhile, or the route is joined at
+// its waypoint nearest to the truck, e.g. just assigned. a one-way route is started
+// over once finished and told to move again.
+type routeFollowing struct {
+	aiming bson.ObjectId // the waypoint being approached
+}
+
+func (s *routeFollowing) Step(tk *Truck, env *DrivingEnv, elapsed time.Duration) DrivingState {
+	st := StateOf(tk)
+	if tk.Route == "" {
+		glog.V(1).Infof(" * Truck %v has no route to follow, stop there.", tk)
+		st.Moving = false
+		return st
+	}
+	rt, ok, loaded := env.Route(tk.Route)
+	if !ok {
+		if loaded {
+			// the route has been deleted
+			glog.V(1).Infof(" * Route of truck %v gone.", tk)
+			st.Route, st.NextWp = "", -1
+		}
+		return st
+	}
+	n := len(rt.Waypoints)
+	if n < 1 {
+		glog.V(1).Infof(" * Route %v of truck %v has no waypoint, stop there.", rt, tk)
+		st.Moving, st.NextWp = false, 0
+		return st
+	}
+
+	nextWp := tk.NextWp
+	if s.aiming != "" && (nextWp < 0 || nextWp >= n || rt.Waypoints[nextWp] != s.aiming) {
+		// the route changed, or another route assigned
+		nextWp = -1
+		for i, id := range rt.Waypoints {
+			if id == s.aiming {
+				nextWp = i
+				break
+			}
+		}
+	}
+	if nextWp == n {
+		// finished a one-way route, told to move again
+		nextWp = 0
+	} else if nextWp < 0 || nextWp > n {
+		nextWp = nearestOnRoute(tk.X, tk.Y, rt, env)
+	}
+
+	wp, ok := env.Waypoint(rt.Waypoints[nextWp])
+	if !ok {
+		// deleted waypoint not taken out of the route yet, skip it
+		s.aiming = rt.Waypoints[(nextWp+1)%n]
+		return st
+	}
+	if st.Approach(wp.X, wp.Y, DrivingSpeed*elapsed.Seconds()) {
+		nextWp++
+		if nextWp >= n {
+			if rt.Loop {
+				nextWp = 0
+			} else {
+				glog.V(1).Infof(" * Truck %v finished route %v.", tk, rt)
+				st.Moving = false
+			}
+		}
+	}
+	if nextWp < n {
+		s.aiming = rt.Waypoints[nextWp]
+	} else {
+		s.aiming = ""
+	}
+	st.NextWp = nextWp
+	return st
+}
+
+// index of the waypoint of the route nearest to (x,y)
+func nearestOnRoute(x, y float64, rt *routes.Route, env *DrivingEnv) int {
+	nearest, dNearest := 0, math.Inf(1)
+	for i, id := range rt.Waypoints {
+		wp, ok := env.Waypoint(id)
+		if !ok {
+			continue
+		}
+		if d := math.Hypot(wp.X-x, wp.Y-y); d < dNearest {
+			nearest, dNearest = i, d
+		}
+	}
+	return nearest
+}
+
+// approaching waypoints picked at random, never the same one twice in a row
+type randomPatrol struct {
+	target bson.ObjectId
+}
+
+func (s *randomPatrol) Step(tk *Truck, env *DrivingEnv, elapsed time.Duration) DrivingState {
+	st := StateOf(tk)
+	wp, ok := env.Waypoint(s.target)
+	if !ok {
+		// just started, or the target deleted
+		if wp, ok = s.pick(env.Waypoints(), env.Rand()); !ok {
+			glog.V(1).Infof(" * No waypoint yet for truck %v.", tk)
+			return st
+		}
+	}
+	if st.Approach(wp.X, wp.Y, DrivingSpeed*elapsed.Seconds()) {
+		s.pick(env.Waypoints(), env.Rand())
+	}
+	return st
+}
+
+func (s *randomPatrol) pick(wps []routes.Waypoint, rnd *rand.Rand) (*routes.Waypoint, bool) {
+	candidates := make([]*routes.Waypoint, 0, len(wps))
+	for i := range wps {
+		if wps[i].Id != s.target {
+			candidates = append(candidates, &wps[i])
+		}
+	}
+	if len(candidates) < 1 {
+		// stay at the only one
+		return nil, false
+	}
+	wp := candidates[rnd.Intn(len(candidates))]
+	s.target = wp.Id
+	return wp, true
+}
+
+// heading back to the depot and stop there. the depot is the waypoint with the
+// smallest seq.
+type returnToDepot struct{}
+
+func (s *returnToDepot) Step(tk *Truck, env *DrivingEnv, elapsed time.Duration) DrivingState {
+	st := StateOf(tk)
+	wps := env.Waypoints()
+	if len(wps) < 1 {
+		glog.V(1).Infof(" * No depot yet for truck %v.", tk)
+		return st
+	}
+	depot := &wps[0] // waypoints are ordered by seq
+	if st.Approach(depot.X, depot.Y, DrivingSpeed*elapsed.Seconds()) {
+		glog.V(1).Infof(" * Truck %v back at depot %v.", tk, depot)
+		st.Moving = false
+	}
+	return st
+}
@@ -3,17 +3,56 @@ package drivers
 import (
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/complyue/ddgo/pkg/dbc"
 	"github.com/complyue/ddgo/pkg/livecoll"
 	"github.com/complyue/hbigo/pkg/errors"
-	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/golang/glog"
 )
 
-func coll() *mgo.Collection {
-	return dbc.DB().C("truck")
+func init() {
+	// for truck change events to be journaled
+	livecoll.RegisterMemberType("drivers.Truck", (*Truck)(nil))
+}
+
+var (
+	tkRepo dbc.Repo
+	tkSeqs *dbc.SeqCounter
+	muRepo sync.Mutex
+)
+
+// the backing storage of trucks, selected by the "db" url in etc/services.json
+func repo() dbc.Repo {
+	muRepo.Lock()
+	defer muRepo.Unlock()
+
+	if tkRepo == nil {
+		r, err := dbc.OpenRepo("truck")
+		if err != nil {
+			glog.Error(err)
+			panic(err)
+		}
+		tkRepo = r
+	}
+	return tkRepo
+}
+
+// allocates seqs of trucks, persisted along with them
+func seqCounter() *dbc.SeqCounter {
+	muRepo.Lock()
+	defer muRepo.Unlock()
+
+	if tkSeqs == nil {
+		sc, err := dbc.OpenSeqCounter("truck")
+		if err != nil {
+			glog.Error(err)
+			panic(err)
+		}
+		tkSeqs = sc
+	}
+	return tkSeqs
 }
 
 // in-memory storage of all trucks of a particular tenant.
@@ -22,8 +61,13 @@ type TruckCollection struct {
 	livecoll.HouseKeeper
 
 	Tid string
-	// this is the primary index to locate a truck by tid+seq
-	bySeq map[int]*Truck
+	// max seq of trucks loaded or added, seqs are allocated by the persisted counter
+	// and never below it, so seqs of deleted trucks are not reused
+	maxSeq int
+
+	// serializes updates and deletions, from reading the version through committing
+	// a new one
+	muUpdate sync.Mutex
 }
 
 // a single truck
@@ -37,12 +81,41 @@ type Truck struct {
 	X      float64 `json:"x"`
 	Y      float64 `json:"y"`
 	Moving bool    `json:"moving"`
+
+	// the route assigned to drive along, empty if roaming through all waypoints
+	Route bson.ObjectId `json:"route,omitempty" bson:"route,omitempty"`
+	// index of the waypoint being approached in the route, negative to join the
+	// route at its waypoint nearest to the truck, the route's length if finished
+	// a one-way route
+	NextWp int `json:"nextWp" bson:"nextWp"`
+	// name of the driving strategy, empty to follow the route if assigned one,
+	// or go round robin otherwise
+	Strategy string `json:"strategy,omitempty" bson:"strategy,omitempty"`
+
+	// increased by each update, stored in db as `dbc.VersionField`
+	Version int `json:"version"`
 }
 
 func (tk *Truck) GetID() interface{} {
 	return tk.Id
 }
 
+func (tk *Truck) GetVersion() int {
+	return tk.Version
+}
+
+func (tk *Truck) GetSeq() int {
+	return tk.Seq
+}
+
+func (tk *Truck) GetXY() (x, y float64) {
+	return tk.X, tk.Y
+}
+
+func (tk *Truck) IsMoving() bool {
+	return tk.Moving
+}
+
 func (tk *Truck) String() string {
 	return fmt.Sprintf("%+v", tk)
 }
@@ -56,53 +129,65 @@ func (tk *Truck) Format(s fmt.State, verb rune) {
 			if tk.Moving {
 				io.WriteString(s, "*")
 			}
+			if tk.Route != "" {
+				io.WriteString(s, fmt.Sprintf("->%s#%d", tk.Route.Hex(), tk.NextWp))
+			}
 		}
 	}
 }
 
-var (
-	tkCollection *TruckCollection
-)
-
-func ensureLoadedFor(tid string) error {
-	// sync is not strictly necessary for load, as worst scenario is to load more than once,
-	// while correctness not violated.
-	if tkCollection != nil {
-		// already have a full list loaded
-		if tid != tkCollection.Tid {
-			// should be coz of malfunctioning of service router, log and deny service
-			err := errors.New(fmt.Sprintf(
-				"Truck service already stuck to [%s], not serving [%s]!",
-				tkCollection.Tid, tid,
-			))
-			glog.Error(err)
-			return err
-		}
-		return nil
+// BySeq locates a truck by seq.
+func (tkc *TruckCollection) BySeq(seq int) (*Truck, bool) {
+	mo, ok := tkc.ReadBy("seq", seq)
+	if !ok {
+		return nil, false
 	}
+	return mo.(*Truck), true
+}
 
-	// the first time serving a tenant, load full list and stuck to this tid
-	var loadingList []Truck
-	err := coll().Find(bson.M{"tid": tid}).All(&loadingList)
+// truck collections of all tenants served by this process
+var tkRegistry = livecoll.NewRegistry("truck", loadTrucks)
+
+// acquire the truck collection of a tenant, loading it if not yet, `release()`
+// should be called when done with it.
+func ensureLoadedFor(tid string) (*TruckCollection, func(), error) {
+	coll, release, err := tkRegistry.Acquire(tid)
 	if err != nil {
 		glog.Error(err)
-		return err
+		return nil, nil, err
 	}
-	optimalSize := 2 * len(loadingList)
-	if optimalSize < 200 {
-		optimalSize = 200
+	return coll.(*TruckCollection), release, nil
+}
+
+// load full list of trucks of a tenant
+func loadTrucks(tid string, former livecoll.HouseKeeper) (livecoll.HouseKeeper, error) {
+	var loadingList []Truck
+	err := repo().LoadAll(tid, &loadingList)
+	if err != nil {
+		return nil, err
 	}
 	var hk livecoll.HouseKeeper
-	if tkCollection != nil {
-		// inherite subscribers by reusing the housekeeper, if already loaded & subscribed
-		hk = tkCollection.HouseKeeper
-	} else {
-		hk = livecoll.NewHouseKeeper()
+	if former != nil {
+		// inherite subscribers by reusing the housekeeper, if evicted while subscribed
+		hk = former.(*TruckCollection).HouseKeeper
+	} else if hk, err = livecoll.OpenHouseKeeper("truck", tid); err != nil {
+		return nil, err
+	}
+	// this is the primary index to locate a truck by tid+seq
+	if err = hk.AddIndex(livecoll.Index{
+		Name: "seq", Unique: true,
+		Key: func(mo livecoll.Member) interface{} {
+			return mo.(*Truck).Seq
+		},
+	}); err != nil {
+		if former == nil {
+			hk.Close()
+		}
+		return nil, err
 	}
 	loadingColl := &TruckCollection{
 		HouseKeeper: hk,
 		Tid:         tid,
-		bySeq:       make(map[int]*Truck, optimalSize),
 	}
 	memberList := make([]livecoll.Member, len(loadingList))
 	for i, tko := range loadingList {
@@ -110,27 +195,34 @@ func ensureLoadedFor(tid string) error {
 		// make a local copy and take pointer for collection storage.
 		tkCopy := tko
 		memberList[i] = &tkCopy
-		loadingColl.bySeq[tko.Seq] = &tkCopy
+		if tko.Seq > loadingColl.maxSeq {
+			loadingColl.maxSeq = tko.Seq
+		}
 	}
-	hk.Load(memberList)
-	tkCollection = loadingColl // only set globally after successfully loaded at all
-	return nil
+	if err = hk.Load(memberList); err != nil {
+		if former == nil {
+			hk.Close()
+		}
+		return nil, err
+	}
+	return loadingColl, nil
 }
 
 // the snapshot of all Trucks of a specific tenant
 type TrucksSnapshot struct {
 	Tid    string
-	CCN    int
+	CCN    livecoll.CCN
 	Trucks []Truck
 }
 
 func FetchTrucks(tid string) *TrucksSnapshot {
-	if err := ensureLoadedFor(tid); err != nil {
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
 		// err has been logged
 		panic(err)
 	}
-	// todo make FetchAll return values instead of pointers, to avoid dirty value reads
-	ccn, tks := tkCollection.FetchAll()
+	defer release()
+	ccn, tks := tkc.FetchAll()
 	snap := &TrucksSnapshot{
 		Tid:    tid,
 		CCN:    ccn,
@@ -148,116 +240,211 @@ func (ctx *serviceContext) FetchTrucks(tid string) *TrucksSnapshot {
 	return FetchTrucks(tid)
 }
 
-type tkDelegate struct {
-	ctx *serviceContext
+// the changes to trucks of a specific tenant, after a known ccn
+type TruckChanges struct {
+	Tid string
+	// changes since the known ccn are no longer available, a snapshot should be
+	// fetched instead
+	TooOld  bool
+	Changes []TruckChange
 }
 
-func (ctx *serviceContext) SubscribeTrucks(tid string) {
-	if err := ensureLoadedFor(tid); err != nil {
+// a single change to trucks, a deleted truck has only the id set. changes
+// committed as a change set share the same ccn
+type TruckChange struct {
+	livecoll.ChangeHeader `bson:",inline"`
+
+	Truck Truck
+}
+
+func FetchTruckChangesSince(tid string, ccn livecoll.CCN) *TruckChanges {
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		// err has been logged
 		panic(err)
 	}
+	defer release()
+	chgs := &TruckChanges{Tid: tid}
+	changes, ok := tkc.FetchChangesSince(ccn)
+	if !ok {
+		chgs.TooOld = true
+		return chgs
+	}
+	chgs.Changes = truckChanges(changes)
+	return chgs
+}
 
-	dele := tkDelegate{ctx}
-	tkCollection.Subscribe(dele)
+// convert change events to truck changes, with change sets flattened
+func truckChanges(events []interface{}) []TruckChange {
+	flat := livecoll.FlattenEvents(events)
+	chgs := make([]TruckChange, len(flat))
+	for i, evt := range flat {
+		hdr, mo, id := livecoll.ChangeOf(evt)
+		chgs[i].ChangeHeader = hdr
+		if mo != nil {
+			chgs[i].Truck = *(mo.(*Truck))
+		} else {
+			chgs[i].Truck.Id = id.(bson.ObjectId)
+		}
+	}
+	return chgs
 }
 
-func (dele tkDelegate) Subscribed() (stop bool) {
-	// not relaying Subscribed event over hbi wire
-	return
+// change events to be replayed by subscribers
+func (chgs *TruckChanges) Events() (changes []interface{}, ok bool) {
+	if chgs.TooOld {
+		return nil, false
+	}
+	flat := make([]interface{}, len(chgs.Changes))
+	for i := range chgs.Changes {
+		flat[i] = chgs.Changes[i].event()
+	}
+	// changes of a change set are consecutive, with the same ccn
+	return livecoll.RegroupEvents(flat), true
 }
 
-func (dele tkDelegate) Epoch(ccn int) (stop bool) {
-	ctx := dele.ctx
-	if ctx.Cancelled() {
-		stop = true
-		return
+func (chg *TruckChange) event() interface{} {
+	return chg.ChangeHeader.Event(&chg.Truck)
+}
+
+// a single truck as of the ccn it's read, `Deleted` if no such truck
+func FetchTruck(tid string, id bson.ObjectId) *TruckChange {
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		// err has been logged
+		panic(err)
+	}
+	defer release()
+	ccn, mo, ok := tkc.FetchMember(id)
+	if !ok {
+		return &TruckChange{
+			ChangeHeader: livecoll.ChangeHeader{CCN: ccn, Deleted: true}, Truck: Truck{Id: id},
+		}
 	}
-	po := ctx.MustPoToPeer()
-	po.Notif(fmt.Sprintf(`
-TkEpoch(%#v)
-`, ccn))
-	return
+	return &TruckChange{ChangeHeader: livecoll.ChangeHeader{CCN: ccn}, Truck: *(mo.(*Truck))}
 }
 
-// Created
-func (dele tkDelegate) MemberCreated(ccn int, eo livecoll.Member) (stop bool) {
-	ctx := dele.ctx
-	if ctx.Cancelled() {
-		stop = true
-		return
+func (ctx *serviceContext) FetchTruck(tid string, id string) *TruckChange {
+	return FetchTruck(tid, bson.ObjectIdHex(id))
+}
+
+func (ctx *serviceContext) FetchTruckChangesSince(tid string, epoch int64, seq uint64) *TruckChanges {
+	return FetchTruckChangesSince(tid, livecoll.CCN{epoch, seq})
+}
+
+// how trucks and their changes are shipped to consumers
+var tkShipping = livecoll.Shipping{
+	MemberHint: "&Truck{}", ChangeHint: "&TruckChange{}", ChangesHint: "&TruckChanges{}",
+	Change: func(hdr livecoll.ChangeHeader, mo livecoll.Member) interface{} {
+		return &TruckChange{ChangeHeader: hdr, Truck: *(mo.(*Truck))}
+	},
+	Changes: func(events []interface{}) interface{} {
+		return &TruckChanges{Changes: truckChanges(events)}
+	},
+}
+
+func (ctx *serviceContext) SubscribeTrucks(tid string) {
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		panic(err)
 	}
-	tk := eo.(*Truck)
-	po := ctx.MustPoToPeer()
-	po.NotifBSON(fmt.Sprintf(`
-TkCreated(%#v)
-`, ccn), tk, "&Truck{}")
-	return
+	defer release()
+
+	dele := ctx.relay("Tk", 0, false, tkShipping)
+	ctx.keepTkSubscription(0, tkc.Subscribe(dele))
 }
 
-// Updated
-func (dele tkDelegate) MemberUpdated(ccn int, eo livecoll.Member) (stop bool) {
-	ctx := dele.ctx
-	if ctx.Cancelled() {
-		stop = true
-		return
+// subscribe with a filter sent as bson object following this notif, only changes
+// of trucks passing the filter are relayed over the wire
+func (ctx *serviceContext) SubscribeFilteredTrucks(tid string, sid int) {
+	fo, err := ctx.Ho().CoRecvObj()
+	if err != nil {
+		panic(err)
 	}
-	tk := eo.(*Truck)
-	po := ctx.MustPoToPeer()
-	if err := po.NotifBSON(fmt.Sprintf(`
-TkUpdated(%#v)
-`, ccn), tk, "&Truck{}"); err != nil {
-		stop = true
-		return
+	filter := fo.(*livecoll.Filter)
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		panic(err)
 	}
-	return
+	defer release()
+
+	glog.V(1).Infof("Subscribing trucks of [%s] with filter %v", tid, filter)
+	dele := ctx.relay("Tk", sid, false, tkShipping)
+	ctx.keepTkSubscription(sid, tkc.SubscribeFiltered(dele, filter.Match))
 }
 
-// Deleted
-func (dele tkDelegate) MemberDeleted(ccn int, id interface{}) (stop bool) {
-	ctx := dele.ctx
-	if ctx.Cancelled() {
-		stop = true
+// watch a single truck, relayed like a filtered subscription, but finishes upon
+// the truck deleted
+func (ctx *serviceContext) SubscribeTruck(tid string, sid int, id string) {
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		panic(err)
+	}
+	defer release()
+
+	tkID := bson.ObjectIdHex(id)
+	if ccn, _, ok := tkc.FetchMember(tkID); !ok {
+		// gone already, nothing to watch
+		po := ctx.MustPoToPeer()
+		po.Notif(fmt.Sprintf(`
+TkDeleted(%d,%d,%d,%#v)
+`, sid, ccn.Epoch, ccn.Seq, id))
 		return
 	}
-	po := ctx.MustPoToPeer()
-	po.Notif(fmt.Sprintf(`
-TkDeleted(%#v,%#v)
-`, ccn, id))
-	return
+	dele := ctx.relay("Tk", sid, true, tkShipping)
+	ctx.keepTkSubscription(sid, tkc.SubscribeFiltered(dele, func(mo livecoll.Member) bool {
+		return mo.GetID() == tkID
+	}))
 }
 
-// individual in-memory Truck objects do not store the tid, tid only
-// meaningful for a Truck collection. however when stored as mongodb documents,
-// the tid field needs to present. so here's the struct, with an in-memory
-// tk object embedded, to be inlined when marshaled to bson (for mango)
-type tkForDb struct {
-	Tid   string `bson:"tid"`
-	Truck `bson:",inline"`
+// the consumer has dropped a subscription, sid 0 for the unfiltered one, its
+// delegate relays no more event
+func (ctx *serviceContext) UnsubscribeTrucks(tid string, sid int) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if unsubscribe := ctx.tkSubscriptions[sid]; unsubscribe != nil {
+		unsubscribe()
+		delete(ctx.tkSubscriptions, sid)
+	}
 }
 
 func AddTruck(tid string, x, y float64) error {
-	if err := ensureLoadedFor(tid); err != nil {
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
 		return err
 	}
+	defer release()
+
+	// seqs are allocated and taken in order of additions
+	tkc.muUpdate.Lock()
+	defer tkc.muUpdate.Unlock()
 
-	newSeq := 1 + len(tkCollection.bySeq)   // assign tenant wide unique seq
+	// assign tenant wide unique seq
+	newSeq, err := seqCounter().Next(tid, tkc.maxSeq)
+	if err != nil {
+		return err
+	}
 	newLabel := fmt.Sprintf("#%d#", newSeq) // label with some rules
-	Truck := tkForDb{tid, Truck{
+	tk := &Truck{
 		Id:  bson.NewObjectId(),
 		Seq: newSeq, Label: newLabel,
 		X: x, Y: y,
 		Moving: false,
-	}}
+	}
+	// not to write into db what can not be indexed in memory
+	if err = tkc.Check(tk); err != nil {
+		return err
+	}
 	// write into backing storage, the db
-	err := coll().Insert(&Truck)
+	err = repo().Insert(tid, tk)
 	if err != nil {
 		return err
 	}
 
 	// add to in-memory collection and index, after successful db insert
-	tk := &Truck.Truck
-	tkCollection.bySeq[Truck.Seq] = tk
-	tkCollection.Created(tk)
+	tkc.maxSeq = tk.Seq
+	tkc.Created(tk)
 
 	return nil
 }
@@ -268,35 +455,73 @@ func (ctx *serviceContext) AddTruck(tid string, x, y float64) error {
 	return AddTruck(tid, x, y)
 }
 
-func MoveTruck(tid string, seq int, id string, x, y float64) error {
-	if err := ensureLoadedFor(tid); err != nil {
-		return err
+// update a truck in db then in memory, if it's still of `version`, or whatever
+// version it is if `version` is negative. the updated truck is returned.
+func updateTruck(
+	tid string, seq int, id string, version int,
+	fields bson.M, update func(tk *Truck),
+) (*Truck, error) {
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		return nil, err
 	}
+	defer release()
+
+	tkc.muUpdate.Lock()
+	defer tkc.muUpdate.Unlock()
 
-	mtk, ok := tkCollection.Read(bson.ObjectIdHex(id))
+	mtk, ok := tkc.Read(bson.ObjectIdHex(id))
 	if !ok || mtk == nil {
-		return errors.New(fmt.Sprintf("Truck seq=[%v], id=[%s] not exists for tid=%s", seq, id, tid))
+		return nil, errors.New(fmt.Sprintf("Truck seq=[%v], id=[%s] not exists for tid=%s", seq, id, tid))
 	}
 	tk := mtk.(*Truck)
 	if tk.Seq != seq {
-		return errors.New(fmt.Sprintf("Truck id=[%s], seq mismatch [%v] vs [%v]", id, seq, tk.Seq))
+		return nil, errors.New(fmt.Sprintf("Truck id=[%s], seq mismatch [%v] vs [%v]", id, seq, tk.Seq))
+	}
+	if version < 0 {
+		version = tk.Version
+	} else if version != tk.Version {
+		return nil, &livecoll.ConflictError{ID: tk.Id, Expected: version, Actual: tk.Version}
 	}
 
 	// update backing storage, the db
-	if err := coll().Update(bson.M{
-		"tid": tid, "_id": tk.Id,
-	}, bson.M{
-		"$set": bson.M{"x": x, "y": y},
-	}); err != nil {
-		return err
+	if err := repo().UpdateVersioned(tid, tk.Id, version, fields); err != nil {
+		if err == dbc.ErrConflict {
+			// changed in db by someone else, not through this collection
+			return nil, &livecoll.ConflictError{ID: tk.Id, Expected: version, Actual: -1}
+		}
+		return nil, err
 	}
 
-	// update in-memory value, after successful db update
-	tk.X, tk.Y = x, y
+	// swap in an updated value, after successful db update
+	updated, ok := tkc.Modify(tk.Id, func(mo livecoll.Member) livecoll.Member {
+		updated := *(mo.(*Truck))
+		update(&updated)
+		updated.Version = version + 1
+		return &updated
+	})
+	if !ok {
+		// deleted meanwhile
+		return nil, errors.New(fmt.Sprintf("Truck seq=[%v], id=[%s] not exists for tid=%s", seq, id, tid))
+	}
+	return updated.(*Truck), nil
+}
 
-	tkCollection.Updated(tk)
+func MoveTruck(tid string, seq int, id string, x, y float64) error {
+	_, err := MoveTruckIf(tid, seq, id, -1, x, y)
+	return err
+}
 
-	return nil
+// MoveTruckIf moves the truck only if it's still of `version`, or returns a
+// `*livecoll.ConflictError`. the new version is returned on success.
+func MoveTruckIf(tid string, seq int, id string, version int, x, y float64) (int, error) {
+	tk, err := updateTruck(tid, seq, id, version, bson.M{"x": x, "y": y}, func(tk *Truck) {
+		tk.X, tk.Y = x, y
+	})
+	if err != nil {
+		return 0, err
+	}
+	return tk.Version, nil
 }
 
 // this service method has async style, successful result will be published
@@ -311,11 +536,184 @@ func (ctx *serviceContext) MoveTruck(
 }
 
 func StopTruck(tid string, seq int, id string, moving bool) error {
-	if err := ensureLoadedFor(tid); err != nil {
+	_, err := StopTruckIf(tid, seq, id, -1, moving)
+	return err
+}
+
+// StopTruckIf tells the truck to be moving or not, only if it's still of `version`,
+// or returns a `*livecoll.ConflictError`. the new version is returned on success.
+func StopTruckIf(tid string, seq int, id string, version int, moving bool) (int, error) {
+	tk, err := updateTruck(tid, seq, id, version, bson.M{"moving": moving}, func(tk *Truck) {
+		tk.Moving = moving
+	})
+	if err != nil {
+		return 0, err
+	}
+	return tk.Version, nil
+}
+
+// this service method has async style, successful result will be published
+// as an event asynchronously
+func (ctx *serviceContext) StopTruck(
+	tid string, seq int, id string, moving bool,
+) error {
+	glog.V(1).Infof(" * Making truck %v to moving=%v by service ...", seq, moving)
+	err := StopTruck(tid, seq, id, moving)
+	glog.V(1).Infof(" * Made truck %v to moving=%v by service.", seq, moving)
+	return err
+}
+
+func AssignRoute(tid string, seq int, id string, routeID string) error {
+	_, err := AssignRouteIf(tid, seq, id, -1, routeID)
+	return err
+}
+
+// AssignRouteIf assigns the truck to drive along a route, or to roam if `routeID`
+// is empty, only if it's still of `version`, or returns a `*livecoll.ConflictError`.
+// the new version is returned on success. a truck being driven joins the new
+// route from where it is.
+func AssignRouteIf(tid string, seq int, id string, version int, routeID string) (int, error) {
+	// stored as null if roaming, the repo sets fields rather than unsetting them,
+	// and a null decodes as the empty id
+	var route interface{}
+	if routeID != "" {
+		if err := checkRoute(tid, routeID); err != nil {
+			return 0, err
+		}
+		route = bson.ObjectIdHex(routeID)
+	}
+	tk, err := updateTruck(tid, seq, id, version, bson.M{"route": route, "nextWp": -1}, func(tk *Truck) {
+		tk.Route, tk.NextWp = bson.ObjectId(""), -1
+		if routeID != "" {
+			tk.Route = bson.ObjectIdHex(routeID)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+	return tk.Version, nil
+}
+
+// the route should exist at routes service
+func checkRoute(tid string, routeID string) error {
+	if !bson.IsObjectIdHex(routeID) {
+		return errors.Errorf("Invalid route id [%s]", routeID)
+	}
+	routesAPI, err := GetRoutesService(tid)
+	if err != nil {
 		return err
 	}
+	_, rtl := routesAPI.FetchRoutes()
+	for i := range rtl {
+		if rtl[i].Id.Hex() == routeID {
+			return nil
+		}
+	}
+	return errors.Errorf("Route id=[%s] not exists for tid=%s", routeID, tid)
+}
 
-	mtk, ok := tkCollection.Read(bson.ObjectIdHex(id))
+// this service method has async style, successful result will be published
+// as an event asynchronously
+func (ctx *serviceContext) AssignRoute(
+	tid string, seq int, id string, routeID string,
+) error {
+	return AssignRoute(tid, seq, id, routeID)
+}
+
+func SetDrivingStrategy(tid string, seq int, id string, strategy string) error {
+	_, err := SetDrivingStrategyIf(tid, seq, id, -1, strategy)
+	return err
+}
+
+// SetDrivingStrategyIf selects the strategy for the truck to be driven by, or the
+// default if `strategy` is empty, only if it's still of `version`, or returns a
+// `*livecoll.ConflictError`. the new version is returned on success.
+func SetDrivingStrategyIf(tid string, seq int, id string, version int, strategy string) (int, error) {
+	if strategy != "" {
+		if _, err := newStrategy(strategy); err != nil {
+			return 0, err
+		}
+	}
+	tk, err := updateTruck(tid, seq, id, version, bson.M{"strategy": strategy}, func(tk *Truck) {
+		tk.Strategy = strategy
+	})
+	if err != nil {
+		return 0, err
+	}
+	return tk.Version, nil
+}
+
+// this service method has async style, successful result will be published
+// as an event asynchronously
+func (ctx *serviceContext) SetDrivingStrategy(
+	tid string, seq int, id string, strategy string,
+) error {
+	return SetDrivingStrategy(tid, seq, id, strategy)
+}
+
+// update the truck as its driving strategy decided
+func driveTruckIf(tid string, seq int, id string, version int, st DrivingState) (int, error) {
+	var route interface{} // stored as null if cleared, as in `AssignRouteIf()`
+	if st.Route != "" {
+		route = st.Route
+	}
+	tk, err := updateTruck(tid, seq, id, version, bson.M{
+		"x": st.X, "y": st.Y, "moving": st.Moving,
+		"route": route, "nextWp": st.NextWp,
+	}, func(tk *Truck) {
+		tk.X, tk.Y, tk.Moving = st.X, st.Y, st.Moving
+		tk.Route, tk.NextWp = st.Route, st.NextWp
+	})
+	if err != nil {
+		return 0, err
+	}
+	return tk.Version, nil
+}
+
+// this service method has rpc style, failures including conflicts are returned
+// in the outcome, not to disconnect the wire
+func (ctx *serviceContext) MoveTruckIf(
+	tid string, seq int, id string, version int, x, y float64,
+) *livecoll.UpdateOutcome {
+	return livecoll.NewUpdateOutcome(MoveTruckIf(tid, seq, id, version, x, y))
+}
+
+// this service method has rpc style, failures including conflicts are returned
+// in the outcome, not to disconnect the wire
+func (ctx *serviceContext) StopTruckIf(
+	tid string, seq int, id string, version int, moving bool,
+) *livecoll.UpdateOutcome {
+	return livecoll.NewUpdateOutcome(StopTruckIf(tid, seq, id, version, moving))
+}
+
+// this service method has rpc style, failures including conflicts are returned
+// in the outcome, not to disconnect the wire
+func (ctx *serviceContext) AssignRouteIf(
+	tid string, seq int, id string, version int, routeID string,
+) *livecoll.UpdateOutcome {
+	return livecoll.NewUpdateOutcome(AssignRouteIf(tid, seq, id, version, routeID))
+}
+
+// this service method has rpc style, failures including conflicts are returned
+// in the outcome, not to disconnect the wire
+func (ctx *serviceContext) SetDrivingStrategyIf(
+	tid string, seq int, id string, version int, strategy string,
+) *livecoll.UpdateOutcome {
+	return livecoll.NewUpdateOutcome(SetDrivingStrategyIf(tid, seq, id, version, strategy))
+}
+
+func DeleteTruck(tid string, seq int, id string) error {
+	tkc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	// not to race with updates of the truck, e.g. by its driving
+	tkc.muUpdate.Lock()
+	defer tkc.muUpdate.Unlock()
+
+	mtk, ok := tkc.Read(bson.ObjectIdHex(id))
 	if !ok || mtk == nil {
 		return errors.New(fmt.Sprintf("Truck seq=[%v], id=[%s] not exists for tid=%s", seq, id, tid))
 	}
@@ -324,30 +722,22 @@ func StopTruck(tid string, seq int, id string, moving bool) error {
 		return errors.New(fmt.Sprintf("Truck id=[%s], seq mismatch [%v] vs [%v]", id, seq, tk.Seq))
 	}
 
-	// update backing storage, the db
-	if err := coll().Update(bson.M{
-		"tid": tid, "_id": tk.Id,
-	}, bson.M{
-		"$set": bson.M{"moving": moving},
-	}); err != nil {
+	// remove from backing storage, the db
+	if err := repo().Delete(tid, tk.Id); err != nil {
 		return err
 	}
 
-	// update in-memory value, after successful db update
-	tk.Moving = moving
-
-	tkCollection.Updated(tk)
+	// remove from in-memory collection and index, after successful db removal
+	tkc.Deleted(tk.Id)
 
 	return nil
 }
 
 // this service method has async style, successful result will be published
 // as an event asynchronously
-func (ctx *serviceContext) StopTruck(
-	tid string, seq int, id string, moving bool,
-) error {
-	glog.V(1).Infof(" * Making truck %v to moving=%v by service ...", seq, moving)
-	err := StopTruck(tid, seq, id, moving)
-	glog.V(1).Infof(" * Made truck %v to moving=%v by service.", seq, moving)
+func (ctx *serviceContext) DeleteTruck(tid string, seq int, id string) error {
+	glog.V(1).Infof(" * Deleting truck %v by service ...", seq)
+	err := DeleteTruck(tid, seq, id)
+	glog.V(1).Infof(" * Deleted truck %v by service, err=%+v.", seq, err)
 	return err
 }
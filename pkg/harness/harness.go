@@ -0,0 +1,135 @@
+// Package harness runs routes and drivers services in-process, over loopback hbi
+// wires with in-memory storage, for integration tests to consume them the same
+// way the web backend does, without MongoDB or service pools.
+package harness
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/complyue/ddgo/pkg/drivers"
+	"github.com/complyue/ddgo/pkg/routes"
+	"github.com/complyue/ddgo/pkg/svcs"
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// StartTimeout is how long to wait for services to start listening.
+var StartTimeout = 10 * time.Second
+
+// Harness has routes and drivers services running in the current process.
+type Harness struct {
+	RoutesAddr, DriversAddr string
+}
+
+var (
+	started *Harness
+	muStart sync.Mutex
+)
+
+// Start starts routes and drivers services on ephemeral loopback ports, with
+// storage in memory and change journals disabled.
+//
+// services keep their states in package vars, so they can only be started once
+// per process, later calls return the same harness. tests sharing a process
+// should use tenant ids of their own, or call `dbc.ResetMemRepos()` in between.
+func Start() (*Harness, error) {
+	muStart.Lock()
+	defer muStart.Unlock()
+
+	if started != nil {
+		return started, nil
+	}
+
+	routesPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	driversPort, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+
+	svcs.OverrideServiceConfig("db", svcs.ServiceConfig{Url: "mem://harness"})
+	svcs.OverrideServiceConfig("journal", svcs.ServiceConfig{Url: ""})
+	svcs.OverrideServiceConfig("routes", loopbackConfig(routesPort))
+	svcs.OverrideServiceConfig("drivers", loopbackConfig(driversPort))
+
+	h := &Harness{
+		RoutesAddr:  fmt.Sprintf("127.0.0.1:%d", routesPort),
+		DriversAddr: fmt.Sprintf("127.0.0.1:%d", driversPort),
+	}
+
+	if err = routes.ServeSolo(); err != nil {
+		return nil, err
+	}
+	if err = drivers.ServeSolo(); err != nil {
+		return nil, err
+	}
+	if err = waitListening(h.RoutesAddr); err != nil {
+		return nil, err
+	}
+	if err = waitListening(h.DriversAddr); err != nil {
+		return nil, err
+	}
+
+	glog.Infof("Harness started with routes at %s, drivers at %s", h.RoutesAddr, h.DriversAddr)
+	started = h
+	return h, nil
+}
+
+// MustStart is like `Start()` but panics on failure.
+func MustStart() *Harness {
+	h, err := Start()
+	if err != nil {
+		panic(err)
+	}
+	return h
+}
+
+// RoutesAPI creates a new consumer api to the routes service, each api has its
+// own hbi wire, like separate consumer processes would have.
+func (h *Harness) RoutesAPI(tid string) *routes.ConsumerAPI {
+	return routes.NewConsumerAPI(tid)
+}
+
+// DriversAPI creates a new consumer api to the drivers service, each api has its
+// own hbi wire, like separate consumer processes would have.
+func (h *Harness) DriversAPI(tid string) *drivers.ConsumerAPI {
+	return drivers.NewConsumerAPI(tid)
+}
+
+func loopbackConfig(port int) svcs.ServiceConfig {
+	return svcs.ServiceConfig{
+		Host: "127.0.0.1", Port: port,
+		Parallel: 1, Size: 1, Hot: 1, Timeout: StartTimeout.String(),
+	}
+}
+
+// find a port free to listen on, it's released before returning so there is a
+// tiny chance that someone else takes it, tolerable for tests
+func freePort() (int, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+func waitListening(addr string) error {
+	deadline := time.Now().Add(StartTimeout)
+	for {
+		conn, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.Wrapf(err, "Service at %s not listening after %v", addr, StartTimeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
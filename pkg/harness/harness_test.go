@@ -0,0 +1,322 @@
+package harness
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/complyue/ddgo/pkg/livecoll"
+	"github.com/complyue/ddgo/pkg/routes"
+)
+
+// how long to wait for events to arrive over the loopback wires
+const waitTimeout = 10 * time.Second
+
+// start the harness, with a tenant id of the test's own
+func startFor(t *testing.T) (h *Harness, tid string) {
+	h, err := Start()
+	if err != nil {
+		t.Fatalf("Harness not started: %+v", err)
+	}
+	return h, fmt.Sprintf("harness-%s-%d", t.Name(), time.Now().UnixNano())
+}
+
+// poll until `cond` holds, fail the test after the timeout
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(waitTimeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Still not %s after %v", what, waitTimeout)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// events after the Epoch from the service, the consumer api fires one with the
+// ccn it knows before the wire subscribes, which has no epoch
+func wireEpochs(events []Event) (n int) {
+	for _, evt := range events {
+		if evt.Kind == Epoch && evt.CCN.Epoch != 0 {
+			n++
+		}
+	}
+	return
+}
+
+func countKind(events []Event, kind string) (n int) {
+	for _, evt := range events {
+		if evt.Kind == kind {
+			n++
+		}
+	}
+	return
+}
+
+func lastEpoch(events []Event) (ccn livecoll.CCN) {
+	for _, evt := range events {
+		if evt.Kind == Epoch {
+			ccn = evt.CCN
+		}
+	}
+	return
+}
+
+func waitEvents(t *testing.T, rec *Recorder, what string, cond func(events []Event) bool) []Event {
+	events, err := rec.WaitFor(waitTimeout, cond)
+	if err != nil {
+		t.Fatalf("Not %s: %+v", what, err)
+	}
+	return events
+}
+
+// add a waypoint, and wait for the service to have it landed, by a fetch over the
+// same wire, which is landed after the notif
+func addWaypoint(t *testing.T, api *routes.ConsumerAPI, x, y float64) livecoll.CCN {
+	if err := api.AddWaypoint(api.Tid(), x, y); err != nil {
+		t.Fatalf("Waypoint not added: %+v", err)
+	}
+	ccn, _ := api.FetchWaypoints()
+	return ccn
+}
+
+func TestEpochThenCreated(t *testing.T) {
+	h, tid := startFor(t)
+	api := h.RoutesAPI(tid)
+	defer api.Disconnect()
+
+	rec := NewRecorder()
+	unsubscribe := api.SubscribeWaypoints(rec)
+	defer unsubscribe()
+	waitEvents(t, rec, "epoch from the service", func(events []Event) bool {
+		return wireEpochs(events) >= 1
+	})
+
+	for i := 0; i < 3; i++ {
+		addWaypoint(t, api, float64(i), float64(i))
+	}
+	events := waitEvents(t, rec, "all created", func(events []Event) bool {
+		return countKind(events, Created) >= 3
+	})
+	if err := CheckCCNs(events); err != nil {
+		t.Fatalf("%+v\n%s", err, FormatEvents(events))
+	}
+	for _, evt := range events {
+		if evt.Kind == Created && evt.CCN.Epoch != lastEpoch(events).Epoch {
+			t.Fatalf("Created in another epoch:\n%s", FormatEvents(events))
+		}
+	}
+}
+
+func TestReconnectResyncsEpoch(t *testing.T) {
+	h, tid := startFor(t)
+	api, other := h.RoutesAPI(tid), h.RoutesAPI(tid)
+	defer api.Disconnect()
+	defer other.Disconnect()
+
+	rec := NewRecorder()
+	unsubscribe := api.SubscribeWaypoints(rec)
+	defer unsubscribe()
+	waitEvents(t, rec, "epoch from the service", func(events []Event) bool {
+		return wireEpochs(events) >= 1
+	})
+	addWaypoint(t, api, 1, 1)
+	events := waitEvents(t, rec, "created before disconnected", func(events []Event) bool {
+		return countKind(events, Created) >= 1
+	})
+	before := events[len(events)-1].CCN
+
+	// a change made while disconnected is missed, the new wire tells an Epoch
+	// covering it
+	api.Disconnect()
+	missed := addWaypoint(t, other, 2, 2)
+	api.EnsureAlive()
+	events = waitEvents(t, rec, "epoch after reconnected", func(events []Event) bool {
+		return wireEpochs(events) >= 2
+	})
+	resynced := lastEpoch(events)
+	if order, _ := resynced.Compare(before); order != livecoll.CCNAhead {
+		t.Fatalf("Epoch %v after reconnected not ahead of %v", resynced, before)
+	}
+	if order, _ := resynced.Compare(missed); order == livecoll.CCNBehind || order == livecoll.EpochDiffers {
+		t.Fatalf("Epoch %v after reconnected misses the change at %v", resynced, missed)
+	}
+
+	// later changes follow right next to the resynced ccn
+	addWaypoint(t, api, 3, 3)
+	addWaypoint(t, other, 4, 4)
+	events = waitEvents(t, rec, "created after reconnected", func(events []Event) bool {
+		return countKind(events, Created) >= 3
+	})
+	if err := CheckCCNs(events); err != nil {
+		t.Fatalf("%+v\n%s", err, FormatEvents(events))
+	}
+}
+
+// counts reloads and creations a replica observed
+type replicaCounter struct {
+	mu        sync.Mutex
+	reloads   int
+	creations int
+}
+
+func (rc *replicaCounter) Counts() (reloads, creations int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return rc.reloads, rc.creations
+}
+
+func (rc *replicaCounter) Reloaded(ccn livecoll.CCN, members []livecoll.Member) (stop bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.reloads++
+	return
+}
+
+func (rc *replicaCounter) Created(ccn livecoll.CCN, mo livecoll.Member) (stop bool) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.creations++
+	return
+}
+
+func (rc *replicaCounter) Updated(ccn livecoll.CCN, former, mo livecoll.Member, delta livecoll.Delta) (stop bool) {
+	return
+}
+
+func (rc *replicaCounter) Deleted(ccn livecoll.CCN, id interface{}, former livecoll.Member) (stop bool) {
+	return
+}
+
+func (rc *replicaCounter) Batched(ccn livecoll.CCN, changes []livecoll.ReplicaChange) (stop bool) {
+	return
+}
+
+func TestReplicaCatchesUpAfterReconnect(t *testing.T) {
+	h, tid := startFor(t)
+	api, other := h.RoutesAPI(tid), h.RoutesAPI(tid)
+	defer api.Disconnect()
+	defer other.Disconnect()
+
+	addWaypoint(t, other, 1, 1)
+
+	rp := livecoll.NewReplica("waypoints of "+tid, api.WaypointSource(nil), nil)
+	rp.Start()
+	defer rp.Stop()
+	synced := func(n int) func() bool {
+		return func() bool {
+			ccn, wpl := other.FetchWaypoints()
+			return len(wpl) == n && rp.Len() == n && rp.CCN() == ccn
+		}
+	}
+	waitUntil(t, "replica loaded", synced(1))
+
+	addWaypoint(t, api, 2, 2)
+	waitUntil(t, "replica following", synced(2))
+
+	api.Disconnect()
+	addWaypoint(t, other, 3, 3)
+	addWaypoint(t, other, 4, 4)
+	api.EnsureAlive()
+	waitUntil(t, "replica caught up after reconnected", synced(4))
+
+	addWaypoint(t, other, 5, 5)
+	waitUntil(t, "replica following after reconnected", synced(5))
+}
+
+func TestSparseReplicaToleratesGaps(t *testing.T) {
+	h, tid := startFor(t)
+	api, other := h.RoutesAPI(tid), h.RoutesAPI(tid)
+	defer api.Disconnect()
+	defer other.Disconnect()
+
+	inside := &livecoll.Filter{BBox: &livecoll.BBox{MinX: 0, MinY: 0, MaxX: 100, MaxY: 100}}
+	addWaypoint(t, other, 10, 10)
+	addWaypoint(t, other, 500, 500)
+
+	rc := &replicaCounter{}
+	rp := livecoll.NewReplica("waypoints inside of "+tid, api.WaypointSource(inside), rc)
+	rp.Sparse = true
+	rp.Start()
+	defer rp.Stop()
+
+	// the Epoch from the service may come after the snapshot got upon subscribed,
+	// reloading the replica again, but always before any change relayed
+	added := 1
+	waitUntil(t, "sparse replica following", func() bool {
+		if _, creations := rc.Counts(); creations > 0 {
+			return true
+		}
+		addWaypoint(t, other, 15, 15)
+		added++
+		return false
+	})
+	reloads, _ := rc.Counts()
+
+	// changes of waypoints outside leave gaps in the ccns the replica sees
+	for i := 0; i < 3; i++ {
+		addWaypoint(t, other, 600+float64(i), 600)
+		addWaypoint(t, other, 20+float64(i), 20)
+		added++
+	}
+	last := addWaypoint(t, other, 700, 700)
+	waitUntil(t, "sparse replica following gaps", func() bool {
+		return rp.Len() == added
+	})
+	if rp.CCN() == last {
+		t.Fatalf("Sparse replica at %v with a change outside", rp.CCN())
+	}
+	if n, _ := rc.Counts(); n != reloads {
+		t.Fatalf("Sparse replica reloaded %d times upon ccn gaps", n-reloads)
+	}
+	rp.View(func(ccn livecoll.CCN, members map[interface{}]livecoll.Member) {
+		for _, mo := range members {
+			if !inside.Match(mo) {
+				t.Errorf("Waypoint outside replicated: %+v", mo)
+			}
+		}
+	})
+}
+
+func TestUnsubscribeStopsRelaying(t *testing.T) {
+	h, tid := startFor(t)
+	api := h.RoutesAPI(tid)
+	defer api.Disconnect()
+
+	rec, kept := NewRecorder(), NewRecorder()
+	unsubscribe := api.SubscribeWaypoints(rec)
+	unsubscribeKept := api.SubscribeWaypoints(kept)
+	defer unsubscribeKept()
+	waitEvents(t, rec, "epoch from the service", func(events []Event) bool {
+		return wireEpochs(events) >= 1
+	})
+	addWaypoint(t, api, 1, 1)
+	waitEvents(t, rec, "created before unsubscribed", func(events []Event) bool {
+		return countKind(events, Created) >= 1
+	})
+
+	unsubscribe()
+	seen := len(rec.Events())
+	addWaypoint(t, api, 2, 2)
+	// the subscriber kept sees the change, by then the one dropped would have too
+	waitEvents(t, kept, "created for the subscriber kept", func(events []Event) bool {
+		return countKind(events, Created) >= 2
+	})
+	if events := rec.Events(); len(events) != seen {
+		t.Fatalf("Events after unsubscribed:\n%s", FormatEvents(events[seen:]))
+	}
+
+	// the wire stops relaying after the last subscriber dropped, subscribing
+	// again starts with a new Epoch
+	unsubscribeKept()
+	addWaypoint(t, api, 3, 3)
+	again := NewRecorder()
+	unsubscribeAgain := api.SubscribeWaypoints(again)
+	defer unsubscribeAgain()
+	events := waitEvents(t, again, "epoch upon subscribed again", func(events []Event) bool {
+		return wireEpochs(events) >= 1
+	})
+	if n := countKind(events, Created); n != 0 {
+		t.Fatalf("Changes before subscribed again relayed:\n%s", FormatEvents(events))
+	}
+}
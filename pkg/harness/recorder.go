@@ -0,0 +1,222 @@
+package harness
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/complyue/ddgo/pkg/livecoll"
+	"github.com/complyue/hbigo/pkg/errors"
+)
+
+// kinds of recorded events
+const (
+	Subscribed = "subscribed"
+	Epoch      = "epoch"
+	Created    = "created"
+	Updated    = "updated"
+	Deleted    = "deleted"
+	Batch      = "batch"
+	Current    = "current" // of a single member watched
+)
+
+// Event is a livecoll event as received by a `Recorder`.
+type Event struct {
+	Kind string
+	CCN  livecoll.CCN
+	EO   livecoll.Member // of created/updated/current events
+	ID   interface{}     // of deleted events
+
+	Delta livecoll.Delta // of updated events, nil if not known
+
+	Changes []interface{} // of batch events, as passed to `MembersChanged()`
+}
+
+func (evt Event) String() string {
+	switch evt.Kind {
+	case Subscribed:
+		return evt.Kind
+	case Deleted:
+		return fmt.Sprintf("%s@%v:%v", evt.Kind, evt.CCN, evt.ID)
+	case Created, Updated, Current:
+		return fmt.Sprintf("%s@%v:%v", evt.Kind, evt.CCN, evt.EO.GetID())
+	case Batch:
+		return fmt.Sprintf("%s@%v:%d changes", evt.Kind, evt.CCN, len(evt.Changes))
+	default:
+		return fmt.Sprintf("%s@%v", evt.Kind, evt.CCN)
+	}
+}
+
+// Recorder is a livecoll subscriber recording all events it receives, for tests
+// to assert on event sequences. it's a member watcher as well, recording events
+// of the watched member as current/updated/deleted.
+type Recorder struct {
+	mu      sync.Mutex
+	events  []Event
+	changed chan struct{} // closed and replaced upon each event recorded
+}
+
+// NewRecorder creates a recorder, to be passed to a `Subscribe*()` method.
+func NewRecorder() *Recorder {
+	return &Recorder{
+		changed: make(chan struct{}),
+	}
+}
+
+func (rec *Recorder) record(evt Event) (stop bool) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.events = append(rec.events, evt)
+	close(rec.changed)
+	rec.changed = make(chan struct{})
+	return
+}
+
+func (rec *Recorder) Subscribed() (stop bool) {
+	return rec.record(Event{Kind: Subscribed})
+}
+
+func (rec *Recorder) Epoch(ccn livecoll.CCN) (stop bool) {
+	return rec.record(Event{Kind: Epoch, CCN: ccn})
+}
+
+func (rec *Recorder) MemberCreated(ccn livecoll.CCN, eo livecoll.Member) (stop bool) {
+	return rec.record(Event{Kind: Created, CCN: ccn, EO: eo})
+}
+
+func (rec *Recorder) MemberUpdated(ccn livecoll.CCN, eo livecoll.Member, delta livecoll.Delta) (stop bool) {
+	return rec.record(Event{Kind: Updated, CCN: ccn, EO: eo, Delta: delta})
+}
+
+func (rec *Recorder) MemberDeleted(ccn livecoll.CCN, id interface{}) (stop bool) {
+	return rec.record(Event{Kind: Deleted, CCN: ccn, ID: id})
+}
+
+func (rec *Recorder) MembersChanged(ccn livecoll.CCN, changes []interface{}) (stop bool) {
+	return rec.record(Event{Kind: Batch, CCN: ccn, Changes: changes})
+}
+
+func (rec *Recorder) Current(ccn livecoll.CCN, mo livecoll.Member) (stop bool) {
+	return rec.record(Event{Kind: Current, CCN: ccn, EO: mo})
+}
+
+func (rec *Recorder) Updated(ccn livecoll.CCN, mo livecoll.Member, delta livecoll.Delta) (stop bool) {
+	return rec.MemberUpdated(ccn, mo, delta)
+}
+
+func (rec *Recorder) Deleted(ccn livecoll.CCN, id interface{}) {
+	rec.MemberDeleted(ccn, id)
+}
+
+// Events returns a copy of events recorded so far.
+func (rec *Recorder) Events() []Event {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	return append([]Event(nil), rec.events...)
+}
+
+// Kinds returns kinds of events recorded so far, in order.
+func (rec *Recorder) Kinds() []string {
+	events := rec.Events()
+	kinds := make([]string, len(events))
+	for i, evt := range events {
+		kinds[i] = evt.Kind
+	}
+	return kinds
+}
+
+// Reset forgets events recorded so far.
+func (rec *Recorder) Reset() {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+
+	rec.events = nil
+}
+
+// WaitFor waits until `cond` holds with events recorded so far, and returns them.
+// an error listing the events is returned if `cond` still doesn't hold after the
+// timeout.
+func (rec *Recorder) WaitFor(timeout time.Duration, cond func(events []Event) bool) ([]Event, error) {
+	deadline := time.After(timeout)
+	for {
+		rec.mu.Lock()
+		events, changed := append([]Event(nil), rec.events...), rec.changed
+		rec.mu.Unlock()
+
+		if cond(events) {
+			return events, nil
+		}
+		select {
+		case <-changed:
+		case <-deadline:
+			return events, errors.Errorf("Condition not met after %v with events:\n%s",
+				timeout, FormatEvents(events))
+		}
+	}
+}
+
+// WaitCount waits until at least `n` events are recorded.
+func (rec *Recorder) WaitCount(timeout time.Duration, n int) ([]Event, error) {
+	return rec.WaitFor(timeout, func(events []Event) bool {
+		return len(events) >= n
+	})
+}
+
+// WaitKinds waits until the kinds of events recorded so far are exactly as
+// expected.
+func (rec *Recorder) WaitKinds(timeout time.Duration, kinds ...string) ([]Event, error) {
+	return rec.WaitFor(timeout, func(events []Event) bool {
+		if len(events) != len(kinds) {
+			return false
+		}
+		for i, evt := range events {
+			if evt.Kind != kinds[i] {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// FormatEvents formats events one per line, for failure messages.
+func FormatEvents(events []Event) string {
+	lines := make([]string, len(events))
+	for i, evt := range events {
+		lines[i] = fmt.Sprintf("  #%d %v", i, evt)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// CheckCCNs verifies that no change is missed after each Epoch event, i.e. every
+// member event is either outdated thus to be ignored, or right next to the last
+// known ccn, as a subscriber not filtered should see them.
+func CheckCCNs(events []Event) error {
+	var (
+		known   livecoll.CCN
+		inEpoch bool
+	)
+	for i, evt := range events {
+		switch evt.Kind {
+		case Subscribed:
+		case Epoch:
+			known, inEpoch = evt.CCN, true
+		default:
+			if !inEpoch {
+				return errors.Errorf("#%d %v before any epoch", i, evt)
+			}
+			order, distance := evt.CCN.Compare(known)
+			switch {
+			case order == livecoll.CCNBehind || order == livecoll.CCNEqual:
+				// outdated
+			case order == livecoll.EpochDiffers || distance > 1:
+				return errors.Errorf("#%d %v missed changes after %v", i, evt, known)
+			default:
+				known = evt.CCN
+			}
+		}
+	}
+	return nil
+}
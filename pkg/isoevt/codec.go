@@ -0,0 +1,80 @@
+package isoevt
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+
+	"github.com/complyue/hbigo/pkg/errors"
+)
+
+// JSONCodec encodes events as JSON, decoding them back to concrete types registered
+// by name. an event type with interface typed fields should implement
+// `json.Marshaler` and `json.Unmarshaler` to be properly restored.
+type JSONCodec struct {
+	mu     sync.RWMutex
+	byName map[string]reflect.Type
+	byType map[reflect.Type]string
+}
+
+func NewJSONCodec() *JSONCodec {
+	return &JSONCodec{
+		byName: make(map[string]reflect.Type),
+		byType: make(map[reflect.Type]string),
+	}
+}
+
+// Register associates a name with the concrete type of `proto`, which can be
+// a pointer or a value, events will be decoded to exactly the same type.
+func (c *JSONCodec) Register(name string, proto interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	t := reflect.TypeOf(proto)
+	c.byName[name] = t
+	c.byType[t] = name
+}
+
+func (c *JSONCodec) Encode(evt interface{}) (typeName string, data json.RawMessage, err error) {
+	c.mu.RLock()
+	typeName, ok := c.byType[reflect.TypeOf(evt)]
+	c.mu.RUnlock()
+	if !ok {
+		err = errors.Errorf("Event of type %T not registered.", evt)
+		return
+	}
+	data, err = json.Marshal(evt)
+	return
+}
+
+func (c *JSONCodec) Decode(typeName string, data json.RawMessage) (evt interface{}, err error) {
+	c.mu.RLock()
+	t, ok := c.byName[typeName]
+	c.mu.RUnlock()
+	if !ok {
+		err = errors.Errorf("Event type [%s] not registered.", typeName)
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		if err = json.Unmarshal(data, v.Interface()); err != nil {
+			return
+		}
+		evt = v.Interface()
+	} else {
+		v := reflect.New(t)
+		if err = json.Unmarshal(data, v.Interface()); err != nil {
+			return
+		}
+		evt = v.Elem().Interface()
+	}
+	return
+}
+
+// DefaultCodec is used by journals opened without a codec specified.
+var DefaultCodec = NewJSONCodec()
+
+// RegisterEventType registers an event type with the default codec.
+func RegisterEventType(name string, proto interface{}) {
+	DefaultCodec.Register(name, proto)
+}
@@ -0,0 +1,397 @@
+package isoevt
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// Journal persists events posted to an event stream, for them to survive process
+// restarts.
+type Journal interface {
+	Append(seq uint64, ts time.Time, evt interface{}) error
+
+	// Replay feeds all journaled events in posting order to the callback.
+	Replay(cb func(seq uint64, ts time.Time, evt interface{})) error
+
+	Close() error
+}
+
+// LatestReplayer is a journal able to replay only its latest events, without
+// decoding all events journaled, e.g. `FileJournal`.
+type LatestReplayer interface {
+	// ReplayLatest feeds the latest `n` journaled events in posting order to the
+	// callback.
+	ReplayLatest(n int, cb func(seq uint64, ts time.Time, evt interface{})) error
+}
+
+// ErrJournalLocked is returned by `OpenFileJournal()` if the journal directory is
+// locked by another process, which is appending to it.
+var ErrJournalLocked = errors.New("Journal locked by another process.")
+
+// SyncPolicy decides when journaled events are flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncInterval fsyncs at most once per `FileJournalOptions.SyncInterval`
+	SyncInterval SyncPolicy = iota
+	// SyncAlways fsyncs after each event appended, slow but safest
+	SyncAlways
+	// SyncNever leaves flushing to the OS
+	SyncNever
+)
+
+type FileJournalOptions struct {
+	Codec *JSONCodec // DefaultCodec if nil
+
+	Sync         SyncPolicy
+	SyncInterval time.Duration
+
+	// a new segment file is started once the current one grows beyond this size
+	SegmentSize int64
+	// oldest segment files are removed once there are more than this many, their
+	// events are dropped for good, see `FileJournal`
+	MaxSegments int
+}
+
+const (
+	DefaultSyncInterval = time.Second
+	DefaultSegmentSize  = 4 << 20
+	DefaultMaxSegments  = 8
+)
+
+// FileJournal journals events into segment files under a directory, one JSON
+// record per line. each segment file is named after the sequence number of its
+// first event.
+//
+// a journal is owned by a single process, the directory is locked exclusively
+// while it's open, so processes never append to the same segments.
+//
+// it only retains the latest `MaxSegments` segments, older events are deleted
+// without being compacted elsewhere, so a replay starts from the oldest event
+// retained rather than the first ever posted. consumers needing full state should
+// keep it elsewhere, e.g. in a db, and use the journal to catch up recent changes.
+type FileJournal struct {
+	dir  string
+	opts FileJournalOptions
+	lock *os.File // flock'ed exclusively while open
+
+	mu    sync.Mutex
+	segs  []uint64 // first seq of each segment file, ascending
+	f     *os.File // the segment file being appended to
+	size  int64    // size of the segment file being appended to
+	dirty bool     // whether unsynced writes exist
+
+	closing chan struct{}
+}
+
+type journalRecord struct {
+	Seq  uint64          `json:"seq"`
+	Ts   time.Time       `json:"ts"`
+	Type string          `json:"type"`
+	Evt  json.RawMessage `json:"evt"`
+}
+
+const segSuffix = ".seg"
+
+const lockFileName = "LOCK"
+
+func segFileName(firstSeq uint64) string {
+	return fmt.Sprintf("%020d%s", firstSeq, segSuffix)
+}
+
+// OpenFileJournal opens the journal under `dir`, creating the directory if not
+// existing yet. `ErrJournalLocked` is returned if another process has it open.
+func OpenFileJournal(dir string, opts FileJournalOptions) (*FileJournal, error) {
+	if opts.Codec == nil {
+		opts.Codec = DefaultCodec
+	}
+	if opts.SyncInterval <= 0 {
+		opts.SyncInterval = DefaultSyncInterval
+	}
+	if opts.SegmentSize <= 0 {
+		opts.SegmentSize = DefaultSegmentSize
+	}
+	if opts.MaxSegments <= 0 {
+		opts.MaxSegments = DefaultMaxSegments
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(filepath.Join(dir, lockFileName), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(lock.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		lock.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, ErrJournalLocked
+		}
+		return nil, errors.Wrapf(err, "Failed locking journal %s", dir)
+	}
+	names, err := filepath.Glob(filepath.Join(dir, "*"+segSuffix))
+	if err != nil {
+		lock.Close()
+		return nil, err
+	}
+	var segs []uint64
+	for _, name := range names {
+		firstSeq, err := strconv.ParseUint(
+			strings.TrimSuffix(filepath.Base(name), segSuffix), 10, 64)
+		if err != nil {
+			glog.Warningf("Ignoring unexpected journal file %s", name)
+			continue
+		}
+		segs = append(segs, firstSeq)
+	}
+	sort.Slice(segs, func(i, j int) bool { return segs[i] < segs[j] })
+
+	j := &FileJournal{
+		dir: dir, opts: opts, lock: lock,
+		segs:    segs,
+		closing: make(chan struct{}),
+	}
+	if opts.Sync == SyncInterval {
+		go j.syncPeriodically()
+	}
+	return j, nil
+}
+
+func (j *FileJournal) syncPeriodically() {
+	ticker := time.NewTicker(j.opts.SyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-j.closing:
+			return
+		case <-ticker.C:
+		}
+		j.mu.Lock()
+		if j.dirty && j.f != nil {
+			if err := j.f.Sync(); err != nil {
+				glog.Errorf("Failed syncing journal %s: %+v", j.dir, err)
+			}
+			j.dirty = false
+		}
+		j.mu.Unlock()
+	}
+}
+
+func (j *FileJournal) Replay(cb func(seq uint64, ts time.Time, evt interface{})) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.replayFrom(0, 0, cb)
+}
+
+// ReplayLatest reads the newest segment to find the last event, then replays from
+// the segment having the first of the latest `n` events.
+func (j *FileJournal) ReplayLatest(n int, cb func(seq uint64, ts time.Time, evt interface{})) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if len(j.segs) < 1 || n <= 0 {
+		return nil
+	}
+	var lastSeq uint64
+	if err := j.replaySeg(j.segs[len(j.segs)-1], true, 0,
+		func(seq uint64, ts time.Time, evt interface{}) {
+			lastSeq = seq
+		}); err != nil {
+		return err
+	}
+	if lastSeq < uint64(n) {
+		return j.replayFrom(0, 0, cb)
+	}
+	fromSeq := lastSeq - uint64(n) + 1
+	// seqs are consecutive across segments, named after their first ones
+	fromSeg := 0
+	for i, firstSeq := range j.segs {
+		if firstSeq <= fromSeq {
+			fromSeg = i
+		}
+	}
+	return j.replayFrom(fromSeg, fromSeq, cb)
+}
+
+// should be called with `j.mu` locked.
+func (j *FileJournal) replayFrom(
+	fromSeg int, fromSeq uint64,
+	cb func(seq uint64, ts time.Time, evt interface{}),
+) error {
+	for i := fromSeg; i < len(j.segs); i++ {
+		lastSeg := i == len(j.segs)-1
+		if err := j.replaySeg(j.segs[i], lastSeg, fromSeq, cb); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// replay events of a segment with seqs not less than `fromSeq`
+func (j *FileJournal) replaySeg(
+	firstSeq uint64, lastSeg bool, fromSeq uint64,
+	cb func(seq uint64, ts time.Time, evt interface{}),
+) error {
+	segPath := filepath.Join(j.dir, segFileName(firstSeq))
+	f, err := os.Open(segPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var goodSize int64
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return nil
+		}
+		var rec journalRecord
+		if err == nil {
+			err = json.Unmarshal(bytes.TrimSpace(line), &rec)
+		}
+		if err != nil {
+			if lastSeg {
+				// a partial record at the very end, left by a crash while appending,
+				// cut it off so further appends start from a clean line.
+				glog.Warningf("Truncating journal %s at %d due to broken record: %+v",
+					segPath, goodSize, err)
+				return os.Truncate(segPath, goodSize)
+			}
+			return errors.Wrapf(err, "Broken record in journal %s at %d", segPath, goodSize)
+		}
+		goodSize += int64(len(line))
+		if rec.Seq < fromSeq {
+			continue
+		}
+		evt, err := j.opts.Codec.Decode(rec.Type, rec.Evt)
+		if err != nil {
+			return errors.Wrapf(err, "Undecodable event #%d in journal %s", rec.Seq, segPath)
+		}
+		cb(rec.Seq, rec.Ts, evt)
+	}
+}
+
+func (j *FileJournal) Append(seq uint64, ts time.Time, evt interface{}) error {
+	typeName, data, err := j.opts.Codec.Encode(evt)
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(journalRecord{
+		Seq: seq, Ts: ts, Type: typeName, Evt: data,
+	})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.f == nil || j.size >= j.opts.SegmentSize {
+		if err = j.rotate(seq); err != nil {
+			return err
+		}
+	}
+	n, err := j.f.Write(line)
+	j.size += int64(n)
+	if err != nil {
+		return err
+	}
+	if j.opts.Sync == SyncAlways {
+		return j.f.Sync()
+	}
+	j.dirty = true
+	return nil
+}
+
+// continue appending to the last segment file if it has room, or start a new one
+// with `seq` being its first event. should be called with `j.mu` locked.
+func (j *FileJournal) rotate(seq uint64) error {
+	if j.f == nil && len(j.segs) > 0 {
+		// reopen the last segment after process restart
+		lastPath := filepath.Join(j.dir, segFileName(j.segs[len(j.segs)-1]))
+		if fi, err := os.Stat(lastPath); err == nil && fi.Size() < j.opts.SegmentSize {
+			f, err := os.OpenFile(lastPath, os.O_WRONLY|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			j.f, j.size = f, fi.Size()
+			return nil
+		}
+	}
+
+	if j.f != nil {
+		if err := j.f.Sync(); err != nil {
+			return err
+		}
+		if err := j.f.Close(); err != nil {
+			return err
+		}
+		j.f, j.size, j.dirty = nil, 0, false
+	}
+	f, err := os.OpenFile(filepath.Join(j.dir, segFileName(seq)),
+		os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	j.f = f
+	j.segs = append(j.segs, seq)
+
+	j.enforceRetention()
+	return nil
+}
+
+// delete oldest segment files beyond the configured count, with events in them
+// lost. should be called with `j.mu` locked.
+func (j *FileJournal) enforceRetention() {
+	for len(j.segs) > j.opts.MaxSegments {
+		segPath := filepath.Join(j.dir, segFileName(j.segs[0]))
+		if err := os.Remove(segPath); err != nil && !os.IsNotExist(err) {
+			glog.Errorf("Failed removing journal segment %s: %+v", segPath, err)
+			return
+		}
+		j.segs = j.segs[1:]
+	}
+}
+
+func (j *FileJournal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	select {
+	case <-j.closing:
+		return nil // already closed
+	default:
+	}
+	close(j.closing)
+
+	var err error
+	if j.f != nil {
+		err = j.f.Sync()
+		if e := j.f.Close(); err == nil {
+			err = e
+		}
+		j.f = nil
+	}
+	// closing the file releases the flock
+	if e := j.lock.Close(); err == nil {
+		err = e
+	}
+	return err
+}
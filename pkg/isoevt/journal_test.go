@@ -0,0 +1,103 @@
+package isoevt
+
+import (
+	"testing"
+	"time"
+)
+
+type journaledNum struct {
+	N int
+}
+
+func init() {
+	RegisterEventType("isoevt.journaledNum", journaledNum{})
+}
+
+func openJournal(t *testing.T, dir string) *FileJournal {
+	// small segments, a few events each
+	j, err := OpenFileJournal(dir, FileJournalOptions{SegmentSize: 64, MaxSegments: 100})
+	if err != nil {
+		t.Fatalf("Journal not opened: %+v", err)
+	}
+	return j
+}
+
+func TestJournaledStreamContinues(t *testing.T) {
+	dir := t.TempDir()
+
+	es, err := NewJournaledStream(openJournal(t, dir), 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := 1; n <= 20; n++ {
+		es.Post(journaledNum{n})
+	}
+	if err := es.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	es, err = NewJournaledStream(openJournal(t, dir), 5, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer es.Close()
+	if seq := es.Seq(); seq != 20 {
+		t.Fatalf("Continued from #%d instead of #20", seq)
+	}
+	retained := es.Retained()
+	if len(retained) != 5 {
+		t.Fatalf("%d events retained instead of 5", len(retained))
+	}
+	for i, evt := range retained {
+		if evt != (journaledNum{16 + i}) {
+			t.Fatalf("Retained %+v at %d", evt, i)
+		}
+	}
+	if seq := es.Post(journaledNum{21}); seq != 21 {
+		t.Fatalf("Posted as #%d after restarted", seq)
+	}
+}
+
+func TestReplayLatest(t *testing.T) {
+	j := openJournal(t, t.TempDir())
+	defer j.Close()
+	now := time.Now()
+	for seq := uint64(1); seq <= 30; seq++ {
+		if err := j.Append(seq, now, journaledNum{int(seq)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(j.segs) < 3 {
+		t.Fatalf("Only %d segments", len(j.segs))
+	}
+
+	for _, n := range []int{1, 7, 30, 50} {
+		var seqs []uint64
+		if err := j.ReplayLatest(n, func(seq uint64, ts time.Time, evt interface{}) {
+			if evt != (journaledNum{int(seq)}) {
+				t.Fatalf("Event #%d replayed as %+v", seq, evt)
+			}
+			seqs = append(seqs, seq)
+		}); err != nil {
+			t.Fatal(err)
+		}
+		want := n
+		if want > 30 {
+			want = 30
+		}
+		if len(seqs) != want || seqs[0] != uint64(30-want+1) || seqs[len(seqs)-1] != 30 {
+			t.Fatalf("Latest %d replayed as %v", n, seqs)
+		}
+	}
+}
+
+func TestJournalLocked(t *testing.T) {
+	dir := t.TempDir()
+	j := openJournal(t, dir)
+	if _, err := OpenFileJournal(dir, FileJournalOptions{}); err != ErrJournalLocked {
+		t.Fatalf("Opened again while open: %v", err)
+	}
+	j.Close()
+	j = openJournal(t, dir)
+	j.Close()
+}
@@ -0,0 +1,144 @@
+package isoevt
+
+import (
+	"context"
+	"expvar"
+	"sync/atomic"
+)
+
+// LagAction decides what happens to a watcher lagging too far behind the posters.
+type LagAction int
+
+const (
+	// LagIgnore lets watchers lag arbitrarily, all pending events are kept in memory
+	LagIgnore LagAction = iota
+	// LagResync skips all pending events of a lagging watcher, delivering it a
+	// synthetic event made by `LagPolicy.Resync` instead
+	LagResync
+	// LagBlock blocks posters until the slowest watcher catches up, a watcher should
+	// never post to the stream it's watching under this policy, or it'll deadlock
+	LagBlock
+	// LagDisconnect stops a lagging watcher
+	LagDisconnect
+)
+
+// LagPolicy applies to watchers with more than `MaxLag` events pending delivery.
+type LagPolicy struct {
+	MaxLag uint64 // 0 disables the policy
+	Action LagAction
+
+	// Resync is called from the watching goroutine with the current tail event,
+	// to make the synthetic event to be delivered for `LagResync`. pending events
+	// are skipped silently if it's nil, and a panic from it stops the watcher.
+	Resync func(tailEvt interface{}) interface{}
+}
+
+// SetLagPolicy changes the lag policy of the stream, effective for existing
+// watchers as well.
+func (es *EventStream) SetLagPolicy(policy LagPolicy) {
+	es.lagPolicy.Store(policy)
+}
+
+func (es *EventStream) LagPolicy() LagPolicy {
+	if policy, ok := es.lagPolicy.Load().(LagPolicy); ok {
+		return policy
+	}
+	return LagPolicy{}
+}
+
+type watcher struct {
+	id   uint64
+	name string
+
+	delivered uint64 // seq of last event delivered, accessed atomically
+}
+
+func (w *watcher) lag(seq uint64) uint64 {
+	if delivered := atomic.LoadUint64(&w.delivered); seq > delivered {
+		return seq - delivered
+	}
+	return 0
+}
+
+func (es *EventStream) newWatcher(ctx context.Context) *watcher {
+	w := &watcher{
+		id: atomic.AddUint64(&es.lastWatcherID, 1),
+	}
+	if name, ok := ctx.Value(watcherNameKey{}).(string); ok {
+		w.name = name
+	}
+	return w
+}
+
+type watcherNameKey struct{}
+
+// WithWatcherName derives a context to name watchers started with it, the name
+// shows up in lag reports and logs.
+func WithWatcherName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, watcherNameKey{}, name)
+}
+
+// WatcherLag reports how far a watcher is behind the stream.
+type WatcherLag struct {
+	ID   uint64 `json:"id"`
+	Name string `json:"name,omitempty"`
+	Lag  uint64 `json:"lag"`
+}
+
+// Lags reports the lag of each live watcher of the stream.
+func (es *EventStream) Lags() []WatcherLag {
+	es.cnd.L.Lock()
+	defer es.cnd.L.Unlock()
+
+	seq := atomic.LoadUint64(&es.seq)
+	lags := make([]WatcherLag, 0, len(es.watchers))
+	for w := range es.watchers {
+		lags = append(lags, WatcherLag{ID: w.id, Name: w.name, Lag: w.lag(seq)})
+	}
+	return lags
+}
+
+// MaxLag returns the lag of the slowest watcher of the stream.
+func (es *EventStream) MaxLag() uint64 {
+	es.cnd.L.Lock()
+	defer es.cnd.L.Unlock()
+	return es.maxLag()
+}
+
+// should be called with `es.cnd.L` locked.
+func (es *EventStream) maxLag() (maxLag uint64) {
+	seq := atomic.LoadUint64(&es.seq)
+	for w := range es.watchers {
+		if lag := w.lag(seq); lag > maxLag {
+			maxLag = lag
+		}
+	}
+	return
+}
+
+// all published streams, visible at `/debug/vars` of a process serving expvar,
+// i.e. the web backend, or a service process started with `-debug-http`
+var streamsVar = expvar.NewMap("isoevt")
+
+// Publish exports the stream's lag gauges by name via expvar, a stream published
+// later with the same name replaces the former. the gauges are of the process
+// the stream lives in, e.g. collections are watched in routes or drivers service
+// processes, unless the backend runs in monolith mode.
+func (es *EventStream) Publish(name string) {
+	streamsVar.Set(name, expvar.Func(func() interface{} {
+		es.cnd.L.Lock()
+		retained := es.retained
+		es.cnd.L.Unlock()
+		return map[string]interface{}{
+			"seq":      atomic.LoadUint64(&es.seq),
+			"retained": retained,
+			"maxLag":   es.MaxLag(),
+			"watchers": es.Lags(),
+		}
+	}))
+}
+
+// Unpublish removes the stream's gauges published by name.
+func (es *EventStream) Unpublish(name string) {
+	streamsVar.Delete(name)
+}
@@ -0,0 +1,115 @@
+package isoevt
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// a watcher stuck at the first event until released, posts made meanwhile pile up
+type slowWatcher struct {
+	entered, release chan struct{}
+	ch               chan seqEvt
+	w                *Watching
+}
+
+func watchSlowly(t *testing.T, es *EventStream) *slowWatcher {
+	sw := &slowWatcher{
+		entered: make(chan struct{}), release: make(chan struct{}),
+		ch: make(chan seqEvt, 100),
+	}
+	sw.w = es.WatchFromContext(context.Background(), 1, func(seq uint64, evt interface{}) bool {
+		if seq == 1 {
+			close(sw.entered)
+			<-sw.release
+		}
+		sw.ch <- seqEvt{seq, evt}
+		return false
+	}, nil)
+	es.Post(1)
+	select {
+	case <-sw.entered:
+	case <-time.After(waitTimeout):
+		t.Fatal("First event not delivered")
+	}
+	return sw
+}
+
+func laggedStream(t *testing.T, policy LagPolicy) (*EventStream, *slowWatcher) {
+	es := NewRetainingStream(100, 0)
+	es.SetLagPolicy(policy)
+	sw := watchSlowly(t, es)
+	postNums(es, 2, 10)
+	if lag := sw.w.Lag(); lag != 10 {
+		t.Fatalf("Lagging %d events instead of 10", lag)
+	}
+	close(sw.release)
+	return es, sw
+}
+
+func TestLagIgnore(t *testing.T) {
+	_, sw := laggedStream(t, LagPolicy{MaxLag: 3, Action: LagIgnore})
+	expectSeqs(t, sw.ch, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10)
+}
+
+func TestLagResync(t *testing.T) {
+	es, sw := laggedStream(t, LagPolicy{MaxLag: 3, Action: LagResync,
+		Resync: func(tailEvt interface{}) interface{} {
+			return fmt.Sprintf("resync@%v", tailEvt)
+		}})
+	expectSeqs(t, sw.ch, 1)
+	select {
+	case se := <-sw.ch:
+		if se.seq != 10 || se.evt != "resync@10" {
+			t.Fatalf("Got #%d %v instead of resync'ed", se.seq, se.evt)
+		}
+	case <-time.After(waitTimeout):
+		t.Fatal("Not resync'ed")
+	}
+	postNums(es, 11, 12)
+	expectSeqs(t, sw.ch, 11, 12)
+
+	// pending events skipped silently without a resync func
+	es, sw = laggedStream(t, LagPolicy{MaxLag: 3, Action: LagResync})
+	expectSeqs(t, sw.ch, 1)
+	postNums(es, 11, 11)
+	expectSeqs(t, sw.ch, 11)
+}
+
+func TestLagBlock(t *testing.T) {
+	es := NewRetainingStream(100, 0)
+	es.SetLagPolicy(LagPolicy{MaxLag: 3, Action: LagBlock})
+	sw := watchSlowly(t, es)
+
+	posted := make(chan struct{})
+	go func() {
+		defer close(posted)
+		postNums(es, 2, 5)
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if seq := es.Seq(); seq != 3 {
+		t.Fatalf("Posted up to #%d with the watcher stuck", seq)
+	}
+	close(sw.release)
+	select {
+	case <-posted:
+	case <-time.After(waitTimeout):
+		t.Fatal("Posting still blocked after the watcher caught up")
+	}
+	expectSeqs(t, sw.ch, 1, 2, 3, 4, 5)
+}
+
+func TestLagDisconnect(t *testing.T) {
+	es, sw := laggedStream(t, LagPolicy{MaxLag: 3, Action: LagDisconnect})
+	expectSeqs(t, sw.ch, 1)
+	waitDone(t, sw.w, "lagging")
+	if n := es.Watchers(); n != 0 {
+		t.Fatalf("%d watchers after disconnected", n)
+	}
+	select {
+	case se := <-sw.ch:
+		t.Fatalf("Event #%d delivered after disconnected", se.seq)
+	default:
+	}
+}
@@ -2,35 +2,211 @@
 package isoevt
 
 import (
+	"context"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
 
 	"github.com/complyue/hbigo/pkg/errors"
 	"github.com/golang/glog"
 )
 
+// NewStream creates an event stream retaining no event beyond its present tail,
+// so only events posted after a watcher started can be delivered to it.
 func NewStream() *EventStream {
+	return NewRetainingStream(0, 0)
+}
+
+// NewRetainingStream creates an event stream retaining at most `maxCount` recent
+// events, and/or events posted no earlier than `maxAge` ago, for watchers to replay
+// from a known sequence number with `WatchFrom()`. a non-positive value disables
+// the respective limit, while with both disabled only the tail event is retained.
+func NewRetainingStream(maxCount int, maxAge time.Duration) *EventStream {
 	return &EventStream{
-		cnd: sync.NewCond(new(sync.Mutex)),
+		cnd:      sync.NewCond(new(sync.Mutex)),
+		maxCount: maxCount,
+		maxAge:   maxAge,
+	}
+}
+
+// NewJournaledStream creates a retaining event stream with all events journaled,
+// events already in the journal are replayed into the stream before it's returned,
+// so the sequence numbering continues and retained events remain watchable across
+// process restarts. with `maxCount` positive, and the journal a `LatestReplayer`,
+// only the latest `maxCount` events are replayed.
+func NewJournaledStream(j Journal, maxCount int, maxAge time.Duration) (*EventStream, error) {
+	es := NewRetainingStream(maxCount, maxAge)
+	now := time.Now()
+	replay := j.Replay
+	if lr, ok := j.(LatestReplayer); ok && maxCount > 0 {
+		replay = func(cb func(seq uint64, ts time.Time, evt interface{})) error {
+			return lr.ReplayLatest(maxCount, cb)
+		}
+	}
+	if err := replay(func(seq uint64, ts time.Time, evt interface{}) {
+		node := &evtNode{
+			seq: seq,
+			ts:  ts,
+			evt: evt,
+		}
+		if es.tail != nil {
+			es.tail.setNext(node)
+		} else {
+			es.head = node
+		}
+		es.tail = node
+		es.retained++
+		atomic.StoreUint64(&es.seq, seq)
+		es.trim(now)
+	}); err != nil {
+		return nil, err
 	}
+	es.journal = j
+	return es, nil
 }
 
 type EventStream struct {
-	cnd  *sync.Cond
-	tail *evtNode
+	cnd *sync.Cond
+
+	// sequence number of the last posted event, 0 before any post.
+	// only changed with `cnd.L` locked, but watchers load it atomically.
+	seq uint64
+
+	head, tail *evtNode // oldest retained event and latest posted event
+	retained   int      // number of events from head to tail
+
+	// watchers started before anything posted, and not reached the first event yet,
+	// nothing is trimmed meanwhile
+	awaitingFirst int
+
+	maxCount int
+	maxAge   time.Duration
+
+	lastWatcherID uint64
+	watchers      map[*watcher]struct{} // live watching goroutines
+	lagPolicy     atomic.Value          // of LagPolicy
+
+	journal Journal // nil if not journaled
 }
 
-func (es *EventStream) Post(evt interface{}) {
+// Post appends an event to the stream, assigning it the next sequence number.
+func (es *EventStream) Post(evt interface{}) (seq uint64) {
 	es.cnd.L.Lock()
 	defer es.cnd.L.Unlock()
+	if policy := es.LagPolicy(); policy.Action == LagBlock && policy.MaxLag > 0 {
+		// wait the slowest watcher to catch up
+		for es.maxLag() >= policy.MaxLag {
+			es.cnd.Wait()
+		}
+	}
+	seq = atomic.AddUint64(&es.seq, 1)
 	newTail := &evtNode{
+		seq: seq,
+		ts:  time.Now(),
 		evt: evt,
 	}
 	if es.tail != nil {
-		es.tail.next = newTail
+		es.tail.setNext(newTail)
+	} else {
+		es.head = newTail
+	}
+	if es.journal != nil {
+		// a journaling failure should not break live delivery, log and go on
+		if err := es.journal.Append(seq, newTail.ts, evt); err != nil {
+			glog.Errorf("Failed journaling event #%d: %+v", seq, errors.RichError(err))
+		}
 	}
 	es.tail = newTail
+	es.retained++
+	es.trim(newTail.ts)
 	es.cnd.Broadcast()
+	return
+}
+
+// drop events out of the retention window from head, the tail is always kept.
+// should be called with `es.cnd.L` locked.
+func (es *EventStream) trim(now time.Time) {
+	if es.awaitingFirst > 0 {
+		return
+	}
+	for es.head != es.tail {
+		overCount := (es.maxCount <= 0 && es.maxAge <= 0) ||
+			(es.maxCount > 0 && es.retained > es.maxCount)
+		overAge := es.maxAge > 0 && now.Sub(es.head.ts) > es.maxAge
+		if !overCount && !overAge {
+			break
+		}
+		es.head = es.head.getNext()
+		es.retained--
+	}
+}
+
+// Seq returns the sequence number of the last posted event, 0 if nothing posted yet.
+func (es *EventStream) Seq() uint64 {
+	es.cnd.L.Lock()
+	defer es.cnd.L.Unlock()
+	return es.seq
+}
+
+// Tail returns the last posted event with its sequence number, the event is nil
+// if nothing posted yet.
+func (es *EventStream) Tail() (seq uint64, evt interface{}) {
+	es.cnd.L.Lock()
+	defer es.cnd.L.Unlock()
+	if es.tail == nil {
+		return 0, nil
+	}
+	return es.tail.seq, es.tail.evt
+}
+
+// OldestSeq returns the sequence number of the oldest event still retained,
+// 0 if nothing posted yet. `WatchFrom()` a sequence number older than this will
+// miss some events.
+func (es *EventStream) OldestSeq() uint64 {
+	es.cnd.L.Lock()
+	defer es.cnd.L.Unlock()
+	if es.head == nil {
+		return 0
+	}
+	return es.head.seq
+}
+
+// Retained returns the events still retained, oldest first.
+func (es *EventStream) Retained() (events []interface{}) {
+	es.cnd.L.Lock()
+	defer es.cnd.L.Unlock()
+	if es.head == nil {
+		return nil
+	}
+	events = make([]interface{}, 0, es.retained)
+	for node := es.head; ; node = node.getNext() {
+		events = append(events, node.evt)
+		if node == es.tail {
+			return
+		}
+	}
+}
+
+// Close closes the journal of the stream if any, events posted afterwards are not
+// journaled.
+func (es *EventStream) Close() error {
+	es.cnd.L.Lock()
+	defer es.cnd.L.Unlock()
+	if es.journal == nil {
+		return nil
+	}
+	err := es.journal.Close()
+	es.journal = nil
+	return err
+}
+
+// Watchers returns the number of live watching goroutines of the stream.
+func (es *EventStream) Watchers() int {
+	es.cnd.L.Lock()
+	defer es.cnd.L.Unlock()
+	return len(es.watchers)
 }
 
 // unless the event stream is guaranteed to be ever received through a channel,
@@ -48,73 +224,310 @@ func (es *EventStream) Watch(
 	evtCallback func(evt interface{}) (stop bool),
 	watchingCallback func() (stop bool),
 ) {
+	// don't distribute present tail event, it's considered obsoleted,
+	// should distribute the 1st event appeared after watching started
+	es.watch(context.Background(), es.newWatcher(context.Background()), nil,
+		func() uint64 { return es.seq + 1 },
+		func(seq uint64, evt interface{}) bool {
+			return evtCallback(evt)
+		}, watchingCallback)
+}
+
+// WatchFrom is like `Watch()`, but replays retained events with sequence number
+// equal to or greater than `fromSeq` before switching to live delivery.
+// if events from `fromSeq` have been dropped out of the retention window, replay
+// starts from the oldest retained event, the watcher can tell such a gap by the
+// sequence number passed to `evtCallback`.
+func (es *EventStream) WatchFrom(
+	fromSeq uint64,
+	evtCallback func(seq uint64, evt interface{}) (stop bool),
+	watchingCallback func() (stop bool),
+) {
+	es.watch(context.Background(), es.newWatcher(context.Background()), nil,
+		func() uint64 { return fromSeq },
+		evtCallback, watchingCallback)
+}
+
+// Watching is the handle to a watching goroutine started with a context.
+type Watching struct {
+	es     *EventStream
+	w      *watcher
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// ID identifies the watching within its event stream, as reported by `Lags()`.
+func (w *Watching) ID() uint64 {
+	return w.w.id
+}
+
+// Lag returns the number of events posted but not yet delivered to the watcher.
+func (w *Watching) Lag() uint64 {
+	return w.w.lag(atomic.LoadUint64(&w.es.seq))
+}
+
+// Stop cancels the watching, a watching goroutine parked waiting for events will
+// wake up and exit immediately, while one busy in a callback will exit after the
+// callback returned.
+func (w *Watching) Stop() {
+	w.cancel()
+}
+
+// Done returns a channel closed after the watching goroutine exited.
+func (w *Watching) Done() <-chan struct{} {
+	return w.done
+}
+
+// WatchContext is like `Watch()`, but the watching stops as soon as `ctx` is done
+// or the returned handle is stopped, even if no more event ever comes.
+func (es *EventStream) WatchContext(
+	ctx context.Context,
+	evtCallback func(evt interface{}) (stop bool),
+	watchingCallback func() (stop bool),
+) *Watching {
+	return es.watchContext(ctx, func() uint64 { return es.seq + 1 },
+		func(seq uint64, evt interface{}) bool {
+			return evtCallback(evt)
+		}, watchingCallback)
+}
+
+// WatchFromContext is like `WatchFrom()`, with cancellation as `WatchContext()`.
+func (es *EventStream) WatchFromContext(
+	ctx context.Context, fromSeq uint64,
+	evtCallback func(seq uint64, evt interface{}) (stop bool),
+	watchingCallback func() (stop bool),
+) *Watching {
+	return es.watchContext(ctx, func() uint64 { return fromSeq },
+		evtCallback, watchingCallback)
+}
+
+func (es *EventStream) watchContext(
+	ctx context.Context, fromSeq func() uint64,
+	evtCallback func(seq uint64, evt interface{}) (stop bool),
+	watchingCallback func() (stop bool),
+) *Watching {
+	ctx, cancel := context.WithCancel(ctx)
+	w := &Watching{
+		es: es, w: es.newWatcher(ctx),
+		cancel: cancel, done: make(chan struct{}),
+	}
 	go func() {
-		var knownTail, nextEvt *evtNode
+		// wake up the watching goro, in case it's parked waiting for events
+		select {
+		case <-ctx.Done():
+			es.cnd.L.Lock()
+			es.cnd.Broadcast()
+			es.cnd.L.Unlock()
+		case <-w.done:
+			cancel() // release the context once the watching goro exited anyway
+		}
+	}()
+	es.watch(ctx, w.w, w.done, fromSeq, evtCallback, watchingCallback)
+	return w
+}
 
-		// wait until got non-nil tail
-		es.cnd.L.Lock()
+// locate the first retained event with sequence number not less than `fromSeq`.
+// should be called with `es.cnd.L` locked.
+func (es *EventStream) seek(fromSeq uint64) *evtNode {
+	for n := es.head; n != nil; n = n.getNext() {
+		if n.seq >= fromSeq {
+			return n
+		}
+	}
+	return nil
+}
+
+func (es *EventStream) watch(
+	ctx context.Context,
+	w *watcher,
+	done chan struct{}, // closed upon exit if not nil
+	fromSeq func() uint64, // evaluated with `es.cnd.L` locked
+	evtCallback func(seq uint64, evt interface{}) (stop bool),
+	watchingCallback func() (stop bool),
+) {
+	var knownTail, nextEvt *evtNode
+
+	// the watcher is registered and positioned before returning, so an event posted
+	// right after, e.g. in reaction to the watching, is not missed by it
+	es.cnd.L.Lock()
+	startSeq := fromSeq()
+	// nothing before the starting event is considered pending for this watcher
+	if startSeq > 0 {
+		atomic.StoreUint64(&w.delivered, startSeq-1)
+	}
+	if es.watchers == nil {
+		es.watchers = make(map[*watcher]struct{})
+	}
+	es.watchers[w] = struct{}{}
+	awaitingFirst := es.tail == nil
+	if awaitingFirst {
+		// nothing posted yet, keep the first event from being trimmed until this
+		// watcher reached it
+		es.awaitingFirst++
+	} else if nextEvt = es.seek(startSeq); nextEvt == nil {
+		// the starting event not posted yet, follow the chain from present tail,
+		// so no event is missed even it's trimmed off before we wake up.
 		knownTail = es.tail
-		if knownTail != nil {
-			// don't distribute present tail event, it's considered obsoleted
-			nextEvt = knownTail.next
-		} else {
-			// should distribute the 1st event appeared after watching started
-			for ; nextEvt == nil; nextEvt = es.tail {
-				es.cnd.Wait()
+	}
+	es.cnd.L.Unlock()
+
+	go es.dispatch(ctx, w, done, startSeq, awaitingFirst, knownTail, nextEvt,
+		evtCallback, watchingCallback)
+}
+
+// the watching goroutine
+func (es *EventStream) dispatch(
+	ctx context.Context,
+	w *watcher,
+	done chan struct{},
+	startSeq uint64, awaitingFirst bool, knownTail, nextEvt *evtNode,
+	evtCallback func(seq uint64, evt interface{}) (stop bool),
+	watchingCallback func() (stop bool),
+) {
+	// `runtime.Goexit()` runs deferred calls as well
+	defer func() {
+		es.cnd.L.Lock()
+		delete(es.watchers, w)
+		es.cnd.Broadcast() // posters may be blocked waiting for this watcher
+		es.cnd.L.Unlock()
+		if done != nil {
+			close(done)
+		}
+	}()
+
+	if awaitingFirst {
+		es.cnd.L.Lock()
+		// wait until got non-nil tail
+		for es.tail == nil && ctx.Err() == nil {
+			es.cnd.Wait()
+		}
+		es.awaitingFirst--
+		if es.tail != nil {
+			if nextEvt = es.seek(startSeq); nextEvt == nil {
+				knownTail = es.tail
 			}
 		}
 		es.cnd.L.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+	}
 
-		if watchingCallback != nil {
-			// signal watching started.
-			func() {
-				defer func() {
-					if err := recover(); err != nil {
-						// the watching cb opt to stop watching by panic
-						glog.Errorf("Event watching cancelled due to callback error: %+v\n", errors.RichError(err))
-						runtime.Goexit()
-					}
-				}()
-				if stop := watchingCallback(); stop {
-					// watching cb opt to stop watching
+	if watchingCallback != nil {
+		// signal watching started.
+		func() {
+			defer func() {
+				if err := recover(); err != nil {
+					// the watching cb opt to stop watching by panic
+					glog.Errorf("Event watching cancelled due to callback error: %+v\n", errors.RichError(err))
 					runtime.Goexit()
 				}
 			}()
+			if stop := watchingCallback(); stop {
+				// watching cb opt to stop watching
+				runtime.Goexit()
+			}
+		}()
+	}
+
+	deliver := func(seq uint64, evt interface{}) {
+		defer func() { // catch watcher failure and stop
+			if err := recover(); err != nil {
+				// the watcher cb opt to stop watching by panic
+				glog.Errorf("Event watching stopped due to callback error: %+v\n", errors.RichError(err))
+				runtime.Goexit()
+			}
+		}()
+		// the watcher cb can panic to stop watching, process crashing is hereby prevented for it
+		if stop := evtCallback(seq, evt); stop {
+			// the watcher cb opt to stop watching by return value
+			runtime.Goexit()
 		}
+		atomic.StoreUint64(&w.delivered, seq)
+	}
+
+	// make the synthetic event for a lagging watcher, a failing `Resync` stops the
+	// watching like a failing watcher cb does
+	resync := func(policy LagPolicy, tailEvt interface{}) interface{} {
+		defer func() {
+			if err := recover(); err != nil {
+				glog.Errorf("Event watching stopped due to resync error: %+v\n", errors.RichError(err))
+				runtime.Goexit()
+			}
+		}()
+		return policy.Resync(tailEvt)
+	}
 
-		for { // continue dispatching until finished or failed
-			for nextEvt != nil { // loop through cached list without sync
-				func() {
-					defer func() { // catch watcher failure and stop
-						if err := recover(); err != nil {
-							// the watcher cb opt to stop watching by panic
-							glog.Errorf("Event watching stopped due to callback error: %+v\n", errors.RichError(err))
-							runtime.Goexit()
+	for { // continue dispatching until finished or failed
+		for nextEvt != nil { // loop through cached list without sync
+			if ctx.Err() != nil {
+				return
+			}
+			if nextEvt.seq < startSeq { // not reached the starting event yet
+				knownTail, nextEvt = nextEvt, nextEvt.getNext()
+				continue
+			}
+			policy := es.LagPolicy()
+			if policy.MaxLag > 0 {
+				if lag := atomic.LoadUint64(&es.seq) - (nextEvt.seq - 1); lag > policy.MaxLag {
+					switch policy.Action {
+					case LagDisconnect:
+						glog.Warningf("Disconnecting watcher #%d [%s] lagging %d events behind.",
+							w.id, w.name, lag)
+						return
+					case LagResync:
+						es.cnd.L.Lock()
+						tail := es.tail
+						es.cnd.L.Unlock()
+						glog.Warningf("Resync'ing watcher #%d [%s] lagging %d events behind.",
+							w.id, w.name, lag)
+						// skip all pending events, they'll be garbage collected
+						if policy.Resync != nil {
+							deliver(tail.seq, resync(policy, tail.evt))
+						} else {
+							// nothing to tell the watcher what's skipped
+							atomic.StoreUint64(&w.delivered, tail.seq)
 						}
-					}()
-					// the watcher cb can panic to stop watching, process crashing is hereby prevented for it
-					if stop := evtCallback(nextEvt.evt); stop {
-						// the watcher cb opt to stop watching by return value
-						runtime.Goexit()
+						knownTail, nextEvt = tail, tail.getNext()
+						continue
 					}
-				}()
-				// `nextEvt.next` may be cached value, but is always valid, even without sync.
-				// atomic pointer loading required here though, but not a problem until more
-				// architectures beyond x64 to be supported.
-				knownTail, nextEvt = nextEvt, nextEvt.next
+				}
 			}
-			es.cnd.L.Lock()
-			nextEvt = knownTail.next // read again after sync-ed
-			if nextEvt == nil {
-				es.cnd.Wait() // really need to wait
+			deliver(nextEvt.seq, nextEvt.evt)
+			if policy.Action == LagBlock {
+				// wake up posters waiting for lagging watchers to catch up
+				es.cnd.L.Lock()
+				es.cnd.Broadcast()
+				es.cnd.L.Unlock()
 			}
-			es.cnd.L.Unlock()
+			// `nextEvt.next` may be nil while a post is linking it, the chain is read
+			// again after sync-ed then.
+			knownTail, nextEvt = nextEvt, nextEvt.getNext()
 		}
-	}()
+		es.cnd.L.Lock()
+		nextEvt = knownTail.getNext() // read again after sync-ed
+		if nextEvt == nil && ctx.Err() == nil {
+			es.cnd.Wait() // really need to wait
+		}
+		es.cnd.L.Unlock()
+		if ctx.Err() != nil {
+			return
+		}
+	}
 }
 
 type evtNode struct {
+	seq uint64
+	ts  time.Time
 	evt interface{}
 
-	next *evtNode
+	next unsafe.Pointer // *evtNode, loaded atomically as watchers follow the chain without sync
+}
+
+func (n *evtNode) getNext() *evtNode {
+	return (*evtNode)(atomic.LoadPointer(&n.next))
+}
+
+func (n *evtNode) setNext(next *evtNode) {
+	atomic.StorePointer(&n.next, unsafe.Pointer(next))
 }
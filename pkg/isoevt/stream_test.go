@@ -0,0 +1,170 @@
+package isoevt
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// how long to wait for events to arrive at a watcher
+const waitTimeout = 10 * time.Second
+
+type seqEvt struct {
+	seq uint64
+	evt interface{}
+}
+
+// watch from `fromSeq` with events relayed through the returned channel
+func watchFrom(es *EventStream, fromSeq uint64) <-chan seqEvt {
+	ch := make(chan seqEvt, 100)
+	es.WatchFrom(fromSeq, func(seq uint64, evt interface{}) bool {
+		ch <- seqEvt{seq, evt}
+		return false
+	}, nil)
+	return ch
+}
+
+func expectSeqs(t *testing.T, ch <-chan seqEvt, seqs ...uint64) {
+	for _, seq := range seqs {
+		select {
+		case se := <-ch:
+			if se.seq != seq || se.evt != int(seq) {
+				t.Fatalf("Got #%d %v instead of #%d", se.seq, se.evt, seq)
+			}
+		case <-time.After(waitTimeout):
+			t.Fatalf("Event #%d not delivered", seq)
+		}
+	}
+}
+
+func postNums(es *EventStream, from, to int) {
+	for n := from; n <= to; n++ {
+		if seq := es.Post(n); seq != uint64(n) {
+			panic("unexpected seq")
+		}
+	}
+}
+
+func TestSeqAndRetention(t *testing.T) {
+	es := NewRetainingStream(3, 0)
+	if seq, evt := es.Tail(); seq != 0 || evt != nil || es.Seq() != 0 || es.OldestSeq() != 0 {
+		t.Fatalf("Empty stream at #%d %v", seq, evt)
+	}
+	for n := 1; n <= 5; n++ {
+		if seq := es.Post(n); seq != uint64(n) {
+			t.Fatalf("Posted #%d as #%d", n, seq)
+		}
+	}
+	if seq, evt := es.Tail(); seq != 5 || evt != 5 || es.Seq() != 5 {
+		t.Fatalf("Tail at #%d %v", seq, evt)
+	}
+	if oldest := es.OldestSeq(); oldest != 3 {
+		t.Fatalf("Oldest retained #%d instead of #3", oldest)
+	}
+
+	// only the tail is retained without limits
+	es = NewStream()
+	postNums(es, 1, 3)
+	if oldest := es.OldestSeq(); oldest != 3 {
+		t.Fatalf("Oldest retained #%d without retention", oldest)
+	}
+
+	// aged events are dropped upon posts
+	es = NewRetainingStream(0, 50*time.Millisecond)
+	postNums(es, 1, 2)
+	time.Sleep(100 * time.Millisecond)
+	postNums(es, 3, 3)
+	if oldest := es.OldestSeq(); oldest != 3 {
+		t.Fatalf("Oldest retained #%d after aged", oldest)
+	}
+}
+
+func TestWatchFromReplays(t *testing.T) {
+	es := NewRetainingStream(5, 0)
+	postNums(es, 1, 8)
+
+	// replay the retained, then go live
+	ch := watchFrom(es, 6)
+	expectSeqs(t, ch, 6, 7, 8)
+	postNums(es, 9, 10)
+	expectSeqs(t, ch, 9, 10)
+
+	// dropped events leave a gap the watcher can tell by seq
+	ch = watchFrom(es, 2)
+	expectSeqs(t, ch, 6, 7, 8, 9, 10)
+
+	// watching from an event not posted yet
+	ch = watchFrom(es, 12)
+	postNums(es, 11, 13)
+	expectSeqs(t, ch, 12, 13)
+
+	// watching a fresh stream from the start
+	es = NewRetainingStream(5, 0)
+	ch = watchFrom(es, 1)
+	postNums(es, 1, 2)
+	expectSeqs(t, ch, 1, 2)
+}
+
+func TestWatchSkipsPresentTail(t *testing.T) {
+	es := NewRetainingStream(5, 0)
+	postNums(es, 1, 3)
+	ch := make(chan seqEvt, 100)
+	es.Watch(func(evt interface{}) bool {
+		ch <- seqEvt{uint64(evt.(int)), evt}
+		return false
+	}, nil)
+	postNums(es, 4, 5)
+	expectSeqs(t, ch, 4, 5)
+}
+
+func waitDone(t *testing.T, w *Watching, what string) {
+	select {
+	case <-w.Done():
+	case <-time.After(waitTimeout):
+		t.Fatalf("Watching not done after %s", what)
+	}
+}
+
+func TestWatchingStops(t *testing.T) {
+	es := NewRetainingStream(5, 0)
+	postNums(es, 1, 2)
+
+	// a watcher parked waiting for events exits upon stopped
+	ch := make(chan seqEvt, 100)
+	w := es.WatchFromContext(context.Background(), 1, func(seq uint64, evt interface{}) bool {
+		ch <- seqEvt{seq, evt}
+		return false
+	}, nil)
+	expectSeqs(t, ch, 1, 2)
+	w.Stop()
+	waitDone(t, w, "stopped")
+	postNums(es, 3, 3)
+	select {
+	case se := <-ch:
+		t.Fatalf("Event #%d delivered after stopped", se.seq)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// a watcher on a stream never posted exits upon its context cancelled
+	es = NewStream()
+	ctx, cancel := context.WithCancel(context.Background())
+	w = es.WatchContext(ctx, func(evt interface{}) bool {
+		t.Errorf("Event %v delivered", evt)
+		return false
+	}, nil)
+	if n := es.Watchers(); n != 1 {
+		t.Fatalf("%d watchers instead of 1", n)
+	}
+	cancel()
+	waitDone(t, w, "context cancelled")
+	if n := es.Watchers(); n != 0 {
+		t.Fatalf("%d watchers after done", n)
+	}
+
+	// done after the callback opt to stop as well
+	w = es.WatchContext(context.Background(), func(evt interface{}) bool {
+		return true
+	}, nil)
+	es.Post(1)
+	waitDone(t, w, "callback stopped")
+}
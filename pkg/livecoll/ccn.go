@@ -0,0 +1,85 @@
+package livecoll
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// CCN is the collection change number, versioning a live collection.
+// a new epoch is chosen whenever the history of a collection restarts, e.g. upon
+// it's (re)loaded, within an epoch, changes are numbered sequentially.
+type CCN struct {
+	Epoch int64  `json:"epoch" bson:"epoch"`
+	Seq   uint64 `json:"seq" bson:"seq"`
+}
+
+func (ccn CCN) String() string {
+	return fmt.Sprintf("%d:%d", ccn.Epoch, ccn.Seq)
+}
+
+// CCNOrder tells how a CCN relates to another.
+type CCNOrder int
+
+const (
+	// EpochDiffers means the 2 CCNs are from different histories, incomparable
+	EpochDiffers CCNOrder = iota
+	// CCNBehind means of the same epoch, and older
+	CCNBehind
+	// CCNEqual means exactly the same version
+	CCNEqual
+	// CCNAhead means of the same epoch, and newer
+	CCNAhead
+)
+
+// Compare tells how `ccn` relates to `known`, with the number of changes in-between
+// if they're of the same epoch.
+func (ccn CCN) Compare(known CCN) (order CCNOrder, distance uint64) {
+	switch {
+	case ccn.Epoch != known.Epoch:
+		return EpochDiffers, 0
+	case ccn.Seq < known.Seq:
+		return CCNBehind, known.Seq - ccn.Seq
+	case ccn.Seq > known.Seq:
+		return CCNAhead, ccn.Seq - known.Seq
+	default:
+		return CCNEqual, 0
+	}
+}
+
+// Next returns the CCN for a change following `ccn`, a new epoch is started in
+// case the seq is to overflow.
+func (ccn CCN) Next() CCN {
+	if ccn.Seq >= math.MaxUint64 {
+		return CCN{Epoch: NewEpoch()}
+	}
+	return CCN{Epoch: ccn.Epoch, Seq: ccn.Seq + 1}
+}
+
+// Prev returns the CCN before `ccn` in the same epoch.
+func (ccn CCN) Prev() CCN {
+	if ccn.Seq <= 0 {
+		return ccn
+	}
+	return CCN{Epoch: ccn.Epoch, Seq: ccn.Seq - 1}
+}
+
+var (
+	lastEpoch int64
+	muEpoch   sync.Mutex
+)
+
+// NewEpoch returns a time based epoch id, unique within the process and very
+// unlikely to collide with ones from other processes.
+func NewEpoch() int64 {
+	muEpoch.Lock()
+	defer muEpoch.Unlock()
+
+	epoch := time.Now().UnixNano()
+	if epoch <= lastEpoch {
+		epoch = lastEpoch + 1
+	}
+	lastEpoch = epoch
+	return epoch
+}
@@ -0,0 +1,126 @@
+package livecoll
+
+import (
+	"github.com/complyue/hbigo/pkg/errors"
+)
+
+// ChangeSet collects changes to multiple members, to be committed by a house
+// keeper atomically, under a single ccn. like single changes, they should have
+// been made to the backing storage before committed.
+type ChangeSet struct {
+	changes []interface{} // change events with ccn not assigned yet
+}
+
+func (cs *ChangeSet) Created(mo Member) *ChangeSet {
+	cs.changes = append(cs.changes, CreatedEvent{EO: mo})
+	return cs
+}
+
+func (cs *ChangeSet) Updated(mo Member) *ChangeSet {
+	cs.changes = append(cs.changes, UpdatedEvent{EO: mo})
+	return cs
+}
+
+func (cs *ChangeSet) Deleted(id interface{}) *ChangeSet {
+	cs.changes = append(cs.changes, DeletedEvent{ID: id})
+	return cs
+}
+
+// Len returns the number of changes collected.
+func (cs *ChangeSet) Len() int {
+	return len(cs.changes)
+}
+
+// a change applied to members, to be undone on failure
+type appliedChange struct {
+	id     interface{}
+	former Member // nil if not a member before
+}
+
+func (hk *houseKeeper) Commit(cs *ChangeSet) CCN {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	if cs == nil || len(cs.changes) <= 0 {
+		return hk.ccn
+	}
+
+	var applied []appliedChange // formers not known unless loaded
+	if hk.members != nil {
+		applied = hk.applyChanges(cs.changes)
+	}
+
+	hk.ccn = hk.ccn.Next()
+
+	{
+		changes := make([]interface{}, len(cs.changes))
+		for i, chg := range cs.changes {
+			switch evo := chg.(type) {
+			case CreatedEvent:
+				changes[i] = CreatedEvent{hk.ccn, evo.EO}
+			case UpdatedEvent:
+				var delta Delta
+				if applied != nil && applied[i].former != nil {
+					delta = Diff(applied[i].former, evo.EO)
+				}
+				changes[i] = UpdatedEvent{hk.ccn, evo.EO, delta}
+			case DeletedEvent:
+				changes[i] = DeletedEvent{hk.ccn, evo.ID}
+			}
+		}
+		evt := BatchEvent{hk.ccn, changes}
+		hk.logChange(evt)
+		hk.ccES.Post(evt)
+	}
+	return hk.ccn
+}
+
+// apply changes to members and indexes, all or none. should be called with
+// `hk.mu` locked.
+func (hk *houseKeeper) applyChanges(changes []interface{}) (applied []appliedChange) {
+	applied = make([]appliedChange, 0, len(changes))
+	defer func() {
+		if e := recover(); e != nil {
+			// undo in reverse order, each step restores a state valid before
+			for i := len(applied) - 1; i >= 0; i-- {
+				ac := applied[i]
+				if ac.former != nil {
+					indexMember(hk.indexes, ac.id, ac.former)
+					hk.members[ac.id] = ac.former
+				} else {
+					unindexMember(hk.indexes, ac.id)
+					delete(hk.members, ac.id)
+				}
+			}
+			panic(e)
+		}
+	}()
+
+	for _, chg := range changes {
+		switch evo := chg.(type) {
+		case CreatedEvent:
+			id := evo.EO.GetID()
+			former := hk.members[id]
+			indexMember(hk.indexes, id, evo.EO)
+			hk.members[id] = evo.EO
+			applied = append(applied, appliedChange{id, former})
+		case UpdatedEvent:
+			id := evo.EO.GetID()
+			former := hk.members[id]
+			indexMember(hk.indexes, id, evo.EO)
+			hk.members[id] = evo.EO
+			applied = append(applied, appliedChange{id, former})
+		case DeletedEvent:
+			former, ok := hk.members[evo.ID]
+			if !ok {
+				panic(errors.Errorf("Removing non member id %+v", evo.ID))
+			}
+			unindexMember(hk.indexes, evo.ID)
+			delete(hk.members, evo.ID)
+			applied = append(applied, appliedChange{evo.ID, former})
+		default:
+			panic(errors.Errorf("Change of type %T ?!", chg))
+		}
+	}
+	return applied
+}
@@ -0,0 +1,118 @@
+package livecoll
+
+import (
+	"testing"
+)
+
+func labeledMember(seq int, label string) *testMember {
+	mo := seqMember(seq)
+	mo.Label = label
+	return mo
+}
+
+func TestCommitBatches(t *testing.T) {
+	hk := loadedKeeper(t, 3)
+	rec := newEventRecorder()
+	unsubscribe := hk.Subscribe(rec)
+	defer unsubscribe()
+	if _, ok := rec.next(t).(EpochEvent); !ok {
+		t.Fatal("Not started with Epoch")
+	}
+	before, _ := hk.FetchAll()
+
+	if ccn := hk.Commit(&ChangeSet{}); ccn != before {
+		t.Fatalf("Empty change set committed as %v", ccn)
+	}
+	ccn := hk.Commit(new(ChangeSet).
+		Created(seqMember(4)).
+		Updated(labeledMember(1, "a")).
+		Deleted(memberID(2)))
+	if ccn != before.Next() {
+		t.Fatalf("Committed as %v after %v", ccn, before)
+	}
+
+	batch, ok := rec.next(t).(BatchEvent)
+	if !ok || batch.CCN != ccn || len(batch.Changes) != 3 {
+		t.Fatalf("Not seen as a batch: %+v", batch)
+	}
+	for i, expected := range []string{"created m04", "updated m01", "deleted m02"} {
+		if seen := changeOf(batch.Changes[i]); seen != expected {
+			t.Fatalf("Seen %s instead of %s", seen, expected)
+		}
+	}
+	if changes, ok := hk.FetchChangesSince(before); !ok || len(changes) != 1 {
+		t.Fatalf("Changes since %v: %+v %v", before, changes, ok)
+	}
+	if _, members := hk.FetchAll(); len(members) != 3 {
+		t.Fatalf("%d members after committed", len(members))
+	}
+}
+
+func TestCommitRollsBack(t *testing.T) {
+	hk := loadedKeeper(t, 3)
+	if err := hk.AddIndex(Index{Name: "label", Unique: true, Key: func(mo Member) interface{} {
+		if label := mo.(*testMember).Label; label != "" {
+			return label
+		}
+		return nil
+	}}); err != nil {
+		t.Fatal(err)
+	}
+	hk.Updated(labeledMember(1, "a"))
+	hk.Updated(labeledMember(2, "b"))
+
+	rec := newEventRecorder()
+	unsubscribe := hk.Subscribe(rec)
+	defer unsubscribe()
+	if _, ok := rec.next(t).(EpochEvent); !ok {
+		t.Fatal("Not started with Epoch")
+	}
+	before, _ := hk.FetchAll()
+
+	for _, cs := range []*ChangeSet{
+		// the last change violates the unique label, after others applied
+		new(ChangeSet).
+			Updated(labeledMember(1, "c")).
+			Deleted(memberID(3)).
+			Created(labeledMember(4, "a")).
+			Updated(labeledMember(2, "c")),
+		// removing a non member
+		new(ChangeSet).
+			Updated(labeledMember(1, "c")).
+			Deleted(memberID(9)),
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatalf("Committed %+v", cs)
+				}
+			}()
+			hk.Commit(cs)
+		}()
+
+		if after, members := hk.FetchAll(); after != before || len(members) != 3 {
+			t.Fatalf("Changed to %v %+v by a failed commit", after, members)
+		}
+		if mo, ok := hk.Read(memberID(1)); !ok || mo.(*testMember).Label != "a" {
+			t.Fatalf("Member rolled back to %+v", mo)
+		}
+		if _, ok := hk.Read(memberID(3)); !ok {
+			t.Fatal("Deleted member not rolled back")
+		}
+		if _, ok := hk.Read(memberID(4)); ok {
+			t.Fatal("Created member not rolled back")
+		}
+		if mo, ok := hk.ReadBy("label", "a"); !ok || mo.GetID() != memberID(1) {
+			t.Fatalf("Read %+v by label after rolled back", mo)
+		}
+		if mo, ok := hk.ReadBy("label", "c"); ok {
+			t.Fatalf("Read %+v by a label rolled back", mo)
+		}
+	}
+
+	// nothing seen from failed commits
+	ccn := hk.Commit(new(ChangeSet).Updated(labeledMember(3, "c")))
+	if batch, ok := rec.next(t).(BatchEvent); !ok || batch.CCN != ccn || batch.CCN != before.Next() {
+		t.Fatalf("Seen %+v after failed commits", batch)
+	}
+}
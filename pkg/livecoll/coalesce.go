@@ -0,0 +1,185 @@
+package livecoll
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/complyue/ddgo/pkg/isoevt"
+	"github.com/golang/glog"
+)
+
+// CoalescingSubscriber opts in to have changes coalesced while it's lagging behind,
+// so only the latest state of each member gets dispatched to it, instead of every
+// intermediate change.
+type CoalescingSubscriber interface {
+	Subscriber
+
+	// Coalesced occurs before a batch of coalesced changes get dispatched, the batch
+	// covers all changes after `fromCCN` up to `toCCN`, with intermediate changes
+	// superseded by later ones of the same member dropped. ccn gaps within this range
+	// are not missed changes, the subscriber should not reload for them.
+	Coalesced(fromCCN, toCCN CCN) (stop bool)
+}
+
+// buffers change events pending dispatch, at most one event per member between
+// change sets
+type coalescer struct {
+	mu  sync.Mutex
+	cnd *sync.Cond
+
+	pending []interface{}       // nil for events merged into a later one
+	byID    map[interface{}]int // index into pending
+	merged  int                 // number of events merged into later ones
+	fromCCN CCN                 // ccn before the first pending event
+	toCCN   CCN                 // ccn of the last pending event
+	stopped bool
+}
+
+func dispatchCoalescing(
+	ccES *isoevt.EventStream, subr CoalescingSubscriber, watchingCallback func() bool,
+) (unsubscribe func()) {
+	cl := &coalescer{byID: make(map[interface{}]int)}
+	cl.cnd = sync.NewCond(&cl.mu)
+
+	ctx, cancel := context.WithCancel(
+		isoevt.WithWatcherName(context.Background(), fmt.Sprintf("%T", subr)),
+	)
+	watching := ccES.WatchContext(ctx, func(evt interface{}) bool {
+		// never block the stream watching goro, so it won't lag
+		return cl.add(evt)
+	}, func() (stop bool) {
+		if stop = startSubscription(subr, watchingCallback); !stop {
+			go cl.drain(subr, cancel)
+		}
+		return
+	})
+	go func() {
+		// the drain goro is parked waiting for events, wake it up to exit
+		<-watching.Done()
+		cl.stop()
+	}()
+	return cancel
+}
+
+func (cl *coalescer) stop() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.stopped = true
+	cl.pending, cl.byID = nil, nil
+	cl.cnd.Signal()
+}
+
+func (cl *coalescer) add(evt interface{}) (stop bool) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	if cl.stopped {
+		return true
+	}
+
+	ccn := eventCCN(evt)
+	if len(cl.pending) <= 0 {
+		cl.fromCCN = ccn.Prev()
+	}
+	cl.toCCN = ccn
+
+	var id interface{}
+	switch evo := evt.(type) {
+	case EpochEvent:
+		// the subscriber will reload upon Epoch, pending changes are all superseded
+		cl.merged += len(cl.byID)
+		cl.pending = append(cl.pending[:0], evt)
+		cl.byID = make(map[interface{}]int)
+		cl.cnd.Signal()
+		return
+	case BatchEvent:
+		// a change set is dispatched whole, changes before and after it are not
+		// merged across it, so the subscriber never sees it partially
+		cl.pending = append(cl.pending, evt)
+		cl.byID = make(map[interface{}]int)
+		cl.cnd.Signal()
+		return
+	case CreatedEvent:
+		id = evo.EO.GetID()
+	case UpdatedEvent:
+		id = evo.EO.GetID()
+	case DeletedEvent:
+		id = evo.ID
+	}
+
+	if i, ok := cl.byID[id]; ok {
+		prev := cl.pending[i]
+		cl.pending[i] = nil
+		delete(cl.byID, id)
+		cl.merged++
+		switch evo := evt.(type) {
+		case UpdatedEvent:
+			switch pevo := prev.(type) {
+			case CreatedEvent:
+				// still a creation to the subscriber, with latest state
+				evt = CreatedEvent{evo.CCN, evo.EO}
+			case UpdatedEvent:
+				// fields changed by either update
+				evt = UpdatedEvent{evo.CCN, evo.EO, pevo.Delta.Then(evo.Delta)}
+			}
+		case DeletedEvent:
+			if _, ok := prev.(CreatedEvent); ok {
+				// created then deleted, the subscriber needs not to know at all
+				return
+			}
+		case CreatedEvent:
+			if _, ok := prev.(DeletedEvent); ok {
+				// deleted then recreated, the subscriber sees it updated, with
+				// fields changed unknown
+				evt = UpdatedEvent{evo.CCN, evo.EO, nil}
+			}
+		}
+	}
+	// always append, so pending events remain in ccn order
+	cl.byID[id] = len(cl.pending)
+	cl.pending = append(cl.pending, evt)
+	cl.cnd.Signal()
+	return
+}
+
+func (cl *coalescer) drain(subr CoalescingSubscriber, cancel context.CancelFunc) {
+	defer func() {
+		if e := recover(); e != nil {
+			glog.Errorf("Coalescing dispatch stopped due to callback error: %+v", e)
+		}
+		cl.stop()
+		cancel()
+	}()
+
+	for {
+		cl.mu.Lock()
+		for len(cl.pending) <= 0 && !cl.stopped {
+			cl.cnd.Wait()
+		}
+		if cl.stopped {
+			// unsubscribed
+			cl.mu.Unlock()
+			return
+		}
+		batch, merged, fromCCN, toCCN := cl.pending, cl.merged, cl.fromCCN, cl.toCCN
+		cl.pending, cl.merged = nil, 0
+		cl.byID = make(map[interface{}]int)
+		cl.mu.Unlock()
+
+		if merged > 0 {
+			if subr.Coalesced(fromCCN, toCCN) {
+				return
+			}
+		}
+		for _, evt := range batch {
+			if evt == nil {
+				continue
+			}
+			if dispatchEvent(subr, evt) {
+				return
+			}
+		}
+	}
+}
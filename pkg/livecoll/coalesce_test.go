@@ -0,0 +1,73 @@
+package livecoll
+
+import (
+	"reflect"
+	"sync"
+	"testing"
+)
+
+func TestCoalescerMerges(t *testing.T) {
+	ccn := func(seq uint64) CCN {
+		return CCN{Epoch: 1, Seq: seq}
+	}
+	a, b := seqMember(1), seqMember(2)
+	a2 := modified(a, func(mo *testMember) { mo.X = 10 })
+	a3 := modified(a2, func(mo *testMember) { mo.Y = 20 })
+	batch := BatchEvent{ccn(2), []interface{}{UpdatedEvent{ccn(2), b, nil}}}
+
+	for _, tc := range []struct {
+		name   string
+		events []interface{}
+		want   []interface{}
+		merged int
+	}{{
+		"Created+Updated",
+		[]interface{}{CreatedEvent{ccn(1), a}, UpdatedEvent{ccn(2), a2, Diff(a, a2)}},
+		[]interface{}{CreatedEvent{ccn(2), a2}}, 1,
+	}, {
+		"Created+Deleted",
+		[]interface{}{CreatedEvent{ccn(1), a}, DeletedEvent{ccn(2), a.ID}},
+		[]interface{}{}, 1,
+	}, {
+		"Deleted+Created",
+		[]interface{}{DeletedEvent{ccn(1), a.ID}, CreatedEvent{ccn(2), a2}},
+		[]interface{}{UpdatedEvent{ccn(2), a2, nil}}, 1,
+	}, {
+		"Updated+Updated",
+		[]interface{}{UpdatedEvent{ccn(1), a2, Diff(a, a2)}, UpdatedEvent{ccn(2), a3, Diff(a2, a3)}},
+		[]interface{}{UpdatedEvent{ccn(2), a3, Diff(a, a3)}}, 1,
+	}, {
+		"other members kept",
+		[]interface{}{UpdatedEvent{ccn(1), a2, nil}, CreatedEvent{ccn(2), b}, UpdatedEvent{ccn(3), a3, nil}},
+		[]interface{}{CreatedEvent{ccn(2), b}, UpdatedEvent{ccn(3), a3, nil}}, 1,
+	}, {
+		"Epoch supersedes",
+		[]interface{}{CreatedEvent{ccn(1), a}, UpdatedEvent{ccn(2), b, nil}, EpochEvent{ccn(3)}},
+		[]interface{}{EpochEvent{ccn(3)}}, 2,
+	}, {
+		"Batch barrier",
+		[]interface{}{UpdatedEvent{ccn(1), a2, nil}, batch, UpdatedEvent{ccn(3), a3, nil}},
+		[]interface{}{UpdatedEvent{ccn(1), a2, nil}, batch, UpdatedEvent{ccn(3), a3, nil}}, 0,
+	}} {
+		cl := &coalescer{byID: make(map[interface{}]int)}
+		cl.cnd = sync.NewCond(&cl.mu)
+		for _, evt := range tc.events {
+			cl.add(evt)
+		}
+		got := []interface{}{}
+		for _, evt := range cl.pending {
+			if evt != nil {
+				got = append(got, evt)
+			}
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: pending %+v instead of %+v", tc.name, got, tc.want)
+		}
+		if cl.merged != tc.merged {
+			t.Errorf("%s: %d merged instead of %d", tc.name, cl.merged, tc.merged)
+		}
+		if cl.fromCCN != ccn(0) || cl.toCCN != eventCCN(tc.events[len(tc.events)-1]) {
+			t.Errorf("%s: coalesced %v -> %v", tc.name, cl.fromCCN, cl.toCCN)
+		}
+	}
+}
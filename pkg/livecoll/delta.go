@@ -0,0 +1,98 @@
+package livecoll
+
+import (
+	"reflect"
+	"strings"
+)
+
+// FieldChange is a change to a single field of a member.
+type FieldChange struct {
+	Field string // named as in json
+	Old   interface{}
+	New   interface{}
+}
+
+// Delta lists fields changed by an update. it's nil if not known, e.g. the former
+// value of the member is not at hand, all fields should be considered changed then.
+type Delta []FieldChange
+
+// Diff compares exported fields of two values of a member, they should be structs
+// or pointers to structs of the same type, or nil is returned.
+func Diff(former, mo Member) Delta {
+	fv, mv := reflect.Indirect(reflect.ValueOf(former)), reflect.Indirect(reflect.ValueOf(mo))
+	if !fv.IsValid() || !mv.IsValid() || fv.Type() != mv.Type() || fv.Kind() != reflect.Struct {
+		return nil
+	}
+	t := fv.Type()
+	delta := Delta{}
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		if sf.PkgPath != "" {
+			continue // unexported
+		}
+		ov, nv := fv.Field(i).Interface(), mv.Field(i).Interface()
+		if !reflect.DeepEqual(ov, nv) {
+			delta = append(delta, FieldChange{fieldName(sf), ov, nv})
+		}
+	}
+	return delta
+}
+
+// a field named as in json
+func fieldName(sf reflect.StructField) string {
+	if tag := sf.Tag.Get("json"); tag != "" {
+		if name := strings.Split(tag, ",")[0]; name != "" && name != "-" {
+			return name
+		}
+	}
+	return sf.Name
+}
+
+// Get returns the change to the named field, `ok` is false if it's not changed,
+// or the delta is not known.
+func (d Delta) Get(field string) (fc FieldChange, ok bool) {
+	for _, fc = range d {
+		if fc.Field == field {
+			return fc, true
+		}
+	}
+	return FieldChange{}, false
+}
+
+// Changed tells whether any of the named fields is changed, always true if the
+// delta is not known.
+func (d Delta) Changed(fields ...string) bool {
+	if d == nil {
+		return true
+	}
+	for _, field := range fields {
+		if _, ok := d.Get(field); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Then merges a later delta of the same member into this one, with old values
+// from this one and new values from the later one, fields changed back to their
+// old values are dropped.
+func (d Delta) Then(later Delta) Delta {
+	if d == nil || later == nil {
+		return nil
+	}
+	merged := Delta{}
+	for _, fc := range d {
+		if lfc, ok := later.Get(fc.Field); ok {
+			fc.New = lfc.New
+		}
+		if !reflect.DeepEqual(fc.Old, fc.New) {
+			merged = append(merged, fc)
+		}
+	}
+	for _, lfc := range later {
+		if _, ok := d.Get(lfc.Field); !ok {
+			merged = append(merged, lfc)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,104 @@
+package livecoll
+
+import (
+	"reflect"
+	"testing"
+)
+
+// a member with json named and unexported fields
+type deltaMember struct {
+	ID    string  `json:"_id"`
+	X     float64 `json:"x"`
+	Label string  `json:",omitempty"`
+	Tags  []string
+	cache int
+}
+
+func (mo *deltaMember) GetID() interface{} {
+	return mo.ID
+}
+
+func TestDiff(t *testing.T) {
+	former := &deltaMember{ID: "d", X: 1, Label: "a", Tags: []string{"t"}, cache: 1}
+	mo := &deltaMember{ID: "d", X: 2, Label: "a", Tags: []string{"t", "u"}, cache: 2}
+	delta := Diff(former, mo)
+	if !reflect.DeepEqual(delta, Delta{
+		{"x", 1.0, 2.0},
+		{"Tags", []string{"t"}, []string{"t", "u"}},
+	}) {
+		t.Fatalf("Diff'ed as %+v", delta)
+	}
+	if delta := Diff(former, former); delta == nil || len(delta) != 0 {
+		t.Fatalf("Diff'ed with itself as %+v", delta)
+	}
+	if delta := Diff(former, seqMember(1)); delta != nil {
+		t.Fatalf("Diff'ed with another type as %+v", delta)
+	}
+	if delta := Diff(nil, mo); delta != nil {
+		t.Fatalf("Diff'ed with nil as %+v", delta)
+	}
+	if delta := Diff(bareMember("a"), bareMember("b")); delta != nil {
+		t.Fatalf("Diff'ed non structs as %+v", delta)
+	}
+}
+
+func TestDeltaChanged(t *testing.T) {
+	delta := Delta{{"x", 1.0, 2.0}, {"Label", "a", "b"}}
+	for _, c := range []struct {
+		delta   Delta
+		fields  []string
+		changed bool
+	}{
+		{delta, []string{"x"}, true},
+		{delta, []string{"y", "Label"}, true},
+		{delta, []string{"y"}, false},
+		{delta, nil, false},
+		{Delta{}, []string{"x"}, false},
+		{nil, []string{"x"}, true},
+		{nil, nil, true},
+	} {
+		if changed := c.delta.Changed(c.fields...); changed != c.changed {
+			t.Errorf("%+v changed %v: %v", c.delta, c.fields, changed)
+		}
+	}
+	if fc, ok := delta.Get("Label"); !ok || fc.Old != "a" || fc.New != "b" {
+		t.Fatalf("Got %+v", fc)
+	}
+	if fc, ok := delta.Get("y"); ok {
+		t.Fatalf("Got %+v not changed", fc)
+	}
+}
+
+func TestDeltaThen(t *testing.T) {
+	merged := Delta{{"x", 1.0, 2.0}, {"Label", "a", "b"}}.
+		Then(Delta{{"Label", "b", "a"}, {"y", 3.0, 4.0}, {"x", 2.0, 5.0}})
+	if !reflect.DeepEqual(merged, Delta{{"x", 1.0, 5.0}, {"y", 3.0, 4.0}}) {
+		t.Fatalf("Merged as %+v", merged)
+	}
+	if merged := (Delta{{"x", 1.0, 2.0}}).Then(nil); merged != nil {
+		t.Fatalf("Merged with unknown as %+v", merged)
+	}
+	if merged := Delta(nil).Then(Delta{}); merged != nil {
+		t.Fatalf("Merged unknown as %+v", merged)
+	}
+}
+
+func TestUpdatedWithDelta(t *testing.T) {
+	hk := loadedKeeper(t, 2)
+	before, _ := hk.FetchAll()
+	mo, _ := hk.Read(memberID(1))
+	hk.Updated(modified(mo, func(mo *testMember) { mo.Label = "a" }))
+	hk.Commit(new(ChangeSet).Updated(labeledMember(2, "b")))
+
+	changes, ok := hk.FetchChangesSince(before)
+	if !ok || len(changes) != 2 {
+		t.Fatalf("Changes since %v: %+v %v", before, changes, ok)
+	}
+	if delta := changes[0].(UpdatedEvent).Delta; !delta.Changed("Label") || delta.Changed("X", "Y") {
+		t.Fatalf("Updated with %+v", delta)
+	}
+	batched := changes[1].(BatchEvent).Changes[0].(UpdatedEvent)
+	if delta := batched.Delta; !delta.Changed("Label") || delta.Changed("X", "Y") {
+		t.Fatalf("Committed with %+v", delta)
+	}
+}
@@ -0,0 +1,291 @@
+package livecoll
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/complyue/hbigo/pkg/errors"
+)
+
+// Located members have a position on the X/Y plane.
+type Located interface {
+	GetXY() (x, y float64)
+}
+
+// Sequenced members have a seq number within their collection.
+type Sequenced interface {
+	GetSeq() int
+}
+
+// Movable members can be moving or not.
+type Movable interface {
+	IsMoving() bool
+}
+
+// BBox is a bounding box on the X/Y plane, borders inclusive.
+type BBox struct {
+	MinX, MinY, MaxX, MaxY float64
+}
+
+func (bb BBox) Contains(x, y float64) bool {
+	return bb.MinX <= x && x <= bb.MaxX && bb.MinY <= y && y <= bb.MaxY
+}
+
+// Filter is a declarative filter on members, it's plain data so can be sent over
+// the wire, for a service to evaluate it before relaying changes to consumers.
+// all criteria set must be met for a member to pass, a zero Filter passes all
+// members.
+type Filter struct {
+	BBox   *BBox `bson:",omitempty"` // members located within
+	Seqs   []int `bson:",omitempty"` // members with one of these seqs
+	Moving *bool `bson:",omitempty"` // members moving or not
+}
+
+// Match tells whether the member passes the filter, a member lacking what's
+// required by a criterion won't pass it.
+func (f *Filter) Match(mo Member) bool {
+	if f == nil {
+		return true
+	}
+	if f.BBox != nil {
+		lo, ok := mo.(Located)
+		if !ok {
+			return false
+		}
+		if !f.BBox.Contains(lo.GetXY()) {
+			return false
+		}
+	}
+	if len(f.Seqs) > 0 {
+		so, ok := mo.(Sequenced)
+		if !ok {
+			return false
+		}
+		seq, found := so.GetSeq(), false
+		for _, s := range f.Seqs {
+			if s == seq {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	if f.Moving != nil {
+		mvo, ok := mo.(Movable)
+		if !ok || mvo.IsMoving() != *f.Moving {
+			return false
+		}
+	}
+	return true
+}
+
+// ParseFilter parses a filter from url query style parameters, i.e.
+//
+//	bbox=minX,minY,maxX,maxY
+//	seqs=1,3,5
+//	moving=true
+//
+// nil is returned if no criterion specified.
+func ParseFilter(get func(key string) string) (*Filter, error) {
+	var (
+		f   Filter
+		any bool
+	)
+	if s := get("bbox"); s != "" {
+		parts := strings.Split(s, ",")
+		if len(parts) != 4 {
+			return nil, errors.Errorf("Bad bbox [%s]", s)
+		}
+		var v [4]float64
+		for i, p := range parts {
+			x, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+			if err != nil {
+				return nil, errors.Wrapf(err, "Bad bbox [%s]", s)
+			}
+			v[i] = x
+		}
+		f.BBox = &BBox{v[0], v[1], v[2], v[3]}
+		any = true
+	}
+	if s := get("seqs"); s != "" {
+		for _, p := range strings.Split(s, ",") {
+			seq, err := strconv.Atoi(strings.TrimSpace(p))
+			if err != nil {
+				return nil, errors.Wrapf(err, "Bad seqs [%s]", s)
+			}
+			f.Seqs = append(f.Seqs, seq)
+		}
+		any = true
+	}
+	if s := get("moving"); s != "" {
+		moving, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Bad moving [%s]", s)
+		}
+		f.Moving = &moving
+		any = true
+	}
+	if !any {
+		return nil, nil
+	}
+	return &f, nil
+}
+
+func (f *Filter) String() string {
+	if f == nil {
+		return "<all>"
+	}
+	var crits []string
+	if f.BBox != nil {
+		crits = append(crits, fmt.Sprintf("bbox=%v,%v,%v,%v",
+			f.BBox.MinX, f.BBox.MinY, f.BBox.MaxX, f.BBox.MaxY))
+	}
+	if len(f.Seqs) > 0 {
+		crits = append(crits, fmt.Sprintf("seqs=%v", f.Seqs))
+	}
+	if f.Moving != nil {
+		crits = append(crits, fmt.Sprintf("moving=%v", *f.Moving))
+	}
+	return strings.Join(crits, "&")
+}
+
+// subscriber wrapper passing only changes of members matching a predicate, with
+// members entering or leaving the filtered set seen as created or deleted.
+type filteringSubscriber struct {
+	subr Subscriber
+	pub  Publisher
+	pred func(mo Member) bool
+
+	snapCCN CCN                  // ccn of the snapshot `in` populated from
+	in      map[interface{}]bool // ids of members currently passing the filter
+}
+
+// subscriber wrapper for coalescing subscribers, to not hide their opt-in
+type coalescingFilteringSubscriber struct {
+	*filteringSubscriber
+}
+
+func (fs coalescingFilteringSubscriber) Coalesced(fromCCN, toCCN CCN) (stop bool) {
+	return fs.subr.(CoalescingSubscriber).Coalesced(fromCCN, toCCN)
+}
+
+// Filtered wraps a subscriber, for it to receive only changes of members passing
+// `pred`, from the specified publisher. an updated member newly passing `pred` is
+// seen as created, and one no longer passing as deleted.
+//
+// changes not passing are not delivered at all, so a filtered subscriber should
+// expect ccn gaps, and only reload upon Epoch.
+func Filtered(pub Publisher, subr Subscriber, pred func(mo Member) bool) Subscriber {
+	fs := &filteringSubscriber{
+		subr: subr, pub: pub, pred: pred,
+	}
+	if _, ok := subr.(CoalescingSubscriber); ok {
+		return coalescingFilteringSubscriber{fs}
+	}
+	return fs
+}
+
+// (re)populate the set of members passing the filter from a snapshot
+func (fs *filteringSubscriber) populate() {
+	ccn, members := fs.pub.FetchAll()
+	fs.in = make(map[interface{}]bool)
+	for _, mo := range members {
+		if fs.pred(mo) {
+			fs.in[mo.GetID()] = true
+		}
+	}
+	fs.snapCCN = ccn
+}
+
+// whether the change has been reflected by the snapshot
+func (fs *filteringSubscriber) seen(ccn CCN) bool {
+	order, _ := ccn.Compare(fs.snapCCN)
+	return order == CCNBehind || order == CCNEqual
+}
+
+func (fs *filteringSubscriber) Subscribed() (stop bool) {
+	return fs.subr.Subscribed()
+}
+
+func (fs *filteringSubscriber) Epoch(ccn CCN) (stop bool) {
+	fs.populate()
+	return fs.subr.Epoch(ccn)
+}
+
+// translate a change to what the filtered subscriber sees, nil if nothing
+func (fs *filteringSubscriber) translate(evt interface{}) interface{} {
+	switch evo := evt.(type) {
+	case CreatedEvent:
+		if !fs.pred(evo.EO) {
+			return nil
+		}
+		fs.in[evo.EO.GetID()] = true
+		return evt
+	case UpdatedEvent:
+		id := evo.EO.GetID()
+		wasIn, isIn := fs.in[id], fs.pred(evo.EO)
+		switch {
+		case wasIn && isIn:
+			return evt
+		case isIn:
+			// entering the filtered set
+			fs.in[id] = true
+			return CreatedEvent{evo.CCN, evo.EO}
+		case wasIn:
+			// leaving the filtered set
+			delete(fs.in, id)
+			return DeletedEvent{evo.CCN, id}
+		}
+		return nil
+	case DeletedEvent:
+		if !fs.in[evo.ID] {
+			return nil
+		}
+		delete(fs.in, evo.ID)
+		return evt
+	default:
+		panic(errors.Errorf("Change of type %T ?!", evt))
+	}
+}
+
+func (fs *filteringSubscriber) relay(ccn CCN, evt interface{}) (stop bool) {
+	if fs.seen(ccn) {
+		return
+	}
+	if evt = fs.translate(evt); evt == nil {
+		return
+	}
+	return dispatchEvent(fs.subr, evt)
+}
+
+func (fs *filteringSubscriber) MemberCreated(ccn CCN, eo Member) (stop bool) {
+	return fs.relay(ccn, CreatedEvent{ccn, eo})
+}
+
+func (fs *filteringSubscriber) MemberUpdated(ccn CCN, eo Member, delta Delta) (stop bool) {
+	return fs.relay(ccn, UpdatedEvent{ccn, eo, delta})
+}
+
+func (fs *filteringSubscriber) MemberDeleted(ccn CCN, id interface{}) (stop bool) {
+	return fs.relay(ccn, DeletedEvent{ccn, id})
+}
+
+// only changes passing the filter are delivered, still as one batch
+func (fs *filteringSubscriber) MembersChanged(ccn CCN, changes []interface{}) (stop bool) {
+	if fs.seen(ccn) {
+		return
+	}
+	var passed []interface{}
+	for _, chg := range changes {
+		if chg = fs.translate(chg); chg != nil {
+			passed = append(passed, chg)
+		}
+	}
+	if len(passed) <= 0 {
+		return
+	}
+	return fs.subr.MembersChanged(ccn, passed)
+}
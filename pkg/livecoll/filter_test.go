@@ -0,0 +1,145 @@
+package livecoll
+
+import (
+	"testing"
+	"time"
+)
+
+// a member with nothing but an id
+type bareMember string
+
+func (mo bareMember) GetID() interface{} {
+	return string(mo)
+}
+
+func TestFilterMatch(t *testing.T) {
+	moving, parked := true, false
+	mo := &testMember{ID: "m", Seq: 3, X: 5, Y: 5, Moving: true}
+	for _, c := range []struct {
+		name   string
+		filter *Filter
+		mo     Member
+		match  bool
+	}{
+		{"nil", nil, mo, true},
+		{"zero", &Filter{}, mo, true},
+		{"zero bare", &Filter{}, bareMember("b"), true},
+		{"bbox in", &Filter{BBox: &BBox{0, 0, 10, 10}}, mo, true},
+		{"bbox border", &Filter{BBox: &BBox{5, 5, 10, 10}}, mo, true},
+		{"bbox out", &Filter{BBox: &BBox{6, 0, 10, 10}}, mo, false},
+		{"bbox bare", &Filter{BBox: &BBox{0, 0, 10, 10}}, bareMember("b"), false},
+		{"seqs in", &Filter{Seqs: []int{1, 3}}, mo, true},
+		{"seqs out", &Filter{Seqs: []int{1, 2}}, mo, false},
+		{"seqs bare", &Filter{Seqs: []int{3}}, bareMember("b"), false},
+		{"moving", &Filter{Moving: &moving}, mo, true},
+		{"parked", &Filter{Moving: &parked}, mo, false},
+		{"moving bare", &Filter{Moving: &moving}, bareMember("b"), false},
+		{"all met", &Filter{BBox: &BBox{0, 0, 10, 10}, Seqs: []int{3}, Moving: &moving}, mo, true},
+		{"one unmet", &Filter{BBox: &BBox{0, 0, 10, 10}, Seqs: []int{3}, Moving: &parked}, mo, false},
+	} {
+		if match := c.filter.Match(c.mo); match != c.match {
+			t.Errorf("%s: matched %v", c.name, match)
+		}
+	}
+}
+
+// records events a subscriber sees, in order
+type eventRecorder struct {
+	events chan interface{}
+}
+
+func newEventRecorder() *eventRecorder {
+	return &eventRecorder{events: make(chan interface{}, 100)}
+}
+
+func (er *eventRecorder) Subscribed() (stop bool) {
+	return
+}
+
+func (er *eventRecorder) Epoch(ccn CCN) (stop bool) {
+	er.events <- EpochEvent{ccn}
+	return
+}
+
+func (er *eventRecorder) MemberCreated(ccn CCN, eo Member) (stop bool) {
+	er.events <- CreatedEvent{ccn, eo}
+	return
+}
+
+func (er *eventRecorder) MemberUpdated(ccn CCN, eo Member, delta Delta) (stop bool) {
+	er.events <- UpdatedEvent{ccn, eo, delta}
+	return
+}
+
+func (er *eventRecorder) MemberDeleted(ccn CCN, id interface{}) (stop bool) {
+	er.events <- DeletedEvent{ccn, id}
+	return
+}
+
+func (er *eventRecorder) MembersChanged(ccn CCN, changes []interface{}) (stop bool) {
+	er.events <- BatchEvent{ccn, changes}
+	return
+}
+
+func (er *eventRecorder) next(t *testing.T) interface{} {
+	select {
+	case evt := <-er.events:
+		return evt
+	case <-time.After(10 * time.Second):
+		t.Fatal("No more event")
+		return nil
+	}
+}
+
+// describe a change by its kind and member id
+func changeOf(evt interface{}) string {
+	switch evo := evt.(type) {
+	case CreatedEvent:
+		return "created " + evo.EO.GetID().(string)
+	case UpdatedEvent:
+		return "updated " + evo.EO.GetID().(string)
+	case DeletedEvent:
+		return "deleted " + evo.ID.(string)
+	}
+	return "?"
+}
+
+func TestFilteredEntersAndLeaves(t *testing.T) {
+	hk := loadedKeeper(t, 5)
+	inside := &Filter{BBox: &BBox{0, 0, 3, 3}}
+	rec := newEventRecorder()
+	unsubscribe := hk.SubscribeFiltered(rec, inside.Match)
+	defer unsubscribe()
+	if _, ok := rec.next(t).(EpochEvent); !ok {
+		t.Fatal("Not started with Epoch")
+	}
+
+	update := func(seq int, modify func(mo *testMember)) {
+		mo, _ := hk.Read(memberID(seq))
+		hk.Updated(modified(mo, modify))
+	}
+	moveTo := func(seq int, x, y float64) {
+		update(seq, func(mo *testMember) { mo.X, mo.Y = x, y })
+	}
+	relabel := func(seq int) {
+		update(seq, func(mo *testMember) { mo.Label += "x" })
+	}
+	relabel(1)
+	moveTo(1, 10, 10) // leaving
+	relabel(1)        // outside
+	moveTo(4, 1, 1)   // entering
+	relabel(5)        // outside
+	hk.Created(seqMember(6))
+	hk.Created(modified(seqMember(7), func(mo *testMember) { mo.X, mo.Y = 2, 2 }))
+	hk.Deleted(memberID(5))
+	hk.Deleted(memberID(2))
+	relabel(3)
+
+	for _, expected := range []string{
+		"updated m01", "deleted m01", "created m04", "created m07", "deleted m02", "updated m03",
+	} {
+		if seen := changeOf(rec.next(t)); seen != expected {
+			t.Fatalf("Seen %s instead of %s", seen, expected)
+		}
+	}
+}
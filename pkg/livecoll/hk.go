@@ -12,124 +12,300 @@ type Member interface {
 }
 
 type HouseKeeper interface {
-	Load(fullList []Member)
+	// Load replaces all members with the full list, and rebuilds the indexes. it
+	// fails with nothing changed, if the list has duplicate ids or violates a
+	// unique index.
+	Load(fullList []Member) error
 
 	Read(id interface{}) (Member, bool)
 
+	// FetchMember reads a member with the ccn it's consistent with, `ok` is false if
+	// no such member.
+	FetchMember(id interface{}) (ccn CCN, mo Member, ok bool)
+
+	// members are immutable once handed to the house keeper, an update should pass
+	// a new value, rather than the stored one changed in place
 	Created(mo Member)
 	Updated(mo Member)
 	Deleted(id interface{})
 
+	// Modify swaps in a new value of the member, made by `modify` from its current
+	// value, atomically wrt other changes. `modify` should return a modified copy,
+	// leaving the value passed in untouched. `ok` is false if no such member.
+	Modify(id interface{}, modify func(mo Member) Member) (modified Member, ok bool)
+
+	// Check tells whether the member can be created or updated as is, e.g. not to
+	// violate a unique index, before it's written to the backing storage. nothing
+	// is changed, the caller should serialize its changes to keep it still true.
+	Check(mo Member) error
+
+	// Commit applies all changes in the change set under a single ccn, subscribers
+	// see them in one `MembersChanged` event. if any change fails, e.g. violating a
+	// unique index, none is applied and the failure panics. the ccn committed is
+	// returned, an empty change set commits nothing.
+	Commit(cs *ChangeSet) CCN
+
+	// AddIndex adds a secondary index maintained along with changes.
+	AddIndex(def Index) error
+	// AddSpatialIndex adds an index on positions of members.
+	AddSpatialIndex(def SpatialIndex) error
+
+	// ReadBy reads the member by key of a unique index, or any member with that key
+	// of a multi-valued index.
+	ReadBy(indexName string, key interface{}) (Member, bool)
+	// ReadAllBy reads all members with the key of an index.
+	ReadAllBy(indexName string, key interface{}) []Member
+	// ReadWithin reads all members located within the box by a spatial index.
+	ReadWithin(indexName string, bbox BBox) []Member
+
+	// Len returns the number of members loaded.
+	Len() int
+
+	// Subscribers returns the number of subscriptions still watching.
+	Subscribers() int
+
+	// Unload drops all members, to free the memory until loaded again. subscribers
+	// are kept, and they'll see an Epoch event when it's loaded again.
+	Unload()
+
+	// Close releases resources held, e.g. the journal, it should not be used any
+	// more afterwards.
+	Close() error
+
 	Publisher
 }
 
 func NewHouseKeeper() HouseKeeper {
 	return &houseKeeper{
-		ccn:     0,
+		ccn:     CCN{Epoch: NewEpoch()},
 		members: nil, // only store members if Load() ever called
-		ccES:    isoevt.NewStream(),
+		ccES:    NewChangeStream(),
 	}
 }
 
 type houseKeeper struct {
-	ccn     int // collection change number
+	ccn     CCN // collection change number
 	members map[interface{}]Member
+	indexes map[string]memberIndex // secondary indexes by name
 
 	mu sync.RWMutex // collection change mutex
 
 	ccES *isoevt.EventStream // collection change event stream
+
+	journaled bool   // whether ccES is journaled, so ccn survives process restarts
+	pubName   string // name the ccES is published by, for lag gauges
+
+	muLog     sync.Mutex    // change log mutex
+	changeLog []interface{} // latest change events, oldest first
+	logCCN    CCN           // ccn of the last logged change, or as of loaded
 }
 
-func (hk *houseKeeper) Load(fullList []Member) {
+// ChangeLogSize is the number of latest changes a house keeper keeps, for consumers
+// to catch up from, instead of reloading the whole collection.
+var ChangeLogSize = 1000
+
+func (hk *houseKeeper) Load(fullList []Member) error {
+	// populated aside, to be swapped in only if all good
+	members := make(map[interface{}]Member, len(fullList))
+	for _, mo := range fullList {
+		id := mo.GetID()
+		if _, ok := members[id]; ok {
+			return errors.Errorf("Duplicate member id %+v", id)
+		}
+		members[id] = mo
+	}
+
 	hk.mu.Lock()
 	defer hk.mu.Unlock()
 
-	hk.members = make(map[interface{}]Member)
-	for _, mo := range fullList {
-		hk.members[mo.GetID()] = mo
+	indexes, err := reindexed(hk.indexes, members)
+	if err != nil {
+		return err
+	}
+	hk.members, hk.indexes = members, indexes
+	if !hk.journaled {
+		// a fresh history, unless continuing a journaled one
+		hk.ccn = CCN{Epoch: NewEpoch()}
+	}
+
+	hk.muLog.Lock()
+	if !hk.journaled || hk.logCCN != hk.ccn {
+		// changes before loading don't lead to the loaded state, unless it's right
+		// at the end of a journaled history
+		hk.changeLog, hk.logCCN = nil, hk.ccn
 	}
-	hk.ccn = 0
+	hk.muLog.Unlock()
 
 	{
 		hk.ccES.Post(EpochEvent{hk.ccn})
 	}
+	return nil
+}
+
+func (hk *houseKeeper) Len() int {
+	hk.mu.RLock()
+	defer hk.mu.RUnlock()
+
+	return len(hk.members)
+}
+
+func (hk *houseKeeper) Subscribers() int {
+	return hk.ccES.Watchers()
+}
+
+func (hk *houseKeeper) Unload() {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	hk.members = nil
+	for _, idx := range hk.indexes {
+		idx.reset()
+	}
+
+	hk.muLog.Lock()
+	hk.changeLog = nil
+	hk.muLog.Unlock()
+}
+
+func (hk *houseKeeper) Close() error {
+	if hk.pubName != "" {
+		hk.ccES.Unpublish(hk.pubName)
+	}
+	return hk.ccES.Close()
 }
 
 func (hk *houseKeeper) Read(id interface{}) (Member, bool) {
+	hk.mu.RLock()
+	defer hk.mu.RUnlock()
+
 	if hk.members == nil {
 		panic("Not a loaded collection.")
 	}
 
+	mbyid, ok := hk.members[id]
+	return mbyid, ok
+}
+
+func (hk *houseKeeper) FetchMember(id interface{}) (ccn CCN, mo Member, ok bool) {
 	hk.mu.RLock()
 	defer hk.mu.RUnlock()
 
-	mbyid, ok := hk.members[id]
-	return mbyid, ok
+	if hk.members == nil {
+		panic("Not a loaded collection.")
+	}
+
+	mo, ok = hk.members[id]
+	return hk.ccn, mo, ok
 }
 
 func (hk *houseKeeper) Created(mo Member) {
-	if hk.members != nil {
-		func() {
-			hk.mu.Lock()
-			defer hk.mu.Unlock()
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
 
-			id := mo.GetID()
-			hk.members[id] = mo
-		}()
+	if hk.members != nil {
+		id := mo.GetID()
+		indexMember(hk.indexes, id, mo)
+		hk.members[id] = mo
 	}
 
-	hk.ccn++
+	hk.ccn = hk.ccn.Next()
 
 	{
-		hk.ccES.Post(CreatedEvent{hk.ccn, mo})
+		evt := CreatedEvent{hk.ccn, mo}
+		hk.logChange(evt)
+		hk.ccES.Post(evt)
 	}
 }
 
 func (hk *houseKeeper) Updated(mo Member) {
-	if hk.members != nil {
-		func() {
-			hk.mu.Lock()
-			defer hk.mu.Unlock()
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
 
-			id := mo.GetID()
-			hk.members[id] = mo
-		}()
+	hk.updated(mo)
+}
+
+// should be called with `hk.mu` locked.
+func (hk *houseKeeper) updated(mo Member) {
+	var delta Delta // not known unless loaded
+	if hk.members != nil {
+		id := mo.GetID()
+		if former, ok := hk.members[id]; ok {
+			delta = Diff(former, mo)
+		}
+		indexMember(hk.indexes, id, mo)
+		hk.members[id] = mo
 	}
 
-	hk.ccn++
+	hk.ccn = hk.ccn.Next()
 
 	{
-		hk.ccES.Post(UpdatedEvent{hk.ccn, mo})
+		evt := UpdatedEvent{hk.ccn, mo, delta}
+		hk.logChange(evt)
+		hk.ccES.Post(evt)
 	}
 }
 
-func (hk *houseKeeper) Deleted(id interface{}) {
-	if hk.members != nil {
-		func() {
-			hk.mu.Lock()
-			defer hk.mu.Unlock()
+func (hk *houseKeeper) Modify(id interface{}, modify func(mo Member) Member) (Member, bool) {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
 
-			if _, ok := hk.members[id]; !ok {
-				panic(errors.Errorf("Removing non member id %+v", id))
-			}
-		}()
+	if hk.members == nil {
+		panic("Not a loaded collection.")
 	}
 
-	hk.ccn++
-
-	{
-		hk.ccES.Post(DeletedEvent{hk.ccn, id})
+	mo, ok := hk.members[id]
+	if !ok {
+		return nil, false
+	}
+	mo = modify(mo)
+	if mo.GetID() != id {
+		panic(errors.Errorf("Member id changed by modification %+v -> %+v", id, mo.GetID()))
 	}
+	hk.updated(mo)
+	return mo, true
 }
 
-func (hk *houseKeeper) FetchAll() (ccn int, members []Member) {
+func (hk *houseKeeper) Check(mo Member) error {
+	hk.mu.RLock()
+	defer hk.mu.RUnlock()
+
 	if hk.members == nil {
 		panic("Not a loaded collection.")
 	}
+	return checkMember(hk.indexes, mo.GetID(), mo)
+}
+
+func (hk *houseKeeper) Deleted(id interface{}) {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	if hk.members != nil {
+		if _, ok := hk.members[id]; !ok {
+			panic(errors.Errorf("Removing non member id %+v", id))
+		}
+		unindexMember(hk.indexes, id)
+		delete(hk.members, id)
+	}
+
+	hk.ccn = hk.ccn.Next()
+
+	{
+		evt := DeletedEvent{hk.ccn, id}
+		hk.logChange(evt)
+		hk.ccES.Post(evt)
+	}
+}
 
+// FetchAll returns a point-in-time snapshot of the collection, with the ccn it's
+// consistent with. members are immutable, so they're safe to be read w/o sync.
+func (hk *houseKeeper) FetchAll() (ccn CCN, members []Member) {
 	hk.mu.RLock()
 	defer hk.mu.RUnlock()
 
+	if hk.members == nil {
+		panic("Not a loaded collection.")
+	}
+
 	members = make([]Member, 0, len(hk.members))
 	for _, cmo := range hk.members {
 		members = append(members, cmo)
@@ -138,10 +314,56 @@ func (hk *houseKeeper) FetchAll() (ccn int, members []Member) {
 	return
 }
 
-func (hk *houseKeeper) Subscribe(subr Subscriber) {
-	Dispatch(hk.ccES, subr, func() bool {
+func (hk *houseKeeper) logChange(evt interface{}) {
+	hk.muLog.Lock()
+	defer hk.muLog.Unlock()
+
+	hk.changeLog = append(hk.changeLog, evt)
+	hk.logCCN = eventCCN(evt)
+	if len(hk.changeLog) >= 2*ChangeLogSize {
+		// trim in batch, to not copy on every change
+		hk.changeLog = append([]interface{}(nil), hk.changeLog[len(hk.changeLog)-ChangeLogSize:]...)
+	}
+}
+
+func (hk *houseKeeper) FetchChangesSince(ccn CCN) (changes []interface{}, ok bool) {
+	hk.muLog.Lock()
+	defer hk.muLog.Unlock()
+
+	order, distance := hk.logCCN.Compare(ccn)
+	switch order {
+	case CCNEqual:
+		return nil, true
+	case CCNAhead:
+		if distance > uint64(len(hk.changeLog)) || distance > uint64(ChangeLogSize) {
+			// too old to catch up from
+			return nil, false
+		}
+		changes = make([]interface{}, distance)
+		copy(changes, hk.changeLog[len(hk.changeLog)-int(distance):])
+		return changes, true
+	default:
+		// of another epoch, or ahead of the log, e.g. known from a former incarnation
+		return nil, false
+	}
+}
+
+func (hk *houseKeeper) Subscribe(subr Subscriber) (unsubscribe func()) {
+	return Dispatch(hk.ccES, subr, func() bool {
 		// fire Epoch event upon watching started
-		subr.Epoch(hk.ccn)
-		return false
+		hk.mu.RLock()
+		ccn := hk.ccn
+		hk.mu.RUnlock()
+		return subr.Epoch(ccn)
 	})
 }
+
+func (hk *houseKeeper) SubscribeFiltered(subr Subscriber, pred func(mo Member) bool) (unsubscribe func()) {
+	return hk.Subscribe(Filtered(hk, subr, pred))
+}
+
+func (hk *houseKeeper) SubscribeMember(id interface{}, watcher MemberWatcher) (unsubscribe func()) {
+	return hk.Subscribe(WatchMember(id, watcher, func() (CCN, Member, bool) {
+		return hk.FetchMember(id)
+	}))
+}
@@ -0,0 +1,120 @@
+package livecoll
+
+import (
+	"fmt"
+	"testing"
+)
+
+// a member for tests, located, sequenced and movable
+type testMember struct {
+	ID     string
+	Seq    int
+	X, Y   float64
+	Moving bool
+	Label  string
+}
+
+func (mo *testMember) GetID() interface{} {
+	return mo.ID
+}
+
+func (mo *testMember) GetSeq() int {
+	return mo.Seq
+}
+
+func (mo *testMember) GetXY() (x, y float64) {
+	return mo.X, mo.Y
+}
+
+func (mo *testMember) IsMoving() bool {
+	return mo.Moving
+}
+
+func init() {
+	RegisterMemberType("livecoll.testMember", (*testMember)(nil))
+}
+
+// a loaded house keeper with members of seqs 1..n, at (seq, seq)
+func loadedKeeper(t *testing.T, n int) HouseKeeper {
+	hk := NewHouseKeeper()
+	members := make([]Member, n)
+	for i := range members {
+		members[i] = seqMember(i + 1)
+	}
+	if err := hk.Load(members); err != nil {
+		t.Fatalf("Not loaded: %+v", err)
+	}
+	return hk
+}
+
+func seqMember(seq int) *testMember {
+	return &testMember{ID: memberID(seq), Seq: seq, X: float64(seq), Y: float64(seq)}
+}
+
+func memberID(seq int) string {
+	return fmt.Sprintf("m%02d", seq)
+}
+
+// a copy of the member with changes made
+func modified(mo Member, modify func(mo *testMember)) *testMember {
+	copied := *mo.(*testMember)
+	modify(&copied)
+	return &copied
+}
+
+func TestFetchChangesSince(t *testing.T) {
+	defer func(size int) { ChangeLogSize = size }(ChangeLogSize)
+	ChangeLogSize = 3
+
+	hk := loadedKeeper(t, 3)
+	loaded, _ := hk.FetchAll()
+	if changes, ok := hk.FetchChangesSince(loaded); !ok || len(changes) != 0 {
+		t.Fatalf("Changes since loaded: %v %v", changes, ok)
+	}
+
+	hk.Created(seqMember(4))
+	created, _ := hk.FetchAll()
+	hk.Updated(modified(seqMember(1), func(mo *testMember) { mo.Label = "updated" }))
+	hk.Deleted(memberID(2))
+	hk.Created(seqMember(5))
+	latest, _ := hk.FetchAll()
+
+	// 4 changes since loaded, more than the log keeps
+	if changes, ok := hk.FetchChangesSince(loaded); ok {
+		t.Fatalf("Caught up from a ccn too old: %v", changes)
+	}
+	changes, ok := hk.FetchChangesSince(created)
+	if !ok || len(changes) != 3 {
+		t.Fatalf("Changes since %v: %v %v", created, changes, ok)
+	}
+	if evt, ok := changes[0].(UpdatedEvent); !ok || evt.CCN != created.Next() ||
+		evt.EO.(*testMember).Label != "updated" {
+		t.Fatalf("Not updated first: %+v", changes[0])
+	}
+	if evt, ok := changes[1].(DeletedEvent); !ok || evt.ID != memberID(2) {
+		t.Fatalf("Not deleted second: %+v", changes[1])
+	}
+	if evt, ok := changes[2].(CreatedEvent); !ok || evt.CCN != latest ||
+		evt.EO.GetID() != memberID(5) {
+		t.Fatalf("Not created last: %+v", changes[2])
+	}
+	if changes, ok := hk.FetchChangesSince(latest); !ok || len(changes) != 0 {
+		t.Fatalf("Changes since latest: %v %v", changes, ok)
+	}
+
+	// of another epoch, or ahead of the collection
+	if changes, ok := hk.FetchChangesSince(CCN{Epoch: NewEpoch()}); ok {
+		t.Fatalf("Caught up from another epoch: %v", changes)
+	}
+	if changes, ok := hk.FetchChangesSince(latest.Next()); ok {
+		t.Fatalf("Caught up from ahead: %v", changes)
+	}
+
+	// a reload starts a new epoch, changes before are gone
+	if err := hk.Load([]Member{seqMember(1)}); err != nil {
+		t.Fatal(err)
+	}
+	if changes, ok := hk.FetchChangesSince(latest); ok {
+		t.Fatalf("Caught up across reloaded: %v", changes)
+	}
+}
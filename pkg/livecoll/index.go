@@ -0,0 +1,428 @@
+package livecoll
+
+import (
+	"math"
+
+	"github.com/complyue/hbigo/pkg/errors"
+)
+
+// Index defines a secondary index on members of a house keeper, it's maintained
+// under the collection change lock along with the members.
+type Index struct {
+	Name string
+
+	// at most one member per key if unique, or any number of members
+	Unique bool
+
+	// extracts the key of a member, a nil key leaves the member out of the index
+	Key func(mo Member) interface{}
+}
+
+// SpatialIndex defines an index on X/Y positions of members, for range lookups
+// by bounding box.
+type SpatialIndex struct {
+	Name string
+
+	// size of grid cells, members are bucketed by the cell they're located in,
+	// should be about the size of a typical lookup box
+	CellSize float64
+
+	// extracts the position of a member, `ok` being false leaves the member out
+	// of the index. `LocatedXY` is used if nil.
+	XY func(mo Member) (x, y float64, ok bool)
+}
+
+// LocatedXY extracts the position of a `Located` member.
+func LocatedXY(mo Member) (x, y float64, ok bool) {
+	lo, ok := mo.(Located)
+	if !ok {
+		return
+	}
+	x, y = lo.GetXY()
+	return
+}
+
+// what the house keeper needs from an index to maintain it
+type memberIndex interface {
+	name() string
+	// check whether the member can be indexed, before any change is made
+	check(id interface{}, mo Member) error
+	put(id interface{}, mo Member)
+	remove(id interface{})
+	reset()
+	// an empty index of the same definition
+	fresh() memberIndex
+}
+
+type idSet map[interface{}]struct{}
+
+type keyIndex struct {
+	Index
+
+	keys  map[interface{}]interface{} // member id to key
+	byKey map[interface{}]idSet       // key to member ids
+}
+
+func (idx *keyIndex) name() string {
+	return idx.Name
+}
+
+func (idx *keyIndex) check(id interface{}, mo Member) error {
+	if !idx.Unique {
+		return nil
+	}
+	key := idx.Key(mo)
+	if key == nil {
+		return nil
+	}
+	for otherID := range idx.byKey[key] {
+		if otherID != id {
+			return errors.Errorf("Duplicate key %+v for unique index [%s], id %+v vs %+v",
+				key, idx.Name, id, otherID)
+		}
+	}
+	return nil
+}
+
+func (idx *keyIndex) put(id interface{}, mo Member) {
+	// the member may have been changed in place, don't derive the former key from it
+	idx.remove(id)
+	key := idx.Key(mo)
+	if key == nil {
+		return
+	}
+	ids := idx.byKey[key]
+	if ids == nil {
+		ids = make(idSet)
+		idx.byKey[key] = ids
+	}
+	ids[id] = struct{}{}
+	idx.keys[id] = key
+}
+
+func (idx *keyIndex) remove(id interface{}) {
+	key, ok := idx.keys[id]
+	if !ok {
+		return
+	}
+	delete(idx.keys, id)
+	if ids := idx.byKey[key]; ids != nil {
+		delete(ids, id)
+		if len(ids) <= 0 {
+			delete(idx.byKey, key)
+		}
+	}
+}
+
+func (idx *keyIndex) reset() {
+	idx.keys = make(map[interface{}]interface{})
+	idx.byKey = make(map[interface{}]idSet)
+}
+
+func (idx *keyIndex) fresh() memberIndex {
+	return &keyIndex{Index: idx.Index}
+}
+
+type gridCell struct {
+	cx, cy int64
+}
+
+type spatialIndex struct {
+	SpatialIndex
+
+	pos   map[interface{}][2]float64 // member id to position
+	cells map[gridCell]idSet         // cell to member ids
+}
+
+// cell coordinates are clamped within this, for positions and boxes huge or
+// infinite to still map to cells, and spans between cells not to overflow
+const maxCellCoord = 1 << 52
+
+func (idx *spatialIndex) cellOf(x, y float64) gridCell {
+	return gridCell{idx.cellCoord(x), idx.cellCoord(y)}
+}
+
+func (idx *spatialIndex) cellCoord(v float64) int64 {
+	c := math.Floor(v / idx.CellSize)
+	if c > maxCellCoord {
+		return maxCellCoord
+	}
+	if !(c >= -maxCellCoord) { // NaN included
+		return -maxCellCoord
+	}
+	return int64(c)
+}
+
+func (idx *spatialIndex) name() string {
+	return idx.Name
+}
+
+func (idx *spatialIndex) check(id interface{}, mo Member) error {
+	return nil
+}
+
+func (idx *spatialIndex) put(id interface{}, mo Member) {
+	idx.remove(id)
+	x, y, ok := idx.XY(mo)
+	if !ok {
+		return
+	}
+	c := idx.cellOf(x, y)
+	ids := idx.cells[c]
+	if ids == nil {
+		ids = make(idSet)
+		idx.cells[c] = ids
+	}
+	ids[id] = struct{}{}
+	idx.pos[id] = [2]float64{x, y}
+}
+
+func (idx *spatialIndex) remove(id interface{}) {
+	p, ok := idx.pos[id]
+	if !ok {
+		return
+	}
+	delete(idx.pos, id)
+	c := idx.cellOf(p[0], p[1])
+	if ids := idx.cells[c]; ids != nil {
+		delete(ids, id)
+		if len(ids) <= 0 {
+			delete(idx.cells, c)
+		}
+	}
+}
+
+func (idx *spatialIndex) reset() {
+	idx.pos = make(map[interface{}][2]float64)
+	idx.cells = make(map[gridCell]idSet)
+}
+
+func (idx *spatialIndex) fresh() memberIndex {
+	return &spatialIndex{SpatialIndex: idx.SpatialIndex}
+}
+
+// ids of members located within the box
+func (idx *spatialIndex) within(bbox BBox) (ids []interface{}) {
+	c0, c1 := idx.cellOf(bbox.MinX, bbox.MinY), idx.cellOf(bbox.MaxX, bbox.MaxY)
+	spanX, spanY := c1.cx-c0.cx+1, c1.cy-c0.cy+1
+	if spanX <= 0 || spanY <= 0 {
+		return // an empty box
+	}
+	// compare spans separately first, their product may overflow
+	if n := int64(len(idx.cells)); spanX > n || spanY > n || spanX*spanY > n {
+		// the box covers more cells than populated, scan populated ones instead
+		for c, cids := range idx.cells {
+			if c.cx < c0.cx || c.cx > c1.cx || c.cy < c0.cy || c.cy > c1.cy {
+				continue
+			}
+			ids = idx.appendWithin(ids, cids, bbox)
+		}
+		return
+	}
+	for cx := c0.cx; cx <= c1.cx; cx++ {
+		for cy := c0.cy; cy <= c1.cy; cy++ {
+			ids = idx.appendWithin(ids, idx.cells[gridCell{cx, cy}], bbox)
+		}
+	}
+	return
+}
+
+func (idx *spatialIndex) appendWithin(ids []interface{}, cids idSet, bbox BBox) []interface{} {
+	for id := range cids {
+		if p := idx.pos[id]; bbox.Contains(p[0], p[1]) {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+func newKeyIndex(def Index) (*keyIndex, error) {
+	if def.Name == "" || def.Key == nil {
+		return nil, errors.New("Index needs a name and a key function.")
+	}
+	return &keyIndex{Index: def}, nil
+}
+
+func newSpatialIndex(def SpatialIndex) (*spatialIndex, error) {
+	if def.Name == "" || def.CellSize <= 0 {
+		return nil, errors.New("Spatial index needs a name and a positive cell size.")
+	}
+	if def.XY == nil {
+		def.XY = LocatedXY
+	}
+	return &spatialIndex{SpatialIndex: def}, nil
+}
+
+// AddIndex adds a secondary index, or replaces the one with the same name, it's
+// populated from existing members if already loaded.
+func (hk *houseKeeper) AddIndex(def Index) error {
+	idx, err := newKeyIndex(def)
+	if err != nil {
+		return err
+	}
+	return hk.addIndex(idx)
+}
+
+// AddSpatialIndex adds a spatial index, or replaces the one with the same name,
+// it's populated from existing members if already loaded.
+func (hk *houseKeeper) AddSpatialIndex(def SpatialIndex) error {
+	idx, err := newSpatialIndex(def)
+	if err != nil {
+		return err
+	}
+	return hk.addIndex(idx)
+}
+
+func (hk *houseKeeper) addIndex(idx memberIndex) error {
+	hk.mu.Lock()
+	defer hk.mu.Unlock()
+
+	if err := populateIndex(idx, hk.members); err != nil {
+		return err
+	}
+	if hk.indexes == nil {
+		hk.indexes = make(map[string]memberIndex)
+	}
+	hk.indexes[idx.name()] = idx
+	return nil
+}
+
+// should be called with `hk.mu` locked.
+func (hk *houseKeeper) indexOf(name string) memberIndex {
+	if hk.members == nil {
+		panic("Not a loaded collection.")
+	}
+	return indexNamed(hk.indexes, name)
+}
+
+func (hk *houseKeeper) ReadBy(indexName string, key interface{}) (Member, bool) {
+	hk.mu.RLock()
+	defer hk.mu.RUnlock()
+
+	return readBy(hk.indexOf(indexName), hk.members, key)
+}
+
+func (hk *houseKeeper) ReadAllBy(indexName string, key interface{}) []Member {
+	hk.mu.RLock()
+	defer hk.mu.RUnlock()
+
+	return readAllBy(hk.indexOf(indexName), hk.members, key)
+}
+
+func (hk *houseKeeper) ReadWithin(indexName string, bbox BBox) []Member {
+	hk.mu.RLock()
+	defer hk.mu.RUnlock()
+
+	return readWithin(hk.indexOf(indexName), hk.members, bbox)
+}
+
+// the following work on members with their indexes, as kept by house keepers and
+// replicas, the caller should have them locked.
+
+func populateIndex(idx memberIndex, members map[interface{}]Member) error {
+	idx.reset()
+	for id, mo := range members {
+		if err := idx.check(id, mo); err != nil {
+			return err
+		}
+		idx.put(id, mo)
+	}
+	return nil
+}
+
+func indexNamed(indexes map[string]memberIndex, name string) memberIndex {
+	idx, ok := indexes[name]
+	if !ok {
+		panic(errors.Errorf("No index named [%s]", name))
+	}
+	return idx
+}
+
+func checkMember(indexes map[string]memberIndex, id interface{}, mo Member) error {
+	for _, idx := range indexes {
+		if err := idx.check(id, mo); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func indexMember(indexes map[string]memberIndex, id interface{}, mo Member) {
+	if err := checkMember(indexes, id, mo); err != nil {
+		panic(err)
+	}
+	for _, idx := range indexes {
+		idx.put(id, mo)
+	}
+}
+
+func unindexMember(indexes map[string]memberIndex, id interface{}) {
+	for _, idx := range indexes {
+		idx.remove(id)
+	}
+}
+
+// indexes of the same definitions populated from scratch, the ones passed in are
+// left untouched, even if failed.
+func reindexed(
+	indexes map[string]memberIndex, members map[interface{}]Member,
+) (map[string]memberIndex, error) {
+	if indexes == nil {
+		return nil, nil
+	}
+	populated := make(map[string]memberIndex, len(indexes))
+	for name, idx := range indexes {
+		idx = idx.fresh()
+		if err := populateIndex(idx, members); err != nil {
+			return nil, err
+		}
+		populated[name] = idx
+	}
+	return populated, nil
+}
+
+func reindexAll(indexes map[string]memberIndex, members map[interface{}]Member) {
+	for _, idx := range indexes {
+		if err := populateIndex(idx, members); err != nil {
+			panic(err)
+		}
+	}
+}
+
+func readBy(idx memberIndex, members map[interface{}]Member, key interface{}) (Member, bool) {
+	kidx, ok := idx.(*keyIndex)
+	if !ok {
+		panic(errors.Errorf("Index [%s] is not keyed.", idx.name()))
+	}
+	for id := range kidx.byKey[key] {
+		mo, ok := members[id]
+		return mo, ok
+	}
+	return nil, false
+}
+
+func readAllBy(idx memberIndex, members map[interface{}]Member, key interface{}) []Member {
+	kidx, ok := idx.(*keyIndex)
+	if !ok {
+		panic(errors.Errorf("Index [%s] is not keyed.", idx.name()))
+	}
+	ids := kidx.byKey[key]
+	result := make([]Member, 0, len(ids))
+	for id := range ids {
+		result = append(result, members[id])
+	}
+	return result
+}
+
+func readWithin(idx memberIndex, members map[interface{}]Member, bbox BBox) []Member {
+	sidx, ok := idx.(*spatialIndex)
+	if !ok {
+		panic(errors.Errorf("Index [%s] is not spatial.", idx.name()))
+	}
+	ids := sidx.within(bbox)
+	result := make([]Member, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, members[id])
+	}
+	return result
+}
@@ -0,0 +1,134 @@
+package livecoll
+
+import (
+	"math"
+	"sort"
+	"testing"
+)
+
+func seqsOf(members []Member) []int {
+	seqs := make([]int, len(members))
+	for i, mo := range members {
+		seqs[i] = mo.(*testMember).Seq
+	}
+	sort.Ints(seqs)
+	return seqs
+}
+
+func sameSeqs(a, b []int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestReadWithin(t *testing.T) {
+	hk := loadedKeeper(t, 20)
+	if err := hk.AddSpatialIndex(SpatialIndex{Name: "xy", CellSize: 5}); err != nil {
+		t.Fatal(err)
+	}
+	far := seqMember(21)
+	far.X, far.Y = 1e300, -1e300
+	hk.Created(far)
+	hk.Modify(memberID(3), func(mo Member) Member {
+		return modified(mo, func(mo *testMember) { mo.X, mo.Y = 50, 50 })
+	})
+	hk.Deleted(memberID(4))
+
+	inf := math.Inf(1)
+	for _, bbox := range []BBox{
+		{0, 0, 4.5, 4.5},
+		{2, 2, 12, 12},
+		{-1e300, -1e300, 1e300, 1e300},
+		{-inf, -inf, inf, inf},
+		{0, -inf, inf, 10},
+		{-inf, 45, 55, inf},
+		{10, 10, 0, 0},
+		{math.NaN(), 0, 10, 10},
+	} {
+		var want []int
+		_, members := hk.FetchAll()
+		for _, mo := range members {
+			if bbox.Contains(mo.(*testMember).GetXY()) {
+				want = append(want, mo.(*testMember).Seq)
+			}
+		}
+		sort.Ints(want)
+		if got := seqsOf(hk.ReadWithin("xy", bbox)); !sameSeqs(got, want) {
+			t.Errorf("Within %+v read %v instead of %v", bbox, got, want)
+		}
+	}
+}
+
+func TestReadByUnique(t *testing.T) {
+	hk := loadedKeeper(t, 3)
+	byLabel := Index{Name: "label", Unique: true, Key: func(mo Member) interface{} {
+		if label := mo.(*testMember).Label; label != "" {
+			return label
+		}
+		return nil
+	}}
+	if err := hk.AddIndex(byLabel); err != nil {
+		t.Fatal(err)
+	}
+	labeled := func(seq int, label string) *testMember {
+		mo := seqMember(seq)
+		mo.Label = label
+		return mo
+	}
+	hk.Updated(labeled(1, "a"))
+	hk.Updated(labeled(2, "b"))
+
+	if mo, ok := hk.ReadBy("label", "a"); !ok || mo.GetID() != memberID(1) {
+		t.Fatalf("Read %+v by label", mo)
+	}
+	if mo, ok := hk.ReadBy("label", "z"); ok {
+		t.Fatalf("Read %+v by a label not used", mo)
+	}
+	if err := hk.Check(labeled(3, "a")); err == nil {
+		t.Fatal("Duplicate label passed check")
+	}
+	if err := hk.Check(labeled(1, "a")); err != nil {
+		t.Fatalf("Unchanged label failed check: %v", err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("Duplicate label created")
+			}
+		}()
+		hk.Created(labeled(4, "b"))
+	}()
+
+	// loading fails with nothing changed
+	ccn, _ := hk.FetchAll()
+	for _, fullList := range [][]Member{
+		{labeled(1, "x"), labeled(2, "x")},
+		{labeled(1, "x"), labeled(1, "y")},
+	} {
+		if err := hk.Load(fullList); err == nil {
+			t.Fatalf("Loaded %+v", fullList)
+		}
+		if after, members := hk.FetchAll(); after != ccn || len(members) != 3 {
+			t.Fatalf("Changed to %v %+v by a failed load", after, members)
+		}
+		if mo, ok := hk.ReadBy("label", "b"); !ok || mo.GetID() != memberID(2) {
+			t.Fatalf("Read %+v by label after a failed load", mo)
+		}
+		if _, ok := hk.ReadBy("label", "x"); ok {
+			t.Fatal("Index changed by a failed load")
+		}
+	}
+
+	if err := hk.Load([]Member{labeled(1, "b"), labeled(2, "a")}); err != nil {
+		t.Fatal(err)
+	}
+	if mo, ok := hk.ReadBy("label", "b"); !ok || mo.GetID() != memberID(1) {
+		t.Fatalf("Read %+v by label after reloaded", mo)
+	}
+}
@@ -0,0 +1,316 @@
+package livecoll
+
+import (
+	"encoding/json"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"sync"
+
+	"github.com/complyue/ddgo/pkg/isoevt"
+	"github.com/complyue/ddgo/pkg/svcs"
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/golang/glog"
+)
+
+func init() {
+	isoevt.RegisterEventType("livecoll.Epoch", EpochEvent{})
+	isoevt.RegisterEventType("livecoll.Created", CreatedEvent{})
+	isoevt.RegisterEventType("livecoll.Updated", UpdatedEvent{})
+	isoevt.RegisterEventType("livecoll.Deleted", DeletedEvent{})
+	isoevt.RegisterEventType("livecoll.Batch", BatchEvent{})
+}
+
+var (
+	memberTypes   = make(map[string]reflect.Type)
+	idTypeMembers = make(map[reflect.Type]string)
+	muMemberTypes sync.RWMutex
+)
+
+// RegisterMemberType registers a concrete member type by name, so change events
+// carrying members of this type can be journaled. `proto` is normally a typed nil
+// pointer, e.g. `(*Waypoint)(nil)`.
+func RegisterMemberType(name string, proto Member) {
+	muMemberTypes.Lock()
+	defer muMemberTypes.Unlock()
+
+	t := reflect.TypeOf(proto)
+	memberTypes[name] = t
+	// a zero value member tells the concrete type of its id
+	idType := reflect.TypeOf(newMember(t).GetID())
+	if _, ok := idTypeMembers[idType]; !ok {
+		idTypeMembers[idType] = name
+	}
+}
+
+func newMember(t reflect.Type) Member {
+	if t.Kind() == reflect.Ptr {
+		return reflect.New(t.Elem()).Interface().(Member)
+	}
+	return reflect.New(t).Elem().Interface().(Member)
+}
+
+// the JSON form of member carrying events
+type memberEventJSON struct {
+	CCN  CCN
+	Type string
+	EO   json.RawMessage `json:",omitempty"`
+	ID   json.RawMessage `json:",omitempty"`
+
+	// fields changed by an update, values come back as decoded from json
+	Delta Delta `json:",omitempty"`
+}
+
+func marshalMember(ccn CCN, eo Member, delta Delta) ([]byte, error) {
+	muMemberTypes.RLock()
+	var typeName string
+	for name, t := range memberTypes {
+		if t == reflect.TypeOf(eo) {
+			typeName = name
+			break
+		}
+	}
+	muMemberTypes.RUnlock()
+	if typeName == "" {
+		return nil, errors.Errorf("Member of type %T not registered.", eo)
+	}
+	data, err := json.Marshal(eo)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(memberEventJSON{CCN: ccn, Type: typeName, EO: data, Delta: delta})
+}
+
+func unmarshalMember(data []byte) (ccn CCN, eo Member, delta Delta, err error) {
+	var mej memberEventJSON
+	if err = json.Unmarshal(data, &mej); err != nil {
+		return
+	}
+	muMemberTypes.RLock()
+	t, ok := memberTypes[mej.Type]
+	muMemberTypes.RUnlock()
+	if !ok {
+		err = errors.Errorf("Member type [%s] not registered.", mej.Type)
+		return
+	}
+	if t.Kind() == reflect.Ptr {
+		v := reflect.New(t.Elem())
+		if err = json.Unmarshal(mej.EO, v.Interface()); err != nil {
+			return
+		}
+		eo = v.Interface().(Member)
+	} else {
+		v := reflect.New(t)
+		if err = json.Unmarshal(mej.EO, v.Interface()); err != nil {
+			return
+		}
+		eo = v.Elem().Interface().(Member)
+	}
+	ccn, delta = mej.CCN, mej.Delta
+	return
+}
+
+func (evt CreatedEvent) MarshalJSON() ([]byte, error) {
+	return marshalMember(evt.CCN, evt.EO, nil)
+}
+
+func (evt *CreatedEvent) UnmarshalJSON(data []byte) (err error) {
+	evt.CCN, evt.EO, _, err = unmarshalMember(data)
+	return
+}
+
+func (evt UpdatedEvent) MarshalJSON() ([]byte, error) {
+	return marshalMember(evt.CCN, evt.EO, evt.Delta)
+}
+
+func (evt *UpdatedEvent) UnmarshalJSON(data []byte) (err error) {
+	evt.CCN, evt.EO, evt.Delta, err = unmarshalMember(data)
+	return
+}
+
+func (evt DeletedEvent) MarshalJSON() ([]byte, error) {
+	muMemberTypes.RLock()
+	typeName, ok := idTypeMembers[reflect.TypeOf(evt.ID)]
+	muMemberTypes.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("No member type registered with id of type %T.", evt.ID)
+	}
+	data, err := json.Marshal(evt.ID)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(memberEventJSON{CCN: evt.CCN, Type: typeName, ID: data})
+}
+
+func (evt *DeletedEvent) UnmarshalJSON(data []byte) error {
+	var mej memberEventJSON
+	if err := json.Unmarshal(data, &mej); err != nil {
+		return err
+	}
+	muMemberTypes.RLock()
+	t, ok := memberTypes[mej.Type]
+	muMemberTypes.RUnlock()
+	if !ok {
+		return errors.Errorf("Member type [%s] not registered.", mej.Type)
+	}
+	idPtr := reflect.New(reflect.TypeOf(newMember(t).GetID()))
+	if err := json.Unmarshal(mej.ID, idPtr.Interface()); err != nil {
+		return err
+	}
+	evt.CCN, evt.ID = mej.CCN, idPtr.Elem().Interface()
+	return nil
+}
+
+// the JSON form of batch events, each change tagged with its kind
+type batchEventJSON struct {
+	CCN     CCN
+	Changes []changeJSON
+}
+
+type changeJSON struct {
+	Kind  string // created/updated/deleted
+	Event json.RawMessage
+}
+
+func (evt BatchEvent) MarshalJSON() ([]byte, error) {
+	bej := batchEventJSON{CCN: evt.CCN, Changes: make([]changeJSON, len(evt.Changes))}
+	for i, chg := range evt.Changes {
+		cj := &bej.Changes[i]
+		switch chg.(type) {
+		case CreatedEvent:
+			cj.Kind = "created"
+		case UpdatedEvent:
+			cj.Kind = "updated"
+		case DeletedEvent:
+			cj.Kind = "deleted"
+		default:
+			return nil, errors.Errorf("Change of type %T ?!", chg)
+		}
+		data, err := json.Marshal(chg)
+		if err != nil {
+			return nil, err
+		}
+		cj.Event = data
+	}
+	return json.Marshal(bej)
+}
+
+func (evt *BatchEvent) UnmarshalJSON(data []byte) error {
+	var bej batchEventJSON
+	if err := json.Unmarshal(data, &bej); err != nil {
+		return err
+	}
+	changes := make([]interface{}, len(bej.Changes))
+	for i, cj := range bej.Changes {
+		var err error
+		switch cj.Kind {
+		case "created":
+			var chg CreatedEvent
+			err = json.Unmarshal(cj.Event, &chg)
+			changes[i] = chg
+		case "updated":
+			var chg UpdatedEvent
+			err = json.Unmarshal(cj.Event, &chg)
+			changes[i] = chg
+		case "deleted":
+			var chg DeletedEvent
+			err = json.Unmarshal(cj.Event, &chg)
+			changes[i] = chg
+		default:
+			err = errors.Errorf("Change of kind [%s] ?!", cj.Kind)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	evt.CCN, evt.Changes = bej.CCN, changes
+	return nil
+}
+
+// NewJournaledHouseKeeper creates a house keeper with its collection changes
+// journaled, the collection change number continues from the journal. only the
+// latest `ChangeLogSize` changes are replayed, into the change log for consumers
+// to catch up from after a restart.
+func NewJournaledHouseKeeper(j isoevt.Journal) (HouseKeeper, error) {
+	ccES, err := isoevt.NewJournaledStream(j, ChangeLogSize, 0)
+	if err != nil {
+		return nil, err
+	}
+	guardLagging(ccES)
+	hk := &houseKeeper{
+		ccn:       CCN{Epoch: NewEpoch()},
+		members:   nil, // only store members if Load() ever called
+		ccES:      ccES,
+		journaled: true,
+	}
+	for _, evt := range ccES.Retained() {
+		ccn := eventCCN(evt)
+		if _, ok := evt.(EpochEvent); ok {
+			if ccn != hk.logCCN {
+				// a history restarted
+				hk.changeLog = nil
+			}
+		} else {
+			hk.changeLog = append(hk.changeLog, evt)
+		}
+		hk.ccn, hk.logCCN = ccn, ccn
+	}
+	if len(hk.changeLog) > ChangeLogSize {
+		hk.changeLog = hk.changeLog[len(hk.changeLog)-ChangeLogSize:]
+	}
+	return hk, nil
+}
+
+// OpenHouseKeeper creates a house keeper for the named collection of a tenant,
+// journaled under the directory configured as "journal" in etc/services.json, e.g.
+//
+//	"journal": {"url": "file:///var/lib/ddgo/journal"}
+//
+// or relative to the working directory, like `file:var/journal`. it's not journaled
+// at all if that's configured empty, as by default.
+//
+// the journal retains only recent changes, see `isoevt.FileJournal`. it's owned by
+// a single process, if another process has it open, e.g. a worker of the same pool,
+// the house keeper is not journaled, starting a new epoch instead.
+func OpenHouseKeeper(collName string, tid string) (hk HouseKeeper, err error) {
+	defer func() {
+		if hk != nil {
+			hk := hk.(*houseKeeper)
+			hk.pubName = collName + "/" + tid
+			hk.ccES.Publish(hk.pubName)
+		}
+	}()
+
+	cfg, err := svcs.GetServiceConfig("journal")
+	if err != nil || cfg.Url == "" {
+		// journal not configured
+		return NewHouseKeeper(), nil
+	}
+	u, err := url.Parse(cfg.Url)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Bad journal url [%s]", cfg.Url)
+	}
+	if u.Scheme != "file" {
+		return nil, errors.Errorf("Unsupported journal url [%s]", cfg.Url)
+	}
+	dir := u.Path
+	if dir == "" {
+		// a relative path like `file:var/journal` parses as opaque
+		dir = u.Opaque
+	}
+	if dir == "" {
+		return nil, errors.Errorf("No journal directory in url [%s]", cfg.Url)
+	}
+	j, err := isoevt.OpenFileJournal(
+		filepath.Join(dir, collName, url.PathEscape(tid)),
+		isoevt.FileJournalOptions{},
+	)
+	if err == isoevt.ErrJournalLocked {
+		glog.Warningf("Journal of %s/%s owned by another process, not journaled.", collName, tid)
+		return NewHouseKeeper(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return NewJournaledHouseKeeper(j)
+}
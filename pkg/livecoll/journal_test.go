@@ -0,0 +1,139 @@
+package livecoll
+
+import (
+	"testing"
+
+	"github.com/complyue/ddgo/pkg/isoevt"
+	"github.com/complyue/ddgo/pkg/svcs"
+)
+
+func openJournaled(t *testing.T, dir string) HouseKeeper {
+	j, err := isoevt.OpenFileJournal(dir, isoevt.FileJournalOptions{})
+	if err != nil {
+		t.Fatalf("Journal not opened: %+v", err)
+	}
+	hk, err := NewJournaledHouseKeeper(j)
+	if err != nil {
+		t.Fatalf("Journal not replayed: %+v", err)
+	}
+	return hk
+}
+
+func TestJournaledRestartCatchesUp(t *testing.T) {
+	dir := t.TempDir()
+
+	hk := openJournaled(t, dir)
+	if err := hk.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	for seq := 1; seq <= 3; seq++ {
+		hk.Created(seqMember(seq))
+	}
+	before, _ := hk.FetchAll()
+	mo, _ := hk.Read(memberID(1))
+	hk.Updated(modified(mo, func(mo *testMember) { mo.Label = "first" }))
+	hk.Deleted(memberID(2))
+	hk.Created(seqMember(4))
+	after, members := hk.FetchAll()
+	if err := hk.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// restarted, loading what's in the backing storage
+	hk = openJournaled(t, dir)
+	defer hk.Close()
+	if err := hk.Load(members); err != nil {
+		t.Fatal(err)
+	}
+	if ccn, _ := hk.FetchAll(); ccn != after {
+		t.Fatalf("Restarted at %v, but was at %v", ccn, after)
+	}
+	changes, ok := hk.FetchChangesSince(before)
+	if !ok || len(changes) != 3 {
+		t.Fatalf("Not caught up from %v after restarted: %v %+v", before, ok, changes)
+	}
+	if _, ok := changes[0].(UpdatedEvent); !ok {
+		t.Errorf("Update not the first change: %+v", changes[0])
+	}
+	if evt, ok := changes[1].(DeletedEvent); !ok || evt.ID != memberID(2) {
+		t.Errorf("Deletion not the second change: %+v", changes[1])
+	}
+	if evt, ok := changes[2].(CreatedEvent); !ok || evt.CCN != after {
+		t.Errorf("Creation not the last change: %+v", changes[2])
+	}
+
+	// changes go on from where the journal was
+	hk.Created(seqMember(5))
+	if ccn, _ := hk.FetchAll(); ccn.Epoch != after.Epoch || ccn.Seq != after.Seq+1 {
+		t.Fatalf("Changed to %v after restarted at %v", ccn, after)
+	}
+}
+
+func TestJournaledRestartReplaysChangeLogSize(t *testing.T) {
+	defer func(size int) { ChangeLogSize = size }(ChangeLogSize)
+	ChangeLogSize = 2
+	dir := t.TempDir()
+
+	hk := openJournaled(t, dir)
+	if err := hk.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	var ccns []CCN
+	for seq := 1; seq <= 5; seq++ {
+		hk.Created(seqMember(seq))
+		ccn, _ := hk.FetchAll()
+		ccns = append(ccns, ccn)
+	}
+	_, members := hk.FetchAll()
+	hk.Close()
+
+	hk = openJournaled(t, dir)
+	defer hk.Close()
+	if err := hk.Load(members); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := hk.FetchChangesSince(ccns[1]); ok {
+		t.Fatalf("Caught up from %v beyond the change log size", ccns[1])
+	}
+	if changes, ok := hk.FetchChangesSince(ccns[2]); !ok || len(changes) != 2 {
+		t.Fatalf("Not caught up from %v: %v %+v", ccns[2], ok, changes)
+	}
+}
+
+func TestJournalOwnedByOne(t *testing.T) {
+	svcs.OverrideServiceConfig("journal", svcs.ServiceConfig{Url: "file:" + t.TempDir()})
+	defer svcs.OverrideServiceConfig("journal", svcs.ServiceConfig{})
+
+	owner, err := OpenHouseKeeper("owned", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !owner.(*houseKeeper).journaled {
+		t.Fatal("First opened not journaled")
+	}
+	other, err := OpenHouseKeeper("owned", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.(*houseKeeper).journaled {
+		t.Fatal("Journaled by two at the same time")
+	}
+	if err := other.Load(nil); err != nil {
+		t.Fatal(err)
+	}
+	if ccn, _ := other.FetchAll(); ccn.Epoch == 0 || ccn.Seq != 0 {
+		t.Fatalf("Not a new epoch: %v", ccn)
+	}
+	other.Close()
+
+	// released on close
+	owner.Close()
+	again, err := OpenHouseKeeper("owned", "t1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if !again.(*houseKeeper).journaled {
+		t.Fatal("Not journaled after the owner closed")
+	}
+}
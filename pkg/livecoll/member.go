@@ -0,0 +1,110 @@
+package livecoll
+
+import (
+	"reflect"
+)
+
+// MemberWatcher watches a single member of a collection, e.g. for a detail panel
+// or an alert rule concerning only that member.
+type MemberWatcher interface {
+	// Current occurs first with the value of the member as subscribed, and again
+	// upon resync, e.g. after the wire reconnected, if it has changed meanwhile.
+	Current(ccn CCN, mo Member) (stop bool)
+
+	// Updated occurs after the member get updated, `delta` lists the fields changed,
+	// it's nil if not known.
+	Updated(ccn CCN, mo Member, delta Delta) (stop bool)
+
+	// Deleted occurs after the member get deleted, or when it's found not existing
+	// upon subscribed or resync. it's terminal, the subscription finishes after it.
+	Deleted(ccn CCN, id interface{})
+}
+
+// WatchMember makes a subscriber relaying changes of the member with `id` to the
+// watcher, it should subscribe to a publisher of the collection, either filtered
+// or not. `fetch` reads the member with the ccn it's consistent with, `ok` being
+// false if no such member, it's called upon each Epoch event.
+//
+// it's not a coalescing subscriber, the watcher sees every update of the member,
+// even when it's lagging behind.
+func WatchMember(
+	id interface{}, watcher MemberWatcher,
+	fetch func() (ccn CCN, mo Member, ok bool),
+) Subscriber {
+	return &memberSubscriber{id: id, watcher: watcher, fetch: fetch}
+}
+
+type memberSubscriber struct {
+	id      interface{}
+	watcher MemberWatcher
+	fetch   func() (ccn CCN, mo Member, ok bool)
+
+	mo      Member // last known value of the member
+	snapCCN CCN    // ccn the last fetched value is consistent with
+}
+
+// whether the change has been reflected by the last fetch
+func (ms *memberSubscriber) seen(ccn CCN) bool {
+	order, _ := ccn.Compare(ms.snapCCN)
+	return order == CCNBehind || order == CCNEqual
+}
+
+func (ms *memberSubscriber) Subscribed() (stop bool) {
+	return
+}
+
+func (ms *memberSubscriber) Epoch(ccn CCN) (stop bool) {
+	snapCCN, mo, ok := ms.fetch()
+	if !ok {
+		ms.watcher.Deleted(snapCCN, ms.id)
+		return true
+	}
+	ms.snapCCN = snapCCN
+	if ms.mo != nil && reflect.DeepEqual(ms.mo, mo) {
+		// not changed, e.g. just reconnected
+		return
+	}
+	ms.mo = mo
+	return ms.watcher.Current(snapCCN, mo)
+}
+
+func (ms *memberSubscriber) MemberCreated(ccn CCN, eo Member) (stop bool) {
+	if ms.seen(ccn) || eo.GetID() != ms.id {
+		return
+	}
+	// entering a filtered set
+	return ms.updated(ccn, eo, Diff(ms.mo, eo))
+}
+
+func (ms *memberSubscriber) MemberUpdated(ccn CCN, eo Member, delta Delta) (stop bool) {
+	if ms.seen(ccn) || eo.GetID() != ms.id {
+		return
+	}
+	return ms.updated(ccn, eo, delta)
+}
+
+func (ms *memberSubscriber) updated(ccn CCN, eo Member, delta Delta) (stop bool) {
+	ms.mo = eo
+	return ms.watcher.Updated(ccn, eo, delta)
+}
+
+func (ms *memberSubscriber) MemberDeleted(ccn CCN, id interface{}) (stop bool) {
+	if ms.seen(ccn) || id != ms.id {
+		return
+	}
+	ms.watcher.Deleted(ccn, id)
+	return true
+}
+
+func (ms *memberSubscriber) MembersChanged(ccn CCN, changes []interface{}) (stop bool) {
+	if ms.seen(ccn) {
+		return
+	}
+	for _, chg := range changes {
+		// changes to other members are skipped by id
+		if stop = dispatchEvent(ms, chg); stop {
+			return
+		}
+	}
+	return
+}
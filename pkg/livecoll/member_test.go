@@ -0,0 +1,83 @@
+package livecoll
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// records what a member watcher sees, blocking on the first update until released
+type memberRecorder struct {
+	current chan struct{}
+	release chan struct{}
+
+	mu      sync.Mutex
+	labels  []string
+	deleted bool
+	done    chan struct{}
+}
+
+func (mr *memberRecorder) seen() (labels []string, deleted bool) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	return append([]string(nil), mr.labels...), mr.deleted
+}
+
+func (mr *memberRecorder) Current(ccn CCN, mo Member) (stop bool) {
+	close(mr.current)
+	return
+}
+
+func (mr *memberRecorder) Updated(ccn CCN, mo Member, delta Delta) (stop bool) {
+	<-mr.release
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.labels = append(mr.labels, mo.(*testMember).Label)
+	return
+}
+
+func (mr *memberRecorder) Deleted(ccn CCN, id interface{}) {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+	mr.deleted = true
+	close(mr.done)
+}
+
+func TestWatchMemberSeesAllUpdates(t *testing.T) {
+	hk := loadedKeeper(t, 3)
+	mr := &memberRecorder{
+		current: make(chan struct{}), release: make(chan struct{}), done: make(chan struct{}),
+	}
+	unsubscribe := hk.SubscribeMember(memberID(2), mr)
+	defer unsubscribe()
+	<-mr.current
+
+	// the watcher lags behind all these changes
+	labels := []string{"a", "b", "c", "d", "e"}
+	for _, label := range labels {
+		label := label
+		hk.Modify(memberID(1), func(mo Member) Member {
+			return modified(mo, func(mo *testMember) { mo.Label = "other " + label })
+		})
+		hk.Modify(memberID(2), func(mo Member) Member {
+			return modified(mo, func(mo *testMember) { mo.Label = label })
+		})
+	}
+	hk.Deleted(memberID(2))
+	close(mr.release)
+
+	select {
+	case <-mr.done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Deletion not seen")
+	}
+	seen, deleted := mr.seen()
+	if !deleted || len(seen) != len(labels) {
+		t.Fatalf("Seen updates %v and deleted %v", seen, deleted)
+	}
+	for i, label := range labels {
+		if seen[i] != label {
+			t.Fatalf("Seen updates %v", seen)
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package livecoll
 
 import (
+	"context"
+	"fmt"
+
 	"github.com/complyue/ddgo/pkg/isoevt"
 	"github.com/complyue/hbigo/pkg/errors"
 	"github.com/golang/glog"
@@ -19,89 +22,179 @@ type Subscriber interface {
 	// Epoch is a wire-bound event, get dispatched to all subscribers over a wire, when
 	// the wire is connected. It is most useful to react to wire reconnection during the
 	// subscription course.
-	Epoch(ccn int) (stop bool)
+	Epoch(ccn CCN) (stop bool)
 
 	// MemberCreated occurs after the specified business object get created.
-	MemberCreated(ccn int, eo Member) (stop bool)
+	MemberCreated(ccn CCN, eo Member) (stop bool)
 
-	// MemberUpdated occurs after the specified business object get updated.
-	MemberUpdated(ccn int, eo Member) (stop bool)
+	// MemberUpdated occurs after the specified business object get updated, `delta`
+	// lists the fields changed, it's nil if not known.
+	MemberUpdated(ccn CCN, eo Member, delta Delta) (stop bool)
 
 	// MemberDeleted occurs after the specified business object get deleted.
-	MemberDeleted(ccn int, id interface{}) (stop bool)
+	MemberDeleted(ccn CCN, id interface{}) (stop bool)
+
+	// MembersChanged occurs after a change set get committed, all `changes` are
+	// `CreatedEvent`, `UpdatedEvent` or `DeletedEvent` of this same ccn, in the order
+	// they were made. `Replay()` can dispatch them one by one if not concerned with
+	// atomicity.
+	MembersChanged(ccn CCN, changes []interface{}) (stop bool)
 }
 
 // Publisher .
+//
+// subscribing methods return a func to cancel the subscription, the subscriber
+// sees no more event after the callback in progress returned, if any. a subscriber
+// can stop by return value as well, calling it afterwards is harmless.
 type Publisher interface {
-	Subscribe(subr Subscriber)
+	Subscribe(subr Subscriber) (unsubscribe func())
+
+	// SubscribeFiltered subscribes with only changes of members passing `pred`
+	// delivered, see `Filtered()`.
+	SubscribeFiltered(subr Subscriber, pred func(mo Member) bool) (unsubscribe func())
+
+	// SubscribeMember watches a single member, see `WatchMember()`.
+	SubscribeMember(id interface{}, watcher MemberWatcher) (unsubscribe func())
+
+	FetchAll() (ccn CCN, members []Member)
+
+	// FetchChangesSince returns the changes after `ccn` in order, or `ok` being false
+	// if `ccn` is too old or of another epoch, a full snapshot should be fetched by
+	// `FetchAll()` in that case.
+	FetchChangesSince(ccn CCN) (changes []interface{}, ok bool)
+}
+
+// MaxSubscriberLag is the number of change events a subscriber can lag behind,
+// before it's resync'ed with a synthetic Epoch event.
+const MaxSubscriberLag = 10000
 
-	FetchAll() (ccn int, members []Member)
+// NewChangeStream creates a collection change event stream, on which lagging
+// subscribers are resync'ed instead of keeping all pending events from being
+// garbage collected.
+func NewChangeStream() *isoevt.EventStream {
+	ccES := isoevt.NewStream()
+	guardLagging(ccES)
+	return ccES
 }
 
-// ChgDistance measures the distance between 2 collection change numbers.
-func ChgDistance(toCCN, fromCCN int) int {
-	// CCN is monotonic incremental, but may overflow/wraparound after many changes occurred
-	if (toCCN >= 0 && fromCCN >= 0) || (toCCN < 0 && fromCCN < 0) {
-		// same sign, assuming NO overflow/wraparound has occurred
-		return toCCN - fromCCN
+func guardLagging(ccES *isoevt.EventStream) {
+	ccES.SetLagPolicy(isoevt.LagPolicy{
+		MaxLag: MaxSubscriberLag,
+		Action: isoevt.LagResync,
+		Resync: func(tailEvt interface{}) interface{} {
+			// the subscriber should reload upon Epoch, to the latest ccn
+			return EpochEvent{eventCCN(tailEvt)}
+		},
+	})
+}
+
+func eventCCN(evt interface{}) CCN {
+	switch evo := evt.(type) {
+	case EpochEvent:
+		return evo.CCN
+	case CreatedEvent:
+		return evo.CCN
+	case UpdatedEvent:
+		return evo.CCN
+	case DeletedEvent:
+		return evo.CCN
+	case BatchEvent:
+		return evo.CCN
+	default:
+		panic(errors.Errorf("Event of type %T ?!", evt))
 	}
-	// different sign, assuming overflow/wraparound has occurred
-	// todo figure out logic to handle this case
-	panic("int overflow of collection change number has to be handled!")
 }
 
-// Dispatch .
-func Dispatch(ccES *isoevt.EventStream, subr Subscriber, watchingCallback func() bool) {
-	ccES.Watch(func(evt interface{}) bool {
-		switch evo := evt.(type) {
-		case EpochEvent:
-			return subr.Epoch(evo.CCN)
-		case CreatedEvent:
-			return subr.MemberCreated(evo.CCN, evo.EO)
-		case UpdatedEvent:
-			return subr.MemberUpdated(evo.CCN, evo.EO)
-		case DeletedEvent:
-			return subr.MemberDeleted(evo.CCN, evo.ID)
-		default:
-			panic(errors.Errorf("Event of type %T ?!", evt))
-		}
+// Dispatch starts a goroutine dispatching change events from the stream to the
+// subscriber, until it stops or `unsubscribe()` is called.
+func Dispatch(
+	ccES *isoevt.EventStream, subr Subscriber, watchingCallback func() bool,
+) (unsubscribe func()) {
+	if csubr, ok := subr.(CoalescingSubscriber); ok {
+		return dispatchCoalescing(ccES, csubr, watchingCallback)
+	}
+
+	// name the watcher after the subscriber, for it to be identified in lag reports
+	ctx := isoevt.WithWatcherName(context.Background(), fmt.Sprintf("%T", subr))
+	watching := ccES.WatchContext(ctx, func(evt interface{}) bool {
+		return dispatchEvent(subr, evt)
 	}, func() (stop bool) {
-		defer func() {
-			if e := recover(); e != nil {
-				glog.Warningf("Subscription cancelled due to error: %+v", e)
-				stop = true
-			}
-		}()
-		if watchingCallback != nil && watchingCallback() {
-			// watching cb opt'ed to stop by returning false
-			stop = true
+		return startSubscription(subr, watchingCallback)
+	})
+	return watching.Stop
+}
+
+// Replay dispatches change events, as returned by `FetchChangesSince()`, to the
+// subscriber in order.
+func Replay(subr Subscriber, changes []interface{}) (stop bool) {
+	for _, evt := range changes {
+		if stop = dispatchEvent(subr, evt); stop {
+			return
 		}
-		if !stop { // if watching cb decided to stop watching, do not invoke Subscribed event
-			stop = subr.Subscribed()
+	}
+	return
+}
+
+func dispatchEvent(subr Subscriber, evt interface{}) (stop bool) {
+	switch evo := evt.(type) {
+	case EpochEvent:
+		return subr.Epoch(evo.CCN)
+	case CreatedEvent:
+		return subr.MemberCreated(evo.CCN, evo.EO)
+	case UpdatedEvent:
+		return subr.MemberUpdated(evo.CCN, evo.EO, evo.Delta)
+	case DeletedEvent:
+		return subr.MemberDeleted(evo.CCN, evo.ID)
+	case BatchEvent:
+		return subr.MembersChanged(evo.CCN, evo.Changes)
+	default:
+		panic(errors.Errorf("Event of type %T ?!", evt))
+	}
+}
+
+func startSubscription(subr Subscriber, watchingCallback func() bool) (stop bool) {
+	defer func() {
+		if e := recover(); e != nil {
+			glog.Warningf("Subscription cancelled due to error: %+v", e)
+			stop = true
 		}
-		return
-	})
+	}()
+	if watchingCallback != nil && watchingCallback() {
+		// watching cb opt'ed to stop by returning false
+		stop = true
+	}
+	if !stop { // if watching cb decided to stop watching, do not invoke Subscribed event
+		stop = subr.Subscribed()
+	}
+	return
 }
 
 // EpochEvent .
 type EpochEvent struct {
-	CCN int
+	CCN CCN
 }
 
 // CreatedEvent .
 type CreatedEvent struct {
-	CCN int
+	CCN CCN
 	EO  Member
 }
 
 // UpdatedEvent .
 type UpdatedEvent struct {
-	CCN int
-	EO  Member
+	CCN   CCN
+	EO    Member
+	Delta Delta // nil if not known
 }
 
 // DeletedEvent .
 type DeletedEvent struct {
-	CCN int
+	CCN CCN
 	ID  interface{}
 }
+
+// BatchEvent carries changes of a change set, committed under a single ccn.
+type BatchEvent struct {
+	CCN     CCN
+	Changes []interface{}
+}
@@ -0,0 +1,305 @@
+package livecoll
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+// DefaultIdleTimeout is how long a tenant's collection stays loaded without being
+// acquired, before evicted, for registries not specifying their own.
+var DefaultIdleTimeout = 30 * time.Minute
+
+// DefaultMaxMembers is the number of members all tenants' collections of a registry
+// can have loaded in total, for registries not specifying their own, 0 for no limit.
+var DefaultMaxMembers = 1000000
+
+// LoadFunc loads the collection of a tenant. `former` is the collection evicted
+// earlier but still subscribed to, its house keeper should be reused for those
+// subscribers to follow, it's nil if the tenant is loaded afresh.
+type LoadFunc func(tid string, former HouseKeeper) (coll HouseKeeper, err error)
+
+// Registry keeps live collections of many tenants in a process, they're loaded
+// lazily upon acquired, and evicted when idle, or least recently used ones when
+// the memory budget is exceeded.
+//
+// a collection acquired is never evicted before released. an evicted collection
+// with subscriptions is unloaded but kept, the subscribers see an Epoch event once
+// it's loaded again.
+type Registry struct {
+	Name string
+	Load LoadFunc
+
+	// 0 for `DefaultIdleTimeout`
+	IdleTimeout time.Duration
+	// 0 for `DefaultMaxMembers`, negative for no limit
+	MaxMembers int
+
+	mu      sync.Mutex
+	tenants map[string]*tenantColl
+
+	sweeping sync.Once
+}
+
+type tenantColl struct {
+	tid string
+
+	muLoad sync.Mutex  // held during loading and eviction
+	coll   HouseKeeper // nil if never loaded, or evicted without subscriptions
+	loaded bool
+
+	// guarded by the registry's mu
+	pins     int // number of acquirings not released yet
+	lastUsed time.Time
+	dead     bool // evicted and removed, a new entry should be made for the tenant
+}
+
+// NewRegistry creates a registry of tenant collections.
+func NewRegistry(name string, load LoadFunc) *Registry {
+	return &Registry{
+		Name: name, Load: load,
+		tenants: make(map[string]*tenantColl),
+	}
+}
+
+func (r *Registry) idleTimeout() time.Duration {
+	if r.IdleTimeout > 0 {
+		return r.IdleTimeout
+	}
+	return DefaultIdleTimeout
+}
+
+func (r *Registry) maxMembers() int {
+	if r.MaxMembers != 0 {
+		return r.MaxMembers
+	}
+	return DefaultMaxMembers
+}
+
+// Acquire returns the loaded collection of a tenant, loading it if not yet. the
+// collection won't be evicted before `release` is called.
+func (r *Registry) Acquire(tid string) (coll HouseKeeper, release func(), err error) {
+	r.sweeping.Do(func() {
+		go r.sweep()
+	})
+
+	var (
+		tc        *tenantColl
+		loadedNow bool
+	)
+	for {
+		r.mu.Lock()
+		var ok bool
+		tc, ok = r.tenants[tid]
+		if !ok || tc.dead {
+			tc = &tenantColl{tid: tid}
+			r.tenants[tid] = tc
+		}
+		tc.pins++
+		tc.lastUsed = time.Now()
+		r.mu.Unlock()
+
+		release = func() {
+			r.mu.Lock()
+			tc.pins--
+			tc.lastUsed = time.Now()
+			r.mu.Unlock()
+		}
+
+		dead := false
+		func() {
+			tc.muLoad.Lock()
+			defer tc.muLoad.Unlock()
+
+			// an eviction may have removed the entry after it's looked up, loading
+			// into it would leave a collection no later acquiring finds
+			r.mu.Lock()
+			dead = tc.dead
+			r.mu.Unlock()
+			if dead {
+				return
+			}
+
+			if tc.loaded {
+				coll = tc.coll
+				return
+			}
+			if coll, err = r.Load(tid, tc.coll); err != nil {
+				return
+			}
+			tc.coll, tc.loaded, loadedNow = coll, true, true
+		}()
+		if dead {
+			release()
+			continue // with the entry made afresh
+		}
+		if err != nil {
+			release()
+			return nil, nil, err
+		}
+		break
+	}
+
+	if loadedNow {
+		glog.V(1).Infof("Loaded %s collection of [%s] with %d members.", r.Name, tid, coll.Len())
+		r.enforceBudget()
+	}
+	return coll, release, nil
+}
+
+// Evict evicts a tenant's collection now, unless it's acquired.
+func (r *Registry) Evict(tid string) bool {
+	r.mu.Lock()
+	tc, ok := r.tenants[tid]
+	r.mu.Unlock()
+	if !ok {
+		return false
+	}
+	return r.evict(tc, nil)
+}
+
+// evict the collection if it's not acquired, and `cond` holds if specified. `cond`
+// is called with `tc.muLoad` locked. an entry never loaded, e.g. failed loading, is
+// removed regardless of `cond`.
+//
+// a collection with subscriptions is unloaded but kept, evicting it again closes
+// it once the subscribers are gone.
+func (r *Registry) evict(tc *tenantColl, cond func(coll HouseKeeper) bool) bool {
+	tc.muLoad.Lock()
+	defer tc.muLoad.Unlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if tc.pins > 0 || tc.dead {
+		return false
+	}
+	if tc.coll != nil {
+		if cond != nil && !cond(tc.coll) {
+			return false
+		}
+		if tc.loaded {
+			glog.V(1).Infof("Evicting %s collection of [%s] with %d members.", r.Name, tc.tid, tc.coll.Len())
+			tc.coll.Unload()
+			tc.loaded = false
+		}
+		if tc.coll.Subscribers() > 0 {
+			// keep it for the subscribers, to be loaded again
+			return true
+		}
+		glog.V(1).Infof("Closing %s collection of [%s].", r.Name, tc.tid)
+		if err := tc.coll.Close(); err != nil {
+			glog.Errorf("Failed closing %s collection of [%s]: %+v", r.Name, tc.tid, err)
+		}
+		tc.coll = nil
+	}
+	// acquirings having looked it up retry with a new entry
+	tc.dead = true
+	if r.tenants[tc.tid] == tc {
+		delete(r.tenants, tc.tid)
+	}
+	return true
+}
+
+// tenant collections not acquired, least recently used first
+func (r *Registry) candidates() []*tenantColl {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tcs := make([]*tenantColl, 0, len(r.tenants))
+	for _, tc := range r.tenants {
+		if tc.pins <= 0 {
+			tcs = append(tcs, tc)
+		}
+	}
+	sort.Slice(tcs, func(i, j int) bool {
+		return tcs[i].lastUsed.Before(tcs[j].lastUsed)
+	})
+	return tcs
+}
+
+// number of members loaded across tenants
+func (r *Registry) loadedMembers() (n int) {
+	r.mu.Lock()
+	tcs := make([]*tenantColl, 0, len(r.tenants))
+	for _, tc := range r.tenants {
+		tcs = append(tcs, tc)
+	}
+	r.mu.Unlock()
+
+	for _, tc := range tcs {
+		tc.muLoad.Lock()
+		if tc.loaded {
+			n += tc.coll.Len()
+		}
+		tc.muLoad.Unlock()
+	}
+	return
+}
+
+// evict least recently used collections until within the memory budget, ones
+// without subscriptions are evicted first.
+func (r *Registry) enforceBudget() {
+	maxMembers := r.maxMembers()
+	if maxMembers <= 0 {
+		return
+	}
+	n := r.loadedMembers()
+	if n <= maxMembers {
+		return
+	}
+	tcs := r.candidates()
+	for _, subscribed := range []bool{false, true} {
+		for _, tc := range tcs {
+			if n <= maxMembers {
+				return
+			}
+			size := 0
+			if r.evict(tc, func(coll HouseKeeper) bool {
+				if (coll.Subscribers() > 0) != subscribed {
+					return false
+				}
+				size = coll.Len()
+				return true
+			}) {
+				n -= size
+			}
+		}
+	}
+	glog.Warningf("%s collections have %d members loaded, exceeding budget %d.", r.Name, n, maxMembers)
+}
+
+func (r *Registry) sweep() {
+	for {
+		idleTimeout := r.idleTimeout()
+		interval := idleTimeout / 4
+		if interval < time.Second {
+			interval = time.Second
+		}
+		time.Sleep(interval)
+
+		deadline := time.Now().Add(-idleTimeout)
+		for _, tc := range r.candidates() {
+			r.mu.Lock()
+			idle := tc.lastUsed.Before(deadline)
+			r.mu.Unlock()
+			if !idle {
+				break // the rest are more recently used
+			}
+			// collections watched are not idle, though not acquired by anyone
+			r.evict(tc, func(coll HouseKeeper) bool {
+				return coll.Subscribers() <= 0
+			})
+		}
+		// collections unloaded for their subscribers are closed once those are
+		// gone, however recently they were used
+		for _, tc := range r.candidates() {
+			r.evict(tc, func(coll HouseKeeper) bool {
+				return !tc.loaded && coll.Subscribers() <= 0
+			})
+		}
+		r.enforceBudget()
+	}
+}
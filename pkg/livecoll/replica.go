@@ -0,0 +1,472 @@
+package livecoll
+
+import (
+	"sync"
+
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/golang/glog"
+)
+
+// Source is where a replica gets members and their changes from, a `Publisher` is
+// a source, so is a consuming api proxying one over hbi wire, see `SourceFuncs`.
+type Source interface {
+	Subscribe(subr Subscriber) (unsubscribe func())
+
+	FetchAll() (ccn CCN, members []Member)
+
+	// FetchChangesSince returns `ok` false if the changes are not available, a full
+	// snapshot is fetched instead then.
+	FetchChangesSince(ccn CCN) (changes []interface{}, ok bool)
+}
+
+// SourceFuncs adapts functions to a `Source`.
+type SourceFuncs struct {
+	SubscribeFunc func(subr Subscriber) (unsubscribe func())
+	FetchAllFunc  func() (ccn CCN, members []Member)
+	// nil if changes can not be fetched, replicas always reload then
+	FetchChangesSinceFunc func(ccn CCN) (changes []interface{}, ok bool)
+}
+
+func (sf SourceFuncs) Subscribe(subr Subscriber) (unsubscribe func()) {
+	return sf.SubscribeFunc(subr)
+}
+
+func (sf SourceFuncs) FetchAll() (ccn CCN, members []Member) {
+	return sf.FetchAllFunc()
+}
+
+func (sf SourceFuncs) FetchChangesSince(ccn CCN) (changes []interface{}, ok bool) {
+	if sf.FetchChangesSinceFunc == nil {
+		return nil, false
+	}
+	return sf.FetchChangesSinceFunc(ccn)
+}
+
+// ReplicaObserver reacts to changes after they're applied to a replica. callbacks
+// are invoked from the dispatching goroutine of the replica, with it not locked,
+// so they can read the replica, and see the change already applied.
+type ReplicaObserver interface {
+	// Reloaded occurs after a full snapshot is loaded, with all members in it.
+	Reloaded(ccn CCN, members []Member) (stop bool)
+
+	Created(ccn CCN, mo Member) (stop bool)
+
+	// Updated occurs with the former value of the member, nil if it was unknown,
+	// and fields changed, nil if neither the source nor the former tells.
+	Updated(ccn CCN, former, mo Member, delta Delta) (stop bool)
+
+	// Deleted occurs with the former value of the member, nil if it was unknown.
+	Deleted(ccn CCN, id interface{}, former Member) (stop bool)
+
+	// Batched occurs after all changes of a change set are applied.
+	Batched(ccn CCN, changes []ReplicaChange) (stop bool)
+}
+
+// ReplicaChange is a change applied to a replica as part of a change set.
+type ReplicaChange struct {
+	// CreatedEvent, UpdatedEvent or DeletedEvent, a creation of a member already
+	// known is seen as an update, like `Created` vs `Updated` of an observer
+	Event interface{}
+
+	// the former value of the member, nil if it was unknown
+	Former Member
+}
+
+// Replica keeps a local copy of a live collection, replicated from a source. it
+// tracks the ccn, catches up or reloads upon missed changes, and keeps its own
+// indexes on members.
+type Replica struct {
+	Name string // shows in logs
+
+	// Sparse tells the source delivers only changes of members passing a filter,
+	// so ccn gaps are expected, and the replica only reloads upon Epoch.
+	Sparse bool
+
+	src        Source
+	observer   ReplicaObserver
+	coalescing bool
+
+	muSub       sync.Mutex
+	unsubscribe func() // nil unless started and not stopped
+
+	mu          sync.RWMutex
+	epochLoaded bool // reloaded upon the Epoch starting the subscription
+	ccn         CCN
+	coalescedTo CCN // ccn gaps up to this are coalesced changes rather than missed ones
+	members     map[interface{}]Member
+	indexes     map[string]memberIndex
+}
+
+// NewReplica creates a replica of the source, the observer can be nil. it should
+// be configured, e.g. indexes added, before started by `Start()`.
+func NewReplica(name string, src Source, observer ReplicaObserver) *Replica {
+	return &Replica{
+		Name: name,
+		src:  src, observer: observer,
+		members: make(map[interface{}]Member),
+		indexes: make(map[string]memberIndex),
+	}
+}
+
+// NewCoalescingReplica creates a replica like `NewReplica()`, but with changes
+// coalesced while it lags behind, when only the latest state of each member
+// matters, e.g. to relay positions to viewers. the observer sees no intermediate
+// change of a member coalesced.
+func NewCoalescingReplica(name string, src Source, observer ReplicaObserver) *Replica {
+	rp := NewReplica(name, src, observer)
+	rp.coalescing = true
+	return rp
+}
+
+// Start subscribes to the source, the replica gets loaded upon subscribed.
+func (rp *Replica) Start() {
+	rp.muSub.Lock()
+	defer rp.muSub.Unlock()
+
+	if rp.unsubscribe != nil {
+		return // already started
+	}
+	rp.mu.Lock()
+	rp.epochLoaded = false
+	rp.mu.Unlock()
+	if rp.coalescing {
+		rp.unsubscribe = rp.src.Subscribe(coalescingReplica{rp})
+	} else {
+		rp.unsubscribe = rp.src.Subscribe(rp)
+	}
+}
+
+// Stop unsubscribes from the source, the replica keeps members as they were, and
+// the observer sees no more callback after the one in progress, if any.
+func (rp *Replica) Stop() {
+	rp.muSub.Lock()
+	defer rp.muSub.Unlock()
+
+	if rp.unsubscribe == nil {
+		return
+	}
+	rp.unsubscribe()
+	rp.unsubscribe = nil
+}
+
+// AddIndex adds a secondary index on members of the replica.
+func (rp *Replica) AddIndex(def Index) error {
+	idx, err := newKeyIndex(def)
+	if err != nil {
+		return err
+	}
+	return rp.addIndex(idx)
+}
+
+// AddSpatialIndex adds an index on positions of members of the replica.
+func (rp *Replica) AddSpatialIndex(def SpatialIndex) error {
+	idx, err := newSpatialIndex(def)
+	if err != nil {
+		return err
+	}
+	return rp.addIndex(idx)
+}
+
+func (rp *Replica) addIndex(idx memberIndex) error {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	if err := populateIndex(idx, rp.members); err != nil {
+		return err
+	}
+	rp.indexes[idx.name()] = idx
+	return nil
+}
+
+// CCN returns the ccn the replica is consistent with.
+func (rp *Replica) CCN() CCN {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	return rp.ccn
+}
+
+func (rp *Replica) Len() int {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	return len(rp.members)
+}
+
+func (rp *Replica) Read(id interface{}) (Member, bool) {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	mo, ok := rp.members[id]
+	return mo, ok
+}
+
+// FetchAll returns all members with the ccn they're consistent with.
+func (rp *Replica) FetchAll() (ccn CCN, members []Member) {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	members = make([]Member, 0, len(rp.members))
+	for _, mo := range rp.members {
+		members = append(members, mo)
+	}
+	return rp.ccn, members
+}
+
+func (rp *Replica) ReadBy(indexName string, key interface{}) (Member, bool) {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	return readBy(indexNamed(rp.indexes, indexName), rp.members, key)
+}
+
+func (rp *Replica) ReadAllBy(indexName string, key interface{}) []Member {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	return readAllBy(indexNamed(rp.indexes, indexName), rp.members, key)
+}
+
+func (rp *Replica) ReadWithin(indexName string, bbox BBox) []Member {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	return readWithin(indexNamed(rp.indexes, indexName), rp.members, bbox)
+}
+
+// View calls `read` with the replica read locked, for multiple reads to be
+// consistent with each other. members passed in should not be modified.
+func (rp *Replica) View(read func(ccn CCN, members map[interface{}]Member)) {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	read(rp.ccn, rp.members)
+}
+
+func (rp *Replica) reload() (stop bool) {
+	// fetch current snapshot of the whole collection
+	ccn, members := rp.src.FetchAll()
+
+	func() {
+		rp.mu.Lock()
+		defer rp.mu.Unlock()
+
+		glog.V(1).Infof(" * %s reloaded %v -> %v", rp.Name, rp.ccn, ccn)
+		rp.members = make(map[interface{}]Member, len(members))
+		for _, mo := range members {
+			rp.members[mo.GetID()] = mo
+		}
+		reindexAll(rp.indexes, rp.members)
+		rp.ccn = ccn
+	}()
+
+	if rp.observer != nil {
+		return rp.observer.Reloaded(ccn, members)
+	}
+	return
+}
+
+// replay changes missed since the locally known ccn, reload if they're no longer
+// available
+func (rp *Replica) catchUp(order CCNOrder) (stop bool) {
+	if order != EpochDiffers {
+		if changes, ok := rp.src.FetchChangesSince(rp.CCN()); ok {
+			return Replay(rp, changes)
+		}
+	}
+	return rp.reload()
+}
+
+// whether the ccn gap before `ccn` is explained by coalesced or filtered out changes,
+// rather than missed ones. should be called with `rp.mu` locked.
+func (rp *Replica) gapExplained(ccn CCN) bool {
+	if rp.Sparse {
+		// changes filtered out at the source never reach here
+		return true
+	}
+	order, distance := ccn.Compare(rp.coalescedTo)
+	return order == CCNBehind || order == CCNEqual ||
+		(order == CCNAhead && distance <= 1)
+}
+
+// decide how to take a change event, `apply` is true if it's right next to the
+// known ccn, it's to be ignored if neither `apply` nor `catchUp`.
+func (rp *Replica) follow(ccn CCN) (apply, catchUp bool, order CCNOrder) {
+	rp.mu.RLock()
+	defer rp.mu.RUnlock()
+
+	order, distance := ccn.Compare(rp.ccn)
+	if order == CCNBehind || order == CCNEqual {
+		// out-dated
+		return false, false, order
+	} else if order == EpochDiffers || (distance > 1 && !rp.gapExplained(ccn)) {
+		// event ccn is ahead of locally known ccn
+		glog.V(1).Infof(" ** Catching up %s due to CCN changed %v -> %v", rp.Name, rp.ccn, ccn)
+		return false, true, order
+	}
+	return true, false, order
+}
+
+// apply a change to members, returns the former value of the member.
+func (rp *Replica) apply(ccn CCN, id interface{}, mo Member) (former Member) {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	former = rp.put(id, mo)
+	rp.ccn = ccn
+	return
+}
+
+// apply all changes of a change set at once, so readers never see it partially.
+func (rp *Replica) applyAll(ccn CCN, changes []interface{}) []ReplicaChange {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+
+	applied := make([]ReplicaChange, len(changes))
+	for i, chg := range changes {
+		rc := &applied[i]
+		switch evo := chg.(type) {
+		case CreatedEvent:
+			rc.Former = rp.put(evo.EO.GetID(), evo.EO)
+			if rc.Former != nil {
+				rc.Event = UpdatedEvent{evo.CCN, evo.EO, Diff(rc.Former, evo.EO)}
+			} else {
+				rc.Event = chg
+			}
+		case UpdatedEvent:
+			rc.Former = rp.put(evo.EO.GetID(), evo.EO)
+			rc.Event = UpdatedEvent{evo.CCN, evo.EO, deltaOf(evo.Delta, rc.Former, evo.EO)}
+		case DeletedEvent:
+			rc.Former, rc.Event = rp.put(evo.ID, nil), chg
+		default:
+			panic(errors.Errorf("Change of type %T ?!", chg))
+		}
+	}
+	rp.ccn = ccn
+	return applied
+}
+
+// the delta told by the source, or figured out from the former value if known
+func deltaOf(delta Delta, former, mo Member) Delta {
+	if delta == nil && former != nil {
+		return Diff(former, mo)
+	}
+	return delta
+}
+
+// put a member, or remove it if `mo` is nil. should be called with `rp.mu` locked.
+func (rp *Replica) put(id interface{}, mo Member) (former Member) {
+	former = rp.members[id]
+	if mo != nil {
+		indexMember(rp.indexes, id, mo)
+		rp.members[id] = mo
+	} else if former != nil {
+		unindexMember(rp.indexes, id)
+		delete(rp.members, id)
+	}
+	return
+}
+
+func (rp *Replica) Subscribed() (stop bool) {
+	rp.mu.Lock()
+	epochLoaded := rp.epochLoaded
+	rp.mu.Unlock()
+	if epochLoaded {
+		// sources fire an Epoch right before, already reloaded upon it
+		return
+	}
+	return rp.reload()
+}
+
+func (rp *Replica) Epoch(ccn CCN) (stop bool) {
+	glog.V(1).Infof(" ** Reloading %s due to epoch CCN %v -> %v", rp.Name, rp.CCN(), ccn)
+	if stop = rp.reload(); stop {
+		return
+	}
+	rp.mu.Lock()
+	rp.epochLoaded = true
+	rp.mu.Unlock()
+	return
+}
+
+// a coalescing replica subscribes as this
+type coalescingReplica struct {
+	*Replica
+}
+
+func (cr coalescingReplica) Coalesced(fromCCN, toCCN CCN) (stop bool) {
+	rp := cr.Replica
+	known := rp.CCN()
+	if order, _ := fromCCN.Compare(known); order == EpochDiffers ||
+		(order == CCNAhead && !rp.Sparse) {
+		// changes missed before the coalesced ones
+		glog.V(1).Infof(" ** Reloading %s due to CCN changed %v -> %v", rp.Name, known, fromCCN)
+		return rp.reload()
+	}
+	rp.mu.Lock()
+	rp.coalescedTo = toCCN
+	rp.mu.Unlock()
+	return
+}
+
+func (rp *Replica) MemberCreated(ccn CCN, eo Member) (stop bool) {
+	apply, catchUp, order := rp.follow(ccn)
+	if catchUp {
+		return rp.catchUp(order)
+	} else if !apply {
+		return
+	}
+	if former := rp.apply(ccn, eo.GetID(), eo); former != nil {
+		// can be a recreation coalesced, or reported by a filtering source
+		if rp.observer != nil {
+			return rp.observer.Updated(ccn, former, eo, Diff(former, eo))
+		}
+		return
+	}
+	if rp.observer != nil {
+		return rp.observer.Created(ccn, eo)
+	}
+	return
+}
+
+func (rp *Replica) MemberUpdated(ccn CCN, eo Member, delta Delta) (stop bool) {
+	apply, catchUp, order := rp.follow(ccn)
+	if catchUp {
+		return rp.catchUp(order)
+	} else if !apply {
+		return
+	}
+	former := rp.apply(ccn, eo.GetID(), eo)
+	if rp.observer != nil {
+		return rp.observer.Updated(ccn, former, eo, deltaOf(delta, former, eo))
+	}
+	return
+}
+
+func (rp *Replica) MemberDeleted(ccn CCN, id interface{}) (stop bool) {
+	apply, catchUp, order := rp.follow(ccn)
+	if catchUp {
+		return rp.catchUp(order)
+	} else if !apply {
+		return
+	}
+	former := rp.apply(ccn, id, nil)
+	if rp.observer != nil {
+		return rp.observer.Deleted(ccn, id, former)
+	}
+	return
+}
+
+func (rp *Replica) MembersChanged(ccn CCN, changes []interface{}) (stop bool) {
+	apply, catchUp, order := rp.follow(ccn)
+	if catchUp {
+		return rp.catchUp(order)
+	} else if !apply {
+		return
+	}
+	applied := rp.applyAll(ccn, changes)
+	if rp.observer != nil {
+		return rp.observer.Batched(ccn, applied)
+	}
+	return
+}
@@ -0,0 +1,138 @@
+package livecoll
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// a source counting snapshots fetched
+type countingSource struct {
+	Publisher
+	fetches int32
+}
+
+func (cs *countingSource) FetchAll() (ccn CCN, members []Member) {
+	atomic.AddInt32(&cs.fetches, 1)
+	return cs.Publisher.FetchAll()
+}
+
+func (cs *countingSource) Fetches() int {
+	return int(atomic.LoadInt32(&cs.fetches))
+}
+
+func waitReplica(t *testing.T, what string, cond func() bool) {
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Replica still not %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestReplicaFetchesOncePerSubscription(t *testing.T) {
+	hk := loadedKeeper(t, 3)
+	src := &countingSource{Publisher: hk}
+	rp := NewReplica("counted", src, nil)
+
+	for round, n := 1, 4; round <= 3; round, n = round+1, n+1 {
+		rp.Start()
+		// a change relayed after the subscription started, both Epoch and Subscribed
+		// have been dispatched by then
+		hk.Created(seqMember(n))
+		waitReplica(t, "following", func() bool {
+			return rp.Len() == n && rp.CCN() == hk.(*houseKeeper).ccn
+		})
+		if fetches := src.Fetches(); fetches != round {
+			t.Fatalf("Fetched %d times by %d subscriptions", fetches, round)
+		}
+		rp.Stop()
+	}
+}
+
+// records updates a replica observed, blocking on the first one until released
+type updateRecorder struct {
+	release chan struct{}
+
+	mu  sync.Mutex
+	xs  []float64
+	ccn CCN
+}
+
+func (ur *updateRecorder) seen() (xs []float64, ccn CCN) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	return append([]float64(nil), ur.xs...), ur.ccn
+}
+
+func (ur *updateRecorder) Reloaded(ccn CCN, members []Member) (stop bool) {
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	ur.ccn = ccn
+	return
+}
+
+func (ur *updateRecorder) Created(ccn CCN, mo Member) (stop bool) {
+	return
+}
+
+func (ur *updateRecorder) Updated(ccn CCN, former, mo Member, delta Delta) (stop bool) {
+	<-ur.release
+	ur.mu.Lock()
+	defer ur.mu.Unlock()
+	ur.xs = append(ur.xs, mo.(*testMember).X)
+	ur.ccn = ccn
+	return
+}
+
+func (ur *updateRecorder) Deleted(ccn CCN, id interface{}, former Member) (stop bool) {
+	return
+}
+
+func (ur *updateRecorder) Batched(ccn CCN, changes []ReplicaChange) (stop bool) {
+	return
+}
+
+// move a member 5 times, with the observer lagging behind
+func laggingUpdates(t *testing.T, coalescing bool) []float64 {
+	hk := loadedKeeper(t, 1)
+	ur := &updateRecorder{release: make(chan struct{})}
+	var rp *Replica
+	if coalescing {
+		rp = NewCoalescingReplica("coalescing", hk, ur)
+	} else {
+		rp = NewReplica("plain", hk, ur)
+	}
+	rp.Start()
+	defer rp.Stop()
+	waitReplica(t, "loaded", func() bool {
+		_, ccn := ur.seen()
+		return ccn == hk.(*houseKeeper).ccn
+	})
+
+	for x := 1; x <= 5; x++ {
+		x := x
+		hk.Modify(memberID(1), func(mo Member) Member {
+			return modified(mo, func(mo *testMember) { mo.X = float64(x) })
+		})
+	}
+	close(ur.release)
+	waitReplica(t, "observed the last update", func() bool {
+		_, ccn := ur.seen()
+		return ccn == hk.(*houseKeeper).ccn
+	})
+	xs, _ := ur.seen()
+	return xs
+}
+
+func TestReplicaCoalescingOptIn(t *testing.T) {
+	if xs := laggingUpdates(t, false); len(xs) != 5 {
+		t.Fatalf("Updates %v observed by a plain replica", xs)
+	}
+	xs := laggingUpdates(t, true)
+	if len(xs) >= 5 || xs[len(xs)-1] != 5 {
+		t.Fatalf("Updates %v observed by a coalescing replica", xs)
+	}
+}
@@ -0,0 +1,68 @@
+package livecoll
+
+import (
+	"fmt"
+
+	"github.com/complyue/hbigo/pkg/errors"
+)
+
+// Versioned members have a version number, increased by each update, for updates
+// to be made conditionally on the version last seen, so concurrent writers don't
+// overwrite each other silently.
+type Versioned interface {
+	GetVersion() int
+}
+
+// ConflictError tells a conditional update is rejected, as the member has been
+// updated by someone else since the version expected. `Actual` is -1 if the
+// actual version is unknown, e.g. the backing storage has diverged.
+type ConflictError struct {
+	ID       interface{}
+	Expected int
+	Actual   int
+}
+
+func (e *ConflictError) Error() string {
+	if e.Actual < 0 {
+		return fmt.Sprintf("Version conflict on %v, expecting version %d.", e.ID, e.Expected)
+	}
+	return fmt.Sprintf("Version conflict on %v, expecting version %d but it's %d.",
+		e.ID, e.Expected, e.Actual)
+}
+
+// IsConflict tells whether the error is a version conflict.
+func IsConflict(err error) (*ConflictError, bool) {
+	ce, ok := err.(*ConflictError)
+	return ce, ok
+}
+
+// UpdateOutcome is the outcome of a conditional update, as returned over the wire
+// by rpc style service methods, not to disconnect the wire upon failures.
+type UpdateOutcome struct {
+	// the new version if updated, or the actual version upon conflict
+	Version  int
+	Conflict bool
+	Err      string
+}
+
+func NewUpdateOutcome(version int, err error) *UpdateOutcome {
+	if err == nil {
+		return &UpdateOutcome{Version: version}
+	}
+	if ce, ok := IsConflict(err); ok {
+		return &UpdateOutcome{Version: ce.Actual, Conflict: true}
+	}
+	return &UpdateOutcome{Err: fmt.Sprintf("%+v", err)}
+}
+
+// Result converts back to the result of the update at consumer side, `id` and
+// `version` are what the update was conditioned on.
+func (uo *UpdateOutcome) Result(id interface{}, version int) (int, error) {
+	if uo.Conflict {
+		return 0, &ConflictError{ID: id, Expected: version, Actual: uo.Version}
+	}
+	if uo.Err != "" {
+		return 0, errors.New(uo.Err)
+	}
+	return uo.Version, nil
+}
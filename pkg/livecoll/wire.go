@@ -0,0 +1,185 @@
+package livecoll
+
+import (
+	"fmt"
+
+	"github.com/complyue/hbigo/pkg/errors"
+)
+
+// ChangeHeader is what a single change to any collection has when shipped over the
+// wire, a collection's change type embeds it inline, along with the member value,
+// which has only the id set for a deletion. changes committed as a change set
+// share the same ccn.
+type ChangeHeader struct {
+	CCN     CCN
+	Deleted bool
+	Created bool
+
+	// fields changed by an update, nil if not known
+	Delta Delta `bson:",omitempty"`
+}
+
+// Event converts the change back to a change event, `mo` is the member value
+// carried along with the header.
+func (hdr *ChangeHeader) Event(mo Member) interface{} {
+	switch {
+	case hdr.Deleted:
+		return DeletedEvent{hdr.CCN, mo.GetID()}
+	case hdr.Created:
+		return CreatedEvent{hdr.CCN, mo}
+	default:
+		return UpdatedEvent{hdr.CCN, mo, hdr.Delta}
+	}
+}
+
+// ChangeOf tells the header of a single change event, with the member it carries,
+// or nil for a deletion, with the id of the deleted member given instead.
+func ChangeOf(evt interface{}) (hdr ChangeHeader, mo Member, id interface{}) {
+	switch evo := evt.(type) {
+	case CreatedEvent:
+		hdr.CCN, hdr.Created, mo = evo.CCN, true, evo.EO
+		id = mo.GetID()
+	case UpdatedEvent:
+		hdr.CCN, hdr.Delta, mo = evo.CCN, evo.Delta, evo.EO
+		id = mo.GetID()
+	case DeletedEvent:
+		hdr.CCN, hdr.Deleted, id = evo.CCN, true, evo.ID
+	default:
+		panic(errors.Errorf("Change event of type %T ?!", evt))
+	}
+	return
+}
+
+// FlattenEvents lists single change events in order, with change sets flattened.
+func FlattenEvents(events []interface{}) []interface{} {
+	flat := make([]interface{}, 0, len(events))
+	for _, evt := range events {
+		if batch, ok := evt.(BatchEvent); ok {
+			flat = append(flat, FlattenEvents(batch.Changes)...)
+			continue
+		}
+		flat = append(flat, evt)
+	}
+	return flat
+}
+
+// RegroupEvents reverses `FlattenEvents()`, consecutive changes of the same ccn are
+// grouped back into change sets.
+func RegroupEvents(flat []interface{}) []interface{} {
+	events := make([]interface{}, 0, len(flat))
+	for i := 0; i < len(flat); {
+		ccn := eventCCN(flat[i])
+		j := i + 1
+		for j < len(flat) && eventCCN(flat[j]) == ccn {
+			j++
+		}
+		if j-i > 1 {
+			batch := make([]interface{}, j-i)
+			copy(batch, flat[i:j])
+			events = append(events, BatchEvent{ccn, batch})
+		} else {
+			events = append(events, flat[i])
+		}
+		i = j
+	}
+	return events
+}
+
+// Shipping tells how members and changes of a collection are shipped over the wire,
+// hints name types exposed at consumer side.
+type Shipping struct {
+	MemberHint  string // e.g. "&Waypoint{}"
+	ChangeHint  string // of what `Change` makes, e.g. "&WaypointChange{}"
+	ChangesHint string // of what `Changes` makes, e.g. "&WaypointChanges{}"
+
+	// Change makes the object shipped for an update, with the delta along, so the
+	// consumer needs not to diff.
+	Change func(hdr ChangeHeader, mo Member) interface{}
+	// Changes makes the object shipped for a change set.
+	Changes func(events []interface{}) interface{}
+}
+
+// Relay is a subscriber relaying changes of a collection to a consumer over the
+// wire, by notifs named after `Prefix`, with objects shipped along as told by
+// `Ship`:
+//
+//	<Prefix>Epoch(sid,epoch,seq)
+//	<Prefix>Created(sid,epoch,seq) + member
+//	<Prefix>Updated(sid,epoch,seq) + change
+//	<Prefix>Deleted(sid,epoch,seq,id)
+//	<Prefix>Batch(sid,epoch,seq) + changes
+//
+// ids are sent by their `Hex()` if they have one. it stops once `Stopped()` tells
+// so, or posting failed.
+type Relay struct {
+	Prefix string // e.g. "Wp"
+	Sid    int    // subscription id at consumer side, 0 for the unfiltered one
+	Member bool   // watching a single member, finishes upon its deletion
+
+	Ship Shipping
+
+	// Stopped tells whether to stop relaying, e.g. the wire is gone.
+	Stopped func() bool
+	// Post sends a notif, with the object following it if not nil.
+	Post func(code string, obj interface{}, hint string) error
+}
+
+func (rl Relay) post(name string, ccn CCN, obj interface{}, hint string, args ...interface{}) (stop bool) {
+	if rl.Stopped() {
+		return true
+	}
+	code := fmt.Sprintf("%s%s(%d,%d,%d", rl.Prefix, name, rl.Sid, ccn.Epoch, ccn.Seq)
+	for _, arg := range args {
+		code += fmt.Sprintf(",%#v", arg)
+	}
+	if err := rl.Post("\n"+code+")\n", obj, hint); err != nil {
+		return true
+	}
+	return false
+}
+
+func (rl Relay) Subscribed() (stop bool) {
+	// not relaying Subscribed event over hbi wire
+	return
+}
+
+func (rl Relay) Epoch(ccn CCN) (stop bool) {
+	return rl.post("Epoch", ccn, nil, "")
+}
+
+func (rl Relay) MemberCreated(ccn CCN, eo Member) (stop bool) {
+	return rl.post("Created", ccn, eo, rl.Ship.MemberHint)
+}
+
+func (rl Relay) MemberUpdated(ccn CCN, eo Member, delta Delta) (stop bool) {
+	chg := rl.Ship.Change(ChangeHeader{CCN: ccn, Delta: delta}, eo)
+	return rl.post("Updated", ccn, chg, rl.Ship.ChangeHint)
+}
+
+func (rl Relay) MemberDeleted(ccn CCN, id interface{}) (stop bool) {
+	if hid, ok := id.(interface {
+		Hex() string
+	}); ok {
+		id = hid.Hex()
+	}
+	if stop = rl.post("Deleted", ccn, nil, "", id); stop {
+		return
+	}
+	// a watched member is gone for good
+	return rl.Member
+}
+
+func (rl Relay) MembersChanged(ccn CCN, changes []interface{}) (stop bool) {
+	if stop = rl.post("Batch", ccn, rl.Ship.Changes(changes), rl.Ship.ChangesHint); stop {
+		return
+	}
+	if rl.Member {
+		// only the watched member passes, any deletion is of it
+		for _, evt := range FlattenEvents(changes) {
+			if _, ok := evt.(DeletedEvent); ok {
+				return true
+			}
+		}
+	}
+	return
+}
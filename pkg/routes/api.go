@@ -10,6 +10,7 @@ import (
 	"github.com/complyue/ddgo/pkg/svcs"
 	"github.com/complyue/hbigo"
 	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/globalsign/mgo/bson"
 	"github.com/golang/glog"
 )
 
@@ -43,8 +44,18 @@ type ConsumerAPI struct {
 	tid string
 
 	// collection change event stream for waypoints
-	wpCCES *isoevt.EventStream
-	wpCCN  int // last known ccn of waypoint collection
+	wpCCES        *isoevt.EventStream
+	wpCCN         livecoll.CCN // last known ccn of waypoint collection
+	wpSubscribers int          // unfiltered subscriptions not dropped yet
+
+	// filtered subscriptions to waypoints collection, by subscription id
+	wpFiltered map[int]*filteredSubscription
+	lastSid    int
+
+	// collection change event stream for routes
+	rtCCES        *isoevt.EventStream
+	rtCCN         livecoll.CCN // last known ccn of route collection
+	rtSubscribers int          // subscriptions not dropped yet
 
 	svc *hbi.TCPConn
 }
@@ -56,6 +67,16 @@ type consumerContext struct {
 	api *ConsumerAPI
 
 	watchingWaypoints bool
+	filteredWaypoints map[int]bool // ids of filtered subscriptions made over this wire
+
+	watchingRoutes bool
+}
+
+// a filtered subscription over hbi wire, with its own change event stream
+type filteredSubscription struct {
+	filter *livecoll.Filter
+	id     string // of the single waypoint watched, empty unless watching one
+	cces   *isoevt.EventStream
 }
 
 // give types to be exposed, with typed nil pointer values to each
@@ -63,6 +84,14 @@ func (ctx *consumerContext) TypesToExpose() []interface{} {
 	return []interface{}{
 		(*Waypoint)(nil),
 		(*WaypointsSnapshot)(nil),
+		(*WaypointChange)(nil),
+		(*WaypointChanges)(nil),
+		(*livecoll.UpdateOutcome)(nil),
+		(*OptimizedRoute)(nil),
+		(*Route)(nil),
+		(*RoutesSnapshot)(nil),
+		(*RouteChange)(nil),
+		(*RouteChanges)(nil),
 	}
 }
 
@@ -105,7 +134,7 @@ func (api *ConsumerAPI) EnsureConn() *hbi.TCPConn {
 							api:       api,
 						}
 						return ctx
-					}, // single tunnel, use tid as sticky session id, for tenant isolation
+					}, // single tunnel, use tid as sticky session id, for tenant affinity
 					"", api.tid, true)
 				if err == nil {
 					api.svc = svc
@@ -113,7 +142,7 @@ func (api *ConsumerAPI) EnsureConn() *hbi.TCPConn {
 			}
 		}()
 		if err == nil {
-			if api.wpCCES != nil {
+			if api.wpSubscribers > 0 {
 				// consumer has subscribed to waypoints collection change event stream,
 				// make sure the connected wire has subscribed as well,
 				// Epoch event will be fired by service upon each subscription.
@@ -126,6 +155,40 @@ SubscribeWaypoints(%#v)
 					ctx.watchingWaypoints = true
 				}
 			}
+			if len(api.wpFiltered) > 0 {
+				// the same for filtered subscriptions, with the filter sent along
+				ctx := api.svc.HoCtx().(*consumerContext)
+				if ctx.filteredWaypoints == nil {
+					ctx.filteredWaypoints = make(map[int]bool)
+				}
+				po := api.svc.MustPoToPeer()
+				for sid, fsub := range api.wpFiltered {
+					if ctx.filteredWaypoints[sid] {
+						continue
+					}
+					if fsub.id != "" {
+						po.Notif(fmt.Sprintf(`
+SubscribeWaypoint(%#v,%#v,%#v)
+`, api.tid, sid, fsub.id))
+					} else {
+						po.NotifBSON(fmt.Sprintf(`
+SubscribeFilteredWaypoints(%#v,%#v)
+`, api.tid, sid), fsub.filter, "&Filter{}")
+					}
+					ctx.filteredWaypoints[sid] = true
+				}
+			}
+			if api.rtSubscribers > 0 {
+				// the same for routes collection change event stream
+				ctx := api.svc.HoCtx().(*consumerContext)
+				if !ctx.watchingRoutes {
+					po := api.svc.MustPoToPeer()
+					po.Notif(fmt.Sprintf(`
+SubscribeRoutes(%#v)
+`, api.tid))
+					ctx.watchingRoutes = true
+				}
+			}
 			return api.svc
 		}
 		glog.Errorf("Failed connecting routes service, retrying... %+v", err)
@@ -133,6 +196,20 @@ SubscribeWaypoints(%#v)
 	}
 }
 
+// Disconnect drops the current hbi wire as if it's broken, e.g. for tests to see
+// how subscribers react to reconnection, which happens upon next `EnsureConn()`.
+func (api *ConsumerAPI) Disconnect() {
+	if api.mono {
+		return
+	}
+
+	api.mu.Lock()
+	defer api.mu.Unlock()
+	if api.svc != nil {
+		api.svc.Close()
+	}
+}
+
 // get posting endpoint
 func (api *ConsumerAPI) conn() (*consumerContext, hbi.Posting) {
 	svc := api.EnsureConn()
@@ -163,7 +240,43 @@ MoveWaypoint(%#v,%#v,%#v,%#v,%#v)
 `, tid, seq, id, x, y))
 }
 
-func (api *ConsumerAPI) FetchWaypoints() (ccn int, wpl []Waypoint) {
+// MoveWaypointIf moves the waypoint only if it's still of `version`, or returns a
+// `*livecoll.ConflictError`. the new version is returned on success.
+func (api *ConsumerAPI) MoveWaypointIf(
+	tid string, seq int, id string, version int, x, y float64,
+) (int, error) {
+	if api.mono {
+		return MoveWaypointIf(tid, seq, id, version, x, y)
+	}
+
+	_, po := api.conn()
+	co, err := po.Co()
+	if err != nil {
+		return 0, err
+	}
+	defer co.Close()
+
+	result, err := co.Get(fmt.Sprintf(`
+MoveWaypointIf(%#v,%#v,%#v,%#v,%#v,%#v)
+`, tid, seq, id, version, x, y), "&UpdateOutcome{}")
+	if err != nil {
+		return 0, err
+	}
+	return result.(*livecoll.UpdateOutcome).Result(bson.ObjectIdHex(id), version)
+}
+
+func (api *ConsumerAPI) DeleteWaypoint(tid string, seq int, id string) error {
+	if api.mono {
+		return DeleteWaypoint(tid, seq, id)
+	}
+
+	_, po := api.conn()
+	return po.Notif(fmt.Sprintf(`
+DeleteWaypoint(%#v,%#v,%#v)
+`, tid, seq, id))
+}
+
+func (api *ConsumerAPI) FetchWaypoints() (ccn livecoll.CCN, wpl []Waypoint) {
 	if api.mono {
 		wps := FetchWaypoints(api.tid)
 
@@ -190,39 +303,324 @@ FetchWaypoints(%#v)
 	return
 }
 
-func (api *ConsumerAPI) SubscribeWaypoints(subr livecoll.Subscriber) {
+// FetchWaypointChangesSince returns the changes after `ccn` as livecoll events in order,
+// `ok` is false if the changes are no longer available, a snapshot should be fetched
+// by `FetchWaypoints()` then.
+func (api *ConsumerAPI) FetchWaypointChangesSince(ccn livecoll.CCN) (changes []interface{}, ok bool) {
 	if api.mono {
-		ensureLoadedFor(api.tid)
-		wpCollection.Subscribe(subr)
-		return
+		return FetchWaypointChangesSince(api.tid, ccn).Events()
 	}
 
-	// ensure the wire connected
-	api.EnsureConn()
+	_, po := api.conn()
+	co, err := po.Co()
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
 
-	if api.wpCCES == nil { // quick check without sync
-		func() {
-			api.mu.Lock()
-			defer api.mu.Unlock()
+	result, err := co.Get(fmt.Sprintf(`
+FetchWaypointChangesSince(%#v,%d,%d)
+`, api.tid, ccn.Epoch, ccn.Seq), "&WaypointChanges{}")
+	if err != nil {
+		panic(err)
+	}
+	return result.(*WaypointChanges).Events()
+}
+
+// FetchWaypoint reads a single waypoint with the ccn it's consistent with, `ok` is false if
+// no such waypoint.
+func (api *ConsumerAPI) FetchWaypoint(id bson.ObjectId) (ccn livecoll.CCN, wp *Waypoint, ok bool) {
+	var chg *WaypointChange
+	if api.mono {
+		chg = FetchWaypoint(api.tid, id)
+	} else {
+		_, po := api.conn()
+		co, err := po.Co()
+		if err != nil {
+			panic(err)
+		}
+		defer co.Close()
 
-			if api.wpCCES != nil { // final check after sync'ed
-				return
+		result, err := co.Get(fmt.Sprintf(`
+FetchWaypoint(%#v,%#v)
+`, api.tid, id.Hex()), "&WaypointChange{}")
+		if err != nil {
+			panic(err)
+		}
+		chg = result.(*WaypointChange)
+	}
+	if chg.Deleted {
+		return chg.CCN, nil, false
+	}
+	return chg.CCN, &chg.Waypoint, true
+}
+
+// OptimizeRoute computes a good order to visit all waypoints, starting from (x,y),
+// with improvement bounded by `timeLimit`, see `OptimizeOrder()`.
+func (api *ConsumerAPI) OptimizeRoute(x, y float64, timeLimit time.Duration) (*OptimizedRoute, error) {
+	if api.mono {
+		return OptimizeRoute(api.tid, x, y, timeLimit)
+	}
+
+	_, po := api.conn()
+	co, err := po.Co()
+	if err != nil {
+		return nil, err
+	}
+	defer co.Close()
+
+	result, err := co.Get(fmt.Sprintf(`
+OptimizeRoute(%#v,%#v,%#v,%d)
+`, api.tid, x, y, int64(timeLimit/time.Millisecond)), "&OptimizedRoute{}")
+	if err != nil {
+		return nil, err
+	}
+	return result.(*OptimizedRoute), nil
+}
+
+// WaypointSource makes a source for waypoints to be replicated from, with only those
+// passing the filter if it's not nil, the replica should be sparse then.
+func (api *ConsumerAPI) WaypointSource(filter *livecoll.Filter) livecoll.Source {
+	src := livecoll.SourceFuncs{
+		SubscribeFunc: api.SubscribeWaypoints,
+		FetchAllFunc: func() (livecoll.CCN, []livecoll.Member) {
+			ccn, wpl := api.FetchWaypoints()
+			members := make([]livecoll.Member, 0, len(wpl))
+			for i := range wpl {
+				// the snapshot is not filtered
+				if filter.Match(&wpl[i]) {
+					members = append(members, &wpl[i])
+				}
 			}
+			return ccn, members
+		},
+		FetchChangesSinceFunc: api.FetchWaypointChangesSince,
+	}
+	if filter != nil {
+		src.SubscribeFunc = func(subr livecoll.Subscriber) func() {
+			return api.SubscribeFilteredWaypoints(subr, filter)
+		}
+		// changes are not filtered, can't be replayed to a sparse replica
+		src.FetchChangesSinceFunc = nil
+	}
+	return src
+}
 
-			api.wpCCES = isoevt.NewStream()
-		}()
+func (api *ConsumerAPI) SubscribeWaypoints(subr livecoll.Subscriber) (unsubscribe func()) {
+	if api.mono {
+		wpc, release, err := ensureLoadedFor(api.tid)
+		if err != nil {
+			panic(err)
+		}
+		defer release()
+		return wpc.Subscribe(subr)
 	}
+
+	func() {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+
+		if api.wpCCES == nil {
+			api.wpCCES = livecoll.NewChangeStream()
+		}
+		api.wpSubscribers++
+	}()
 	// now api.wpCCES is guarranteed to not be nil
 	// consumer side event stream dispatching for waypoint changes
-	livecoll.Dispatch(api.wpCCES, subr, func() bool {
+	stopDispatch := livecoll.Dispatch(api.wpCCES, subr, func() bool {
 		// fire Epoch event upon watching started
 		subr.Epoch(api.wpCCN)
 		return false
 	})
+
+	// the wire subscribes upon connected
+	api.EnsureConn()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			stopDispatch()
+			api.releaseWaypoints()
+		})
+	}
+}
+
+// count off an unfiltered subscription, the wire stops relaying after the last one
+// dropped. the cces stays for a later subscription to reuse.
+func (api *ConsumerAPI) releaseWaypoints() {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	api.wpSubscribers--
+	if api.wpSubscribers > 0 {
+		return
+	}
+	if api.svc == nil || api.svc.Hosting.Cancelled() || api.svc.Posting.Cancelled() {
+		// a new wire won't subscribe it
+		return
+	}
+	ctx := api.svc.HoCtx().(*consumerContext)
+	if !ctx.watchingWaypoints {
+		return
+	}
+	ctx.watchingWaypoints = false
+	po := api.svc.MustPoToPeer()
+	po.Notif(fmt.Sprintf(`
+UnsubscribeWaypoints(%#v,0)
+`, api.tid))
+}
+
+// SubscribeFilteredWaypoints subscribes with only changes of waypoints passing the filter
+// delivered, the filter is evaluated at service side if consuming over hbi wire.
+// see `livecoll.Filtered()` for semantics.
+func (api *ConsumerAPI) SubscribeFilteredWaypoints(subr livecoll.Subscriber, filter *livecoll.Filter) (unsubscribe func()) {
+	if api.mono {
+		wpc, release, err := ensureLoadedFor(api.tid)
+		if err != nil {
+			panic(err)
+		}
+		defer release()
+		return wpc.SubscribeFiltered(subr, filter.Match)
+	}
+
+	if filter == nil {
+		filter = &livecoll.Filter{}
+	}
+	fsub := &filteredSubscription{
+		filter: filter,
+		cces:   livecoll.NewChangeStream(),
+	}
+	sid := api.addFiltered(fsub)
+	// consumer side event stream dispatching for this subscription
+	stopDispatch := livecoll.Dispatch(fsub.cces, subr, func() bool {
+		// fire Epoch event upon watching started
+		subr.Epoch(api.wpCCN)
+		return false
+	})
+
+	// the wire subscribes upon connected
+	api.EnsureConn()
+
+	return func() {
+		stopDispatch()
+		api.dropFiltered(sid)
+	}
+}
+
+// SubscribeWaypoint watches a single waypoint, the watcher sees its current value, every
+// update, and finally its deletion, after which the subscription finishes. see
+// `livecoll.WatchMember()` for semantics.
+func (api *ConsumerAPI) SubscribeWaypoint(id bson.ObjectId, watcher livecoll.MemberWatcher) (unsubscribe func()) {
+	if api.mono {
+		wpc, release, err := ensureLoadedFor(api.tid)
+		if err != nil {
+			panic(err)
+		}
+		defer release()
+		return wpc.SubscribeMember(id, watcher)
+	}
+
+	fsub := &filteredSubscription{
+		id:   id.Hex(),
+		cces: livecoll.NewChangeStream(),
+	}
+	sid := api.addFiltered(fsub)
+	subr := livecoll.WatchMember(id, wpWatch{api, sid, watcher}, func() (livecoll.CCN, livecoll.Member, bool) {
+		ccn, wp, ok := api.FetchWaypoint(id)
+		if !ok {
+			return ccn, nil, false
+		}
+		return ccn, wp, true
+	})
+	// consumer side event stream dispatching for this subscription
+	stopDispatch := livecoll.Dispatch(fsub.cces, subr, func() bool {
+		// fire Epoch event upon watching started, it finishes right away if no
+		// such waypoint
+		return subr.Epoch(api.wpCCN)
+	})
+
+	// the wire subscribes upon connected
+	api.EnsureConn()
+
+	return func() {
+		stopDispatch()
+		api.dropFiltered(sid)
+	}
 }
 
-func (ctx *consumerContext) wpCCES() *isoevt.EventStream {
+// relays to a member watcher, dropping the subscription once it finished
+type wpWatch struct {
+	api     *ConsumerAPI
+	sid     int
+	watcher livecoll.MemberWatcher
+}
+
+func (w wpWatch) Current(ccn livecoll.CCN, mo livecoll.Member) (stop bool) {
+	if stop = w.watcher.Current(ccn, mo); stop {
+		w.api.dropFiltered(w.sid)
+	}
+	return
+}
+
+func (w wpWatch) Updated(ccn livecoll.CCN, mo livecoll.Member, delta livecoll.Delta) (stop bool) {
+	if stop = w.watcher.Updated(ccn, mo, delta); stop {
+		w.api.dropFiltered(w.sid)
+	}
+	return
+}
+
+func (w wpWatch) Deleted(ccn livecoll.CCN, id interface{}) {
+	w.watcher.Deleted(ccn, id)
+	w.api.dropFiltered(w.sid)
+}
+
+// register a filtered subscription, the wire subscribes it upon connected
+func (api *ConsumerAPI) addFiltered(fsub *filteredSubscription) (sid int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	if api.wpFiltered == nil {
+		api.wpFiltered = make(map[int]*filteredSubscription)
+	}
+	api.lastSid++
+	api.wpFiltered[api.lastSid] = fsub
+	return api.lastSid
+}
+
+// drop a filtered subscription, and tell the service to stop relaying it
+func (api *ConsumerAPI) dropFiltered(sid int) {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	delete(api.wpFiltered, sid)
+	if api.svc == nil || api.svc.Hosting.Cancelled() || api.svc.Posting.Cancelled() {
+		// a new wire won't subscribe it
+		return
+	}
+	ctx := api.svc.HoCtx().(*consumerContext)
+	if !ctx.filteredWaypoints[sid] {
+		return
+	}
+	delete(ctx.filteredWaypoints, sid)
+	po := api.svc.MustPoToPeer()
+	po.Notif(fmt.Sprintf(`
+UnsubscribeWaypoints(%#v,%#v)
+`, api.tid, sid))
+}
+
+// the consumer side change event stream of a subscription, nil if it's dropped
+func (ctx *consumerContext) wpCCES(sid int) *isoevt.EventStream {
 	api := ctx.api
+	if sid != 0 {
+		api.mu.Lock()
+		fsub := api.wpFiltered[sid]
+		api.mu.Unlock()
+		if fsub == nil {
+			// dropped, with events still on the wire
+			return nil
+		}
+		return fsub.cces
+	}
 	// api.wpCCES won't change once assigned non-nil, we can trust thread local cache
 	cces := api.wpCCES // fast read without sync
 	if cces == nil {   // sync'ed read on cache miss
@@ -236,40 +634,314 @@ func (ctx *consumerContext) wpCCES() *isoevt.EventStream {
 	return cces
 }
 
-func (ctx *consumerContext) WpEpoch(ccn int) {
-	cces := ctx.wpCCES()
-	cces.Post(livecoll.EpochEvent{ccn})
+func (ctx *consumerContext) WpEpoch(sid int, epoch int64, seq uint64) {
+	cces := ctx.wpCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.EpochEvent{livecoll.CCN{epoch, seq}})
 }
 
 // Create
-func (ctx *consumerContext) WpCreated(ccn int) {
+func (ctx *consumerContext) WpCreated(sid int, epoch int64, seq uint64) {
 	eo, err := ctx.Ho().CoRecvObj()
 	if err != nil {
 		panic(err)
 	}
 	wp := eo.(*Waypoint)
-	cces := ctx.wpCCES()
-	cces.Post(livecoll.CreatedEvent{ccn, wp})
+	cces := ctx.wpCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.CreatedEvent{livecoll.CCN{epoch, seq}, wp})
 }
 
 // Update
-func (ctx *consumerContext) WpUpdated(ccn int) {
+func (ctx *consumerContext) WpUpdated(sid int, epoch int64, seq uint64) {
 	eo, err := ctx.Ho().CoRecvObj()
 	if err != nil {
 		panic(err)
 	}
-	wp := eo.(*Waypoint)
-	cces := ctx.wpCCES()
-	cces.Post(livecoll.UpdatedEvent{ccn, wp})
+	chg := eo.(*WaypointChange)
+	cces := ctx.wpCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.UpdatedEvent{livecoll.CCN{epoch, seq}, &chg.Waypoint, chg.Delta})
 }
 
 // Delete
-func (ctx *consumerContext) WpDeleted(ccn int) {
+func (ctx *consumerContext) WpDeleted(sid int, epoch int64, seq uint64, id string) {
+	cces := ctx.wpCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.DeletedEvent{livecoll.CCN{epoch, seq}, bson.ObjectIdHex(id)})
+}
+
+// Batch
+func (ctx *consumerContext) WpBatch(sid int, epoch int64, seq uint64) {
+	co, err := ctx.Ho().CoRecvObj()
+	if err != nil {
+		panic(err)
+	}
+	chgs := co.(*WaypointChanges)
+	changes := make([]interface{}, len(chgs.Changes))
+	for i := range chgs.Changes {
+		changes[i] = chgs.Changes[i].event()
+	}
+	cces := ctx.wpCCES(sid)
+	if cces == nil {
+		return
+	}
+	cces.Post(livecoll.BatchEvent{livecoll.CCN{epoch, seq}, changes})
+}
+
+func (api *ConsumerAPI) AddRoute(label string, wpIDs []bson.ObjectId, loop bool) error {
+	if api.mono {
+		return AddRoute(api.tid, label, wpIDs, loop)
+	}
+
+	_, po := api.conn()
+	return po.Notif(fmt.Sprintf(`
+AddRoute(%#v,%#v,%#v,%#v)
+`, api.tid, label, joinWaypointIDs(wpIDs), loop))
+}
+
+func (api *ConsumerAPI) UpdateRoute(id string, label string, wpIDs []bson.ObjectId, loop bool) error {
+	if api.mono {
+		return UpdateRoute(api.tid, id, label, wpIDs, loop)
+	}
+
+	_, po := api.conn()
+	return po.Notif(fmt.Sprintf(`
+UpdateRoute(%#v,%#v,%#v,%#v,%#v)
+`, api.tid, id, label, joinWaypointIDs(wpIDs), loop))
+}
+
+// UpdateRouteIf updates the route only if it's still of `version`, or returns a
+// `*livecoll.ConflictError`. the new version is returned on success.
+func (api *ConsumerAPI) UpdateRouteIf(
+	id string, version int, label string, wpIDs []bson.ObjectId, loop bool,
+) (int, error) {
+	if api.mono {
+		return UpdateRouteIf(api.tid, id, version, label, wpIDs, loop)
+	}
+
+	_, po := api.conn()
+	co, err := po.Co()
+	if err != nil {
+		return 0, err
+	}
+	defer co.Close()
+
+	result, err := co.Get(fmt.Sprintf(`
+UpdateRouteIf(%#v,%#v,%#v,%#v,%#v,%#v)
+`, api.tid, id, version, label, joinWaypointIDs(wpIDs), loop), "&UpdateOutcome{}")
+	if err != nil {
+		return 0, err
+	}
+	return result.(*livecoll.UpdateOutcome).Result(bson.ObjectIdHex(id), version)
+}
+
+func (api *ConsumerAPI) DeleteRoute(id string) error {
+	if api.mono {
+		return DeleteRoute(api.tid, id)
+	}
+
+	_, po := api.conn()
+	return po.Notif(fmt.Sprintf(`
+DeleteRoute(%#v,%#v)
+`, api.tid, id))
+}
+
+func (api *ConsumerAPI) FetchRoutes() (ccn livecoll.CCN, rtl []Route) {
+	if api.mono {
+		rts := FetchRoutes(api.tid)
+
+		ccn, rtl = rts.CCN, rts.Routes
+		return
+	}
+
+	_, po := api.conn()
+	co, err := po.Co()
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
+
+	result, err := co.Get(fmt.Sprintf(`
+FetchRoutes(%#v)
+`, api.tid), "&RoutesSnapshot{}")
+	if err != nil {
+		panic(err)
+	}
+	rts := result.(*RoutesSnapshot)
+
+	ccn, rtl = rts.CCN, rts.Routes
+	return
+}
+
+// FetchRouteChangesSince returns the changes after `ccn` as livecoll events in order,
+// `ok` is false if the changes are no longer available, a snapshot should be fetched
+// by `FetchRoutes()` then.
+func (api *ConsumerAPI) FetchRouteChangesSince(ccn livecoll.CCN) (changes []interface{}, ok bool) {
+	if api.mono {
+		return FetchRouteChangesSince(api.tid, ccn).Events()
+	}
+
+	_, po := api.conn()
+	co, err := po.Co()
+	if err != nil {
+		panic(err)
+	}
+	defer co.Close()
+
+	result, err := co.Get(fmt.Sprintf(`
+FetchRouteChangesSince(%#v,%d,%d)
+`, api.tid, ccn.Epoch, ccn.Seq), "&RouteChanges{}")
+	if err != nil {
+		panic(err)
+	}
+	return result.(*RouteChanges).Events()
+}
+
+// RouteSource makes a source for routes to be replicated from.
+func (api *ConsumerAPI) RouteSource() livecoll.Source {
+	return livecoll.SourceFuncs{
+		SubscribeFunc: api.SubscribeRoutes,
+		FetchAllFunc: func() (livecoll.CCN, []livecoll.Member) {
+			ccn, rtl := api.FetchRoutes()
+			members := make([]livecoll.Member, len(rtl))
+			for i := range rtl {
+				members[i] = &rtl[i]
+			}
+			return ccn, members
+		},
+		FetchChangesSinceFunc: api.FetchRouteChangesSince,
+	}
+}
+
+func (api *ConsumerAPI) SubscribeRoutes(subr livecoll.Subscriber) (unsubscribe func()) {
+	if api.mono {
+		rtc, release, err := ensureRoutesLoadedFor(api.tid)
+		if err != nil {
+			panic(err)
+		}
+		defer release()
+		return rtc.Subscribe(subr)
+	}
+
+	func() {
+		api.mu.Lock()
+		defer api.mu.Unlock()
+
+		if api.rtCCES == nil {
+			api.rtCCES = livecoll.NewChangeStream()
+		}
+		api.rtSubscribers++
+	}()
+	// now api.rtCCES is guarranteed to not be nil
+	// consumer side event stream dispatching for route changes
+	stopDispatch := livecoll.Dispatch(api.rtCCES, subr, func() bool {
+		// fire Epoch event upon watching started
+		subr.Epoch(api.rtCCN)
+		return false
+	})
+
+	// the wire subscribes upon connected
+	api.EnsureConn()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			stopDispatch()
+			api.releaseRoutes()
+		})
+	}
+}
+
+// count off a subscription to routes, the wire stops relaying after the last one
+// dropped
+func (api *ConsumerAPI) releaseRoutes() {
+	api.mu.Lock()
+	defer api.mu.Unlock()
+
+	api.rtSubscribers--
+	if api.rtSubscribers > 0 {
+		return
+	}
+	if api.svc == nil || api.svc.Hosting.Cancelled() || api.svc.Posting.Cancelled() {
+		// a new wire won't subscribe it
+		return
+	}
+	ctx := api.svc.HoCtx().(*consumerContext)
+	if !ctx.watchingRoutes {
+		return
+	}
+	ctx.watchingRoutes = false
+	po := api.svc.MustPoToPeer()
+	po.Notif(fmt.Sprintf(`
+UnsubscribeRoutes(%#v)
+`, api.tid))
+}
+
+// the consumer side change event stream of routes. notifs of routes carry sid 0
+// like other collections, there's no filtered subscription to routes.
+func (ctx *consumerContext) rtCCES() *isoevt.EventStream {
+	api := ctx.api
+	// api.rtCCES won't change once assigned non-nil, we can trust thread local cache
+	cces := api.rtCCES // fast read without sync
+	if cces == nil {   // sync'ed read on cache miss
+		api.mu.Lock()
+		cces = api.rtCCES
+		api.mu.Unlock()
+	}
+	if cces == nil {
+		panic("Consumer side rt cces not present on service event ?!")
+	}
+	return cces
+}
+
+func (ctx *consumerContext) RtEpoch(sid int, epoch int64, seq uint64) {
+	ctx.rtCCES().Post(livecoll.EpochEvent{livecoll.CCN{epoch, seq}})
+}
+
+// Create
+func (ctx *consumerContext) RtCreated(sid int, epoch int64, seq uint64) {
 	eo, err := ctx.Ho().CoRecvObj()
 	if err != nil {
 		panic(err)
 	}
-	wp := eo.(*Waypoint)
-	cces := ctx.wpCCES()
-	cces.Post(livecoll.DeletedEvent{ccn, wp})
+	rt := eo.(*Route)
+	ctx.rtCCES().Post(livecoll.CreatedEvent{livecoll.CCN{epoch, seq}, rt})
+}
+
+// Update
+func (ctx *consumerContext) RtUpdated(sid int, epoch int64, seq uint64) {
+	eo, err := ctx.Ho().CoRecvObj()
+	if err != nil {
+		panic(err)
+	}
+	chg := eo.(*RouteChange)
+	ctx.rtCCES().Post(livecoll.UpdatedEvent{livecoll.CCN{epoch, seq}, &chg.Route, chg.Delta})
+}
+
+// Delete
+func (ctx *consumerContext) RtDeleted(sid int, epoch int64, seq uint64, id string) {
+	ctx.rtCCES().Post(livecoll.DeletedEvent{livecoll.CCN{epoch, seq}, bson.ObjectIdHex(id)})
+}
+
+// Batch
+func (ctx *consumerContext) RtBatch(sid int, epoch int64, seq uint64) {
+	co, err := ctx.Ho().CoRecvObj()
+	if err != nil {
+		panic(err)
+	}
+	chgs := co.(*RouteChanges)
+	changes := make([]interface{}, len(chgs.Changes))
+	for i := range chgs.Changes {
+		changes[i] = chgs.Changes[i].event()
+	}
+	ctx.rtCCES().Post(livecoll.BatchEvent{livecoll.CCN{epoch, seq}, changes})
 }
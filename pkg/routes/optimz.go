@@ -1 +1,279 @@
 package routes
+
+import (
+	"math"
+	"time"
+
+	"github.com/complyue/ddgo/pkg/livecoll"
+	"github.com/golang/glog"
+)
+
+var (
+	// DefaultOptimzTimeLimit bounds the improvement of a route if not specified.
+	DefaultOptimzTimeLimit = 200 * time.Millisecond
+	// MaxOptimzTimeLimit bounds the improvement of a route no matter requested.
+	MaxOptimzTimeLimit = 10 * time.Second
+)
+
+// OptimizedRoute is an order to visit waypoints of a tenant, starting from a
+// position, with the total distance to go through all of them.
+type OptimizedRoute struct {
+	Tid string
+	CCN livecoll.CCN // of the waypoint collection optimized against
+
+	StartX, StartY float64
+	Waypoints      []Waypoint // in visiting order
+	Distance       float64
+}
+
+// OptimizeRoute computes a good order to visit all waypoints of a tenant, starting
+// from (x,y). `timeLimit` bounds the improvement after the initial route is
+// constructed, 0 for `DefaultOptimzTimeLimit`.
+func OptimizeRoute(tid string, x, y float64, timeLimit time.Duration) (*OptimizedRoute, error) {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	ccn, mos := wpc.FetchAll()
+	wps := make([]Waypoint, len(mos))
+	for i, mo := range mos {
+		wps[i] = *(mo.(*Waypoint))
+	}
+	ordered, distance := OptimizeOrder(x, y, wps, timeLimit)
+	return &OptimizedRoute{
+		Tid: tid, CCN: ccn,
+		StartX: x, StartY: y,
+		Waypoints: ordered, Distance: distance,
+	}, nil
+}
+
+// this service method has rpc style, with err-out converted to panic,
+// which will induce forceful disconnection
+func (ctx *serviceContext) OptimizeRoute(tid string, x, y float64, timeLimitMs int64) *OptimizedRoute {
+	rt, err := OptimizeRoute(tid, x, y, time.Duration(timeLimitMs)*time.Millisecond)
+	if err != nil {
+		panic(err)
+	}
+	return rt
+}
+
+// OptimizeOrder orders waypoints to be visited starting from (x,y), by nearest
+// neighbour construction, then improved by 2-opt and Or-opt moves until no more
+// improvement found or `timeLimit` reached. the route is open, it ends at the last
+// waypoint. `wps` is not changed.
+func OptimizeOrder(x, y float64, wps []Waypoint, timeLimit time.Duration) (ordered []Waypoint, distance float64) {
+	if timeLimit <= 0 {
+		timeLimit = DefaultOptimzTimeLimit
+	} else if timeLimit > MaxOptimzTimeLimit {
+		timeLimit = MaxOptimzTimeLimit
+	}
+	deadline := time.Now().Add(timeLimit)
+
+	rt := &optimzRoute{
+		start: optimzPoint{x, y},
+		pts:   make([]optimzPoint, len(wps)),
+	}
+	for i := range wps {
+		rt.pts[i] = optimzPoint{wps[i].X, wps[i].Y}
+	}
+	rt.nearestNeighbour()
+	constructed := rt.length()
+
+	passes := 0
+	for time.Now().Before(deadline) {
+		passes++
+		improved := rt.twoOpt(deadline)
+		if rt.orOpt(deadline) {
+			improved = true
+		}
+		if !improved {
+			break
+		}
+	}
+	distance = rt.length()
+	glog.V(1).Infof("Optimized route of %d waypoints, %0.1f -> %0.1f after %d passes.",
+		len(wps), constructed, distance, passes)
+
+	ordered = make([]Waypoint, len(wps))
+	for pos, i := range rt.order {
+		ordered[pos] = wps[i]
+	}
+	return
+}
+
+type optimzPoint struct {
+	x, y float64
+}
+
+func (p optimzPoint) dist(q optimzPoint) float64 {
+	return math.Hypot(p.x-q.x, p.y-q.y)
+}
+
+// improvements smaller than this are float noise, not to loop forever on them
+const optimzEpsilon = 1e-9
+
+// a route under optimization, visiting points by indices in `order`, starting
+// from `start`
+type optimzRoute struct {
+	start optimzPoint
+	pts   []optimzPoint
+	order []int
+}
+
+// the point visited at a position, the start if before the first one
+func (rt *optimzRoute) at(pos int) optimzPoint {
+	if pos < 0 {
+		return rt.start
+	}
+	return rt.pts[rt.order[pos]]
+}
+
+// distance of the leg from position `pos` to the next one, 0 if it's the last
+func (rt *optimzRoute) leg(pos int) float64 {
+	if pos+1 >= len(rt.order) {
+		return 0
+	}
+	return rt.at(pos).dist(rt.at(pos + 1))
+}
+
+func (rt *optimzRoute) length() float64 {
+	total := 0.0
+	for pos := -1; pos < len(rt.order); pos++ {
+		total += rt.leg(pos)
+	}
+	return total
+}
+
+// construct the route by always going to the nearest point not visited yet
+func (rt *optimzRoute) nearestNeighbour() {
+	n := len(rt.pts)
+	rt.order = make([]int, 0, n)
+	visited := make([]bool, n)
+	at := rt.start
+	for len(rt.order) < n {
+		nearest, dNearest := -1, math.Inf(1)
+		for i, p := range rt.pts {
+			if visited[i] {
+				continue
+			}
+			if d := at.dist(p); d < dNearest {
+				nearest, dNearest = i, d
+			}
+		}
+		visited[nearest] = true
+		rt.order = append(rt.order, nearest)
+		at = rt.pts[nearest]
+	}
+}
+
+// reverse segments of the route wherever that shortens it, returns whether
+// improved
+func (rt *optimzRoute) twoOpt(deadline time.Time) (improved bool) {
+	n := len(rt.order)
+	for i := 0; i < n-1; i++ {
+		if time.Now().After(deadline) {
+			return
+		}
+		for j := i + 1; j < n; j++ {
+			// reversing order[i..j] replaces legs (i-1,i) and (j,j+1)
+			before, first, last := rt.at(i-1), rt.at(i), rt.at(j)
+			delta := before.dist(last) - before.dist(first)
+			if j+1 < n {
+				after := rt.at(j + 1)
+				delta += first.dist(after) - last.dist(after)
+			}
+			if delta < -optimzEpsilon {
+				for a, b := i, j; a < b; a, b = a+1, b-1 {
+					rt.order[a], rt.order[b] = rt.order[b], rt.order[a]
+				}
+				improved = true
+			}
+		}
+	}
+	return
+}
+
+// move segments of up to 3 points elsewhere in the route, reversed or not,
+// wherever that shortens it, returns whether improved
+func (rt *optimzRoute) orOpt(deadline time.Time) (improved bool) {
+	for segLen := 1; segLen <= 3; segLen++ {
+		for i := 0; i+segLen <= len(rt.order); i++ {
+			if time.Now().After(deadline) {
+				return
+			}
+			if rt.moveSegment(i, segLen) {
+				improved = true
+			}
+		}
+	}
+	return
+}
+
+// move the segment of `segLen` points at position `i` to where it shortens the
+// route the most, returns whether moved
+func (rt *optimzRoute) moveSegment(i, segLen int) bool {
+	n := len(rt.order)
+	j := i + segLen - 1
+	first, last := rt.at(i), rt.at(j)
+
+	// gain of taking the segment out, joining its neighbours
+	before := rt.at(i - 1)
+	removal := before.dist(first)
+	if j+1 < n {
+		after := rt.at(j + 1)
+		removal += last.dist(after) - before.dist(after)
+	}
+
+	// the route without the segment
+	rest := make([]int, 0, n-segLen)
+	rest = append(rest, rt.order[:i]...)
+	rest = append(rest, rt.order[j+1:]...)
+	restAt := func(pos int) optimzPoint {
+		if pos < 0 {
+			return rt.start
+		}
+		return rt.pts[rest[pos]]
+	}
+
+	bestK, bestReversed, bestGain := -1, false, optimzEpsilon
+	for k := 0; k <= len(rest); k++ {
+		if k == i {
+			// where it was
+			continue
+		}
+		// insert before rest[k], after rest[k-1]
+		a := restAt(k - 1)
+		insertion, reversedInsertion := a.dist(first), a.dist(last)
+		if k < len(rest) {
+			b := restAt(k)
+			insertion += last.dist(b) - a.dist(b)
+			reversedInsertion += first.dist(b) - a.dist(b)
+		}
+		if gain := removal - insertion; gain > bestGain {
+			bestK, bestReversed, bestGain = k, false, gain
+		}
+		if segLen > 1 {
+			if gain := removal - reversedInsertion; gain > bestGain {
+				bestK, bestReversed, bestGain = k, true, gain
+			}
+		}
+	}
+	if bestK < 0 {
+		return false
+	}
+
+	seg := append([]int(nil), rt.order[i:j+1]...)
+	if bestReversed {
+		for a, b := 0, len(seg)-1; a < b; a, b = a+1, b-1 {
+			seg[a], seg[b] = seg[b], seg[a]
+		}
+	}
+	order := make([]int, 0, n)
+	order = append(order, rest[:bestK]...)
+	order = append(order, seg...)
+	order = append(order, rest[bestK:]...)
+	rt.order = order
+	return true
+}
@@ -0,0 +1,88 @@
+package routes
+
+import (
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func randomPoints(rnd *rand.Rand, n int) []optimzPoint {
+	pts := make([]optimzPoint, n)
+	for i := range pts {
+		pts[i] = optimzPoint{rnd.Float64() * 1000, rnd.Float64() * 1000}
+	}
+	return pts
+}
+
+func TestOptimzMovesNeverLengthen(t *testing.T) {
+	rnd := rand.New(rand.NewSource(20181018))
+	deadline := time.Now().Add(time.Minute)
+	for round := 0; round < 50; round++ {
+		rt := &optimzRoute{
+			start: optimzPoint{rnd.Float64() * 1000, rnd.Float64() * 1000},
+			pts:   randomPoints(rnd, 1+rnd.Intn(60)),
+		}
+		rt.nearestNeighbour()
+		last := rt.length()
+		for pass := 0; ; pass++ {
+			improved := rt.twoOpt(deadline)
+			if l := rt.length(); l > last+optimzEpsilon {
+				t.Fatalf("round %d pass %d: 2-opt lengthened %v -> %v", round, pass, last, l)
+			} else {
+				last = l
+			}
+			if rt.orOpt(deadline) {
+				improved = true
+			}
+			if l := rt.length(); l > last+optimzEpsilon {
+				t.Fatalf("round %d pass %d: Or-opt lengthened %v -> %v", round, pass, last, l)
+			} else {
+				last = l
+			}
+			if !improved {
+				break
+			}
+		}
+	}
+}
+
+func TestOptimizeOrderKeepsWaypoints(t *testing.T) {
+	rnd := rand.New(rand.NewSource(20181018))
+	for round := 0; round < 20; round++ {
+		x, y := rnd.Float64()*1000, rnd.Float64()*1000
+		pts := randomPoints(rnd, rnd.Intn(60))
+		wps := make([]Waypoint, len(pts))
+		for i, p := range pts {
+			wps[i] = Waypoint{Seq: i + 1, X: p.x, Y: p.y}
+		}
+
+		nn := &optimzRoute{start: optimzPoint{x, y}, pts: pts}
+		nn.nearestNeighbour()
+
+		ordered, distance := OptimizeOrder(x, y, wps, time.Second)
+		if len(ordered) != len(wps) {
+			t.Fatalf("round %d: %d waypoints ordered out of %d", round, len(ordered), len(wps))
+		}
+		seen := make(map[int]bool)
+		for _, wp := range ordered {
+			if wp.Seq < 1 || wp.Seq > len(wps) || seen[wp.Seq] {
+				t.Fatalf("round %d: waypoint #%d ordered unexpectedly", round, wp.Seq)
+			}
+			seen[wp.Seq] = true
+		}
+		if distance > nn.length()+optimzEpsilon {
+			t.Fatalf("round %d: optimized %v longer than nearest neighbour %v", round, distance, nn.length())
+		}
+
+		// the distance told is of the order returned
+		walked, at := 0.0, optimzPoint{x, y}
+		for _, wp := range ordered {
+			p := optimzPoint{wp.X, wp.Y}
+			walked += at.dist(p)
+			at = p
+		}
+		if d := walked - distance; d > 1e-6 || d < -1e-6 {
+			t.Fatalf("round %d: distance %v told for a route of %v", round, distance, walked)
+		}
+	}
+}
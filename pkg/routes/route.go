@@ -0,0 +1,530 @@
+package routes
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/complyue/ddgo/pkg/dbc"
+	"github.com/complyue/ddgo/pkg/livecoll"
+	"github.com/complyue/hbigo/pkg/errors"
+	"github.com/globalsign/mgo/bson"
+	"github.com/golang/glog"
+)
+
+func init() {
+	// for route change events to be journaled
+	livecoll.RegisterMemberType("routes.Route", (*Route)(nil))
+}
+
+var (
+	rtRepo   dbc.Repo
+	muRtRepo sync.Mutex
+)
+
+// the backing storage of routes, selected by the "db" url in etc/services.json
+func routeRepo() dbc.Repo {
+	muRtRepo.Lock()
+	defer muRtRepo.Unlock()
+
+	if rtRepo == nil {
+		r, err := dbc.OpenRepo("route")
+		if err != nil {
+			glog.Error(err)
+			panic(err)
+		}
+		rtRepo = r
+	}
+	return rtRepo
+}
+
+// in-memory storage of all routes of a particular tenant
+type RouteCollection struct {
+	livecoll.HouseKeeper
+
+	Tid string
+
+	// serializes updates, from validating the waypoints referenced through
+	// committing a new version. waypoint deletion holds it as well, so no route
+	// can reference a waypoint being deleted.
+	muUpdate sync.Mutex
+}
+
+// a route through waypoints of a tenant
+type Route struct {
+	Id bson.ObjectId `json:"_id" bson:"_id"`
+
+	Label string `json:"label"`
+	// in visiting order, a waypoint can be visited more than once
+	Waypoints []bson.ObjectId `json:"waypoints"`
+	// back to the first waypoint after the last one, or one-way
+	Loop bool `json:"loop"`
+
+	// increased by each update, stored in db as `dbc.VersionField`
+	Version int `json:"version"`
+}
+
+func (rt *Route) GetID() interface{} {
+	return rt.Id
+}
+
+func (rt *Route) GetVersion() int {
+	return rt.Version
+}
+
+// whether the route visits the waypoint
+func (rt *Route) Visits(wpID bson.ObjectId) bool {
+	for _, id := range rt.Waypoints {
+		if id == wpID {
+			return true
+		}
+	}
+	return false
+}
+
+func (rt *Route) String() string {
+	return fmt.Sprintf("%+v", rt)
+}
+
+func (rt *Route) Format(s fmt.State, verb rune) {
+	switch verb {
+	case 'v':
+		io.WriteString(s, fmt.Sprintf("%s", rt.Label))
+		if s.Flag('+') {
+			kind := "one-way"
+			if rt.Loop {
+				kind = "loop"
+			}
+			io.WriteString(s, fmt.Sprintf("(%s of %d waypoints)", kind, len(rt.Waypoints)))
+		}
+	}
+}
+
+// route collections of all tenants served by this process
+var rtRegistry = livecoll.NewRegistry("route", loadRoutes)
+
+// acquire the route collection of a tenant, loading it if not yet, `release()`
+// should be called when done with it.
+func ensureRoutesLoadedFor(tid string) (*RouteCollection, func(), error) {
+	coll, release, err := rtRegistry.Acquire(tid)
+	if err != nil {
+		glog.Error(err)
+		return nil, nil, err
+	}
+	return coll.(*RouteCollection), release, nil
+}
+
+// load full list of routes of a tenant
+func loadRoutes(tid string, former livecoll.HouseKeeper) (livecoll.HouseKeeper, error) {
+	var loadingList []Route
+	err := routeRepo().LoadAll(tid, &loadingList)
+	if err != nil {
+		return nil, err
+	}
+	var hk livecoll.HouseKeeper
+	if former != nil {
+		// inherite subscribers by reusing the housekeeper, if evicted while subscribed
+		hk = former.(*RouteCollection).HouseKeeper
+	} else if hk, err = livecoll.OpenHouseKeeper("route", tid); err != nil {
+		return nil, err
+	}
+	memberList := make([]livecoll.Member, len(loadingList))
+	for i, rto := range loadingList {
+		rtCopy := rto
+		memberList[i] = &rtCopy
+	}
+	if err = hk.Load(memberList); err != nil {
+		if former == nil {
+			hk.Close()
+		}
+		return nil, err
+	}
+	return &RouteCollection{
+		HouseKeeper: hk,
+		Tid:         tid,
+	}, nil
+}
+
+// the snapshot of all routes of a specific tenant
+type RoutesSnapshot struct {
+	Tid    string
+	CCN    livecoll.CCN
+	Routes []Route
+}
+
+func FetchRoutes(tid string) *RoutesSnapshot {
+	rtc, release, err := ensureRoutesLoadedFor(tid)
+	if err != nil {
+		// err has been logged
+		panic(err)
+	}
+	defer release()
+	ccn, rts := rtc.FetchAll()
+	snap := &RoutesSnapshot{
+		Tid:    tid,
+		CCN:    ccn,
+		Routes: make([]Route, len(rts)),
+	}
+	for i, rt := range rts {
+		snap.Routes[i] = *(rt.(*Route))
+	}
+	return snap
+}
+
+// this service method has rpc style, with err-out converted to panic,
+// which will induce forceful disconnection
+func (ctx *serviceContext) FetchRoutes(tid string) *RoutesSnapshot {
+	return FetchRoutes(tid)
+}
+
+// the changes to routes of a specific tenant, after a known ccn
+type RouteChanges struct {
+	Tid string
+	// changes since the known ccn are no longer available, a snapshot should be
+	// fetched instead
+	TooOld  bool
+	Changes []RouteChange
+}
+
+// a single change to routes, a deleted route has only the id set. changes
+// committed as a change set share the same ccn
+type RouteChange struct {
+	livecoll.ChangeHeader `bson:",inline"`
+
+	Route Route
+}
+
+func FetchRouteChangesSince(tid string, ccn livecoll.CCN) *RouteChanges {
+	rtc, release, err := ensureRoutesLoadedFor(tid)
+	if err != nil {
+		// err has been logged
+		panic(err)
+	}
+	defer release()
+	chgs := &RouteChanges{Tid: tid}
+	changes, ok := rtc.FetchChangesSince(ccn)
+	if !ok {
+		chgs.TooOld = true
+		return chgs
+	}
+	chgs.Changes = routeChanges(changes)
+	return chgs
+}
+
+func (ctx *serviceContext) FetchRouteChangesSince(tid string, epoch int64, seq uint64) *RouteChanges {
+	return FetchRouteChangesSince(tid, livecoll.CCN{epoch, seq})
+}
+
+// convert change events to route changes, with change sets flattened
+func routeChanges(events []interface{}) []RouteChange {
+	flat := livecoll.FlattenEvents(events)
+	chgs := make([]RouteChange, len(flat))
+	for i, evt := range flat {
+		hdr, mo, id := livecoll.ChangeOf(evt)
+		chgs[i].ChangeHeader = hdr
+		if mo != nil {
+			chgs[i].Route = *(mo.(*Route))
+		} else {
+			chgs[i].Route.Id = id.(bson.ObjectId)
+		}
+	}
+	return chgs
+}
+
+// change events to be replayed by subscribers
+func (chgs *RouteChanges) Events() (changes []interface{}, ok bool) {
+	if chgs.TooOld {
+		return nil, false
+	}
+	flat := make([]interface{}, len(chgs.Changes))
+	for i := range chgs.Changes {
+		flat[i] = chgs.Changes[i].event()
+	}
+	// changes of a change set are consecutive, with the same ccn
+	return livecoll.RegroupEvents(flat), true
+}
+
+func (chg *RouteChange) event() interface{} {
+	return chg.ChangeHeader.Event(&chg.Route)
+}
+
+// how routes and their changes are shipped to consumers
+var rtShipping = livecoll.Shipping{
+	MemberHint: "&Route{}", ChangeHint: "&RouteChange{}", ChangesHint: "&RouteChanges{}",
+	Change: func(hdr livecoll.ChangeHeader, mo livecoll.Member) interface{} {
+		return &RouteChange{ChangeHeader: hdr, Route: *(mo.(*Route))}
+	},
+	Changes: func(events []interface{}) interface{} {
+		return &RouteChanges{Changes: routeChanges(events)}
+	},
+}
+
+func (ctx *serviceContext) SubscribeRoutes(tid string) {
+	rtc, release, err := ensureRoutesLoadedFor(tid)
+	if err != nil {
+		panic(err)
+	}
+	defer release()
+
+	dele := ctx.relay("Rt", 0, false, rtShipping)
+	unsubscribe := rtc.Subscribe(dele)
+
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+	if ctx.rtSubscription != nil {
+		ctx.rtSubscription()
+	}
+	ctx.rtSubscription = unsubscribe
+}
+
+// the consumer has dropped its subscription to routes, the delegate relays no more
+// event
+func (ctx *serviceContext) UnsubscribeRoutes(tid string) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if ctx.rtSubscription != nil {
+		ctx.rtSubscription()
+		ctx.rtSubscription = nil
+	}
+}
+
+// waypoint ids are passed over the wire joined by commas
+func joinWaypointIDs(wpIDs []bson.ObjectId) string {
+	hexes := make([]string, len(wpIDs))
+	for i, id := range wpIDs {
+		hexes[i] = id.Hex()
+	}
+	return strings.Join(hexes, ",")
+}
+
+// ParseWaypointIDs parses waypoint ids in hex.
+func ParseWaypointIDs(hexes []string) ([]bson.ObjectId, error) {
+	wpIDs := make([]bson.ObjectId, len(hexes))
+	for i, hex := range hexes {
+		if !bson.IsObjectIdHex(hex) {
+			return nil, errors.Errorf("Invalid waypoint id [%s]", hex)
+		}
+		wpIDs[i] = bson.ObjectIdHex(hex)
+	}
+	return wpIDs, nil
+}
+
+// parse waypoint ids as joined by commas
+func splitWaypointIDs(joined string) ([]bson.ObjectId, error) {
+	if joined == "" {
+		return nil, nil
+	}
+	return ParseWaypointIDs(strings.Split(joined, ","))
+}
+
+// all waypoints referenced should exist, should be called with `rtc.muUpdate`
+// locked, so none of them can be deleted before the route committed.
+func checkWaypoints(tid string, wpIDs []bson.ObjectId) error {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	for _, id := range wpIDs {
+		if _, ok := wpc.Read(id); !ok {
+			return errors.Errorf("Waypoint id=[%s] not exists for tid=%s", id.Hex(), tid)
+		}
+	}
+	return nil
+}
+
+func AddRoute(tid string, label string, wpIDs []bson.ObjectId, loop bool) error {
+	rtc, release, err := ensureRoutesLoadedFor(tid)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	rtc.muUpdate.Lock()
+	defer rtc.muUpdate.Unlock()
+
+	if err := checkWaypoints(tid, wpIDs); err != nil {
+		return err
+	}
+	rt := &Route{
+		Id:    bson.NewObjectId(),
+		Label: label, Waypoints: wpIDs, Loop: loop,
+	}
+	// write into backing storage, the db
+	if err := routeRepo().Insert(tid, rt); err != nil {
+		return err
+	}
+
+	// add to in-memory collection, after successful db insert
+	rtc.Created(rt)
+
+	return nil
+}
+
+// this service method has async style, successful result will be published
+// as an event asynchronously
+func (ctx *serviceContext) AddRoute(tid string, label string, wpIDs string, loop bool) error {
+	ids, err := splitWaypointIDs(wpIDs)
+	if err != nil {
+		return err
+	}
+	return AddRoute(tid, label, ids, loop)
+}
+
+func UpdateRoute(tid string, id string, label string, wpIDs []bson.ObjectId, loop bool) error {
+	_, err := UpdateRouteIf(tid, id, -1, label, wpIDs, loop)
+	return err
+}
+
+// UpdateRouteIf updates the route only if it's still of `version`, or returns a
+// `*livecoll.ConflictError`. the new version is returned on success. a negative
+// `version` updates whatever version it is.
+func UpdateRouteIf(
+	tid string, id string, version int,
+	label string, wpIDs []bson.ObjectId, loop bool,
+) (int, error) {
+	rtc, release, err := ensureRoutesLoadedFor(tid)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+
+	rtc.muUpdate.Lock()
+	defer rtc.muUpdate.Unlock()
+
+	mrt, ok := rtc.Read(bson.ObjectIdHex(id))
+	if !ok || mrt == nil {
+		return 0, errors.Errorf("Route id=[%s] not exists for tid=%s", id, tid)
+	}
+	rt := mrt.(*Route)
+	if version < 0 {
+		version = rt.Version
+	} else if version != rt.Version {
+		return 0, &livecoll.ConflictError{ID: rt.Id, Expected: version, Actual: rt.Version}
+	}
+	if err := checkWaypoints(tid, wpIDs); err != nil {
+		return 0, err
+	}
+
+	// update backing storage, the db
+	if err := routeRepo().UpdateVersioned(tid, rt.Id, version, bson.M{
+		"label": label, "waypoints": wpIDs, "loop": loop,
+	}); err != nil {
+		if err == dbc.ErrConflict {
+			// changed in db by someone else, not through this collection
+			return 0, &livecoll.ConflictError{ID: rt.Id, Expected: version, Actual: -1}
+		}
+		return 0, err
+	}
+
+	// swap in an updated value, after successful db update
+	updated, ok := rtc.Modify(rt.Id, func(mo livecoll.Member) livecoll.Member {
+		updated := *(mo.(*Route))
+		updated.Label, updated.Waypoints, updated.Loop = label, wpIDs, loop
+		updated.Version = version + 1
+		return &updated
+	})
+	if !ok {
+		// deleted meanwhile
+		return 0, errors.Errorf("Route id=[%s] not exists for tid=%s", id, tid)
+	}
+	return updated.(*Route).Version, nil
+}
+
+// this service method has async style, successful result will be published
+// as an event asynchronously
+func (ctx *serviceContext) UpdateRoute(tid string, id string, label string, wpIDs string, loop bool) error {
+	ids, err := splitWaypointIDs(wpIDs)
+	if err != nil {
+		return err
+	}
+	return UpdateRoute(tid, id, label, ids, loop)
+}
+
+// this service method has rpc style, failures including conflicts are returned
+// in the outcome, not to disconnect the wire
+func (ctx *serviceContext) UpdateRouteIf(
+	tid string, id string, version int, label string, wpIDs string, loop bool,
+) *livecoll.UpdateOutcome {
+	ids, err := splitWaypointIDs(wpIDs)
+	if err != nil {
+		return livecoll.NewUpdateOutcome(0, err)
+	}
+	return livecoll.NewUpdateOutcome(UpdateRouteIf(tid, id, version, label, ids, loop))
+}
+
+func DeleteRoute(tid string, id string) error {
+	rtc, release, err := ensureRoutesLoadedFor(tid)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	rtc.muUpdate.Lock()
+	defer rtc.muUpdate.Unlock()
+
+	mrt, ok := rtc.Read(bson.ObjectIdHex(id))
+	if !ok || mrt == nil {
+		return errors.Errorf("Route id=[%s] not exists for tid=%s", id, tid)
+	}
+	rt := mrt.(*Route)
+
+	// remove from backing storage, the db
+	if err := routeRepo().Delete(tid, rt.Id); err != nil {
+		return err
+	}
+
+	// remove from in-memory collection, after successful db removal
+	rtc.Deleted(rt.Id)
+
+	return nil
+}
+
+// this service method has async style, successful result will be published
+// as an event asynchronously
+func (ctx *serviceContext) DeleteRoute(tid string, id string) error {
+	return DeleteRoute(tid, id)
+}
+
+// take a waypoint being deleted out of all routes visiting it, as a single change
+// set. should be called with `rtc.muUpdate` locked, and held until the waypoint
+// deleted, so no route can reference it again meanwhile.
+func (rtc *RouteCollection) dropWaypoint(wpID bson.ObjectId) error {
+	var cs livecoll.ChangeSet
+	// routes updated in db so far are committed even if a later one failed
+	defer rtc.Commit(&cs)
+
+	_, mos := rtc.FetchAll()
+	for _, mo := range mos {
+		rt := mo.(*Route)
+		if !rt.Visits(wpID) {
+			continue
+		}
+		wpIDs := make([]bson.ObjectId, 0, len(rt.Waypoints))
+		for _, id := range rt.Waypoints {
+			if id != wpID {
+				wpIDs = append(wpIDs, id)
+			}
+		}
+		if err := routeRepo().UpdateVersioned(rtc.Tid, rt.Id, rt.Version, bson.M{
+			"waypoints": wpIDs,
+		}); err != nil {
+			if err == dbc.ErrConflict {
+				// changed in db by someone else, not through this collection
+				return &livecoll.ConflictError{ID: rt.Id, Expected: rt.Version, Actual: -1}
+			}
+			return err
+		}
+		updated := *rt
+		updated.Waypoints = wpIDs
+		updated.Version = rt.Version + 1
+		cs.Updated(&updated)
+	}
+	if cs.Len() > 0 {
+		glog.V(1).Infof("Waypoint [%s] dropped from %d routes of [%s].", wpID.Hex(), cs.Len(), rtc.Tid)
+	}
+	return nil
+}
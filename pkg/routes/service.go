@@ -3,12 +3,14 @@ package routes
 
 import (
 	"fmt"
+	"github.com/complyue/ddgo/pkg/livecoll"
 	"github.com/complyue/ddgo/pkg/svcs"
 	"github.com/complyue/hbigo"
 	"github.com/complyue/hbigo/pkg/svcpool"
 	"github.com/golang/glog"
 	"net"
 	"os"
+	"sync"
 )
 
 // construct a service hosting context for serving over HBI wires
@@ -21,12 +23,52 @@ func NewServiceContext() hbi.HoContext {
 // implementation details of service context
 type serviceContext struct {
 	hbi.HoContext
+
+	mu sync.Mutex
+	// to cancel waypoint subscriptions relayed over this wire, by subscription id
+	// at consumer side, 0 for the unfiltered one
+	wpSubscriptions map[int]func()
+	rtSubscription  func() // to cancel the routes subscription, nil if none
+}
+
+// a subscriber relaying changes over this wire, it stops once the wire is gone, a
+// subscription the consumer has dropped is cancelled directly
+func (ctx *serviceContext) relay(
+	prefix string, sid int, member bool, ship livecoll.Shipping,
+) livecoll.Relay {
+	return livecoll.Relay{
+		Prefix: prefix, Sid: sid, Member: member, Ship: ship,
+		Stopped: ctx.Cancelled,
+		Post: func(code string, obj interface{}, hint string) error {
+			po := ctx.MustPoToPeer()
+			if obj == nil {
+				return po.Notif(code)
+			}
+			return po.NotifBSON(code, obj, hint)
+		},
+	}
+}
+
+// keep the handle of a waypoints subscription, to be cancelled once the consumer
+// dropped it. a former one of the same id is cancelled.
+func (ctx *serviceContext) keepWpSubscription(sid int, unsubscribe func()) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if former := ctx.wpSubscriptions[sid]; former != nil {
+		former()
+	}
+	if ctx.wpSubscriptions == nil {
+		ctx.wpSubscriptions = make(map[int]func())
+	}
+	ctx.wpSubscriptions[sid] = unsubscribe
 }
 
 // give types to be exposed, with typed nil pointer values to each
 func (ctx *serviceContext) TypesToExpose() []interface{} {
 	return []interface{}{
 		(*Waypoint)(nil),
+		(*livecoll.Filter)(nil),
 	}
 }
 
@@ -3,17 +3,56 @@ package routes
 import (
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/complyue/ddgo/pkg/dbc"
 	"github.com/complyue/ddgo/pkg/livecoll"
 	"github.com/complyue/hbigo/pkg/errors"
-	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	"github.com/golang/glog"
 )
 
-func coll() *mgo.Collection {
-	return dbc.DB().C("waypoint")
+func init() {
+	// for waypoint change events to be journaled
+	livecoll.RegisterMemberType("routes.Waypoint", (*Waypoint)(nil))
+}
+
+var (
+	wpRepo dbc.Repo
+	wpSeqs *dbc.SeqCounter
+	muRepo sync.Mutex
+)
+
+// the backing storage of waypoints, selected by the "db" url in etc/services.json
+func repo() dbc.Repo {
+	muRepo.Lock()
+	defer muRepo.Unlock()
+
+	if wpRepo == nil {
+		r, err := dbc.OpenRepo("waypoint")
+		if err != nil {
+			glog.Error(err)
+			panic(err)
+		}
+		wpRepo = r
+	}
+	return wpRepo
+}
+
+// allocates seqs of waypoints, persisted along with them
+func seqCounter() *dbc.SeqCounter {
+	muRepo.Lock()
+	defer muRepo.Unlock()
+
+	if wpSeqs == nil {
+		sc, err := dbc.OpenSeqCounter("waypoint")
+		if err != nil {
+			glog.Error(err)
+			panic(err)
+		}
+		wpSeqs = sc
+	}
+	return wpSeqs
 }
 
 // in-memory storage of all waypoints of a particular tenant.
@@ -22,8 +61,13 @@ type WaypointCollection struct {
 	livecoll.HouseKeeper
 
 	Tid string
-	// this is the primary index to locate a waypoint by tid+seq
-	bySeq map[int]*Waypoint
+	// max seq of waypoints loaded or added, seqs are allocated by the persisted counter
+	// and never below it, so seqs of deleted waypoints are not reused
+	maxSeq int
+
+	// serializes updates and deletions, from reading the version through committing
+	// a new one. taken before `RouteCollection.muUpdate` if both are needed.
+	muUpdate sync.Mutex
 }
 
 // a single waypoint
@@ -36,12 +80,27 @@ type Waypoint struct {
 	Label string  `json:"label"`
 	X     float64 `json:"x"`
 	Y     float64 `json:"y"`
+
+	// increased by each update, stored in db as `dbc.VersionField`
+	Version int `json:"version"`
 }
 
 func (wp *Waypoint) GetID() interface{} {
 	return wp.Id
 }
 
+func (wp *Waypoint) GetVersion() int {
+	return wp.Version
+}
+
+func (wp *Waypoint) GetSeq() int {
+	return wp.Seq
+}
+
+func (wp *Waypoint) GetXY() (x, y float64) {
+	return wp.X, wp.Y
+}
+
 func (wp *Waypoint) String() string {
 	return fmt.Sprintf("%+v", wp)
 }
@@ -56,49 +115,58 @@ func (wp *Waypoint) Format(s fmt.State, verb rune) {
 	}
 }
 
-var (
-	wpCollection *WaypointCollection
-)
-
-func ensureLoadedFor(tid string) error {
-	// sync is not strictly necessary for load, as worst scenario is to load more than once,
-	// while correctness not violated.
-	if wpCollection != nil {
-		// already have a full list loaded
-		if tid != wpCollection.Tid {
-			// should be coz of malfunctioning of service router, log and deny service
-			err := errors.New(fmt.Sprintf(
-				"Waypoint service already stuck to [%s], not serving [%s]!",
-				wpCollection.Tid, tid,
-			))
-			glog.Error(err)
-			return err
-		}
-		return nil
+// BySeq locates a waypoint by seq.
+func (wpc *WaypointCollection) BySeq(seq int) (*Waypoint, bool) {
+	mo, ok := wpc.ReadBy("seq", seq)
+	if !ok {
+		return nil, false
 	}
+	return mo.(*Waypoint), true
+}
 
-	// the first time serving a tenant, load full list and stuck to this tid
-	var loadingList []Waypoint
-	err := coll().Find(bson.M{"tid": tid}).All(&loadingList)
+// waypoint collections of all tenants served by this process
+var wpRegistry = livecoll.NewRegistry("waypoint", loadWaypoints)
+
+// acquire the waypoint collection of a tenant, loading it if not yet, `release()`
+// should be called when done with it.
+func ensureLoadedFor(tid string) (*WaypointCollection, func(), error) {
+	coll, release, err := wpRegistry.Acquire(tid)
 	if err != nil {
 		glog.Error(err)
-		return err
+		return nil, nil, err
 	}
-	optimalSize := 2 * len(loadingList)
-	if optimalSize < 200 {
-		optimalSize = 200
+	return coll.(*WaypointCollection), release, nil
+}
+
+// load full list of waypoints of a tenant
+func loadWaypoints(tid string, former livecoll.HouseKeeper) (livecoll.HouseKeeper, error) {
+	var loadingList []Waypoint
+	err := repo().LoadAll(tid, &loadingList)
+	if err != nil {
+		return nil, err
 	}
 	var hk livecoll.HouseKeeper
-	if wpCollection != nil {
-		// inherite subscribers by reusing the housekeeper, if already loaded & subscribed
-		hk = wpCollection.HouseKeeper
-	} else {
-		hk = livecoll.NewHouseKeeper()
+	if former != nil {
+		// inherite subscribers by reusing the housekeeper, if evicted while subscribed
+		hk = former.(*WaypointCollection).HouseKeeper
+	} else if hk, err = livecoll.OpenHouseKeeper("waypoint", tid); err != nil {
+		return nil, err
+	}
+	// this is the primary index to locate a waypoint by tid+seq
+	if err = hk.AddIndex(livecoll.Index{
+		Name: "seq", Unique: true,
+		Key: func(mo livecoll.Member) interface{} {
+			return mo.(*Waypoint).Seq
+		},
+	}); err != nil {
+		if former == nil {
+			hk.Close()
+		}
+		return nil, err
 	}
 	loadingColl := &WaypointCollection{
 		HouseKeeper: hk,
 		Tid:         tid,
-		bySeq:       make(map[int]*Waypoint, optimalSize),
 	}
 	memberList := make([]livecoll.Member, len(loadingList))
 	for i, wpo := range loadingList {
@@ -106,27 +174,34 @@ func ensureLoadedFor(tid string) error {
 		// make a local copy and take pointer for collection storage.
 		wpCopy := wpo
 		memberList[i] = &wpCopy
-		loadingColl.bySeq[wpo.Seq] = &wpCopy
+		if wpo.Seq > loadingColl.maxSeq {
+			loadingColl.maxSeq = wpo.Seq
+		}
 	}
-	hk.Load(memberList)
-	wpCollection = loadingColl // only set globally after successfully loaded at all
-	return nil
+	if err = hk.Load(memberList); err != nil {
+		if former == nil {
+			hk.Close()
+		}
+		return nil, err
+	}
+	return loadingColl, nil
 }
 
 // the snapshot of all waypoints of a specific tenant
 type WaypointsSnapshot struct {
 	Tid       string
-	CCN       int
+	CCN       livecoll.CCN
 	Waypoints []Waypoint
 }
 
 func FetchWaypoints(tid string) *WaypointsSnapshot {
-	if err := ensureLoadedFor(tid); err != nil {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
 		// err has been logged
 		panic(err)
 	}
-	// todo make FetchAll return values instead of pointers, to avoid dirty value reads
-	ccn, wps := wpCollection.FetchAll()
+	defer release()
+	ccn, wps := wpc.FetchAll()
 	snap := &WaypointsSnapshot{
 		Tid:       tid,
 		CCN:       ccn,
@@ -144,112 +219,210 @@ func (ctx *serviceContext) FetchWaypoints(tid string) *WaypointsSnapshot {
 	return FetchWaypoints(tid)
 }
 
-type wpDelegate struct {
-	ctx *serviceContext
+// the changes to waypoints of a specific tenant, after a known ccn
+type WaypointChanges struct {
+	Tid string
+	// changes since the known ccn are no longer available, a snapshot should be
+	// fetched instead
+	TooOld  bool
+	Changes []WaypointChange
 }
 
-func (ctx *serviceContext) SubscribeWaypoints(tid string) {
-	if err := ensureLoadedFor(tid); err != nil {
+// a single change to waypoints, a deleted waypoint has only the id set. changes
+// committed as a change set share the same ccn
+type WaypointChange struct {
+	livecoll.ChangeHeader `bson:",inline"`
+
+	Waypoint Waypoint
+}
+
+func FetchWaypointChangesSince(tid string, ccn livecoll.CCN) *WaypointChanges {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		// err has been logged
 		panic(err)
 	}
+	defer release()
+	chgs := &WaypointChanges{Tid: tid}
+	changes, ok := wpc.FetchChangesSince(ccn)
+	if !ok {
+		chgs.TooOld = true
+		return chgs
+	}
+	chgs.Changes = waypointChanges(changes)
+	return chgs
+}
+
+// convert change events to waypoint changes, with change sets flattened
+func waypointChanges(events []interface{}) []WaypointChange {
+	flat := livecoll.FlattenEvents(events)
+	chgs := make([]WaypointChange, len(flat))
+	for i, evt := range flat {
+		hdr, mo, id := livecoll.ChangeOf(evt)
+		chgs[i].ChangeHeader = hdr
+		if mo != nil {
+			chgs[i].Waypoint = *(mo.(*Waypoint))
+		} else {
+			chgs[i].Waypoint.Id = id.(bson.ObjectId)
+		}
+	}
+	return chgs
+}
 
-	dele := wpDelegate{ctx}
-	wpCollection.Subscribe(dele)
+// change events to be replayed by subscribers
+func (chgs *WaypointChanges) Events() (changes []interface{}, ok bool) {
+	if chgs.TooOld {
+		return nil, false
+	}
+	flat := make([]interface{}, len(chgs.Changes))
+	for i := range chgs.Changes {
+		flat[i] = chgs.Changes[i].event()
+	}
+	// changes of a change set are consecutive, with the same ccn
+	return livecoll.RegroupEvents(flat), true
 }
 
-func (dele wpDelegate) Subscribed() (stop bool) {
-	// not relaying Subscribed event over hbi wire
-	return
+func (chg *WaypointChange) event() interface{} {
+	return chg.ChangeHeader.Event(&chg.Waypoint)
 }
 
-func (dele wpDelegate) Epoch(ccn int) (stop bool) {
-	ctx := dele.ctx
-	if ctx.Cancelled() {
-		stop = true
-		return
+// a single waypoint as of the ccn it's read, `Deleted` if no such waypoint
+func FetchWaypoint(tid string, id bson.ObjectId) *WaypointChange {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		// err has been logged
+		panic(err)
+	}
+	defer release()
+	ccn, mo, ok := wpc.FetchMember(id)
+	if !ok {
+		return &WaypointChange{
+			ChangeHeader: livecoll.ChangeHeader{CCN: ccn, Deleted: true}, Waypoint: Waypoint{Id: id},
+		}
 	}
-	po := ctx.MustPoToPeer()
-	po.Notif(fmt.Sprintf(`
-WpEpoch(%#v)
-`, ccn))
-	return
+	return &WaypointChange{ChangeHeader: livecoll.ChangeHeader{CCN: ccn}, Waypoint: *(mo.(*Waypoint))}
 }
 
-// Created
-func (dele wpDelegate) MemberCreated(ccn int, eo livecoll.Member) (stop bool) {
-	ctx := dele.ctx
-	if ctx.Cancelled() {
-		stop = true
-		return
+func (ctx *serviceContext) FetchWaypoint(tid string, id string) *WaypointChange {
+	return FetchWaypoint(tid, bson.ObjectIdHex(id))
+}
+
+func (ctx *serviceContext) FetchWaypointChangesSince(tid string, epoch int64, seq uint64) *WaypointChanges {
+	return FetchWaypointChangesSince(tid, livecoll.CCN{epoch, seq})
+}
+
+// how waypoints and their changes are shipped to consumers
+var wpShipping = livecoll.Shipping{
+	MemberHint: "&Waypoint{}", ChangeHint: "&WaypointChange{}", ChangesHint: "&WaypointChanges{}",
+	Change: func(hdr livecoll.ChangeHeader, mo livecoll.Member) interface{} {
+		return &WaypointChange{ChangeHeader: hdr, Waypoint: *(mo.(*Waypoint))}
+	},
+	Changes: func(events []interface{}) interface{} {
+		return &WaypointChanges{Changes: waypointChanges(events)}
+	},
+}
+
+func (ctx *serviceContext) SubscribeWaypoints(tid string) {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		panic(err)
 	}
-	wp := eo.(*Waypoint)
-	po := ctx.MustPoToPeer()
-	po.NotifBSON(fmt.Sprintf(`
-WpCreated(%#v)
-`, ccn), wp, "&Waypoint{}")
-	return
+	defer release()
+
+	dele := ctx.relay("Wp", 0, false, wpShipping)
+	ctx.keepWpSubscription(0, wpc.Subscribe(dele))
 }
 
-// Updated
-func (dele wpDelegate) MemberUpdated(ccn int, eo livecoll.Member) (stop bool) {
-	ctx := dele.ctx
-	if ctx.Cancelled() {
-		stop = true
-		return
+// subscribe with a filter sent as bson object following this notif, only changes
+// of waypoints passing the filter are relayed over the wire
+func (ctx *serviceContext) SubscribeFilteredWaypoints(tid string, sid int) {
+	fo, err := ctx.Ho().CoRecvObj()
+	if err != nil {
+		panic(err)
+	}
+	filter := fo.(*livecoll.Filter)
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		panic(err)
 	}
-	wp := eo.(*Waypoint)
-	po := ctx.MustPoToPeer()
-	po.NotifBSON(fmt.Sprintf(`
-WpUpdated(%#v)
-`, ccn), wp, "&Waypoint{}")
-	return
+	defer release()
+
+	glog.V(1).Infof("Subscribing waypoints of [%s] with filter %v", tid, filter)
+	dele := ctx.relay("Wp", sid, false, wpShipping)
+	ctx.keepWpSubscription(sid, wpc.SubscribeFiltered(dele, filter.Match))
 }
 
-// Deleted
-func (dele wpDelegate) MemberDeleted(ccn int, id interface{}) (stop bool) {
-	ctx := dele.ctx
-	if ctx.Cancelled() {
-		stop = true
+// watch a single waypoint, relayed like a filtered subscription, but finishes upon
+// the waypoint deleted
+func (ctx *serviceContext) SubscribeWaypoint(tid string, sid int, id string) {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		panic(err)
+	}
+	defer release()
+
+	wpID := bson.ObjectIdHex(id)
+	if ccn, _, ok := wpc.FetchMember(wpID); !ok {
+		// gone already, nothing to watch
+		po := ctx.MustPoToPeer()
+		po.Notif(fmt.Sprintf(`
+WpDeleted(%d,%d,%d,%#v)
+`, sid, ccn.Epoch, ccn.Seq, id))
 		return
 	}
-	po := ctx.MustPoToPeer()
-	po.NotifBSON(fmt.Sprintf(`
-WpDeleted(%#v,%#v)
-`, ccn), id, "&Waypoint{}")
-	return
+	dele := ctx.relay("Wp", sid, true, wpShipping)
+	ctx.keepWpSubscription(sid, wpc.SubscribeFiltered(dele, func(mo livecoll.Member) bool {
+		return mo.GetID() == wpID
+	}))
 }
 
-// individual in-memory waypoint objects do not store the tid, tid only
-// meaningful for a waypoint collection. however when stored as mongodb documents,
-// the tid field needs to present. so here's the struct, with an in-memory
-// wp object embedded, to be inlined when marshaled to bson (for mango)
-type wpForDb struct {
-	Tid      string `bson:"tid"`
-	Waypoint `bson:",inline"`
+// the consumer has dropped a subscription, sid 0 for the unfiltered one, its
+// delegate relays no more event
+func (ctx *serviceContext) UnsubscribeWaypoints(tid string, sid int) {
+	ctx.mu.Lock()
+	defer ctx.mu.Unlock()
+
+	if unsubscribe := ctx.wpSubscriptions[sid]; unsubscribe != nil {
+		unsubscribe()
+		delete(ctx.wpSubscriptions, sid)
+	}
 }
 
 func AddWaypoint(tid string, x, y float64) error {
-	if err := ensureLoadedFor(tid); err != nil {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
 		return err
 	}
+	defer release()
 
-	newSeq := 1 + len(wpCollection.bySeq)   // assign tenant wide unique seq
+	// seqs are allocated and taken in order of additions
+	wpc.muUpdate.Lock()
+	defer wpc.muUpdate.Unlock()
+
+	// assign tenant wide unique seq
+	newSeq, err := seqCounter().Next(tid, wpc.maxSeq)
+	if err != nil {
+		return err
+	}
 	newLabel := fmt.Sprintf("#%d#", newSeq) // label with some rules
-	waypoint := wpForDb{tid, Waypoint{
+	wp := &Waypoint{
 		Id:  bson.NewObjectId(),
 		Seq: newSeq, Label: newLabel,
 		X: x, Y: y,
-	}}
+	}
+	// not to write into db what can not be indexed in memory
+	if err = wpc.Check(wp); err != nil {
+		return err
+	}
 	// write into backing storage, the db
-	err := coll().Insert(&waypoint)
+	err = repo().Insert(tid, wp)
 	if err != nil {
 		return err
 	}
 
 	// add to in-memory collection and index, after successful db insert
-	wp := &waypoint.Waypoint
-	wpCollection.bySeq[waypoint.Seq] = wp
-	wpCollection.Created(wp)
+	wpc.maxSeq = wp.Seq
+	wpc.Created(wp)
 
 	return nil
 }
@@ -260,12 +433,105 @@ func (ctx *serviceContext) AddWaypoint(tid string, x, y float64) error {
 	return AddWaypoint(tid, x, y)
 }
 
+// update a waypoint in db then in memory, if it's still of `version`, or whatever
+// version it is if `version` is negative. the updated waypoint is returned.
+func updateWaypoint(
+	tid string, seq int, id string, version int,
+	fields bson.M, update func(wp *Waypoint),
+) (*Waypoint, error) {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	wpc.muUpdate.Lock()
+	defer wpc.muUpdate.Unlock()
+
+	mwp, ok := wpc.Read(bson.ObjectIdHex(id))
+	if !ok || mwp == nil {
+		return nil, errors.New(fmt.Sprintf("Waypoint seq=[%v], id=[%s] not exists for tid=%s", seq, id, tid))
+	}
+	wp := mwp.(*Waypoint)
+	if wp.Seq != seq {
+		return nil, errors.New(fmt.Sprintf("Waypoint id=[%s], seq mismatch [%v] vs [%v]", id, seq, wp.Seq))
+	}
+	if version < 0 {
+		version = wp.Version
+	} else if version != wp.Version {
+		return nil, &livecoll.ConflictError{ID: wp.Id, Expected: version, Actual: wp.Version}
+	}
+
+	// update backing storage, the db
+	if err := repo().UpdateVersioned(tid, wp.Id, version, fields); err != nil {
+		if err == dbc.ErrConflict {
+			// changed in db by someone else, not through this collection
+			return nil, &livecoll.ConflictError{ID: wp.Id, Expected: version, Actual: -1}
+		}
+		return nil, err
+	}
+
+	// swap in an updated value, after successful db update
+	updated, ok := wpc.Modify(wp.Id, func(mo livecoll.Member) livecoll.Member {
+		updated := *(mo.(*Waypoint))
+		update(&updated)
+		updated.Version = version + 1
+		return &updated
+	})
+	if !ok {
+		// deleted meanwhile
+		return nil, errors.New(fmt.Sprintf("Waypoint seq=[%v], id=[%s] not exists for tid=%s", seq, id, tid))
+	}
+	return updated.(*Waypoint), nil
+}
+
 func MoveWaypoint(tid string, seq int, id string, x, y float64) error {
-	if err := ensureLoadedFor(tid); err != nil {
+	_, err := MoveWaypointIf(tid, seq, id, -1, x, y)
+	return err
+}
+
+// MoveWaypointIf moves the waypoint only if it's still of `version`, or returns a
+// `*livecoll.ConflictError`. the new version is returned on success.
+func MoveWaypointIf(tid string, seq int, id string, version int, x, y float64) (int, error) {
+	wp, err := updateWaypoint(tid, seq, id, version, bson.M{"x": x, "y": y}, func(wp *Waypoint) {
+		wp.X, wp.Y = x, y
+	})
+	if err != nil {
+		return 0, err
+	}
+	return wp.Version, nil
+}
+
+// this service method has async style, successful result will be published
+// as an event asynchronously
+func (ctx *serviceContext) MoveWaypoint(
+	tid string, seq int, id string, x, y float64,
+) error {
+	return MoveWaypoint(tid, seq, id, x, y)
+}
+
+// this service method has rpc style, failures including conflicts are returned
+// in the outcome, not to disconnect the wire
+func (ctx *serviceContext) MoveWaypointIf(
+	tid string, seq int, id string, version int, x, y float64,
+) *livecoll.UpdateOutcome {
+	return livecoll.NewUpdateOutcome(MoveWaypointIf(tid, seq, id, version, x, y))
+}
+
+func DeleteWaypoint(tid string, seq int, id string) error {
+	wpc, release, err := ensureLoadedFor(tid)
+	if err != nil {
 		return err
 	}
+	defer release()
+
+	// not to race with updates of the waypoint, they'd fail to find it after
+	// deleted. `rtc.muUpdate` is taken after this one, no path takes them the
+	// other way round.
+	wpc.muUpdate.Lock()
+	defer wpc.muUpdate.Unlock()
 
-	mwp, ok := wpCollection.Read(bson.ObjectIdHex(id))
+	mwp, ok := wpc.Read(bson.ObjectIdHex(id))
 	if !ok || mwp == nil {
 		return errors.New(fmt.Sprintf("Waypoint seq=[%v], id=[%s] not exists for tid=%s", seq, id, tid))
 	}
@@ -274,27 +540,32 @@ func MoveWaypoint(tid string, seq int, id string, x, y float64) error {
 		return errors.New(fmt.Sprintf("Waypoint id=[%s], seq mismatch [%v] vs [%v]", id, seq, wp.Seq))
 	}
 
-	// update backing storage, the db
-	if err := coll().Update(bson.M{
-		"tid": tid, "_id": wp.Id,
-	}, bson.M{
-		"$set": bson.M{"x": x, "y": y},
-	}); err != nil {
+	// routes shall not reference a deleted waypoint, take it out of them first,
+	// and keep them from referencing it again until it's gone
+	rtc, releaseRoutes, err := ensureRoutesLoadedFor(tid)
+	if err != nil {
+		return err
+	}
+	defer releaseRoutes()
+	rtc.muUpdate.Lock()
+	defer rtc.muUpdate.Unlock()
+	if err := rtc.dropWaypoint(wp.Id); err != nil {
 		return err
 	}
 
-	// update in-memory value, after successful db update
-	wp.X, wp.Y = x, y
+	// remove from backing storage, the db
+	if err := repo().Delete(tid, wp.Id); err != nil {
+		return err
+	}
 
-	wpCollection.Updated(wp)
+	// remove from in-memory collection and index, after successful db removal
+	wpc.Deleted(wp.Id)
 
 	return nil
 }
 
 // this service method has async style, successful result will be published
 // as an event asynchronously
-func (ctx *serviceContext) MoveWaypoint(
-	tid string, seq int, id string, x, y float64,
-) error {
-	return MoveWaypoint(tid, seq, id, x, y)
+func (ctx *serviceContext) DeleteWaypoint(tid string, seq int, id string) error {
+	return DeleteWaypoint(tid, seq, id)
 }
@@ -27,9 +27,28 @@ func (cfg ServiceConfig) Addr() string {
 }
 
 var svcConfigs map[string]ServiceConfig
+var cfgOverrides = make(map[string]ServiceConfig)
+var muConfigs sync.Mutex
+
+// OverrideServiceConfig makes the specified config be used for a service key, in
+// place of what's in etc/services.json, e.g. for a test harness to run services
+// on loopback ports with an in-memory db. it should be called before any service
+// of the key is consumed, as connection pools are cached once created.
+func OverrideServiceConfig(serviceKey string, cfg ServiceConfig) {
+	muConfigs.Lock()
+	defer muConfigs.Unlock()
+
+	cfgOverrides[serviceKey] = cfg
+}
 
 func GetServiceConfig(serviceKey string) (cfg ServiceConfig, err error) {
+	muConfigs.Lock()
+	defer muConfigs.Unlock()
+
 	var ok bool
+	if cfg, ok = cfgOverrides[serviceKey]; ok {
+		return
+	}
 	if svcConfigs == nil {
 		var servicesEtc []byte
 		servicesEtc, err = ioutil.ReadFile("etc/services.json")